@@ -7,41 +7,11 @@ import (
 	"log"
 	"os"
 
-	"github.com/joho/godotenv"
+	"example.com/utils/config"
+	"example.com/utils/store"
 )
 
-func loadEnv() {
-	paths := []string{"../../.env", "../.env", "./.env"} // flexible search
-	for _, path := range paths {
-		if err := godotenv.Load(path); err == nil {
-			return
-		}
-	}
-	log.Fatal("Error loading .env from known locations")
-}
-
-// === Reusable JSON Reader ===
-func ReadInput(filePath string) (map[string]interface{}, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open file: %w", err)
-	}
-	defer file.Close()
-
-	bytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read file: %w", err)
-	}
-
-	var data map[string]interface{}
-	err = json.Unmarshal(bytes, &data)
-	if err != nil {
-		return nil, fmt.Errorf("invalid JSON format: %w", err)
-	}
-
-	return data, nil
-}
-
+// === JSON Writer ===
 func WriteOutput(filePath string, data interface{}) error {
 	bytes, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
@@ -55,53 +25,24 @@ func WriteOutput(filePath string, data interface{}) error {
 	return nil
 }
 
-// === Read UTXO ===
-func readUTXO() (map[string]interface{}, error) {
-	path := os.Getenv("UTXO_JSON")
-	data, err := ReadInput(path)
+// === Main Function ===
+func main() {
+	cfg, _, err := config.FromArgs(os.Args[1:])
 	if err != nil {
-		return nil, err
-	}
-	unspentsRaw, ok := data["unspents"]
-	if !ok || unspentsRaw == nil {
-		return nil, fmt.Errorf("missing or null 'unspents' field")
+		log.Fatal(err)
 	}
-	unspents, ok := unspentsRaw.([]interface{})
-	if !ok || len(unspents) == 0 {
-		return nil, fmt.Errorf("'unspents' is not a non-empty array")
-	}
-	return unspents[0].(map[string]interface{}), nil
-}
+	rpcURL, rpcUser, rpcPassword = cfg.RPC.URL, cfg.RPC.User, cfg.RPC.Password
 
-// === Read Party Info ===
-func readPartyInfo() (map[string]interface{}, map[string]interface{}, error) {
-	path := os.Getenv("ADDRESS_TEST")
-	data, err := ReadInput(path)
+	firstUnspent, err := store.ReadFirstUnspent(cfg.Files.UTXO)
 	if err != nil {
-		return nil, nil, err
-	}
-
-	senderList, ok := data["sender"].([]interface{})
-	if !ok || len(senderList) == 0 {
-		return nil, nil, fmt.Errorf("missing or invalid 'sender' field")
-	}
-	htlcList, ok := data["HTLC"].([]interface{})
-	if !ok || len(htlcList) == 0 {
-		return nil, nil, fmt.Errorf("missing or invalid 'HTLC' field")
+		log.Fatalf("Failed to read UTXO: %v", err)
 	}
 
-	return senderList[0].(map[string]interface{}), htlcList[0].(map[string]interface{}), nil
-}
-
-// === Main Function ===
-func main() {
-	loadEnv()
-	firstUnspent, err := readUTXO()
+	sender, err := store.ReadSender(cfg.Files.AddressTest)
 	if err != nil {
-		log.Fatalf("Failed to read UTXO: %v", err)
+		log.Fatalf("Failed to read party info: %v", err)
 	}
-
-	senderMap, htlcMap, err := readPartyInfo()
+	htlc, err := store.ReadHTLCAddress(cfg.Files.AddressTest)
 	if err != nil {
 		log.Fatalf("Failed to read party info: %v", err)
 	}
@@ -109,15 +50,15 @@ func main() {
 	// Prepare inputs
 	inputs := []TxInput{
 		{
-			TxID: firstUnspent["txid"].(string),
-			Vout: int(firstUnspent["vout"].(float64)),
+			TxID: firstUnspent.TxID,
+			Vout: int(firstUnspent.Vout),
 		},
 	}
 
 	// Prepare outputs
 	outputs1 := []TxOutput{
-		{Address: htlcMap["address"].(string), Amount: 10},
-		{Address: senderMap["address"].(string), Amount: 89.9999},
+		{Address: htlc.Address, Amount: 10},
+		{Address: sender.Address, Amount: 89.9999},
 	}
 
 	rawTx1, err := CreateRawTransaction(inputs, outputs1, nil, nil)
@@ -127,9 +68,8 @@ func main() {
 	output := map[string]interface{}{
 		"raw_transaction": rawTx1,
 	}
-	fmt.Println("Raw transaction: ", output["raw_transaction"].(string))
-	outputPath := os.Getenv("RAW_TX_OUTPUT")
-	err = WriteOutput(outputPath, output)
+	fmt.Println("Raw transaction: ", rawTx1)
+	err = WriteOutput(cfg.Files.RawTx, output)
 	if err != nil {
 		log.Fatalf("Failed to write raw transaction: %v", err)
 	}
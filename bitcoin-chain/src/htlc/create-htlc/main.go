@@ -7,7 +7,9 @@ import (
 	"log"
 	"os"
 
-	"github.com/joho/godotenv"
+	"example.com/utils/config"
+	"example.com/utils/statefile"
+	"example.com/utils/store"
 )
 
 type HTLCInput struct {
@@ -18,16 +20,6 @@ type HTLCInput struct {
 	Signature   string  `json:"signature"`
 }
 
-func loadEnv() {
-	paths := []string{"../../.env", "../.env", "./.env", "../../../.env"}
-	for _, path := range paths {
-		if err := godotenv.Load(path); err == nil {
-			return
-		}
-	}
-	log.Fatal("Error loading .env from any known location")
-}
-
 func readHTLCInput(path string) (*HTLCInput, error) {
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -40,43 +32,23 @@ func readHTLCInput(path string) (*HTLCInput, error) {
 	return &input, nil
 }
 
+// updateHTLCOutput records the HTLC in the address book under the state
+// file lock, so a concurrent writer's sender keys are not lost.
 func updateHTLCOutput(filePath, address, redeemScript string) error {
-	raw, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to read output file: %w", err)
-	}
-
-	var data map[string]interface{}
-	if err := json.Unmarshal(raw, &data); err != nil {
-		return fmt.Errorf("failed to parse output file: %w", err)
-	}
-
-	data["HTLC"] = []interface{}{map[string]interface{}{
-		"address":      address,
-		"redeemScript": redeemScript,
-	}}
-
-	out, err := json.MarshalIndent(data, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to encode updated output: %w", err)
-	}
-
-	return ioutil.WriteFile(filePath, out, 0644)
+	var book store.AddressBook
+	return statefile.Update(filePath, &book, func() error {
+		book.HTLC = []store.HTLCAddress{{Address: address, RedeemScript: redeemScript}}
+		return nil
+	})
 }
 
 func main() {
-	loadEnv()
-
-	messagePath := os.Getenv("PAYMENT_MESSAGE_HTLC")
-	if messagePath == "" {
-		log.Fatal("Missing PAYMENT_MESSAGE in .env")
-	}
-
-	input, err := readHTLCInput(messagePath)
+	cfg, _, err := config.FromArgs(os.Args[1:])
 	if err != nil {
-		log.Fatalf("Failed to read HTLC input: %v", err)
+		log.Fatal(err)
 	}
 
+	input, err := readHTLCInput(cfg.Files.PaymentMessage)
 	if err != nil {
 		log.Fatalf("Failed to read HTLC input: %v", err)
 	}
@@ -97,11 +69,7 @@ func main() {
 	fmt.Printf("P2SH Address:      %s\n", address)
 	fmt.Printf("Redeem Script Hex: %s\n", redeemScript)
 
-	outputPath := os.Getenv("ADDRESS_TEST")
-	if outputPath == "" {
-		log.Fatal("Missing ADDRESS_TEST in .env")
-	}
-	if err := updateHTLCOutput(outputPath, address, redeemScript); err != nil {
+	if err := updateHTLCOutput(cfg.Files.AddressTest, address, redeemScript); err != nil {
 		log.Fatalf("Failed to update HTLC output file: %v", err)
 	}
 }
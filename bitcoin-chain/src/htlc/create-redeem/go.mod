@@ -4,7 +4,7 @@ go 1.24.1
 
 require (
 	github.com/btcsuite/btcd v0.24.2
-	github.com/btcsuite/btcd/btcec/v2 v2.3.5
+	github.com/btcsuite/btcd/btcec/v2 v2.3.5 // indirect
 	github.com/btcsuite/btcd/btcutil v1.1.6
 	github.com/btcsuite/btcd/chaincfg/chainhash v1.1.0
 )
@@ -13,7 +13,15 @@ require (
 	github.com/btcsuite/btclog v0.0.0-20170628155309-84c8d2346e9f // indirect
 	github.com/decred/dcrd/crypto/blake256 v1.0.0 // indirect
 	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
-	github.com/joho/godotenv v1.5.1
 	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
-	golang.org/x/sys v0.0.0-20200814200057-3d37ad5750ed // indirect
+	golang.org/x/sys v0.29.0 // indirect
 )
+
+require example.com/utils v0.0.0-00010101000000-000000000000
+
+require (
+	github.com/BurntSushi/toml v1.4.0 // indirect
+	go.etcd.io/bbolt v1.4.3 // indirect
+)
+
+replace example.com/utils => ../../utils
@@ -9,34 +9,11 @@ import (
 	"log"
 	"os"
 
-	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/joho/godotenv"
+	"example.com/utils/config"
+	"example.com/utils/store"
 )
 
-// === Load .env ===
-func loadEnv() {
-	paths := []string{"../../../.env", "../../.env", "../.env", "./.env"}
-	for _, path := range paths {
-		if err := godotenv.Load(path); err == nil {
-			return
-		}
-	}
-	log.Fatal("Error loading .env from known locations")
-}
-
-// === JSON Reader/Writer ===
-func ReadInput(filePath string) (map[string]interface{}, error) {
-	data, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read file: %w", err)
-	}
-	var result map[string]interface{}
-	if err := json.Unmarshal(data, &result); err != nil {
-		return nil, fmt.Errorf("invalid JSON format: %w", err)
-	}
-	return result, nil
-}
-
+// === JSON Writer ===
 func WriteOutput(filePath string, data interface{}) error {
 	out, err := json.MarshalIndent(data, "", "  ")
 	if err != nil {
@@ -45,81 +22,37 @@ func WriteOutput(filePath string, data interface{}) error {
 	return ioutil.WriteFile(filePath, out, 0644)
 }
 
-// === Read UTXO ===
-func readUTXO() (map[string]interface{}, error) {
-	path := os.Getenv("UTXO_HTLC_JSON")
-	if path == "" {
-		return nil, fmt.Errorf("UTXO_HTLC_JSON not set in .env")
-	}
-	data, err := ReadInput(path)
-	if err != nil {
-		return nil, err
-	}
-	unspentsRaw, ok := data["unspents"].([]interface{})
-	if !ok || len(unspentsRaw) == 0 {
-		return nil, fmt.Errorf("no unspents found in UTXO file: %s", path)
-	}
-	return unspentsRaw[0].(map[string]interface{}), nil
-}
-
-// === Read Receiver Info from state.json (Alice) ===
-func readPartyInfo() (map[string]interface{}, error) {
-	path := os.Getenv("STATE_PATH_HTLC")
-	if path == "" {
-		return nil, fmt.Errorf("STATE_PATH_HTLC not set in .env")
-	}
-	data, err := ReadInput(path)
-	if err != nil {
-		return nil, err
-	}
-	return data["alice"].(map[string]interface{}), nil
-}
-
-// === Read BTC amount from payment message ===
-func readBTCAmountFromMessage() (float64, error) {
-	path := os.Getenv("PAYMENT_MESSAGE_HTLC")
-	if path == "" {
-		return 0, fmt.Errorf("PAYMENT_MESSAGE_HTLC not set in .env")
-	}
-	data, err := ReadInput(path)
-	if err != nil {
-		return 0, err
-	}
-	amount, ok := data["btc_amount"].(float64)
-	if !ok {
-		return 0, fmt.Errorf("invalid or missing btc_amount field")
-	}
-	return amount, nil
-}
-
 // === Main ===
 func main() {
-	loadEnv()
-	netParams := &chaincfg.RegressionNetParams
-	const feeSats = 500
+	cfg, _, err := config.FromArgs(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	netParams, _ := cfg.NetParams()
+	feeSats := float64(cfg.Fees.FixedFeeSat)
 	const satsPerBTC = 1e8
 
-	firstUnspent, err := readUTXO()
+	firstUnspent, err := store.ReadFirstUnspent(cfg.Files.UTXOHTLC)
 	if err != nil {
 		log.Fatalf("Failed to read UTXO: %v", err)
 	}
 
-	receiverMap, err := readPartyInfo()
+	receiver, err := store.ReadKeyPair(cfg.Keys.State, "alice")
 	if err != nil {
 		log.Fatalf("Failed to read party info: %v", err)
 	}
 
-	btcAmount, err := readBTCAmountFromMessage()
+	msg, err := store.ReadPaymentMessage(cfg.Files.PaymentMessage)
 	if err != nil {
 		log.Fatalf("Failed to read BTC amount: %v", err)
 	}
 
-	outputAmount := (btcAmount*satsPerBTC - feeSats) / satsPerBTC
+	outputAmount := (msg.BTCAmount*satsPerBTC - feeSats) / satsPerBTC
 
 	rawInput := InputRawRedeemTransaction{
-		prevTxHash:      firstUnspent["txid"].(string),
-		prevOutputIndex: uint32(firstUnspent["vout"].(float64)),
-		outputAddr:      receiverMap["address"].(string),
+		prevTxHash:      firstUnspent.TxID,
+		prevOutputIndex: firstUnspent.Vout,
+		outputAddr:      receiver.Address,
 		outputAmount:    outputAmount,
 	}
 
@@ -138,11 +71,7 @@ func main() {
 	output := map[string]interface{}{
 		"raw_redeem_transaction": rawTxHex,
 	}
-	outputPath := os.Getenv("REDEEM_TX_OUTPUT")
-	if outputPath == "" {
-		log.Fatal("REDEEM_TX_OUTPUT not set in .env")
-	}
-	if err := WriteOutput(outputPath, output); err != nil {
+	if err := WriteOutput(cfg.Files.RedeemTx, output); err != nil {
 		log.Fatalf("Failed to write raw redeem transaction: %v", err)
 	}
 
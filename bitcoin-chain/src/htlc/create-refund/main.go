@@ -3,74 +3,77 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 
+	"example.com/utils/broadcast"
+	"example.com/utils/config"
+	"example.com/utils/store"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcutil"
-	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/rpcclient"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
-	"github.com/joho/godotenv"
 )
 
-func loadEnv() {
-	paths := []string{"../../.env", "../.env", "./.env", "../../../.env"}
-	for _, path := range paths {
-		if err := godotenv.Load(path); err == nil {
-			return
-		}
-	}
-	log.Fatal("Error loading .env from any known location")
-}
-
 func main() {
-	loadEnv()
-
-	// Load environment variables
-	utxoPath := os.Getenv("UTXO_HTLC_JSON")
-	addressPath := os.Getenv("ADDRESS_TEST")
-	statePath := os.Getenv("STATE_PATH_HTLC")
+	cfg, _, err := config.FromArgs(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	netParams, _ := cfg.NetParams()
 
 	// Load HTLC redeemScript
-	addrRaw, _ := ioutil.ReadFile(addressPath)
-	var addrData map[string][]map[string]string
-	_ = json.Unmarshal(addrRaw, &addrData)
-	redeemHex := addrData["HTLC"][0]["redeemScript"]
-	redeemScript, _ := hex.DecodeString(redeemHex)
+	htlc, err := store.ReadHTLCAddress(cfg.Files.AddressTest)
+	if err != nil {
+		log.Fatalf("Failed to read HTLC: %v", err)
+	}
+	redeemScript, err := hex.DecodeString(htlc.RedeemScript)
+	if err != nil {
+		log.Fatalf("Invalid redeem script: %v", err)
+	}
 
 	// Load UTXO data
-	utxoRaw, _ := ioutil.ReadFile(utxoPath)
-	var utxoData map[string]interface{}
-	_ = json.Unmarshal(utxoRaw, &utxoData)
-	utxo := utxoData["unspents"].([]interface{})[0].(map[string]interface{})
-	txidStr := utxo["txid"].(string)
-	vout := uint32(utxo["vout"].(float64))
-	amount := btcutil.Amount(utxo["amount"].(float64) * 1e8)
+	utxo, err := store.ReadFirstUnspent(cfg.Files.UTXOHTLC)
+	if err != nil {
+		log.Fatalf("Failed to read HTLC UTXO: %v", err)
+	}
+	amount, err := btcutil.NewAmount(utxo.Amount)
+	if err != nil {
+		log.Fatalf("Invalid UTXO amount: %v", err)
+	}
 
 	// Load sender key and address
-	stateRaw, _ := ioutil.ReadFile(statePath)
-	var state map[string]interface{}
-	_ = json.Unmarshal(stateRaw, &state)
-	sender := state["alice"].(map[string]interface{})
-	privHex := sender["privkey"].(string)
-	privKey, _ := btcec.PrivKeyFromBytes(hexDecode(privHex))
-	address, _ := btcutil.DecodeAddress(sender["address"].(string), &chaincfg.RegressionNetParams)
-	pkScript, _ := txscript.PayToAddrScript(address)
+	sender, err := store.ReadKeyPair(cfg.Keys.State, "alice")
+	if err != nil {
+		log.Fatalf("Failed to read sender key: %v", err)
+	}
+	privBytes, err := hex.DecodeString(sender.PrivKey)
+	if err != nil {
+		log.Fatalf("Invalid sender privkey: %v", err)
+	}
+	privKey, _ := btcec.PrivKeyFromBytes(privBytes)
+	address, err := btcutil.DecodeAddress(sender.Address, netParams)
+	if err != nil {
+		log.Fatalf("Invalid sender address: %v", err)
+	}
+	pkScript, err := txscript.PayToAddrScript(address)
+	if err != nil {
+		log.Fatalf("Failed to build refund script: %v", err)
+	}
 
 	// Build transaction
 	tx := wire.NewMsgTx(wire.TxVersion)
-	txHash, _ := chainhash.NewHashFromStr(txidStr)
-	txIn := wire.NewTxIn(wire.NewOutPoint(txHash, vout), nil, nil)
+	txHash, err := chainhash.NewHashFromStr(utxo.TxID)
+	if err != nil {
+		log.Fatalf("Invalid UTXO txid: %v", err)
+	}
+	txIn := wire.NewTxIn(wire.NewOutPoint(txHash, utxo.Vout), nil, nil)
 	txIn.Sequence = 0 // For locktime to be respected
 	tx.TxIn = append(tx.TxIn, txIn)
 
-	fee := btcutil.Amount(500)
+	fee := btcutil.Amount(cfg.Fees.FixedFeeSat)
 	refundAmount := int64(amount - fee)
 	txOut := wire.NewTxOut(refundAmount, pkScript)
 	tx.TxOut = append(tx.TxOut, txOut)
@@ -94,24 +97,14 @@ func main() {
 	fmt.Println("Refund Raw TX:", rawTxHex)
 
 	// Broadcast
-	client, err := rpcclient.New(&rpcclient.ConnConfig{
-		Host:         os.Getenv("RPC_HOST"),
-		User:         os.Getenv("RPC_USER"),
-		Pass:         os.Getenv("RPC_PASS"),
-		HTTPPostMode: true,
-		DisableTLS:   true,
-	}, nil)
+	b, err := broadcast.Open(cfg)
 	if err != nil {
-		log.Fatalf("RPC connection error: %v", err)
+		log.Fatalf("Failed to open swap database: %v", err)
 	}
-	txid, err := client.SendRawTransaction(tx, false)
+	defer b.Close()
+	res, err := b.Send(rawTxHex, "htlc-refund")
 	if err != nil {
 		log.Fatalf("Broadcast failed: %v", err)
 	}
-	fmt.Println("Refund TXID:", txid.String())
-}
-
-func hexDecode(s string) []byte {
-	b, _ := hex.DecodeString(s)
-	return b
+	fmt.Println("Refund TXID:", res.Txid)
 }
@@ -1,24 +1,22 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+
+	"example.com/utils/config"
+	"example.com/utils/store"
 )
 
-func ScanHTLCUTXO() error {
+func ScanHTLCUTXO(cfg *config.Config) error {
 	// Load HTLC address from address-test.json
-	addressFile := "../../../data-script/address-test.json"
-	raw, err := ioutil.ReadFile(addressFile)
+	htlc, err := store.ReadHTLCAddress(cfg.Files.AddressTest)
 	if err != nil {
-		return fmt.Errorf("failed to read %s: %w", addressFile, err)
-	}
-	var data map[string][]map[string]string
-	if err := json.Unmarshal(raw, &data); err != nil {
-		return fmt.Errorf("invalid address JSON: %w", err)
+		return err
 	}
-	htlcAddress := data["HTLC"][0]["address"]
+	htlcAddress := htlc.Address
 
 	// Prepare descriptor format
 	query := []interface{}{fmt.Sprintf("addr(%s)", htlcAddress)}
@@ -31,7 +29,7 @@ func ScanHTLCUTXO() error {
 	}
 
 	// Write result to output file
-	outputFile := "../../../data-script/utxo-htlc.json"
+	outputFile := cfg.Files.UTXOHTLC
 	if err := ioutil.WriteFile(outputFile, result, 0644); err != nil {
 		return fmt.Errorf("failed to write %s: %w", outputFile, err)
 	}
@@ -41,7 +39,13 @@ func ScanHTLCUTXO() error {
 }
 
 func main() {
-	if err := ScanHTLCUTXO(); err != nil {
+	cfg, _, err := config.FromArgs(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	rpcURL, rpcUser, rpcPassword = cfg.RPC.URL, cfg.RPC.User, cfg.RPC.Password
+
+	if err := ScanHTLCUTXO(cfg); err != nil {
 		log.Fatalf("Error scanning HTLC UTXO: %v", err)
 	}
 }
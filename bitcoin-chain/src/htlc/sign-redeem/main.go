@@ -7,149 +7,72 @@ import (
 	"log"
 	"os"
 
-	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/joho/godotenv"
+	"example.com/utils/broadcast"
+	"example.com/utils/config"
+	"example.com/utils/rpc"
+	"example.com/utils/store"
 )
 
-// === Load .env ===
-func loadEnv() {
-	paths := []string{"../../../.env", "../../.env", "../.env", "./.env"}
-	for _, path := range paths {
-		if err := godotenv.Load(path); err == nil {
-			return
-		}
-	}
-	log.Fatal("Error loading .env from known locations")
-}
-
-// === Reusable JSON Reader ===
-func ReadInput(filePath string) (map[string]interface{}, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to open file: %w", err)
-	}
-	defer file.Close()
-
-	bytes, err := ioutil.ReadAll(file)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read file: %w", err)
-	}
-
-	var data map[string]interface{}
-	err = json.Unmarshal(bytes, &data)
+// === Readers ===
+func readRedeemTransaction(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("invalid JSON format: %w", err)
+		return "", fmt.Errorf("unable to read file: %w", err)
 	}
-
-	return data, nil
-}
-
-// === Readers ===
-func readRedeemTransaction() (string, error) {
-	path := os.Getenv("REDEEM_TX_OUTPUT")
-	if path == "" {
-		return "", fmt.Errorf("REDEEM_TX_INPUT not set in .env")
+	var out struct {
+		RawRedeemTransaction string `json:"raw_redeem_transaction"`
 	}
-	data, err := ReadInput(path)
-	if err != nil {
-		return "", err
+	if err := json.Unmarshal(data, &out); err != nil {
+		return "", fmt.Errorf("invalid JSON format: %w", err)
 	}
-	redeemTx, ok := data["raw_redeem_transaction"].(string)
-	if !ok {
+	if out.RawRedeemTransaction == "" {
 		return "", fmt.Errorf("missing unsigned redeem transaction")
 	}
-	return redeemTx, nil
+	return out.RawRedeemTransaction, nil
 }
 
-func readReceiverInfo() (map[string]interface{}, error) {
-	path := os.Getenv("STATE_PATH_HTLC")
-	if path == "" {
-		return nil, fmt.Errorf("STATE_PATH_HTLC not set in .env")
-	}
-	data, err := ReadInput(path)
+// === Main ===
+func main() {
+	cfg, _, err := config.FromArgs(os.Args[1:])
 	if err != nil {
-		return nil, fmt.Errorf("failed to read state.json: %v", err)
+		log.Fatal(err)
 	}
+	netParams, _ := cfg.NetParams()
 
-	alice, ok := data["alice"].(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("missing or invalid 'alice' field in state.json")
-	}
-	return alice, nil
-}
-
-func readHTLCInfo() (map[string]interface{}, error) {
-	path := os.Getenv("ADDRESS_TEST")
-	if path == "" {
-		return nil, fmt.Errorf("ADDRESS_TEST not set in .env")
-	}
-	data, err := ReadInput(path)
+	secret, err := store.ReadSecret(cfg.Files.ExchangeData)
 	if err != nil {
-		return nil, err
-	}
-
-	htlcInfo, ok := data["HTLC"].([]interface{})
-	if !ok || len(htlcInfo) == 0 {
-		return nil, fmt.Errorf("missing or invalid 'HTLC' field")
+		fmt.Printf("Error reading secret from exchange data: %v\n", err)
+		return
 	}
 
-	return htlcInfo[0].(map[string]interface{}), nil
-}
-
-func readSecretPreimage() (string, error) {
-	path := os.Getenv("EXCHANGE_DATA_HTLC")
-	if path == "" {
-		return "", fmt.Errorf("EXCHANGE_DATA_HTLC not set in .env")
-	}
-	data, err := ReadInput(path)
+	txHex, err := readRedeemTransaction(cfg.Files.RedeemTx)
 	if err != nil {
-		return "", err
-	}
-
-	htlcs, ok := data["htlcs"].([]interface{})
-	if !ok || len(htlcs) == 0 {
-		return "", fmt.Errorf("missing or invalid 'htlcs' field")
-	}
-
-	firstHTLC, ok := htlcs[0].(map[string]interface{})
-	if !ok {
-		return "", fmt.Errorf("invalid structure in 'htlcs[0]'")
-	}
-
-	secret, ok := firstHTLC["secret"].(string)
-	if !ok || len(secret) == 0 {
-		return "", fmt.Errorf("missing or invalid 'secret' field in htlcs[0]")
+		fmt.Printf("Error reading redeem transaction: %v\n", err)
+		return
 	}
 
-	return secret, nil
-}
-
-// === Main ===
-func main() {
-	loadEnv()
-	netParams := &chaincfg.RegressionNetParams
-
-	secret, err := readSecretPreimage()
+	receiver, err := store.ReadKeyPair(cfg.Keys.State, "alice")
 	if err != nil {
-		fmt.Printf("Error reading secret from exchange data: %v\n", err)
+		fmt.Printf("Error reading receiver information: %v\n", err)
 		return
 	}
 
-	txHex, err := readRedeemTransaction()
+	htlc, err := store.ReadHTLCAddress(cfg.Files.AddressTest)
 	if err != nil {
-		fmt.Printf("Error reading redeem transaction: %v\n", err)
+		fmt.Printf("Error reading htlc information: %v\n", err)
 		return
 	}
 
-	receiverMap, err := readReceiverInfo()
+	htlcUTXO, err := store.ReadFirstUnspent(cfg.Files.UTXOHTLC)
 	if err != nil {
-		fmt.Printf("Error reading receiver information: %v\n", err)
+		fmt.Printf("Error reading HTLC UTXO: %v\n", err)
 		return
 	}
+	htlcAmount := int64(htlcUTXO.Amount*1e8 + 0.5)
 
-	htlcMap, err := readHTLCInfo()
+	height, err := rpc.New(cfg.RPC).GetBlockCount()
 	if err != nil {
-		fmt.Printf("Error reading htlc information: %v\n", err)
+		fmt.Printf("Error fetching chain height: %v\n", err)
 		return
 	}
 
@@ -161,11 +84,21 @@ func main() {
 
 	signInput := InputSignRedeemTransaction{
 		tx:                 tx,
-		redeemScript:       htlcMap["redeemScript"].(string),
+		redeemScript:       htlc.RedeemScript,
 		mySecret:           secret,
-		receiverPrivKeyWif: receiverMap["privkey"].(string),
-		receiverPubKey:     receiverMap["pubkey"].(string),
+		receiverPrivKeyWif: receiver.PrivKey,
+		receiverPubKey:     receiver.PubKey,
+		htlcAmount:         htlcAmount,
+		chainHeight:        height,
+	}
+
+	b, err := broadcast.Open(cfg)
+	if err != nil {
+		fmt.Printf("Error opening swap database: %v\n", err)
+		return
 	}
+	defer b.Close()
+	signInput.broadcaster = b
 
 	signedTxHex, err := signTransaction(signInput, netParams)
 	if err != nil {
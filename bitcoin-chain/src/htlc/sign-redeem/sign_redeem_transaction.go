@@ -5,10 +5,12 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"os/exec"
 
+	"example.com/utils/broadcast"
+	"example.com/utils/txverify"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
@@ -20,6 +22,9 @@ type InputSignRedeemTransaction struct {
 	mySecret           string
 	receiverPrivKeyWif string
 	receiverPubKey     string
+	htlcAmount         int64 // value of the HTLC output being spent, in satoshis
+	chainHeight        int64
+	broadcaster        *broadcast.Broadcaster
 }
 
 func decodeTx(txHex string) (*wire.MsgTx, error) {
@@ -118,6 +123,22 @@ func signTransaction(input InputSignRedeemTransaction, netParams *chaincfg.Param
 	// Set scriptSig
 	input.tx.TxIn[0].SignatureScript = scriptSig
 
+	// Run the input against the HTLC output before anything is broadcast
+	htlcAddr, err := btcutil.NewAddressScriptHash(redeemScriptBytes, netParams)
+	if err != nil {
+		return "", fmt.Errorf("error deriving HTLC address: %v", err)
+	}
+	htlcPkScript, err := txscript.PayToAddrScript(htlcAddr)
+	if err != nil {
+		return "", fmt.Errorf("error creating HTLC output script: %v", err)
+	}
+	prevOuts := map[wire.OutPoint]*wire.TxOut{
+		input.tx.TxIn[0].PreviousOutPoint: wire.NewTxOut(input.htlcAmount, htlcPkScript),
+	}
+	if err := txverify.Verify(input.tx, prevOuts, input.chainHeight); err != nil {
+		return "", fmt.Errorf("refusing to broadcast: %v", err)
+	}
+
 	// Serialize the transaction
 	var signedTx bytes.Buffer
 	err = input.tx.Serialize(&signedTx)
@@ -125,13 +146,10 @@ func signTransaction(input InputSignRedeemTransaction, netParams *chaincfg.Param
 		return "", fmt.Errorf("error serializing transaction: %v", err)
 	}
 
-	// Broadcast using bitcoin-cli sendrawtransaction
-	cmd := exec.Command("bitcoin-cli", "sendrawtransaction", hex.EncodeToString(signedTx.Bytes()))
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("failed to broadcast transaction: %v\n%s", err, output)
+	// Broadcast after a testmempoolaccept preflight
+	if _, err := input.broadcaster.Send(hex.EncodeToString(signedTx.Bytes()), "htlc-redeem"); err != nil {
+		return "", fmt.Errorf("failed to broadcast transaction: %v", err)
 	}
-	fmt.Printf("Transaction broadcasted successfully. TXID: %s\n", output)
 
 	return hex.EncodeToString(signedTx.Bytes()), nil
 }
@@ -0,0 +1,120 @@
+// Package backup keeps a static backup of every channel: what a node needs
+// to find the channel's peer and its funds again after losing the state
+// file. The backup is written once, when the channel is funded, and does
+// not change with the balances.
+package backup
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"example.com/utils/statefile"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Version is the format of the backups this package writes.
+const Version = 1
+
+// Channel is the static backup of one channel.
+type Channel struct {
+	Version   int    `json:"version"`
+	ChannelID string `json:"channelId"`
+	Self      string `json:"self"` // alice or bob
+	CreatedAt string `json:"createdAt"`
+
+	// the peer to ask for a close
+	Peer     string `json:"peer,omitempty"`
+	PeerKey  string `json:"peerKey"`
+	PeerAddr string `json:"peerAddr,omitempty"`
+
+	FundingTxid     string `json:"fundingTxid"`
+	FundingVout     uint32 `json:"fundingVout"`
+	FundingPkScript string `json:"fundingPkScript"`
+	CapacitySat     int64  `json:"capacitySat"`
+
+	// our funding key: the peer's commitments pay our balance to it, and
+	// the address it is swept to
+	PrivKey      string `json:"privkey"`
+	PubKey       string `json:"pubkey"`
+	Address      string `json:"address"`
+	RemotePubKey string `json:"remotePubkey"`
+}
+
+// sealKey derives the backup encryption key from the node key, so a backup
+// is useless without the node_key file it was made with.
+func sealKey(nodeKey *btcec.PrivateKey) []byte {
+	h := sha256.Sum256(append([]byte("intent-dex static backup"), nodeKey.Serialize()...))
+	return h[:]
+}
+
+// Seal encrypts c with a key derived from nodeKey. The random nonce is
+// prepended to the ciphertext.
+func Seal(nodeKey *btcec.PrivateKey, c *Channel) ([]byte, error) {
+	plain, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(sealKey(nodeKey))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Open decrypts a backup made by Seal with the same node key.
+func Open(nodeKey *btcec.PrivateKey, blob []byte) (*Channel, error) {
+	aead, err := chacha20poly1305.New(sealKey(nodeKey))
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < aead.NonceSize() {
+		return nil, fmt.Errorf("backup too short")
+	}
+	nonce, sealed := blob[:aead.NonceSize()], blob[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("backup was not made with this node key: %v", err)
+	}
+	var c Channel
+	if err := json.Unmarshal(plain, &c); err != nil {
+		return nil, fmt.Errorf("invalid backup: %v", err)
+	}
+	if c.Version != Version {
+		return nil, fmt.Errorf("unsupported backup version %d", c.Version)
+	}
+	return &c, nil
+}
+
+// Write saves c to <dir>/<channel-id>.scb and returns the path.
+func Write(dir string, nodeKey *btcec.PrivateKey, c *Channel) (string, error) {
+	blob, err := Seal(nodeKey, c)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, c.ChannelID+".scb")
+	if err := statefile.WriteFile(path, blob, 0600); err != nil {
+		return "", fmt.Errorf("failed to write backup: %v", err)
+	}
+	return path, nil
+}
+
+// Read loads and decrypts the backup at path.
+func Read(path string, nodeKey *btcec.PrivateKey) (*Channel, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Open(nodeKey, blob)
+}
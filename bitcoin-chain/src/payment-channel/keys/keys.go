@@ -2,11 +2,9 @@ package keys
 
 import (
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
 
+	"example.com/utils/statefile"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -21,11 +19,14 @@ type KeyInfo struct {
 type State struct {
 	Alice *KeyInfo `json:"alice,omitempty"`
 	Bob   *KeyInfo `json:"bob,omitempty"`
+	// Wallet belongs to no channel role: a node that manages many channels
+	// funds them from it and derives each channel's own key from it
+	Wallet *KeyInfo `json:"wallet,omitempty"`
 }
 
 func GenerateAndStoreKeys(stateFile string, role string) {
-	if role != "alice" && role != "bob" {
-		fmt.Println("Invalid role. Must be 'alice' or 'bob'")
+	if role != "alice" && role != "bob" && role != "wallet" {
+		fmt.Println("Invalid role. Must be 'alice', 'bob' or 'wallet'")
 		return
 	}
 
@@ -53,35 +54,20 @@ func GenerateAndStoreKeys(stateFile string, role string) {
 	fmt.Println("Public Key :", keyInfo.PubKey)
 	fmt.Println("Address    :", keyInfo.Address)
 
-	// Load existing state if available
+	// Update key based on role, keeping the rest of the state intact
 	var state State
-	if _, err := os.Stat(stateFile); err == nil {
-		data, err := os.ReadFile(stateFile)
-		if err == nil {
-			json.Unmarshal(data, &state)
+	err = statefile.Update(stateFile, &state, func() error {
+		switch role {
+		case "alice":
+			state.Alice = keyInfo
+		case "bob":
+			state.Bob = keyInfo
+		default:
+			state.Wallet = keyInfo
 		}
-	}
-
-	// Update key based on role
-	if role == "alice" {
-		state.Alice = keyInfo
-	} else {
-		state.Bob = keyInfo
-	}
-
-	// Ensure directory exists
-	dir := filepath.Dir(stateFile)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		panic(fmt.Errorf("failed to create directory: %v", err))
-	}
-
-	// Save updated state
-	newData, err := json.MarshalIndent(state, "", "  ")
+		return nil
+	})
 	if err != nil {
 		panic(err)
 	}
-
-	if err := os.WriteFile(stateFile, newData, 0644); err != nil {
-		panic(err)
-	}
 }
@@ -4,106 +4,525 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"time"
 
 	"example.com/m/keys"
+	"example.com/m/peer"
 	"example.com/m/scripts"
 	"example.com/m/txbuilder"
-	"github.com/joho/godotenv"
+	"example.com/m/watchtower"
+	"example.com/utils/config"
+	"example.com/utils/noise"
+	"example.com/utils/store"
 )
 
-func loadEnv() {
-	paths := []string{"../../.env", "../.env", "./.env"} // flexible search
-	for _, path := range paths {
-		if err := godotenv.Load(path); err == nil {
-			return
-		}
-	}
-	log.Fatal("Error loading .env from known locations")
-}
-
 func main() {
-	loadEnv()
+	cfg, args, err := config.FromArgs(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	txbuilder.Configure(cfg)
 
-	statePath := os.Getenv("STATE_PATH")
-	paymentMessagePath := os.Getenv("PAYMENT_MESSAGE")
-	opreturnTxPath := os.Getenv("OPRETURN_TX")
+	statePath := cfg.Keys.State
+	paymentMessagePath := cfg.Files.PaymentMessage
+	opreturnTxPath := cfg.Files.OpReturnTx
+	fundPath := filepath.Join(cfg.DataDir, "data", "fund.json")
 
-	if statePath == "" || paymentMessagePath == "" || opreturnTxPath == "" {
-		log.Fatal("Missing environment variables: STATE_PATH, PAYMENT_MESSAGE, or OPRETURN_TX")
+	if len(args) < 1 {
+		fmt.Println("Usage:")
+		fmt.Println("  go run main.go [--config <file>] [init|fund|multisig|htlc|commit|pay|splice|sign|cosign|settle|close|refund|channel|justice|tower|peer|channels|db-import]")
+		return
 	}
 
-	if len(os.Args) < 2 {
-		fmt.Println("Usage:")
-		fmt.Println("  go run main.go [init|fund|multisig|htlc|commit|sign|settle|refund]")
+	// every channel subcommand first checks where the channel is in its
+	// lifecycle
+	if err := txbuilder.CheckCommand(statePath, args); err != nil {
+		fmt.Println(err)
 		return
 	}
 
-	switch os.Args[1] {
+	switch args[0] {
 	case "init":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: go run main.go init <alice|bob>")
+		if len(args) < 2 {
+			fmt.Println("Usage: go run main.go init <alice|bob|wallet>")
 			return
 		}
-		keys.GenerateAndStoreKeys(statePath, os.Args[2])
+		keys.GenerateAndStoreKeys(statePath, args[1])
 
 	case "fund":
+		// fund offchain <amount> builds the funding tx without sending it,
+		// fund broadcast sends it once the first commitment is signed
+		if len(args) >= 3 && args[1] == "offchain" {
+			var amount float64
+			fmt.Sscanf(args[2], "%f", &amount)
+			if err := txbuilder.FundMultisigFromBobOffchain(statePath, amount); err != nil {
+				fmt.Println("Funding error:", err)
+			}
+			return
+		}
+		if len(args) >= 2 && args[1] == "broadcast" {
+			if err := txbuilder.BroadcastFundingTx(statePath); err != nil {
+				fmt.Println("Funding error:", err)
+			}
+			return
+		}
 		txbuilder.FundChannel(statePath)
 
 	case "multisig":
-		_, _, err := scripts.GenerateMultisig(statePath)
+		// multisig taproot aggregates both keys with MuSig2 instead
+		if len(args) >= 2 && args[1] == "taproot" {
+			if _, err := scripts.GenerateTaprootFunding(statePath, fundPath); err != nil {
+				fmt.Println("Multisig error:", err)
+			}
+			return
+		}
+		// optional Bob-only refund branch: refund-cltv <locktime> or refund-csv <blocks>
+		var refund *scripts.RefundTerms
+		if len(args) >= 3 {
+			switch args[1] {
+			case "refund-cltv":
+				refund = &scripts.RefundTerms{Locktime: uint32(parseInt64(args[2]))}
+			case "refund-csv":
+				refund = &scripts.RefundTerms{Delay: uint16(parseInt64(args[2]))}
+			default:
+				fmt.Println("Usage: go run main.go multisig [taproot|refund-cltv <locktime>|refund-csv <blocks>]")
+				return
+			}
+		}
+		_, _, err := scripts.GenerateMultisig(statePath, fundPath, refund)
 		if err != nil {
 			fmt.Println("Multisig error:", err)
 		}
 
 	case "htlc":
-		if len(os.Args) < 4 {
+		// add/settle/fail run the HTLC inside the channel instead of on chain,
+		// claim takes one off a commitment with its second-stage tx
+		if len(args) >= 2 && (args[1] == "add" || args[1] == "settle" || args[1] == "fail" || args[1] == "claim") {
+			var err error
+			switch {
+			case args[1] == "add" && len(args) >= 5:
+				offerer := "bob"
+				if len(args) > 5 {
+					offerer = args[5]
+				}
+				var amount float64
+				fmt.Sscanf(args[4], "%f", &amount)
+				err = txbuilder.AddHTLC(statePath, offerer, args[2], uint32(parseInt64(args[3])), amount)
+			case args[1] == "settle" && len(args) >= 4:
+				err = txbuilder.SettleHTLC(statePath, int(parseInt64(args[2])), args[3])
+			case args[1] == "fail" && len(args) >= 3:
+				err = txbuilder.FailHTLC(statePath, int(parseInt64(args[2])))
+			case args[1] == "claim" && len(args) >= 4:
+				preimage := ""
+				if len(args) > 4 {
+					preimage = args[4]
+				}
+				err = txbuilder.ClaimHTLC(statePath, args[2], int(parseInt64(args[3])), preimage)
+			default:
+				fmt.Println("Usage:")
+				fmt.Println("  go run main.go htlc add <sha256(secret)> <expiry> <amount> [alice|bob]")
+				fmt.Println("  go run main.go htlc settle <id> <secret>")
+				fmt.Println("  go run main.go htlc fail <id>")
+				fmt.Println("  go run main.go htlc claim <alice|bob> <id> [secret]")
+				return
+			}
+			if err != nil {
+				fmt.Println("HTLC error:", err)
+			}
+			return
+		}
+		if len(args) < 3 {
 			fmt.Println("Usage: go run main.go htlc <sha256(secret)> <timelock>")
 			return
 		}
-		_, _, err := scripts.GenerateHTLCScript(statePath, os.Args[2], parseInt64(os.Args[3]))
+		_, _, err := scripts.GenerateHTLCScript(statePath, args[1], parseInt64(args[2]))
 		if err != nil {
 			fmt.Println("HTLC error:", err)
 		}
 
 	case "commit":
-		if len(os.Args) < 4 {
+		if len(args) < 3 {
 			fmt.Println("Usage: go run main.go commit <aliceAmount> <bobAmount>")
 			return
 		}
 		var a, b float64
-		fmt.Sscanf(os.Args[2], "%f", &a)
-		fmt.Sscanf(os.Args[3], "%f", &b)
+		fmt.Sscanf(args[1], "%f", &a)
+		fmt.Sscanf(args[2], "%f", &b)
 		if err := txbuilder.CreateCommitmentTx(statePath, a, b); err != nil {
 			fmt.Println("Commitment Tx error:", err)
 		}
 
+	case "pay":
+		// pay <amount> [alice|bob] moves amount from the payer, Bob unless
+		// given, to the other party and signs the new commitment
+		if len(args) < 2 {
+			fmt.Println("Usage: go run main.go pay <amount> [alice|bob]")
+			return
+		}
+		payer := "bob"
+		if len(args) > 2 {
+			payer = args[2]
+		}
+		p, err := txbuilder.Pay(statePath, payer, parseSat(args[1]))
+		if err != nil {
+			fmt.Println("Payment error:", err)
+			return
+		}
+		fmt.Printf("%s paid %d sat, channel at commitment #%d: Alice=%d sat, Bob=%d sat\n", p.Payer, p.AmountSat, p.Commitment, p.AliceSat, p.BobSat)
+
+	case "splice":
+		// splice in/out changes the capacity of an open channel; the party,
+		// Bob unless given, adds funds from its wallet or takes them out.
+		// splice abort goes back to the old funding output
+		if len(args) >= 2 && args[1] == "abort" {
+			sp, err := txbuilder.AbortSplice(statePath)
+			if err != nil {
+				fmt.Println("Splice error:", err)
+				return
+			}
+			fmt.Printf("Splice %s aborted, the channel is back at commitment #%d on %s:%d\n", sp.Txid, sp.PrevCommitment, sp.PrevFunding.Txid, sp.PrevFunding.Vout)
+			return
+		}
+		if len(args) < 3 || (args[1] != "in" && args[1] != "out") {
+			fmt.Println("Usage:")
+			fmt.Println("  go run main.go splice in <amount> [alice|bob]")
+			fmt.Println("  go run main.go splice out <amount> [alice|bob] [address]")
+			fmt.Println("  go run main.go splice abort")
+			return
+		}
+		party := "bob"
+		if len(args) > 3 {
+			party = args[3]
+		}
+		var sp *txbuilder.Splice
+		var err error
+		if args[1] == "in" {
+			sp, err = txbuilder.SpliceIn(statePath, party, parseSat(args[2]))
+		} else {
+			payTo := ""
+			if len(args) > 4 {
+				payTo = args[4]
+			}
+			sp, err = txbuilder.SpliceOut(statePath, party, parseSat(args[2]), payTo)
+		}
+		if err != nil {
+			fmt.Println("Splice error:", err)
+			return
+		}
+		fmt.Printf("Splice %s broadcast, the channel is at commitment #%d; #%d stays valid and the balances cannot change until it confirms\n", sp.Txid, sp.Commitment, sp.PrevCommitment)
+
 	case "sign":
 		if err := txbuilder.SignCommitmentTx(statePath); err != nil {
 			fmt.Println("Sign error:", err)
 		}
 
+	case "cosign":
+		// two-party signing of Bob's commitment: on a Taproot channel each
+		// side first runs cosign nonce, then Alice and Bob sign in turn
+		var err error
+		switch {
+		case len(args) >= 3 && args[1] == "nonce":
+			err = txbuilder.MusigNonce(statePath, args[2])
+		case len(args) >= 2 && args[1] == "alice":
+			err = txbuilder.SignCommitmentTxAlice(statePath)
+		case len(args) >= 2 && args[1] == "bob":
+			err = txbuilder.SignCommitmentTxBob(statePath)
+		default:
+			fmt.Println("Usage:")
+			fmt.Println("  go run main.go cosign nonce <alice|bob>")
+			fmt.Println("  go run main.go cosign <alice|bob>")
+			return
+		}
+		if err != nil {
+			fmt.Println("Cosign error:", err)
+		}
+
 	case "settle":
-		b, err := os.ReadFile("data/commit-signed.txt")
+		// each party can only broadcast its own version of the commitment
+		holder := "bob"
+		if len(args) > 1 {
+			holder = args[1]
+		}
+		if holder != "alice" && holder != "bob" {
+			fmt.Println("Usage: go run main.go settle [alice|bob]")
+			return
+		}
+		txHex, err := txbuilder.SignedCommitmentTx(statePath, holder)
 		if err != nil {
-			fmt.Println("Missing signed tx file:", err)
+			fmt.Println("Settle error:", err)
 			return
 		}
 		fmt.Println("Use bitcoin-cli to send this tx:")
-		fmt.Println("bitcoin-cli sendrawtransaction", string(b))
+		fmt.Println("bitcoin-cli sendrawtransaction", txHex)
 
 	case "refund":
 		if err := txbuilder.RefundTransaction(statePath); err != nil {
 			fmt.Println("Refund error:", err)
 		}
 
-	case "generate-message":
-		exchangePath := os.Getenv("EXCHANGE_DATA")
-		if exchangePath == "" {
-			fmt.Println("EXCHANGE_DATA not set in .env")
+	case "close":
+		// each side's opening offer for the closing fee, in satoshis
+		bobFee, aliceFee := int64(0), int64(0)
+		if len(args) > 1 {
+			bobFee = parseInt64(args[1])
+		}
+		if len(args) > 2 {
+			aliceFee = parseInt64(args[2])
+		}
+		if bobFee <= 0 {
+			bobFee = cfg.Fees.FixedFeeSat
+		}
+		if aliceFee <= 0 {
+			aliceFee = bobFee
+		}
+		if err := txbuilder.CloseChannel(statePath, bobFee, aliceFee); err != nil {
+			fmt.Println("Close error:", err)
+		}
+
+	case "channel":
+		if len(args) >= 2 && args[1] == "history" {
+			if err := txbuilder.PrintHistory(statePath); err != nil {
+				fmt.Println("History error:", err)
+			}
 			return
 		}
+		if len(args) >= 2 && args[1] == "status" {
+			if err := txbuilder.PrintStatus(statePath); err != nil {
+				fmt.Println("Status error:", err)
+			}
+			return
+		}
+		if len(args) >= 3 && args[1] == "show" {
+			if err := txbuilder.ShowCommitment(statePath, int(parseInt64(args[2]))); err != nil {
+				fmt.Println("Show error:", err)
+			}
+			return
+		}
+		if len(args) >= 3 && args[1] == "force-close" {
+			interval := 30 * time.Second
+			if len(args) > 3 {
+				interval = time.Duration(parseInt64(args[3])) * time.Second
+			}
+			if err := txbuilder.ForceCloseChannel(statePath, args[2], interval); err != nil {
+				fmt.Println("Force-close error:", err)
+			}
+			return
+		}
+		if len(args) >= 2 && args[1] == "bump" {
+			// 0 asks the node for a fee estimate
+			var feeRate int64
+			if len(args) > 2 {
+				feeRate = parseInt64(args[2])
+			}
+			txid, err := txbuilder.BumpCommitment(statePath, feeRate)
+			if err != nil {
+				fmt.Println("Bump error:", err)
+				return
+			}
+			fmt.Println("Fee-bump tx broadcast:", txid)
+			return
+		}
+		fmt.Println("Usage:")
+		fmt.Println("  go run main.go channel status")
+		fmt.Println("  go run main.go channel history")
+		fmt.Println("  go run main.go channel show <n>")
+		fmt.Println("  go run main.go channel force-close <alice|bob> [poll-seconds]")
+		fmt.Println("  go run main.go channel bump [fee-rate-sat-vb]")
+
+	case "justice":
+		if len(args) < 3 {
+			fmt.Println("Usage: go run main.go justice <alice|bob> <revoked-commitment-hex>")
+			return
+		}
+		if err := txbuilder.JusticeTransaction(statePath, args[1], args[2]); err != nil {
+			fmt.Println("Justice error:", err)
+		}
+
+	case "tower":
+		towerURL := "http://127.0.0.1:9911"
+		if len(args) >= 2 && args[1] == "run" {
+			addr := "127.0.0.1:9911"
+			if len(args) > 2 {
+				addr = args[2]
+			}
+			tower := watchtower.New(cfg, filepath.Join(cfg.DataDir, "tower.json"))
+			if err := tower.Run(addr, 10*time.Second); err != nil {
+				fmt.Println("Tower error:", err)
+			}
+			return
+		}
+		if len(args) >= 3 && args[1] == "push" {
+			if len(args) > 3 {
+				towerURL = args[3]
+			}
+			client := &watchtower.Client{URL: towerURL, ID: args[2]}
+			if err := txbuilder.PushJusticeToTower(statePath, args[2], client); err != nil {
+				fmt.Println("Tower error:", err)
+			}
+			return
+		}
+		fmt.Println("Usage:")
+		fmt.Println("  go run main.go tower run [listen-addr]")
+		fmt.Println("  go run main.go tower push <alice|bob> [tower-url]")
 
+	case "peer":
+		// each party runs its own node with its own data dir and state file
+		nodeKey, err := noise.LoadKey(filepath.Join(cfg.DataDir, "node_key"))
+		if err != nil {
+			fmt.Println("Peer error:", err)
+			return
+		}
+		pins := noise.OpenPins(filepath.Join(cfg.DataDir, "peers.json"))
+		newNode := func(role string, fee int64) *peer.Node {
+			return &peer.Node{Role: role, StatePath: statePath, FeeSat: fee, NodeKey: nodeKey, Pins: pins,
+				BackupDir: filepath.Join(cfg.DataDir, "backups")}
+		}
+
+		switch {
+		case len(args) >= 2 && args[1] == "id":
+			fmt.Println(noise.KeyString(nodeKey.PubKey()))
+		case len(args) >= 3 && args[1] == "forget":
+			err = pins.Forget(args[2])
+		case len(args) >= 3 && args[1] == "serve":
+			addr := "127.0.0.1:9735"
+			if len(args) > 3 {
+				addr = args[3]
+			}
+			err = newNode(args[2], cfg.Fees.FixedFeeSat).Serve(addr)
+		case len(args) >= 5 && args[1] == "open" && args[4] == "dual":
+			err = newNode("bob", cfg.Fees.FixedFeeSat).OpenDual(args[2], parseSat(args[3]))
+		case len(args) >= 4 && args[1] == "open":
+			err = newNode("bob", cfg.Fees.FixedFeeSat).Open(args[2], parseSat(args[3]))
+		case len(args) >= 6 && args[1] == "update":
+			err = newNode(args[2], cfg.Fees.FixedFeeSat).Update(args[3], parseSat(args[4]), parseSat(args[5]))
+		case len(args) >= 5 && args[1] == "pay":
+			err = newNode(args[2], cfg.Fees.FixedFeeSat).Pay(args[3], parseSat(args[4]))
+		case len(args) >= 5 && args[1] == "approve":
+			err = txbuilder.ApproveUpdate(statePath, args[2], parseSat(args[3]), parseSat(args[4]))
+		case len(args) >= 4 && args[1] == "close":
+			fee := cfg.Fees.FixedFeeSat
+			if len(args) > 4 {
+				fee = parseInt64(args[4])
+			}
+			err = newNode(args[2], fee).Close(args[3], fee)
+		default:
+			fmt.Println("Usage:")
+			fmt.Println("  go run main.go peer id")
+			fmt.Println("  go run main.go peer serve <alice|bob> [listen-addr]")
+			fmt.Println("  go run main.go peer open [<node-key>@]<peer-addr> <amount> [dual]")
+			fmt.Println("  go run main.go peer update <alice|bob> [<node-key>@]<peer-addr> <aliceAmount> <bobAmount>")
+			fmt.Println("  go run main.go peer pay <alice|bob> [<node-key>@]<peer-addr> <amount>")
+			fmt.Println("  go run main.go peer approve <alice|bob> <aliceAmount> <bobAmount>")
+			fmt.Println("  go run main.go peer close <alice|bob> [<node-key>@]<peer-addr> [fee-sat]")
+			fmt.Println("  go run main.go peer forget <alice|bob>")
+			return
+		}
+		if err != nil {
+			fmt.Println("Peer error:", err)
+		}
+
+	case "channels":
+		// many channels with many peers, each in its own state file under
+		// the data dir; amounts are given from our side
+		nodeKey, err := noise.LoadKey(filepath.Join(cfg.DataDir, "node_key"))
+		if err != nil {
+			fmt.Println("Channels error:", err)
+			return
+		}
+		// opening a channel needs the wallet key, recovering one from its
+		// backup does not
+		wallet, _ := peer.WalletKey(statePath)
+		pins := noise.OpenPins(filepath.Join(cfg.DataDir, "peers.json"))
+		manager := peer.NewManager(cfg.DataDir, nodeKey, pins, cfg.Fees.FixedFeeSat, wallet)
+
+		optional := func(i int) string {
+			if len(args) > i {
+				return args[i]
+			}
+			return ""
+		}
+		switch {
+		case len(args) >= 2 && args[1] == "list":
+			err = manager.List()
+		case len(args) >= 2 && args[1] == "serve":
+			addr := "127.0.0.1:9735"
+			if len(args) > 2 {
+				addr = args[2]
+			}
+			err = manager.Serve(addr)
+		case len(args) >= 6 && args[1] == "open" && args[5] == "dual":
+			err = manager.OpenDual(args[2], args[3], parseSat(args[4]))
+		case len(args) >= 5 && args[1] == "open":
+			err = manager.Open(args[2], args[3], parseSat(args[4]))
+		case len(args) >= 5 && args[1] == "update":
+			err = manager.Update(args[2], parseSat(args[3]), parseSat(args[4]), optional(5))
+		case len(args) >= 4 && args[1] == "pay":
+			err = manager.Pay(args[2], parseSat(args[3]), optional(4))
+		case len(args) >= 5 && args[1] == "approve":
+			err = manager.Approve(args[2], parseSat(args[3]), parseSat(args[4]))
+		case len(args) >= 3 && args[1] == "close":
+			fee := cfg.Fees.FixedFeeSat
+			if len(args) > 3 {
+				fee = parseInt64(args[3])
+			}
+			err = manager.Close(args[2], fee, optional(4))
+		case len(args) >= 2 && args[1] == "backup":
+			err = manager.Backup(optional(2))
+		case len(args) >= 3 && args[1] == "recover":
+			err = manager.Recover(args[2], optional(3))
+		default:
+			fmt.Println("Usage:")
+			fmt.Println("  go run main.go channels list")
+			fmt.Println("  go run main.go channels serve [listen-addr]")
+			fmt.Println("  go run main.go channels open <peer-name> [<node-key>@]<peer-addr> <amount> [dual]")
+			fmt.Println("  go run main.go channels update <channel-id> <localAmount> <remoteAmount> [peer-addr]")
+			fmt.Println("  go run main.go channels pay <channel-id> <amount> [peer-addr]")
+			fmt.Println("  go run main.go channels approve <channel-id> <localAmount> <remoteAmount>")
+			fmt.Println("  go run main.go channels close <channel-id> [fee-sat] [peer-addr]")
+			fmt.Println("  go run main.go channels backup [dir]")
+			fmt.Println("  go run main.go channels recover <backup-file> [peer-addr]")
+			return
+		}
+		if err != nil {
+			fmt.Println("Channels error:", err)
+		}
+
+	case "db-import":
+		db, err := store.Open(cfg.Files.SwapDB)
+		if err != nil {
+			fmt.Println("Database error:", err)
+			return
+		}
+		defer db.Close()
+
+		report, err := store.ImportJSON(db, store.ImportFiles{
+			ChannelState:   statePath,
+			AddressTest:    cfg.Files.AddressTest,
+			UTXO:           cfg.Files.UTXO,
+			UTXOHTLC:       cfg.Files.UTXOHTLC,
+			PaymentMessage: paymentMessagePath,
+			ExchangeData:   cfg.Files.ExchangeData,
+			Fund:           fundPath,
+			CommitUnsigned: filepath.Join(cfg.DataDir, "data", "commit-unsigned.txt"),
+			CommitSigned:   filepath.Join(cfg.DataDir, "data", "commit-signed.txt"),
+		})
+		if err != nil {
+			fmt.Println("Import error:", err)
+			return
+		}
+		for kind, n := range report.Imported {
+			fmt.Printf("Imported %d %s\n", n, kind)
+		}
+		for _, path := range report.Skipped {
+			fmt.Println("Skipped missing file:", path)
+		}
+		fmt.Println("Swap database:", db.Path())
+
+	case "generate-message":
+		exchangePath := cfg.Files.ExchangeData
 		exchangeDataRaw, err := os.ReadFile(exchangePath)
 		if err != nil {
 			fmt.Println("Failed to read exchange-data.json:", err)
@@ -144,17 +563,17 @@ func main() {
 		}
 
 	case "verify-opreturn":
-		if len(os.Args) != 4 {
+		if len(args) != 3 {
 			fmt.Println("Usage: go run main.go verify-opreturn <payment_message.json> <payment_opreturn.txt>")
 			return
 		}
-		msg, err := scripts.ExtractOpReturnMessage(os.Args[3])
+		msg, err := scripts.ExtractOpReturnMessage(args[2])
 		if err != nil {
 			fmt.Println("Failed to extract OP_RETURN:", err)
 			return
 		}
 		fmt.Println("Extracted OP_RETURN message:", msg)
-		if err := scripts.VerifyPaymentMessageWithExtracted(msg, os.Args[2], statePath); err != nil {
+		if err := scripts.VerifyPaymentMessageWithExtracted(msg, args[1], statePath); err != nil {
 			fmt.Println("Signature or content mismatch:", err)
 		} else {
 			fmt.Println("Signature and OP_RETURN match verified.")
@@ -167,3 +586,10 @@ func parseInt64(s string) int64 {
 	fmt.Sscanf(s, "%d", &i)
 	return i
 }
+
+// parseSat reads a BTC amount and returns it in satoshis.
+func parseSat(s string) int64 {
+	var f float64
+	fmt.Sscanf(s, "%f", &f)
+	return int64(math.Round(f * 1e8))
+}
@@ -0,0 +1,101 @@
+package musig
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr/musig2"
+)
+
+// Channel funding outputs are BIP86 key-path-only Taproot outputs: the
+// aggregate of both keys, tweaked with an empty script tree. Keys are always
+// sorted, so both parties get the same key regardless of argument order.
+
+// keySet copies keys for musig2, which sorts the slice it is given in
+// place and would reorder the caller's.
+func keySet(keys []*btcec.PublicKey) []*btcec.PublicKey {
+	return append([]*btcec.PublicKey(nil), keys...)
+}
+
+// OutputKey is the Taproot output key for the signer set.
+func OutputKey(keys []*btcec.PublicKey) (*btcec.PublicKey, error) {
+	agg, _, _, err := musig2.AggregateKeys(keySet(keys), true, musig2.WithBIP86KeyTweak())
+	if err != nil {
+		return nil, fmt.Errorf("key aggregation failed: %v", err)
+	}
+	return agg.FinalKey, nil
+}
+
+// NewNonce creates a signing nonce for msg. The nonce is random; the key and
+// message only strengthen it against a broken random source.
+func NewNonce(priv *btcec.PrivateKey, msg [32]byte) (*musig2.Nonces, error) {
+	return musig2.GenNonces(
+		musig2.WithPublicKey(priv.PubKey()),
+		musig2.WithNonceSecretKeyAux(priv),
+		musig2.WithNonceMessageAux(msg),
+	)
+}
+
+// Sign produces priv's partial signature over msg once every signer's
+// public nonce is known. secNonce must never be used again afterwards.
+func Sign(secNonce [musig2.SecNonceSize]byte, priv *btcec.PrivateKey, keys []*btcec.PublicKey,
+	pubNonces [][musig2.PubNonceSize]byte, msg [32]byte) (*musig2.PartialSignature, error) {
+
+	combined, err := musig2.AggregateNonces(pubNonces)
+	if err != nil {
+		return nil, fmt.Errorf("nonce aggregation failed: %v", err)
+	}
+	psig, err := musig2.Sign(secNonce, priv, combined, keySet(keys), msg,
+		musig2.WithSortedKeys(), musig2.WithBip86SignTweak())
+	if err != nil {
+		return nil, fmt.Errorf("partial signing failed: %v", err)
+	}
+	return psig, nil
+}
+
+// Verify checks signer's partial signature against the public nonce it sent.
+func Verify(psig *musig2.PartialSignature, signer *btcec.PublicKey, pubNonce [musig2.PubNonceSize]byte,
+	keys []*btcec.PublicKey, pubNonces [][musig2.PubNonceSize]byte, msg [32]byte) error {
+
+	combined, err := musig2.AggregateNonces(pubNonces)
+	if err != nil {
+		return fmt.Errorf("nonce aggregation failed: %v", err)
+	}
+	if !psig.Verify(pubNonce, combined, keySet(keys), signer, msg,
+		musig2.WithSortedKeys(), musig2.WithBip86SignTweak()) {
+		return fmt.Errorf("partial signature is invalid")
+	}
+	return nil
+}
+
+// Combine aggregates the partial signatures into the final Schnorr
+// signature. ours must be a signature produced by Sign, which carries the
+// final nonce point that encoded partial signatures leave out.
+func Combine(ours *musig2.PartialSignature, others []*musig2.PartialSignature,
+	keys []*btcec.PublicKey, msg [32]byte) *schnorr.Signature {
+
+	psigs := append([]*musig2.PartialSignature{ours}, others...)
+	return musig2.CombineSigs(ours.R, psigs, musig2.WithBip86TweakedCombine(msg, keySet(keys), true))
+}
+
+// EncodePartial serializes a partial signature (32 bytes).
+func EncodePartial(psig *musig2.PartialSignature) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := psig.Encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func DecodePartial(b []byte) (*musig2.PartialSignature, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("partial signature must be 32 bytes, got %d", len(b))
+	}
+	psig := new(musig2.PartialSignature)
+	if err := psig.Decode(bytes.NewReader(b)); err != nil {
+		return nil, err
+	}
+	return psig, nil
+}
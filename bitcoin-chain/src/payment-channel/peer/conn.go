@@ -0,0 +1,69 @@
+package peer
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// messageTimeout is how long we wait for the peer's next message.
+const messageTimeout = 30 * time.Second
+
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Conn exchanges messages with one peer over any byte stream, normally a
+// TCP connection.
+type Conn struct {
+	rw io.ReadWriteCloser
+}
+
+func NewConn(rw io.ReadWriteCloser) *Conn {
+	return &Conn{rw: rw}
+}
+
+func (c *Conn) Close() error {
+	return c.rw.Close()
+}
+
+func (c *Conn) Send(msg Message) error {
+	if err := WriteMessage(c.rw, msg); err != nil {
+		return fmt.Errorf("failed to send %s: %v", msg.Type(), err)
+	}
+	return nil
+}
+
+// Receive returns the next message; an error message from the peer is
+// returned as an error.
+func (c *Conn) Receive() (Message, error) {
+	if d, ok := c.rw.(deadliner); ok {
+		d.SetReadDeadline(time.Now().Add(messageTimeout))
+	}
+	msg, err := ReadMessage(c.rw)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := msg.(*Error); ok {
+		return nil, fmt.Errorf("peer error: %s", e.Message)
+	}
+	return msg, nil
+}
+
+// expect receives the next message and fails unless it has type t.
+func (c *Conn) expect(t MessageType) (Message, error) {
+	msg, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type() != t {
+		return nil, fmt.Errorf("expected %s, got %s", t, msg.Type())
+	}
+	return msg, nil
+}
+
+// fail tells the peer why we stop and returns err.
+func (c *Conn) fail(err error) error {
+	c.Send(&Error{Message: err.Error()})
+	return err
+}
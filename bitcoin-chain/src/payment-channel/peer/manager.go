@@ -0,0 +1,555 @@
+package peer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"example.com/m/backup"
+	"example.com/m/txbuilder"
+	"example.com/utils/noise"
+	"example.com/utils/statefile"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/btcutil/hdkeychain"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// Manager runs many channels with many peers from one node, for instance a
+// liquidity provider with a channel per swap user. Every channel has its
+// own state file under <Dir>/channels and a record in <Dir>/channels.json;
+// peer sessions are routed to a channel by its ID.
+type Manager struct {
+	Dir     string
+	NodeKey *btcec.PrivateKey
+	Pins    *noise.Pins
+	FeeSat  int64
+	// Wallet is our on-chain key: it funds the channels we open and takes
+	// their change. Our funding key and payout address in each channel are
+	// derived from it, see channelKey
+	Wallet   *txbuilder.KeyInfo
+	Registry *Registry
+}
+
+func NewManager(dir string, nodeKey *btcec.PrivateKey, pins *noise.Pins, feeSat int64, wallet *txbuilder.KeyInfo) *Manager {
+	return &Manager{
+		Dir:      dir,
+		NodeKey:  nodeKey,
+		Pins:     pins,
+		FeeSat:   feeSat,
+		Wallet:   wallet,
+		Registry: OpenRegistry(filepath.Join(dir, "channels.json")),
+	}
+}
+
+// WalletKey reads the key created by init wallet from the main state file.
+// State files from before init wallet fall back to Bob's key, then Alice's.
+func WalletKey(statePath string) (*txbuilder.KeyInfo, error) {
+	var state txbuilder.State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return nil, err
+	}
+	for _, k := range []*txbuilder.KeyInfo{state.Wallet, state.Bob, state.Alice} {
+		if k != nil && k.PrivKey != "" {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("no wallet key, run init wallet first")
+}
+
+func (m *Manager) node(rec *ChannelRecord) *Node {
+	return &Node{
+		Role:      rec.Local,
+		StatePath: rec.StateFile,
+		FeeSat:    m.FeeSat,
+		NodeKey:   m.NodeKey,
+		Pins:      m.Pins,
+		Peer:      rec.Peer,
+	}
+}
+
+// newChannel registers a channel under a temporary ID. Its state file
+// starts out with our wallet key and, in our role, a key derived for this
+// channel alone, so no two channels share a funding key or payout script.
+func (m *Manager) newChannel(local, peer string, peerKey *btcec.PublicKey, peerAddr string) (*ChannelRecord, error) {
+	if m.Wallet == nil {
+		return nil, fmt.Errorf("no wallet key, run init wallet first")
+	}
+	id := temporaryChannelID()
+	rec := &ChannelRecord{
+		ID:        id,
+		Temporary: true,
+		Peer:      peer,
+		PeerKey:   noise.KeyString(peerKey),
+		PeerAddr:  peerAddr,
+		Local:     local,
+		StateFile: filepath.Join(m.Dir, "channels", id+".json"),
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	if err := m.Registry.add(rec); err != nil {
+		return nil, err
+	}
+	key, err := channelKey(m.Wallet, rec.KeyIndex)
+	if err != nil {
+		m.Registry.remove(rec.ID)
+		return nil, err
+	}
+	var state txbuilder.State
+	err = statefile.Update(rec.StateFile, &state, func() error {
+		wallet := *m.Wallet
+		state.Wallet = &wallet
+		if local == "alice" {
+			state.Alice = key
+		} else {
+			state.Bob = key
+		}
+		return nil
+	})
+	if err != nil {
+		m.Registry.remove(rec.ID)
+		return nil, err
+	}
+	return rec, nil
+}
+
+// channelKey derives our key for the channel at index: the hardened BIP32
+// child at index of a master key seeded from the wallet key. It pays to a
+// P2WPKH address.
+func channelKey(wallet *txbuilder.KeyInfo, index uint32) (*txbuilder.KeyInfo, error) {
+	walletPriv, err := hex.DecodeString(wallet.PrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wallet key: %v", err)
+	}
+	seed := sha256.Sum256(append([]byte("intent-dex channel keys"), walletPriv...))
+	master, err := hdkeychain.NewMaster(seed[:], &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, err
+	}
+	child, err := master.Derive(hdkeychain.HardenedKeyStart + index)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive channel key %d: %v", index, err)
+	}
+	priv, err := child.ECPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	pub := priv.PubKey().SerializeCompressed()
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pub), &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, err
+	}
+	return &txbuilder.KeyInfo{
+		PrivKey: hex.EncodeToString(priv.Serialize()),
+		PubKey:  hex.EncodeToString(pub),
+		Address: addr.EncodeAddress(),
+	}, nil
+}
+
+// settleOpen gives a channel its channel ID once the funding outpoint is
+// known, or drops it if the open failed before anything was saved.
+func (m *Manager) settleOpen(rec *ChannelRecord, openErr error) error {
+	var state txbuilder.State
+	if _, err := statefile.Load(rec.StateFile, &state); err != nil {
+		return err
+	}
+	if txbuilder.StatusOf(&state) == txbuilder.StatusNone {
+		os.Remove(rec.StateFile)
+		os.Remove(rec.StateFile + ".lock")
+		m.Registry.remove(rec.ID)
+		return openErr
+	}
+	id, err := txbuilder.ChannelID(&state)
+	if err != nil {
+		return err
+	}
+	if err := m.Registry.fund(rec.ID, id); err != nil {
+		return err
+	}
+	rec.ID = id
+	fmt.Printf("Channel %s with %s\n", id, rec.Peer)
+	if err := m.writeBackup(rec); err != nil {
+		fmt.Println("Static backup failed:", err)
+	}
+	return openErr
+}
+
+func (m *Manager) backupDir() string {
+	return filepath.Join(m.Dir, "backups")
+}
+
+// writeBackup saves the static backup of rec under <Dir>/backups.
+func (m *Manager) writeBackup(rec *ChannelRecord) error {
+	return writeBackup(m.backupDir(), m.NodeKey, rec.StateFile, rec.Peer, rec.PeerKey, rec.PeerAddr)
+}
+
+// writeBackup saves the static backup of the channel in statePath to dir,
+// with where to reach its peer.
+func writeBackup(dir string, nodeKey *btcec.PrivateKey, statePath, peer, peerKey, peerAddr string) error {
+	var state txbuilder.State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return err
+	}
+	c, err := txbuilder.StaticBackup(&state)
+	if err != nil {
+		return err
+	}
+	c.Peer, c.PeerKey, c.PeerAddr = peer, peerKey, peerAddr
+	path, err := backup.Write(dir, nodeKey, c)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Static backup:", path)
+	return nil
+}
+
+// Backup writes the static backup of every funded channel, to dir if given,
+// else under <Dir>/backups. Keep a copy away from the data dir together
+// with node_key, which the backups are encrypted with.
+func (m *Manager) Backup(dir string) error {
+	if dir == "" {
+		dir = m.backupDir()
+	}
+	channels, err := m.Registry.List()
+	if err != nil {
+		return err
+	}
+	for i := range channels {
+		rec := &channels[i]
+		if rec.Temporary {
+			continue
+		}
+		if err := writeBackup(dir, m.NodeKey, rec.StateFile, rec.Peer, rec.PeerKey, rec.PeerAddr); err != nil {
+			return fmt.Errorf("channel %s: %v", rec.ID, err)
+		}
+	}
+	return nil
+}
+
+// Recover gets our funds out of a channel whose state was lost, from its
+// static backup. While the funding output is unspent it asks the peer,
+// reached at addr or the address in the backup, to force-close; once the
+// peer's commitment is on chain it sweeps our balance from it.
+func (m *Manager) Recover(path, addr string) error {
+	c, err := backup.Read(path, m.NodeKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Channel %s: %d sat funded by %s:%d, we are %s\n", c.ChannelID, c.CapacitySat, c.FundingTxid, c.FundingVout, c.Self)
+	closing, err := txbuilder.FundingSpend(c)
+	if err != nil {
+		return err
+	}
+	if closing == nil {
+		return m.requestClose(c, addr)
+	}
+
+	fmt.Println("Channel closed by", closing.TxHash())
+	txid, err := txbuilder.SweepToRemote(c, closing)
+	if err != nil {
+		return err
+	}
+	if txid == "" {
+		fmt.Println("Nothing is left to sweep from the closing tx")
+		return nil
+	}
+	fmt.Println("Recovered our balance by", txid)
+	return nil
+}
+
+// requestClose sends channel_reestablish as a node that has lost all
+// commitments, which has the peer force-close.
+func (m *Manager) requestClose(c *backup.Channel, addr string) error {
+	if addr == "" {
+		addr = c.PeerAddr
+	}
+	if addr == "" {
+		return fmt.Errorf("%s's address is unknown, pass it to the command", c.Peer)
+	}
+	node := &Node{Role: c.Self, NodeKey: m.NodeKey, Pins: m.Pins, Peer: c.Peer}
+	conn, err := node.dial(c.PeerKey + "@" + addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// no commitment signed or revoked and no secret to prove
+	lost := &ChannelReestablish{ChannelID: c.ChannelID, Signed: -1, Revoked: -1, Received: -1}
+	if err := conn.Send(lost); err != nil {
+		return err
+	}
+	msg, err := conn.expect(MsgReestablish)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is at commitment #%d and force-closes the channel; run recover again once its commitment confirms\n",
+		c.Peer, msg.(*ChannelReestablish).NextCommitment-1)
+	return nil
+}
+
+// Open funds a new channel of amountSat with the node at
+// "<node-key>@host:port", pinning its key under peer. The key may be left
+// out for a peer we already know.
+func (m *Manager) Open(peer, addr string, amountSat int64) error {
+	return m.open(peer, addr, func(n *Node, target string) error {
+		return n.Open(target, amountSat)
+	})
+}
+
+// OpenDual is Open for a dual-funded channel the peer may add to.
+func (m *Manager) OpenDual(peer, addr string, amountSat int64) error {
+	return m.open(peer, addr, func(n *Node, target string) error {
+		return n.OpenDual(target, amountSat)
+	})
+}
+
+func (m *Manager) open(peer, addr string, open func(n *Node, target string) error) error {
+	key, hostport, err := noise.SplitAddress(addr)
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		if key, err = m.Pins.Lookup(peer); err != nil {
+			return err
+		}
+		if key == nil {
+			return fmt.Errorf("%s's node key is unknown, dial <node-key>@%s", peer, hostport)
+		}
+	}
+	rec, err := m.newChannel("bob", peer, key, hostport)
+	if err != nil {
+		return err
+	}
+	err = open(m.node(rec), noise.KeyString(key)+"@"+hostport)
+	return m.settleOpen(rec, err)
+}
+
+// dialAddr is where to reach the peer of rec: addr if given, else where
+// the peer listened when we opened the channel.
+func dialAddr(rec *ChannelRecord, addr string) (string, error) {
+	if addr == "" {
+		addr = rec.PeerAddr
+	}
+	if addr == "" {
+		return "", fmt.Errorf("%s's address is unknown, pass it to the command", rec.Peer)
+	}
+	return rec.PeerKey + "@" + addr, nil
+}
+
+// Update moves channel id to new balances, given from our side.
+func (m *Manager) Update(id string, localSat, remoteSat int64, addr string) error {
+	rec, err := m.Registry.Find(id)
+	if err != nil {
+		return err
+	}
+	target, err := dialAddr(rec, addr)
+	if err != nil {
+		return err
+	}
+	aliceSat, bobSat := localSat, remoteSat
+	if rec.Local == "bob" {
+		aliceSat, bobSat = remoteSat, localSat
+	}
+	return m.node(rec).Update(target, aliceSat, bobSat)
+}
+
+// Approve lets the peer of channel id move it to the given balances, from
+// our side, once.
+func (m *Manager) Approve(id string, localSat, remoteSat int64) error {
+	rec, err := m.Registry.Find(id)
+	if err != nil {
+		return err
+	}
+	aliceSat, bobSat := localSat, remoteSat
+	if rec.Local == "bob" {
+		aliceSat, bobSat = remoteSat, localSat
+	}
+	return txbuilder.ApproveUpdate(rec.StateFile, rec.Local, aliceSat, bobSat)
+}
+
+// Pay sends amountSat to the peer of channel id.
+func (m *Manager) Pay(id string, amountSat int64, addr string) error {
+	rec, err := m.Registry.Find(id)
+	if err != nil {
+		return err
+	}
+	target, err := dialAddr(rec, addr)
+	if err != nil {
+		return err
+	}
+	return m.node(rec).Pay(target, amountSat)
+}
+
+// Close closes channel id cooperatively, offering feeSat first.
+func (m *Manager) Close(id string, feeSat int64, addr string) error {
+	rec, err := m.Registry.Find(id)
+	if err != nil {
+		return err
+	}
+	target, err := dialAddr(rec, addr)
+	if err != nil {
+		return err
+	}
+	node := m.node(rec)
+	node.FeeSat = feeSat
+	return node.Close(target, feeSat)
+}
+
+// Serve accepts sessions from any peer, each in its own goroutine. Each
+// channel's state file is locked while an exchange runs on it, so sessions
+// on different channels proceed in parallel.
+func (m *Manager) Serve(addr string) error {
+	ln, err := noise.Listen(addr, m.NodeKey)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Printf("Channel manager listening on %s@%s\n", noise.KeyString(m.NodeKey.PubKey()), ln.Addr())
+
+	for {
+		c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			fmt.Println("Handshake failed:", err)
+			continue
+		}
+		go m.session(c)
+	}
+}
+
+func (m *Manager) session(c *noise.Conn) {
+	conn := NewConn(c)
+	defer conn.Close()
+	remote := c.RemoteKey()
+
+	for {
+		msg, err := conn.Receive()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			fmt.Println("Peer session error:", err)
+			return
+		}
+
+		var rec *ChannelRecord
+		switch msg := msg.(type) {
+		case *OpenChannel:
+			err = m.acceptChannel(remote, func(n *Node) error {
+				return n.acceptChannel(conn, msg)
+			})
+		case *OpenChannel2:
+			err = m.acceptChannel(remote, func(n *Node) error {
+				return n.acceptDualChannel(conn, msg)
+			})
+		case *UpdateBalance:
+			if rec, err = m.channel(msg.ChannelID, remote); err == nil {
+				err = m.node(rec).acceptUpdate(conn, msg)
+			}
+		case *Shutdown:
+			if rec, err = m.channel(msg.ChannelID, remote); err == nil {
+				err = m.node(rec).acceptShutdown(conn, msg)
+			}
+		case *ChannelReestablish:
+			if rec, err = m.channel(msg.ChannelID, remote); err == nil {
+				err = m.node(rec).acceptReestablish(conn, msg)
+			}
+		default:
+			err = fmt.Errorf("unexpected %s", msg.Type())
+		}
+		if err != nil {
+			conn.fail(err)
+			fmt.Println("Peer session error:", err)
+			return
+		}
+	}
+}
+
+// channel finds channel id and checks the connected peer is its peer.
+func (m *Manager) channel(id string, remote *btcec.PublicKey) (*ChannelRecord, error) {
+	if id == "" {
+		return nil, fmt.Errorf("message names no channel")
+	}
+	rec, err := m.Registry.Find(id)
+	if err != nil {
+		return nil, err
+	}
+	if rec.ID != id || rec.PeerKey != noise.KeyString(remote) {
+		return nil, fmt.Errorf("no channel %s with this peer", id)
+	}
+	return rec, nil
+}
+
+// peerName is the name an inbound peer's key is pinned under: the name of
+// an existing channel with the same key, or one derived from the key.
+func (m *Manager) peerName(remote *btcec.PublicKey) (string, error) {
+	key := noise.KeyString(remote)
+	channels, err := m.Registry.List()
+	if err != nil {
+		return "", err
+	}
+	for _, c := range channels {
+		if c.PeerKey == key {
+			return c.Peer, nil
+		}
+	}
+	return "node-" + key[:12], nil
+}
+
+// acceptChannel registers a channel for an inbound open, which accept
+// answers on the channel's node.
+func (m *Manager) acceptChannel(remote *btcec.PublicKey, accept func(n *Node) error) error {
+	peer, err := m.peerName(remote)
+	if err != nil {
+		return err
+	}
+	if err := m.Pins.Check(peer, remote); err != nil {
+		return err
+	}
+	rec, err := m.newChannel("alice", peer, remote, "")
+	if err != nil {
+		return err
+	}
+	err = accept(m.node(rec))
+	return m.settleOpen(rec, err)
+}
+
+// List prints every channel with its status and both balances from our
+// side.
+func (m *Manager) List() error {
+	channels, err := m.Registry.List()
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		fmt.Println("No channels")
+		return nil
+	}
+	fmt.Printf("%-16s  %-18s %-6s %-17s %-14s %s\n", "Channel", "Peer", "Local", "Status", "Local (BTC)", "Remote (BTC)")
+	for _, c := range channels {
+		var state txbuilder.State
+		if _, err := txbuilder.RefreshStateFile(c.StateFile, &state); err != nil {
+			fmt.Printf("%-16s  %-18s %v\n", c.ID[:16], c.Peer, err)
+			continue
+		}
+		var local, remote float64
+		if ch := state.Channel; ch != nil {
+			local, remote = ch.AliceBalance, ch.BobBalance
+			if c.Local == "bob" {
+				local, remote = remote, local
+			}
+		}
+		id := c.ID[:16]
+		if c.Temporary {
+			id = "(opening)"
+		}
+		fmt.Printf("%-16s  %-18s %-6s %-17s %-14.8f %.8f\n", id, c.Peer, c.Local, txbuilder.StatusOf(&state), local, remote)
+	}
+	return nil
+}
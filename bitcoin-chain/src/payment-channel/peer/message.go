@@ -0,0 +1,299 @@
+package peer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"example.com/m/txbuilder"
+)
+
+// MessageType numbers follow BOLT #1/#2 where there is a BOLT message;
+// update_balance has no BOLT equivalent and uses an odd type from the
+// custom range.
+type MessageType uint16
+
+const (
+	MsgError            MessageType = 17
+	MsgOpenChannel      MessageType = 32
+	MsgAcceptChannel    MessageType = 33
+	MsgFundingCreated   MessageType = 34
+	MsgFundingSigned    MessageType = 35
+	MsgShutdown         MessageType = 38
+	MsgClosingSigned    MessageType = 39
+	MsgOpenChannel2     MessageType = 64
+	MsgAcceptChannel2   MessageType = 65
+	MsgTxAddInput       MessageType = 66
+	MsgTxAddOutput      MessageType = 67
+	MsgTxComplete       MessageType = 70
+	MsgTxSignatures     MessageType = 71
+	MsgCommitmentSigned MessageType = 132
+	MsgRevokeAndAck     MessageType = 133
+	MsgReestablish      MessageType = 136
+	MsgUpdateBalance    MessageType = 32769
+)
+
+var messageNames = map[MessageType]string{
+	MsgError:            "error",
+	MsgOpenChannel:      "open_channel",
+	MsgAcceptChannel:    "accept_channel",
+	MsgFundingCreated:   "funding_created",
+	MsgFundingSigned:    "funding_signed",
+	MsgShutdown:         "shutdown",
+	MsgClosingSigned:    "closing_signed",
+	MsgOpenChannel2:     "open_channel2",
+	MsgAcceptChannel2:   "accept_channel2",
+	MsgTxAddInput:       "tx_add_input",
+	MsgTxAddOutput:      "tx_add_output",
+	MsgTxComplete:       "tx_complete",
+	MsgTxSignatures:     "tx_signatures",
+	MsgCommitmentSigned: "commitment_signed",
+	MsgRevokeAndAck:     "revoke_and_ack",
+	MsgReestablish:      "channel_reestablish",
+	MsgUpdateBalance:    "update_balance",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", uint16(t))
+}
+
+// Message is one protocol message; the body is sent as JSON.
+type Message interface {
+	Type() MessageType
+}
+
+// Error aborts the exchange in progress.
+type Error struct {
+	Message string `json:"message"`
+}
+
+// OpenChannel is sent by Bob, who funds the channel. The temporary ID
+// names the channel until the funding outpoint gives it its channel ID.
+type OpenChannel struct {
+	TemporaryChannelID string              `json:"temporaryChannelId"`
+	FundingSat         int64               `json:"fundingSat"`
+	ToSelfDelay        uint16              `json:"toSelfDelay"`
+	Keys               txbuilder.PartyKeys `json:"keys"`
+	// Policy is the funder's; the acceptor refuses the channel if it
+	// cannot live with it
+	Policy *txbuilder.ChannelPolicy `json:"policy"`
+}
+
+type AcceptChannel struct {
+	TemporaryChannelID string              `json:"temporaryChannelId"`
+	Keys               txbuilder.PartyKeys `json:"keys"`
+}
+
+// FundingCreated names the funding outpoint and carries Bob's signature on
+// Alice's first commitment.
+type FundingCreated struct {
+	FundingTxid string `json:"fundingTxid"`
+	FundingVout uint32 `json:"fundingVout"`
+	Signature   string `json:"signature"`
+}
+
+// FundingSigned is Alice's signature on Bob's first commitment; with it Bob
+// can safely broadcast the funding tx.
+type FundingSigned struct {
+	Signature string `json:"signature"`
+}
+
+// OpenChannel2 opens a dual-funded channel. Bob still opens it, but only
+// puts in FundingSat; Alice answers with what she adds. Each side pays
+// FundingFeeRate (sat/vB) for its own inputs and outputs of the funding tx.
+type OpenChannel2 struct {
+	TemporaryChannelID string                   `json:"temporaryChannelId"`
+	FundingSat         int64                    `json:"fundingSat"`
+	FundingFeeRate     int64                    `json:"fundingFeeRate"`
+	ToSelfDelay        uint16                   `json:"toSelfDelay"`
+	Keys               txbuilder.PartyKeys      `json:"keys"`
+	Policy             *txbuilder.ChannelPolicy `json:"policy"`
+}
+
+type AcceptChannel2 struct {
+	TemporaryChannelID string              `json:"temporaryChannelId"`
+	FundingSat         int64               `json:"fundingSat"`
+	Keys               txbuilder.PartyKeys `json:"keys"`
+}
+
+// TxAddInput and TxAddOutput add to the funding tx under construction.
+type TxAddInput struct {
+	ChannelID string `json:"channelId"`
+	txbuilder.InteractiveInput
+}
+
+type TxAddOutput struct {
+	ChannelID string `json:"channelId"`
+	txbuilder.InteractiveOutput
+}
+
+// TxComplete says the sender has nothing more to add. Construction ends
+// once both sides send it in a row.
+type TxComplete struct {
+	ChannelID string `json:"channelId"`
+}
+
+// TxSignatures carries the witnesses of the sender's inputs to the funding
+// tx, in serial ID order.
+type TxSignatures struct {
+	ChannelID string     `json:"channelId"`
+	Txid      string     `json:"txid"`
+	Witnesses [][]string `json:"witnesses"`
+}
+
+// UpdateBalance proposes the balances of the next commitment.
+type UpdateBalance struct {
+	ChannelID string `json:"channelId"`
+	AliceSat  int64  `json:"aliceSat"`
+	BobSat    int64  `json:"bobSat"`
+}
+
+// CommitmentSigned is the sender's signature on the receiver's version of
+// commitment Commitment.
+type CommitmentSigned struct {
+	Commitment int    `json:"commitment"`
+	Signature  string `json:"signature"`
+}
+
+type RevokeAndAck struct {
+	txbuilder.RevocationMsg
+}
+
+type Shutdown struct {
+	ChannelID string `json:"channelId"`
+	Address   string `json:"address"`
+}
+
+// ChannelReestablish tells the peer which commitment the sender expects
+// next. A node restoring a channel from its static backup sends 0; a peer
+// that is further along then knows the sender lost its state and
+// force-closes with its latest commitment, the only close that pays the
+// sender without it knowing the balances.
+//
+// LastSecret is the receiver's per-commitment secret for commitment
+// Received (option_data_loss_protect): the sender proves how far it got
+// before the receiver acts on its position.
+type ChannelReestablish struct {
+	ChannelID      string `json:"channelId"`
+	NextCommitment int    `json:"nextCommitmentNumber"`
+	// the rest of txbuilder.Position, so an interrupted exchange can be
+	// finished
+	Signed     int    `json:"signedCommitment"`
+	Revoked    int    `json:"revokedCommitment"`
+	Received   int    `json:"receivedRevocation"`
+	LastSecret string `json:"yourLastPerCommitmentSecret,omitempty"`
+}
+
+// ClosingSigned offers a closing fee with the sender's signature on the
+// closing tx paying it.
+type ClosingSigned struct {
+	FeeSat    int64  `json:"feeSat"`
+	Signature string `json:"signature"`
+}
+
+func (*Error) Type() MessageType              { return MsgError }
+func (*OpenChannel) Type() MessageType        { return MsgOpenChannel }
+func (*AcceptChannel) Type() MessageType      { return MsgAcceptChannel }
+func (*FundingCreated) Type() MessageType     { return MsgFundingCreated }
+func (*FundingSigned) Type() MessageType      { return MsgFundingSigned }
+func (*UpdateBalance) Type() MessageType      { return MsgUpdateBalance }
+func (*CommitmentSigned) Type() MessageType   { return MsgCommitmentSigned }
+func (*RevokeAndAck) Type() MessageType       { return MsgRevokeAndAck }
+func (*Shutdown) Type() MessageType           { return MsgShutdown }
+func (*ClosingSigned) Type() MessageType      { return MsgClosingSigned }
+func (*ChannelReestablish) Type() MessageType { return MsgReestablish }
+func (*OpenChannel2) Type() MessageType       { return MsgOpenChannel2 }
+func (*AcceptChannel2) Type() MessageType     { return MsgAcceptChannel2 }
+func (*TxAddInput) Type() MessageType         { return MsgTxAddInput }
+func (*TxAddOutput) Type() MessageType        { return MsgTxAddOutput }
+func (*TxComplete) Type() MessageType         { return MsgTxComplete }
+func (*TxSignatures) Type() MessageType       { return MsgTxSignatures }
+
+func newMessage(t MessageType) (Message, error) {
+	switch t {
+	case MsgError:
+		return &Error{}, nil
+	case MsgOpenChannel:
+		return &OpenChannel{}, nil
+	case MsgAcceptChannel:
+		return &AcceptChannel{}, nil
+	case MsgFundingCreated:
+		return &FundingCreated{}, nil
+	case MsgFundingSigned:
+		return &FundingSigned{}, nil
+	case MsgUpdateBalance:
+		return &UpdateBalance{}, nil
+	case MsgCommitmentSigned:
+		return &CommitmentSigned{}, nil
+	case MsgRevokeAndAck:
+		return &RevokeAndAck{}, nil
+	case MsgShutdown:
+		return &Shutdown{}, nil
+	case MsgClosingSigned:
+		return &ClosingSigned{}, nil
+	case MsgReestablish:
+		return &ChannelReestablish{}, nil
+	case MsgOpenChannel2:
+		return &OpenChannel2{}, nil
+	case MsgAcceptChannel2:
+		return &AcceptChannel2{}, nil
+	case MsgTxAddInput:
+		return &TxAddInput{}, nil
+	case MsgTxAddOutput:
+		return &TxAddOutput{}, nil
+	case MsgTxComplete:
+		return &TxComplete{}, nil
+	case MsgTxSignatures:
+		return &TxSignatures{}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %d", uint16(t))
+}
+
+// MaxMessageSize bounds a frame so a peer cannot make us allocate at will.
+const MaxMessageSize = 64 * 1024
+
+// WriteMessage frames msg as a 4-byte big-endian length followed by the
+// 2-byte message type and the JSON body.
+func WriteMessage(w io.Writer, msg Message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(body)+2 > MaxMessageSize {
+		return fmt.Errorf("%s message too large: %d bytes", msg.Type(), len(body)+2)
+	}
+	frame := make([]byte, 6+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(2+len(body)))
+	binary.BigEndian.PutUint16(frame[4:], uint16(msg.Type()))
+	copy(frame[6:], body)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadMessage reads one frame written by WriteMessage.
+func ReadMessage(r io.Reader) (Message, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[:])
+	if size < 2 || size > MaxMessageSize {
+		return nil, fmt.Errorf("invalid frame length %d", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, fmt.Errorf("truncated frame: %v", err)
+	}
+	msg, err := newMessage(MessageType(binary.BigEndian.Uint16(frame)))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(frame[2:], msg); err != nil {
+		return nil, fmt.Errorf("invalid %s message: %v", msg.Type(), err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,1088 @@
+package peer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"example.com/m/txbuilder"
+	"example.com/utils/noise"
+	"example.com/utils/statefile"
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// temporaryChannelID is a random 32-byte ID for a channel that has no
+// funding outpoint yet.
+func temporaryChannelID() string {
+	var b [32]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// maxClosingRounds stops a fee negotiation with a peer that never converges.
+const maxClosingRounds = 64
+
+// Node is one party's side of the channel. Its state file holds only that
+// party's keys; everything it learns about the counterparty arrives in
+// messages over a Noise connection authenticated by NodeKey. Opening and
+// closing run inside one state file update, so a failed exchange leaves the
+// state as it was. Commitment updates instead save every step as it
+// completes, and channel_reestablish finishes an interrupted one.
+type Node struct {
+	Role      string // alice or bob
+	StatePath string
+	// FeeSat is our first offer when negotiating the closing fee
+	FeeSat  int64
+	NodeKey *btcec.PrivateKey
+	// Pins holds the counterparty's node key once we have seen it
+	Pins *noise.Pins
+	// Peer is the name the counterparty's key is pinned under; the
+	// counterparty's role if empty
+	Peer string
+	// BackupDir receives the static backup of a channel the node opens or
+	// accepts; none is written if it is empty
+	BackupDir string
+}
+
+func (n *Node) peerName() string {
+	if n.Peer != "" {
+		return n.Peer
+	}
+	if n.Role == "alice" {
+		return "bob"
+	}
+	return "alice"
+}
+
+// writeBackup saves the static backup of the channel once its funding
+// outpoint is known. peerAddr is where the peer listens, if we know it. A
+// failure is only reported, since the channel is open either way.
+func (n *Node) writeBackup(peerAddr string) {
+	if n.BackupDir == "" {
+		return
+	}
+	key, err := n.Pins.Lookup(n.peerName())
+	if err == nil && key == nil {
+		err = fmt.Errorf("%s's node key is not pinned", n.peerName())
+	}
+	if err == nil {
+		err = writeBackup(n.BackupDir, n.NodeKey, n.StatePath, n.peerName(), noise.KeyString(key), peerAddr)
+	}
+	if err != nil {
+		fmt.Println("Static backup failed:", err)
+	}
+}
+
+// ID is what the counterparty dials: our node key and listen address.
+func (n *Node) ID(addr string) string {
+	return noise.KeyString(n.NodeKey.PubKey()) + "@" + addr
+}
+
+// session is the state of one commitment exchange. It is saved after each
+// step, before anything that depends on it is sent, so a secret we revealed
+// or a signature we received is never rolled back by a later failure. Save
+// refuses to overwrite a state another process changed in between.
+type session struct {
+	path  string
+	state txbuilder.State
+	snap  *statefile.Snapshot
+}
+
+func (n *Node) load() (*session, error) {
+	s := &session{path: n.StatePath}
+	snap, err := statefile.Load(n.StatePath, &s.state)
+	if err != nil {
+		return nil, err
+	}
+	s.snap = snap
+	return s, nil
+}
+
+func (s *session) save() error {
+	return statefile.Save(s.path, s.snap, &s.state)
+}
+
+func (n *Node) update(fn func(state *txbuilder.State) error) error {
+	var state txbuilder.State
+	return statefile.Update(n.StatePath, &state, func() error {
+		return fn(&state)
+	})
+}
+
+// channel checks that state is our peer channel and, once the node has
+// been asked about the funding tx, in one of allowed.
+func (n *Node) channel(state *txbuilder.State, allowed ...txbuilder.ChannelStatus) error {
+	if state.Self != n.Role {
+		return fmt.Errorf("state file does not belong to %s's node", n.Role)
+	}
+	if _, err := txbuilder.RefreshChannelStatus(state); err != nil {
+		return err
+	}
+	return txbuilder.RequireStatus(state, allowed...)
+}
+
+// dial connects to "<node-key>@host:port". Without a key in addr we use
+// the counterparty's pinned key; a key that differs from the pin is refused.
+func (n *Node) dial(addr string) (*Conn, error) {
+	key, hostport, err := noise.SplitAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		if key, err = n.Pins.Lookup(n.peerName()); err != nil {
+			return nil, err
+		}
+		if key == nil {
+			return nil, fmt.Errorf("%s's node key is unknown, dial <node-key>@%s", n.peerName(), hostport)
+		}
+	}
+	c, err := noise.Dial(hostport, n.NodeKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach peer: %v", err)
+	}
+	if err := n.Pins.Check(n.peerName(), c.RemoteKey()); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return NewConn(c), nil
+}
+
+// Serve accepts peer connections on addr and answers them one at a time.
+// Only the counterparty's pinned node key may connect; the first key to
+// connect is pinned.
+func (n *Node) Serve(addr string) error {
+	ln, err := noise.Listen(addr, n.NodeKey)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	fmt.Printf("%s's node listening on %s\n", n.Role, n.ID(ln.Addr().String()))
+
+	for {
+		c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			fmt.Println("Handshake failed:", err)
+			continue
+		}
+		if err := n.Pins.Check(n.peerName(), c.RemoteKey()); err != nil {
+			fmt.Println("Rejected peer:", err)
+			c.Close()
+			continue
+		}
+		conn := NewConn(c)
+		if err := n.handle(conn); err != nil {
+			fmt.Println("Peer session error:", err)
+		}
+		conn.Close()
+	}
+}
+
+// handle answers the exchanges a peer starts until it hangs up.
+func (n *Node) handle(conn *Conn) error {
+	for {
+		msg, err := conn.Receive()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println("Received", msg.Type())
+		switch m := msg.(type) {
+		case *OpenChannel:
+			err = n.acceptChannel(conn, m)
+		case *OpenChannel2:
+			err = n.acceptDualChannel(conn, m)
+		case *UpdateBalance:
+			err = n.acceptUpdate(conn, m)
+		case *Shutdown:
+			err = n.acceptShutdown(conn, m)
+		case *ChannelReestablish:
+			err = n.acceptReestablish(conn, m)
+		default:
+			err = fmt.Errorf("unexpected %s", msg.Type())
+		}
+		if err != nil {
+			return conn.fail(err)
+		}
+	}
+}
+
+// Open funds a channel of amountSat with the node at addr: open_channel,
+// accept_channel, funding_created, funding_signed. Bob only broadcasts the
+// funding tx once he holds Alice's signature on his first commitment.
+func (n *Node) Open(addr string, amountSat int64) error {
+	if n.Role != "bob" {
+		return fmt.Errorf("only Bob opens and funds the channel")
+	}
+	policy, err := txbuilder.NewChannelPolicy(amountSat)
+	if err != nil {
+		return err
+	}
+	conn, err := n.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = n.update(func(state *txbuilder.State) error {
+		if err := txbuilder.RequireStatus(state, txbuilder.StatusNone); err != nil {
+			return err
+		}
+		keys, err := txbuilder.LocalPartyKeys(state, n.Role)
+		if err != nil {
+			return err
+		}
+		open := &OpenChannel{
+			TemporaryChannelID: temporaryChannelID(),
+			FundingSat:         amountSat,
+			ToSelfDelay:        state.Revocation.ToSelfDelay,
+			Keys:               *keys,
+			Policy:             policy,
+		}
+		if err := conn.Send(open); err != nil {
+			return err
+		}
+		msg, err := conn.expect(MsgAcceptChannel)
+		if err != nil {
+			return err
+		}
+		if err := txbuilder.SetCounterparty(state, &msg.(*AcceptChannel).Keys, open.ToSelfDelay); err != nil {
+			return conn.fail(err)
+		}
+
+		if err := txbuilder.SetupFunding(state, amountSat, policy); err != nil {
+			return conn.fail(err)
+		}
+		if err := txbuilder.BuildFundingTx(state); err != nil {
+			return conn.fail(err)
+		}
+		c, err := txbuilder.NewCommitment(state, 0, amountSat)
+		if err != nil {
+			return conn.fail(err)
+		}
+		sig, err := txbuilder.SignCommitment(state, c)
+		if err != nil {
+			return conn.fail(err)
+		}
+		created := &FundingCreated{FundingTxid: state.HTLC.Txid, FundingVout: state.HTLC.Vout, Signature: sig}
+		if err := conn.Send(created); err != nil {
+			return err
+		}
+
+		msg, err = conn.expect(MsgFundingSigned)
+		if err != nil {
+			return err
+		}
+		return txbuilder.ReceiveCommitmentSig(state, c, msg.(*FundingSigned).Signature)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("Alice signed our first commitment")
+	if err := txbuilder.BroadcastFundingTx(n.StatePath); err != nil {
+		return err
+	}
+	_, hostport, _ := noise.SplitAddress(addr)
+	n.writeBackup(hostport)
+	return nil
+}
+
+func (n *Node) acceptChannel(conn *Conn, open *OpenChannel) error {
+	if n.Role != "alice" {
+		return fmt.Errorf("only Alice accepts channels")
+	}
+	if err := txbuilder.AcceptChannelPolicy(open.FundingSat, open.Policy); err != nil {
+		return fmt.Errorf("refusing channel: %v", err)
+	}
+	err := n.update(func(state *txbuilder.State) error {
+		if err := txbuilder.RequireStatus(state, txbuilder.StatusNone); err != nil {
+			return err
+		}
+		keys, err := txbuilder.LocalPartyKeys(state, n.Role)
+		if err != nil {
+			return err
+		}
+		if err := txbuilder.SetCounterparty(state, &open.Keys, open.ToSelfDelay); err != nil {
+			return err
+		}
+		if err := conn.Send(&AcceptChannel{TemporaryChannelID: open.TemporaryChannelID, Keys: *keys}); err != nil {
+			return err
+		}
+
+		msg, err := conn.expect(MsgFundingCreated)
+		if err != nil {
+			return err
+		}
+		created := msg.(*FundingCreated)
+		if err := txbuilder.SetupFunding(state, open.FundingSat, open.Policy); err != nil {
+			return err
+		}
+		state.HTLC.Txid = created.FundingTxid
+		state.HTLC.Vout = created.FundingVout
+		c, err := txbuilder.NewCommitment(state, 0, open.FundingSat)
+		if err != nil {
+			return err
+		}
+		if err := txbuilder.ReceiveCommitmentSig(state, c, created.Signature); err != nil {
+			return err
+		}
+		sig, err := txbuilder.SignCommitment(state, c)
+		if err != nil {
+			return err
+		}
+		if err := conn.Send(&FundingSigned{Signature: sig}); err != nil {
+			return err
+		}
+		fmt.Printf("Accepted channel of %d sat funded by %s\n", open.FundingSat, created.FundingTxid)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.writeBackup("")
+	return nil
+}
+
+// OpenDual opens a dual-funded channel with the node at addr, putting in
+// amountSat; the peer adds what its config says. open_channel2 and
+// accept_channel2 settle the amounts, then the funding tx is built with
+// the peer and both first commitments are signed before either side signs
+// its inputs.
+func (n *Node) OpenDual(addr string, amountSat int64) error {
+	if n.Role != "bob" {
+		return fmt.Errorf("only Bob opens channels")
+	}
+	if amountSat <= 0 {
+		return fmt.Errorf("amount must be positive")
+	}
+	conn, err := n.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = n.update(func(state *txbuilder.State) error {
+		if err := txbuilder.RequireStatus(state, txbuilder.StatusNone); err != nil {
+			return err
+		}
+		keys, err := txbuilder.LocalPartyKeys(state, n.Role)
+		if err != nil {
+			return err
+		}
+		open := &OpenChannel2{
+			TemporaryChannelID: temporaryChannelID(),
+			FundingSat:         amountSat,
+			FundingFeeRate:     txbuilder.FundingFeeRate(),
+			ToSelfDelay:        state.Revocation.ToSelfDelay,
+			Keys:               *keys,
+			Policy:             txbuilder.ProposeDualFundedPolicy(amountSat),
+		}
+		if err := conn.Send(open); err != nil {
+			return err
+		}
+		msg, err := conn.expect(MsgAcceptChannel2)
+		if err != nil {
+			return err
+		}
+		accept := msg.(*AcceptChannel2)
+		if accept.FundingSat < 0 {
+			return conn.fail(fmt.Errorf("peer adds %d sat", accept.FundingSat))
+		}
+		if err := txbuilder.SetCounterparty(state, &accept.Keys, open.ToSelfDelay); err != nil {
+			return conn.fail(err)
+		}
+		policy, err := txbuilder.DualFundedPolicy(open.Policy, amountSat+accept.FundingSat)
+		if err != nil {
+			return conn.fail(err)
+		}
+		if err := txbuilder.SetupDualFunding(state, accept.FundingSat, amountSat, policy); err != nil {
+			return conn.fail(err)
+		}
+		return n.fundDual(conn, state, open.TemporaryChannelID, accept.FundingSat, amountSat, open.FundingFeeRate)
+	})
+	if err != nil {
+		return err
+	}
+	if err := txbuilder.BroadcastFundingTx(n.StatePath); err != nil {
+		return err
+	}
+	_, hostport, _ := noise.SplitAddress(addr)
+	n.writeBackup(hostport)
+	return nil
+}
+
+func (n *Node) acceptDualChannel(conn *Conn, open *OpenChannel2) error {
+	if n.Role != "alice" {
+		return fmt.Errorf("only Alice accepts channels")
+	}
+	if open.FundingSat <= 0 {
+		return fmt.Errorf("refusing channel: peer puts in %d sat", open.FundingSat)
+	}
+	if err := txbuilder.AcceptFundingFeeRate(open.FundingFeeRate); err != nil {
+		return fmt.Errorf("refusing channel: %v", err)
+	}
+	ours := txbuilder.DualFundContribution()
+	policy, err := txbuilder.DualFundedPolicy(open.Policy, open.FundingSat+ours)
+	if err != nil {
+		return fmt.Errorf("refusing channel: %v", err)
+	}
+	if err := txbuilder.AcceptChannelPolicy(open.FundingSat+ours, policy); err != nil {
+		return fmt.Errorf("refusing channel: %v", err)
+	}
+	err = n.update(func(state *txbuilder.State) error {
+		if err := txbuilder.RequireStatus(state, txbuilder.StatusNone); err != nil {
+			return err
+		}
+		keys, err := txbuilder.LocalPartyKeys(state, n.Role)
+		if err != nil {
+			return err
+		}
+		if err := txbuilder.SetCounterparty(state, &open.Keys, open.ToSelfDelay); err != nil {
+			return err
+		}
+		if err := txbuilder.SetupDualFunding(state, ours, open.FundingSat, policy); err != nil {
+			return err
+		}
+		accept := &AcceptChannel2{TemporaryChannelID: open.TemporaryChannelID, FundingSat: ours, Keys: *keys}
+		if err := conn.Send(accept); err != nil {
+			return err
+		}
+		if err := n.fundDual(conn, state, open.TemporaryChannelID, ours, open.FundingSat, open.FundingFeeRate); err != nil {
+			return err
+		}
+		fmt.Printf("Accepted dual-funded channel of %d sat (we put in %d sat) funded by %s\n",
+			open.FundingSat+ours, ours, state.HTLC.Txid)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	n.writeBackup("")
+	return nil
+}
+
+// fundDual builds the funding tx with the peer, exchanges signatures on
+// the first commitments, Bob's first, and then the witnesses of the
+// funding inputs, Alice's first. Nobody signs an input before holding a
+// commitment that returns its money. Each side pays feeRate sat/vB for the
+// weight it adds.
+func (n *Node) fundDual(conn *Conn, state *txbuilder.State, id string, aliceSat, bobSat, feeRate int64) error {
+	ours := aliceSat
+	if n.Role == "bob" {
+		ours = bobSat
+	}
+	inputs, outputs, err := txbuilder.FundingContribution(state, ours, feeRate)
+	if err != nil {
+		return conn.fail(err)
+	}
+	var t txbuilder.InteractiveTx
+	if err := n.constructTx(conn, &t, id, inputs, outputs); err != nil {
+		return err
+	}
+	tx, prevOuts, err := txbuilder.CompleteFundingTx(state, &t, feeRate)
+	if err != nil {
+		return conn.fail(err)
+	}
+
+	c, err := txbuilder.NewCommitment(state, aliceSat, bobSat)
+	if err != nil {
+		return conn.fail(err)
+	}
+	sig, err := txbuilder.SignCommitment(state, c)
+	if err != nil {
+		return conn.fail(err)
+	}
+	if n.Role == "bob" {
+		if err := conn.Send(&CommitmentSigned{Commitment: c, Signature: sig}); err != nil {
+			return err
+		}
+	}
+	msg, err := conn.expect(MsgCommitmentSigned)
+	if err != nil {
+		return err
+	}
+	theirs := msg.(*CommitmentSigned)
+	if theirs.Commitment != c {
+		return conn.fail(fmt.Errorf("peer signed commitment #%d, expected #%d", theirs.Commitment, c))
+	}
+	if err := txbuilder.ReceiveCommitmentSig(state, c, theirs.Signature); err != nil {
+		return conn.fail(err)
+	}
+	if n.Role == "alice" {
+		if err := conn.Send(&CommitmentSigned{Commitment: c, Signature: sig}); err != nil {
+			return err
+		}
+	}
+
+	witnesses, err := txbuilder.SignFundingInputs(state, &t, tx, prevOuts)
+	if err != nil {
+		return conn.fail(err)
+	}
+	txid := tx.TxHash().String()
+	if n.Role == "alice" {
+		if err := conn.Send(&TxSignatures{ChannelID: id, Txid: txid, Witnesses: witnesses}); err != nil {
+			return err
+		}
+	}
+	msg, err = conn.expect(MsgTxSignatures)
+	if err != nil {
+		return err
+	}
+	sigs := msg.(*TxSignatures)
+	if sigs.Txid != txid {
+		return conn.fail(fmt.Errorf("peer signed funding tx %s, we built %s", sigs.Txid, txid))
+	}
+	if err := txbuilder.AddFundingWitnesses(state, &t, tx, sigs.Witnesses); err != nil {
+		return conn.fail(err)
+	}
+	if err := txbuilder.FinishFundingTx(state, tx, prevOuts); err != nil {
+		return conn.fail(err)
+	}
+	if n.Role == "bob" {
+		return conn.Send(&TxSignatures{ChannelID: id, Txid: txid, Witnesses: witnesses})
+	}
+	return nil
+}
+
+// constructTx takes turns with the peer, Bob first, each turn adding one
+// of our inputs or outputs or sending tx_complete once we have nothing
+// left. It ends when both sides send tx_complete one after the other.
+func (n *Node) constructTx(conn *Conn, t *txbuilder.InteractiveTx, id string, inputs []txbuilder.InteractiveInput, outputs []txbuilder.InteractiveOutput) error {
+	ourTurn := n.Role == "bob"
+	theirs := "alice"
+	if n.Role == "alice" {
+		theirs = "bob"
+	}
+	var weCompleted, theyCompleted bool
+	for !(weCompleted && theyCompleted) {
+		if ourTurn {
+			var msg Message = &TxComplete{ChannelID: id}
+			var err error
+			if len(inputs) > 0 {
+				msg, err = &TxAddInput{ChannelID: id, InteractiveInput: inputs[0]}, t.AddInput(n.Role, inputs[0])
+				inputs = inputs[1:]
+			} else if len(outputs) > 0 {
+				msg, err = &TxAddOutput{ChannelID: id, InteractiveOutput: outputs[0]}, t.AddOutput(n.Role, outputs[0])
+				outputs = outputs[1:]
+			}
+			if err != nil {
+				return conn.fail(err)
+			}
+			if err := conn.Send(msg); err != nil {
+				return err
+			}
+			_, weCompleted = msg.(*TxComplete)
+			if !weCompleted {
+				theyCompleted = false
+			}
+		} else {
+			msg, err := conn.Receive()
+			if err != nil {
+				return err
+			}
+			switch m := msg.(type) {
+			case *TxAddInput:
+				err = t.AddInput(theirs, m.InteractiveInput)
+			case *TxAddOutput:
+				err = t.AddOutput(theirs, m.InteractiveOutput)
+			case *TxComplete:
+			default:
+				err = fmt.Errorf("unexpected %s while building the funding tx", msg.Type())
+			}
+			if err != nil {
+				return conn.fail(err)
+			}
+			_, theyCompleted = msg.(*TxComplete)
+			if !theyCompleted {
+				weCompleted = false
+			}
+		}
+		ourTurn = !ourTurn
+	}
+	return nil
+}
+
+// Update moves the channel to new balances: update_balance and
+// commitment_signed from us, revoke_and_ack and commitment_signed from the
+// peer, and our revoke_and_ack. An exchange left unfinished on either side
+// is completed first.
+func (n *Node) Update(addr string, aliceSat, bobSat int64) error {
+	return n.updateBalances(addr, func(*txbuilder.State) (int64, int64, error) {
+		return aliceSat, bobSat, nil
+	})
+}
+
+// Pay sends amountSat to the peer. The new balances are worked out from
+// the channel as loaded for the exchange; a concurrent payment on the same
+// channel makes saving it fail rather than overwrite the other.
+func (n *Node) Pay(addr string, amountSat int64) error {
+	return n.updateBalances(addr, func(state *txbuilder.State) (int64, int64, error) {
+		return txbuilder.PaymentBalances(state, n.Role, amountSat)
+	})
+}
+
+func (n *Node) updateBalances(addr string, balances func(state *txbuilder.State) (int64, int64, error)) error {
+	conn, err := n.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s, err := n.load()
+	if err != nil {
+		return err
+	}
+	if err := n.channel(&s.state, txbuilder.StatusOpen); err != nil {
+		return err
+	}
+	if err := n.reestablish(conn, s); err != nil {
+		return err
+	}
+
+	aliceSat, bobSat, err := balances(&s.state)
+	if err != nil {
+		return err
+	}
+	c, err := txbuilder.NewCommitment(&s.state, aliceSat, bobSat)
+	if err != nil {
+		return err
+	}
+	sig, err := txbuilder.SignCommitment(&s.state, c)
+	if err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	id, err := txbuilder.ChannelID(&s.state)
+	if err != nil {
+		return err
+	}
+	if err := conn.Send(&UpdateBalance{ChannelID: id, AliceSat: aliceSat, BobSat: bobSat}); err != nil {
+		return err
+	}
+	if err := conn.Send(&CommitmentSigned{Commitment: c, Signature: sig}); err != nil {
+		return err
+	}
+	return n.finishUpdate(conn, s, c)
+}
+
+// finishUpdate is the rest of an update we proposed as commitment c: the
+// peer's revoke_and_ack and commitment_signed, then our revoke_and_ack.
+func (n *Node) finishUpdate(conn *Conn, s *session, c int) error {
+	if err := n.receiveRevocation(conn, s); err != nil {
+		return err
+	}
+	if err := n.receiveCommitment(conn, s, c); err != nil {
+		return err
+	}
+	aliceSat, bobSat, _ := txbuilder.CommitmentBalances(&s.state, c)
+	fmt.Printf("Channel at commitment #%d: Alice=%d sat, Bob=%d sat\n", c, aliceSat, bobSat)
+	return nil
+}
+
+// receiveRevocation takes the peer's revoke_and_ack and saves the secret
+// at once.
+func (n *Node) receiveRevocation(conn *Conn, s *session) error {
+	msg, err := conn.expect(MsgRevokeAndAck)
+	if err != nil {
+		return err
+	}
+	if err := txbuilder.ReceiveRevocation(&s.state, &msg.(*RevokeAndAck).RevocationMsg); err != nil {
+		return conn.fail(err)
+	}
+	return s.save()
+}
+
+// receiveCommitment takes the peer's signature on our commitment c, saves
+// it and only then revokes the one before with our revoke_and_ack.
+func (n *Node) receiveCommitment(conn *Conn, s *session, c int) error {
+	msg, err := conn.expect(MsgCommitmentSigned)
+	if err != nil {
+		return err
+	}
+	theirs := msg.(*CommitmentSigned)
+	if theirs.Commitment != c {
+		return conn.fail(fmt.Errorf("peer signed commitment #%d, expected #%d", theirs.Commitment, c))
+	}
+	if err := txbuilder.ReceiveCommitmentSig(&s.state, c, theirs.Signature); err != nil {
+		return conn.fail(err)
+	}
+	rev, err := txbuilder.RevokePrevious(&s.state, c)
+	if err != nil {
+		return conn.fail(err)
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	return conn.Send(&RevokeAndAck{*rev})
+}
+
+func (n *Node) acceptUpdate(conn *Conn, upd *UpdateBalance) error {
+	s, err := n.load()
+	if err != nil {
+		return err
+	}
+	if err := n.channel(&s.state, txbuilder.StatusOpen); err != nil {
+		return err
+	}
+	return n.acceptUpdateIn(conn, s, upd)
+}
+
+// acceptUpdateIn answers an update the peer proposed. Our signed commitment,
+// the revocation of the one before and our signature on the peer's are
+// saved together before revoke_and_ack goes out.
+func (n *Node) acceptUpdateIn(conn *Conn, s *session, upd *UpdateBalance) error {
+	state := &s.state
+	if err := txbuilder.CheckUpdate(state, upd.AliceSat, upd.BobSat); err != nil {
+		return err
+	}
+	msg, err := conn.expect(MsgCommitmentSigned)
+	if err != nil {
+		return err
+	}
+	signed := msg.(*CommitmentSigned)
+	c, err := txbuilder.NewCommitment(state, upd.AliceSat, upd.BobSat)
+	if err != nil {
+		return err
+	}
+	if c != signed.Commitment {
+		return fmt.Errorf("peer signed commitment #%d, we are at #%d", signed.Commitment, c)
+	}
+	if err := txbuilder.ReceiveCommitmentSig(state, c, signed.Signature); err != nil {
+		return err
+	}
+	rev, err := txbuilder.RevokePrevious(state, c)
+	if err != nil {
+		return err
+	}
+	sig, err := txbuilder.SignCommitment(state, c)
+	if err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		return err
+	}
+	if err := conn.Send(&RevokeAndAck{*rev}); err != nil {
+		return err
+	}
+	if err := conn.Send(&CommitmentSigned{Commitment: c, Signature: sig}); err != nil {
+		return err
+	}
+	if err := n.receiveRevocation(conn, s); err != nil {
+		return err
+	}
+	fmt.Printf("Channel at commitment #%d: Alice=%d sat, Bob=%d sat\n", c, upd.AliceSat, upd.BobSat)
+	return nil
+}
+
+func (n *Node) reestablishMsg(state *txbuilder.State) (*ChannelReestablish, error) {
+	id, err := txbuilder.ChannelID(state)
+	if err != nil {
+		return nil, err
+	}
+	p := txbuilder.CommitmentPosition(state)
+	return &ChannelReestablish{
+		ChannelID:      id,
+		NextCommitment: p.Next,
+		Signed:         p.Signed,
+		Revoked:        p.Revoked,
+		Received:       p.Received,
+		LastSecret:     txbuilder.LastReceivedSecret(state, p.Received),
+	}, nil
+}
+
+// checkReestablish holds the peer to the proof in re before we act on its
+// position: it must know our secret for the last commitment it says we
+// revoked. A right secret for a commitment we never revoked means our own
+// state is the stale one, and broadcasting it would hand the peer our
+// balance.
+func checkReestablish(state *txbuilder.State, re *ChannelReestablish) error {
+	if err := txbuilder.CheckRevealedSecret(state, re.Received, re.LastSecret); err != nil {
+		return fmt.Errorf("peer at commitment #%d failed the data loss check: %v", re.NextCommitment, err)
+	}
+	if o := txbuilder.CommitmentPosition(state); re.Received > o.Revoked {
+		return fmt.Errorf("peer proves we revoked commitment #%d but our state only revoked #%d: it is outdated, restore the channel and do not broadcast our commitment", re.Received, o.Revoked)
+	}
+	return nil
+}
+
+// reestablish swaps positions with the peer and finishes whatever exchange
+// was interrupted before we start a new one.
+func (n *Node) reestablish(conn *Conn, s *session) error {
+	re, err := n.reestablishMsg(&s.state)
+	if err != nil {
+		return err
+	}
+	if err := conn.Send(re); err != nil {
+		return err
+	}
+	msg, err := conn.expect(MsgReestablish)
+	if err != nil {
+		return err
+	}
+	theirs := msg.(*ChannelReestablish)
+	if err := checkReestablish(&s.state, theirs); err != nil {
+		return err
+	}
+	return n.resume(conn, s, theirs)
+}
+
+// resume retransmits what the peer at position p is missing from us and
+// takes what we are missing from it. A commitment's number is only used
+// once both sides have signed the other's version of it, and each side
+// signs the counterparty's version of every commitment it creates, so the
+// positions alone tell each side what the other will send.
+func (n *Node) resume(conn *Conn, s *session, p *ChannelReestablish) error {
+	state := &s.state
+	o := txbuilder.CommitmentPosition(state)
+	if p.NextCommitment <= o.Signed {
+		return fmt.Errorf("peer expects commitment #%d but signed #%d with us: it lost its state", p.NextCommitment, o.Signed)
+	}
+	if o.Next <= p.Signed {
+		return fmt.Errorf("peer holds commitment #%d signed, we are at #%d: restore the channel from its backup", p.Signed, o.Next)
+	}
+	last, peerLast := o.Next-1, p.NextCommitment-1
+
+	if p.Received < o.Revoked {
+		rev, err := txbuilder.RevokePrevious(state, o.Revoked+1)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Resending revocation of commitment #%d\n", rev.Revoked)
+		if err := conn.Send(&RevokeAndAck{*rev}); err != nil {
+			return err
+		}
+	}
+	sentSig, sentUpdate := p.Signed < last, p.NextCommitment <= last
+	if sentSig {
+		if sentUpdate {
+			if o.Next <= peerLast {
+				return fmt.Errorf("both sides started commitment #%d", last)
+			}
+			aliceSat, bobSat, err := txbuilder.CommitmentBalances(state, last)
+			if err != nil {
+				return err
+			}
+			if err := conn.Send(&UpdateBalance{ChannelID: p.ChannelID, AliceSat: aliceSat, BobSat: bobSat}); err != nil {
+				return err
+			}
+		}
+		sig, err := txbuilder.SignCommitment(state, last)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Resending signature on commitment #%d\n", last)
+		if err := conn.Send(&CommitmentSigned{Commitment: last, Signature: sig}); err != nil {
+			return err
+		}
+		if sentUpdate {
+			return n.finishUpdate(conn, s, last)
+		}
+	}
+
+	if o.Received < p.Revoked {
+		if err := n.receiveRevocation(conn, s); err != nil {
+			return err
+		}
+	}
+	if o.Signed < peerLast {
+		if o.Next <= peerLast {
+			msg, err := conn.expect(MsgUpdateBalance)
+			if err != nil {
+				return err
+			}
+			return n.acceptUpdateIn(conn, s, msg.(*UpdateBalance))
+		}
+		if err := n.receiveCommitment(conn, s, peerLast); err != nil {
+			return err
+		}
+	}
+	if sentSig {
+		return n.receiveRevocation(conn, s)
+	}
+	return nil
+}
+
+// checkShutdown makes sure the channel can be closed and the peer pays out
+// to the address it gave when the channel was opened.
+func (n *Node) checkShutdown(state *txbuilder.State, sh *Shutdown) error {
+	if err := n.channel(state, txbuilder.StatusOpen, txbuilder.StatusShuttingDown); err != nil {
+		return err
+	}
+	if err := txbuilder.StartShutdown(state); err != nil {
+		return err
+	}
+	if theirs := state.Remote(); sh.Address != theirs.Address {
+		return fmt.Errorf("shutdown address %s differs from the channel's %s", sh.Address, theirs.Address)
+	}
+	return nil
+}
+
+func (n *Node) shutdown(state *txbuilder.State) *Shutdown {
+	id, _ := txbuilder.ChannelID(state)
+	return &Shutdown{ChannelID: id, Address: state.Local().Address}
+}
+
+// Close closes the channel cooperatively: shutdown both ways, then
+// closing_signed offers until both name the same fee. Whoever accepts the
+// other's offer broadcasts the closing tx.
+func (n *Node) Close(addr string, feeSat int64) error {
+	conn, err := n.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return n.update(func(state *txbuilder.State) error {
+		if err := n.channel(state, txbuilder.StatusOpen, txbuilder.StatusShuttingDown); err != nil {
+			return err
+		}
+		if err := conn.Send(n.shutdown(state)); err != nil {
+			return err
+		}
+		msg, err := conn.expect(MsgShutdown)
+		if err != nil {
+			return err
+		}
+		if err := n.checkShutdown(state, msg.(*Shutdown)); err != nil {
+			return conn.fail(err)
+		}
+
+		offer := feeSat
+		for round := 0; round < maxClosingRounds; round++ {
+			sig, err := txbuilder.ClosingSig(state, offer)
+			if err != nil {
+				return conn.fail(err)
+			}
+			fmt.Printf("Offering closing fee %d sat\n", offer)
+			if err := conn.Send(&ClosingSigned{FeeSat: offer, Signature: sig}); err != nil {
+				return err
+			}
+			msg, err := conn.expect(MsgClosingSigned)
+			if err != nil {
+				return err
+			}
+			reply := msg.(*ClosingSigned)
+			if reply.FeeSat == offer {
+				// the peer accepted and broadcast it
+				txid, err := txbuilder.CompleteClose(state, offer, reply.Signature, false)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Peer accepted closing fee %d sat, the channel is closed once %s confirms\n", offer, txid)
+				return nil
+			}
+			next, done := txbuilder.ClosingCounterOffer(offer, reply.FeeSat)
+			if done {
+				return n.acceptClosingFee(conn, state, reply)
+			}
+			offer = next
+		}
+		return conn.fail(fmt.Errorf("no closing fee agreed after %d rounds", maxClosingRounds))
+	})
+}
+
+// acceptClosingFee takes the peer's offer: we complete and broadcast the
+// closing tx and send our signature back so the peer can record it too.
+func (n *Node) acceptClosingFee(conn *Conn, state *txbuilder.State, offer *ClosingSigned) error {
+	sig, err := txbuilder.ClosingSig(state, offer.FeeSat)
+	if err != nil {
+		return err
+	}
+	txid, err := txbuilder.CompleteClose(state, offer.FeeSat, offer.Signature, true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Accepted closing fee %d sat, the channel is closed once %s confirms\n", offer.FeeSat, txid)
+	return conn.Send(&ClosingSigned{FeeSat: offer.FeeSat, Signature: sig})
+}
+
+func (n *Node) acceptShutdown(conn *Conn, sh *Shutdown) error {
+	return n.update(func(state *txbuilder.State) error {
+		if err := n.checkShutdown(state, sh); err != nil {
+			return err
+		}
+		if err := conn.Send(n.shutdown(state)); err != nil {
+			return err
+		}
+
+		var ours int64
+		for round := 0; round < maxClosingRounds; round++ {
+			msg, err := conn.expect(MsgClosingSigned)
+			if err != nil {
+				return err
+			}
+			offer := msg.(*ClosingSigned)
+			fmt.Printf("Peer offers closing fee %d sat\n", offer.FeeSat)
+
+			next, done := offer.FeeSat, offer.FeeSat == n.FeeSat
+			if ours != 0 {
+				next, done = txbuilder.ClosingCounterOffer(ours, offer.FeeSat)
+			} else if !done {
+				// our first answer is the fee we want ourselves
+				next = n.FeeSat
+			}
+			if done {
+				return n.acceptClosingFee(conn, state, offer)
+			}
+
+			ours = next
+			sig, err := txbuilder.ClosingSig(state, ours)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Offering closing fee %d sat\n", ours)
+			if err := conn.Send(&ClosingSigned{FeeSat: ours, Signature: sig}); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("no closing fee agreed after %d rounds", maxClosingRounds)
+	})
+}
+
+// acceptReestablish answers with our position and finishes an interrupted
+// exchange. If the peer is behind what it signed with us, and proves the
+// position it claims, it has lost its state, and we force-close so it can
+// sweep its balance from our commitment.
+func (n *Node) acceptReestablish(conn *Conn, re *ChannelReestablish) error {
+	// the funding tx may have confirmed since we last looked
+	var refreshed txbuilder.State
+	if _, err := txbuilder.RefreshStateFile(n.StatePath, &refreshed); err != nil {
+		return err
+	}
+	s, err := n.load()
+	if err != nil {
+		return err
+	}
+	if s.state.Self != n.Role {
+		return fmt.Errorf("state file does not belong to %s's node", n.Role)
+	}
+	ours, err := n.reestablishMsg(&s.state)
+	if err != nil {
+		return err
+	}
+	if err := conn.Send(ours); err != nil {
+		return err
+	}
+	if err := checkReestablish(&s.state, re); err != nil {
+		return err
+	}
+	if re.NextCommitment > ours.Signed {
+		return n.resume(conn, s, re)
+	}
+	fmt.Printf("Peer expects commitment #%d, we are at #%d: it lost its state, force-closing\n", re.NextCommitment, ours.NextCommitment)
+	txid, err := txbuilder.BroadcastLatestCommitment(n.StatePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Broadcast our commitment %s, run channel force-close %s to sweep to_local once it matures\n", txid, n.Role)
+	return nil
+}
@@ -0,0 +1,127 @@
+package peer
+
+import (
+	"fmt"
+	"strings"
+
+	"example.com/utils/statefile"
+)
+
+// ChannelRecord is one channel a node runs. Inside the channel the funder
+// plays bob and the acceptor alice; Local says which of the two we are.
+type ChannelRecord struct {
+	// ID is the BOLT #2 channel ID once funded, a temporary ID before
+	ID        string `json:"id"`
+	Temporary bool   `json:"temporary,omitempty"`
+	Peer      string `json:"peer"`    // name the peer's node key is pinned under
+	PeerKey   string `json:"peerKey"` // the peer's node key
+	// PeerAddr is where the peer listens, if we know it
+	PeerAddr  string `json:"peerAddr,omitempty"`
+	Local     string `json:"local"`
+	StateFile string `json:"stateFile"`
+	CreatedAt string `json:"createdAt"`
+	// KeyIndex is the hardened BIP32 child of the wallet key our key in
+	// the channel is derived at
+	KeyIndex uint32 `json:"keyIndex"`
+}
+
+// Remote is the peer's role in the channel.
+func (r *ChannelRecord) Remote() string {
+	if r.Local == "alice" {
+		return "bob"
+	}
+	return "alice"
+}
+
+type registryFile struct {
+	Channels []ChannelRecord `json:"channels"`
+}
+
+// Registry lists a node's channels; each channel keeps its own state file.
+type Registry struct {
+	path string
+}
+
+func OpenRegistry(path string) *Registry {
+	return &Registry{path: path}
+}
+
+func (r *Registry) List() ([]ChannelRecord, error) {
+	var f registryFile
+	if _, err := statefile.Load(r.path, &f); err != nil {
+		return nil, err
+	}
+	return f.Channels, nil
+}
+
+// Find returns the channel whose ID starts with id.
+func (r *Registry) Find(id string) (*ChannelRecord, error) {
+	channels, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	var found *ChannelRecord
+	for i := range channels {
+		if !strings.HasPrefix(channels[i].ID, id) {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("channel ID %s is ambiguous", id)
+		}
+		found = &channels[i]
+	}
+	if found == nil || id == "" {
+		return nil, fmt.Errorf("no channel %s", id)
+	}
+	return found, nil
+}
+
+func (r *Registry) update(fn func(f *registryFile) error) error {
+	var f registryFile
+	return statefile.Update(r.path, &f, func() error {
+		return fn(&f)
+	})
+}
+
+// add registers rec and gives it the next unused key index.
+func (r *Registry) add(rec *ChannelRecord) error {
+	return r.update(func(f *registryFile) error {
+		rec.KeyIndex = 0
+		for _, c := range f.Channels {
+			if c.ID == rec.ID {
+				return fmt.Errorf("channel %s already exists", rec.ID)
+			}
+			if c.KeyIndex >= rec.KeyIndex {
+				rec.KeyIndex = c.KeyIndex + 1
+			}
+		}
+		f.Channels = append(f.Channels, *rec)
+		return nil
+	})
+}
+
+// fund replaces a temporary ID with the channel ID from the funding outpoint.
+func (r *Registry) fund(temporaryID, id string) error {
+	return r.update(func(f *registryFile) error {
+		for i := range f.Channels {
+			if f.Channels[i].ID == temporaryID {
+				f.Channels[i].ID = id
+				f.Channels[i].Temporary = false
+				return nil
+			}
+		}
+		return fmt.Errorf("no channel %s", temporaryID)
+	})
+}
+
+func (r *Registry) remove(id string) error {
+	return r.update(func(f *registryFile) error {
+		for i := range f.Channels {
+			if f.Channels[i].ID == id {
+				f.Channels = append(f.Channels[:i], f.Channels[i+1:]...)
+				return nil
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+package revocation
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// Secrets are generated from a 48-bit index that counts down from this value,
+// so commitment number 0 uses the largest index (BOLT #3).
+const maxIndex = 1<<48 - 1
+
+// PerCommitmentSecret returns the secret for commitment number n derived from
+// seed with the BOLT #3 shachain construction. Revealing the secret for n
+// lets the holder of any later secret check it, but not guess the next one.
+func PerCommitmentSecret(seed [32]byte, n uint64) [32]byte {
+	index := uint64(maxIndex) - n
+	p := seed
+	for b := 47; b >= 0; b-- {
+		if index&(1<<uint(b)) != 0 {
+			p[b/8] ^= 1 << uint(b%8)
+			p = sha256.Sum256(p[:])
+		}
+	}
+	return p
+}
+
+// PerCommitmentPoint is the public point shared with the counterparty so it
+// can build our commitment before we reveal the secret.
+func PerCommitmentPoint(seed [32]byte, n uint64) *btcec.PublicKey {
+	secret := PerCommitmentSecret(seed, n)
+	_, pub := btcec.PrivKeyFromBytes(secret[:])
+	return pub
+}
+
+func tweak(a, b *btcec.PublicKey) *btcec.ModNScalar {
+	h := sha256.New()
+	h.Write(a.SerializeCompressed())
+	h.Write(b.SerializeCompressed())
+	var s btcec.ModNScalar
+	s.SetByteSlice(h.Sum(nil))
+	return &s
+}
+
+func add(a, b *btcec.PublicKey) *btcec.PublicKey {
+	var pa, pb, sum btcec.JacobianPoint
+	a.AsJacobian(&pa)
+	b.AsJacobian(&pb)
+	btcec.AddNonConst(&pa, &pb, &sum)
+	sum.ToAffine()
+	return btcec.NewPublicKey(&sum.X, &sum.Y)
+}
+
+func mul(k *btcec.ModNScalar, p *btcec.PublicKey) *btcec.PublicKey {
+	var pj, res btcec.JacobianPoint
+	p.AsJacobian(&pj)
+	btcec.ScalarMultNonConst(k, &pj, &res)
+	res.ToAffine()
+	return btcec.NewPublicKey(&res.X, &res.Y)
+}
+
+// DerivePubKey returns basepoint + SHA256(per_commitment_point || basepoint)*G,
+// used for the delayed to_local key.
+func DerivePubKey(basepoint, point *btcec.PublicKey) *btcec.PublicKey {
+	var tg btcec.JacobianPoint
+	btcec.ScalarBaseMultNonConst(tweak(point, basepoint), &tg)
+	tg.ToAffine()
+	return add(basepoint, btcec.NewPublicKey(&tg.X, &tg.Y))
+}
+
+// DerivePrivKey is the private counterpart of DerivePubKey.
+func DerivePrivKey(baseSecret *btcec.PrivateKey, point *btcec.PublicKey) *btcec.PrivateKey {
+	k := *tweak(point, baseSecret.PubKey())
+	k.Add(&baseSecret.Key)
+	return &btcec.PrivateKey{Key: k}
+}
+
+// RevocationPubKey combines the counterparty's revocation basepoint with our
+// per-commitment point. Neither side alone knows the private key until the
+// per-commitment secret is revealed.
+func RevocationPubKey(revocationBasepoint, point *btcec.PublicKey) *btcec.PublicKey {
+	a := mul(tweak(revocationBasepoint, point), revocationBasepoint)
+	b := mul(tweak(point, revocationBasepoint), point)
+	return add(a, b)
+}
+
+// RevocationPrivKey derives the key that spends a revoked to_local output
+// from our revocation basepoint secret and the revealed commitment secret.
+func RevocationPrivKey(revocationBaseSecret *btcec.PrivateKey, commitmentSecret [32]byte) *btcec.PrivateKey {
+	secret, point := btcec.PrivKeyFromBytes(commitmentSecret[:])
+	basepoint := revocationBaseSecret.PubKey()
+
+	a := *tweak(basepoint, point)
+	a.Mul(&revocationBaseSecret.Key)
+	b := *tweak(point, basepoint)
+	b.Mul(&secret.Key)
+	a.Add(&b)
+	return &btcec.PrivateKey{Key: a}
+}
+
+// CheckSecret verifies a revealed secret against the point we were given
+// for the same commitment number earlier.
+func CheckSecret(secret [32]byte, point *btcec.PublicKey) error {
+	_, pub := btcec.PrivKeyFromBytes(secret[:])
+	if !pub.IsEqual(point) {
+		return fmt.Errorf("revealed secret does not match per-commitment point")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package scripts
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// ToLocalScript is the witness script of a commitment's to_local output.
+// The owner can spend it after toSelfDelay blocks; the counterparty can
+// spend it at once with the revocation key if this commitment was revoked.
+func ToLocalScript(revocationKey, delayedKey []byte, toSelfDelay uint16) ([]byte, error) {
+	builder := txscript.NewScriptBuilder()
+
+	builder.AddOp(txscript.OP_IF)
+	builder.AddData(revocationKey)
+	builder.AddOp(txscript.OP_ELSE)
+	builder.AddInt64(int64(toSelfDelay))
+	builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+	builder.AddOp(txscript.OP_DROP)
+	builder.AddData(delayedKey)
+	builder.AddOp(txscript.OP_ENDIF)
+	builder.AddOp(txscript.OP_CHECKSIG)
+
+	return builder.Script()
+}
+
+// ToRemoteScript is the witness script of the to_remote output of a
+// commitment with anchors. The counterparty spends it with its key after
+// one confirmation, so it cannot spend the output in the mempool to pin the
+// commitment there.
+func ToRemoteScript(remoteKey []byte) ([]byte, error) {
+	builder := txscript.NewScriptBuilder()
+
+	builder.AddData(remoteKey)
+	builder.AddOp(txscript.OP_CHECKSIGVERIFY)
+	builder.AddOp(txscript.OP_1)
+	builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+
+	return builder.Script()
+}
+
+// AnchorScript is the witness script of a commitment's anchor output. The
+// key's owner can spend it at once to bump the commitment's fee by CPFP;
+// after 16 blocks anyone can, so spent commitments do not leave dust
+// behind.
+func AnchorScript(fundingKey []byte) ([]byte, error) {
+	builder := txscript.NewScriptBuilder()
+
+	builder.AddData(fundingKey)
+	builder.AddOp(txscript.OP_CHECKSIG)
+	builder.AddOp(txscript.OP_IFDUP)
+	builder.AddOp(txscript.OP_NOTIF)
+	builder.AddOp(txscript.OP_16)
+	builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+	builder.AddOp(txscript.OP_ENDIF)
+
+	return builder.Script()
+}
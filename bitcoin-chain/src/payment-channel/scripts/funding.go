@@ -0,0 +1,74 @@
+package scripts
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// RefundTerms adds a Bob-only refund branch to the funding script. Exactly
+// one of Locktime (absolute, CLTV) or Delay (blocks after funding, CSV) is set.
+type RefundTerms struct {
+	Locktime uint32 `json:"locktime,omitempty"`
+	Delay    uint16 `json:"delay,omitempty"`
+}
+
+func (r *RefundTerms) validate() error {
+	if (r.Locktime == 0) == (r.Delay == 0) {
+		return fmt.Errorf("set exactly one of refund locktime or delay")
+	}
+	return nil
+}
+
+// FundingScript is the channel's 2-of-2 multisig with the keys sorted as in
+// BIP67, so both parties derive the same script. With refund terms it
+// becomes
+//
+//	OP_IF 2 <key1> <key2> 2 OP_CHECKMULTISIG
+//	OP_ELSE <locktime> OP_CHECKLOCKTIMEVERIFY (or <delay> OP_CHECKSEQUENCEVERIFY)
+//	        OP_DROP <bob> OP_CHECKSIG OP_ENDIF
+//
+// so Bob, who funds the channel, can get his money back if Alice never signs.
+func FundingScript(alicePub, bobPub []byte, refund *RefundTerms) ([]byte, error) {
+	builder := txscript.NewScriptBuilder()
+	if refund != nil {
+		if err := refund.validate(); err != nil {
+			return nil, err
+		}
+		builder.AddOp(txscript.OP_IF)
+	}
+
+	first, second := alicePub, bobPub
+	if bytes.Compare(bobPub, alicePub) < 0 {
+		first, second = bobPub, alicePub
+	}
+	builder.AddOp(txscript.OP_2)
+	builder.AddData(first)
+	builder.AddData(second)
+	builder.AddOp(txscript.OP_2)
+	builder.AddOp(txscript.OP_CHECKMULTISIG)
+
+	if refund != nil {
+		builder.AddOp(txscript.OP_ELSE)
+		if refund.Locktime != 0 {
+			builder.AddInt64(int64(refund.Locktime))
+			builder.AddOp(txscript.OP_CHECKLOCKTIMEVERIFY)
+		} else {
+			builder.AddInt64(int64(refund.Delay))
+			builder.AddOp(txscript.OP_CHECKSEQUENCEVERIFY)
+		}
+		builder.AddOp(txscript.OP_DROP)
+		builder.AddData(bobPub)
+		builder.AddOp(txscript.OP_CHECKSIG)
+		builder.AddOp(txscript.OP_ENDIF)
+	}
+
+	return builder.Script()
+}
+
+// HasRefundBranch reports whether a funding script was built with refund
+// terms; spends of such a script must select the branch they take.
+func HasRefundBranch(script []byte) bool {
+	return len(script) > 0 && script[0] == txscript.OP_IF
+}
@@ -0,0 +1,104 @@
+package scripts
+
+import (
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// HTLCKeys are the per-commitment keys of an HTLC output on the holder's
+// commitment (BOLT #3): the counterparty's revocation key, and the HTLC keys
+// of the holder (local) and the counterparty (remote).
+type HTLCKeys struct {
+	Revocation []byte
+	Local      []byte
+	Remote     []byte
+}
+
+func ripemd(b []byte) []byte {
+	h := ripemd160.New()
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+// revocationBranch starts every HTLC script: a revocation key and signature
+// spend the output at once if the commitment was revoked.
+func revocationBranch(keys HTLCKeys) *txscript.ScriptBuilder {
+	return txscript.NewScriptBuilder().
+		AddOp(txscript.OP_DUP).
+		AddOp(txscript.OP_HASH160).
+		AddData(btcutil.Hash160(keys.Revocation)).
+		AddOp(txscript.OP_EQUAL).
+		AddOp(txscript.OP_IF).
+		AddOp(txscript.OP_CHECKSIG).
+		AddOp(txscript.OP_ELSE).
+		AddData(keys.Remote).
+		AddOp(txscript.OP_SWAP).
+		AddOp(txscript.OP_SIZE).
+		AddInt64(32).
+		AddOp(txscript.OP_EQUAL)
+}
+
+// OfferedHTLCScript is the witness script of an HTLC the holder pays. The
+// remote side claims it with the preimage; the holder gets it back through
+// an HTLC-timeout transaction signed by both, locked until the expiry.
+//
+//	OP_DUP OP_HASH160 <RIPEMD160(SHA256(revocationkey))> OP_EQUAL
+//	OP_IF OP_CHECKSIG
+//	OP_ELSE <remote_htlckey> OP_SWAP OP_SIZE 32 OP_EQUAL
+//	    OP_NOTIF OP_DROP 2 OP_SWAP <local_htlckey> 2 OP_CHECKMULTISIG
+//	    OP_ELSE OP_HASH160 <RIPEMD160(payment_hash)> OP_EQUALVERIFY OP_CHECKSIG
+//	    OP_ENDIF
+//	OP_ENDIF
+func OfferedHTLCScript(keys HTLCKeys, paymentHash []byte) ([]byte, error) {
+	return revocationBranch(keys).
+		AddOp(txscript.OP_NOTIF).
+		AddOp(txscript.OP_DROP).
+		AddOp(txscript.OP_2).
+		AddOp(txscript.OP_SWAP).
+		AddData(keys.Local).
+		AddOp(txscript.OP_2).
+		AddOp(txscript.OP_CHECKMULTISIG).
+		AddOp(txscript.OP_ELSE).
+		AddOp(txscript.OP_HASH160).
+		AddData(ripemd(paymentHash)).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddOp(txscript.OP_CHECKSIG).
+		AddOp(txscript.OP_ENDIF).
+		AddOp(txscript.OP_ENDIF).
+		Script()
+}
+
+// ReceivedHTLCScript is the witness script of an HTLC paid to the holder.
+// The holder claims it with the preimage through an HTLC-success
+// transaction signed by both; the remote side takes it back after expiry.
+//
+//	OP_DUP OP_HASH160 <RIPEMD160(SHA256(revocationkey))> OP_EQUAL
+//	OP_IF OP_CHECKSIG
+//	OP_ELSE <remote_htlckey> OP_SWAP OP_SIZE 32 OP_EQUAL
+//	    OP_IF OP_HASH160 <RIPEMD160(payment_hash)> OP_EQUALVERIFY
+//	          2 OP_SWAP <local_htlckey> 2 OP_CHECKMULTISIG
+//	    OP_ELSE OP_DROP <expiry> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_CHECKSIG
+//	    OP_ENDIF
+//	OP_ENDIF
+func ReceivedHTLCScript(keys HTLCKeys, paymentHash []byte, expiry uint32) ([]byte, error) {
+	return revocationBranch(keys).
+		AddOp(txscript.OP_IF).
+		AddOp(txscript.OP_HASH160).
+		AddData(ripemd(paymentHash)).
+		AddOp(txscript.OP_EQUALVERIFY).
+		AddOp(txscript.OP_2).
+		AddOp(txscript.OP_SWAP).
+		AddData(keys.Local).
+		AddOp(txscript.OP_2).
+		AddOp(txscript.OP_CHECKMULTISIG).
+		AddOp(txscript.OP_ELSE).
+		AddOp(txscript.OP_DROP).
+		AddInt64(int64(expiry)).
+		AddOp(txscript.OP_CHECKLOCKTIMEVERIFY).
+		AddOp(txscript.OP_DROP).
+		AddOp(txscript.OP_CHECKSIG).
+		AddOp(txscript.OP_ENDIF).
+		AddOp(txscript.OP_ENDIF).
+		Script()
+}
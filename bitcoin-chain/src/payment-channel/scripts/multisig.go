@@ -1,14 +1,14 @@
 package scripts
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"os"
 
+	"example.com/utils/statefile"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
-	"github.com/btcsuite/btcd/txscript"
 )
 
 type KeyInfo struct {
@@ -26,6 +26,11 @@ type HTLC struct {
 	Vout         uint32  `json:"vout"`
 	Amount       float64 `json:"amount,omitempty"`
 	RedeemScript string  `json:"redeemScript,omitempty"`
+	// Segwit is set for P2WSH funding outputs; older channels are P2SH
+	Segwit bool `json:"segwit,omitempty"`
+	// Taproot funding outputs are a MuSig2 key with no script
+	Taproot bool         `json:"taproot,omitempty"`
+	Refund  *RefundTerms `json:"refund,omitempty"`
 }
 
 type State struct {
@@ -34,27 +39,23 @@ type State struct {
 	HTLC  *HTLC    `json:"htlc,omitempty"`
 }
 
-func SaveState(stateFile string, state *State) error {
-	data, err := json.MarshalIndent(state, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal state: %v", err)
-	}
-	if err := os.WriteFile(stateFile, data, 0644); err != nil {
-		return fmt.Errorf("failed to write %s: %v", stateFile, err)
+// SaveState writes state back to stateFile, failing with statefile.ErrStale
+// if another command saved the file since snap was loaded.
+func SaveState(stateFile string, snap *statefile.Snapshot, state *State) error {
+	if err := statefile.Save(stateFile, snap, state); err != nil {
+		return fmt.Errorf("failed to write %s: %w", stateFile, err)
 	}
 	return nil
 }
 
-func GenerateMultisig(stateFile string) (string, string, error) {
+// GenerateMultisig builds the channel funding script and its P2WSH address.
+// refund may be nil for a plain 2-of-2 that needs both parties to spend.
+func GenerateMultisig(stateFile, fundPath string, refund *RefundTerms) (string, string, error) {
 	// Load state.json
-	data, err := os.ReadFile(stateFile)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read state file: %v", err)
-	}
-
 	var state State
-	if err := json.Unmarshal(data, &state); err != nil {
-		return "", "", fmt.Errorf("failed to parse state file: %v", err)
+	snap, err := statefile.Load(stateFile, &state)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to load state file: %v", err)
 	}
 
 	if state.Alice == nil || state.Bob == nil {
@@ -71,33 +72,31 @@ func GenerateMultisig(stateFile string) (string, string, error) {
 		return "", "", fmt.Errorf("invalid bob pubkey: %v", err)
 	}
 
-	// Convert to AddressPubKey
-	aliceAddrPubKey, err := btcutil.NewAddressPubKey(alicePubKeyBytes, &chaincfg.RegressionNetParams)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create AddressPubKey for Alice: %v", err)
-	}
-	bobAddrPubKey, err := btcutil.NewAddressPubKey(bobPubKeyBytes, &chaincfg.RegressionNetParams)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create AddressPubKey for Bob: %v", err)
-	}
-
-	// Build multisig redeem script (2-of-2)
-	redeemScript, err := txscript.MultiSigScript(
-		[]*btcutil.AddressPubKey{aliceAddrPubKey, bobAddrPubKey},
-		2)
+	// Build multisig redeem script (2-of-2, optionally with Bob's refund)
+	redeemScript, err := FundingScript(alicePubKeyBytes, bobPubKeyBytes, refund)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to build multisig script: %v", err)
 	}
 
-	// Generate P2SH address
-	address, err := btcutil.NewAddressScriptHash(redeemScript, &chaincfg.RegressionNetParams)
+	// Generate P2WSH address: the funding txid cannot be malleated, so
+	// commitments and the refund can be signed before it is broadcast
+	scriptHash := sha256.Sum256(redeemScript)
+	address, err := btcutil.NewAddressWitnessScriptHash(scriptHash[:], &chaincfg.RegressionNetParams)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create p2sh address: %v", err)
+		return "", "", fmt.Errorf("failed to create p2wsh address: %v", err)
 	}
 
 	redeemScriptHex := hex.EncodeToString(redeemScript)
 	fmt.Println("Redeem Script:", redeemScriptHex)
-	fmt.Println("P2SH Address :", address.EncodeAddress())
+	fmt.Println("P2WSH Address:", address.EncodeAddress())
+	switch {
+	case refund == nil:
+		fmt.Println("No refund branch: spending needs both signatures")
+	case refund.Locktime != 0:
+		fmt.Println("Bob can refund alone after locktime", refund.Locktime)
+	default:
+		fmt.Printf("Bob can refund alone %d blocks after funding confirms\n", refund.Delay)
+	}
 
 	// Save to fund.json
 	fund := FundData{
@@ -107,20 +106,23 @@ func GenerateMultisig(stateFile string) (string, string, error) {
 	if err != nil {
 		return "", "", fmt.Errorf("failed to marshal fund.json: %v", err)
 	}
-	err = os.WriteFile("data/fund.json", fundBytes, 0644)
+	err = statefile.WriteFile(fundPath, fundBytes, 0644)
 	if err != nil {
 		return "", "", fmt.Errorf("failed to write fund.json: %v", err)
 	}
-	fmt.Println("Saved fund.json with P2SH address")
+	fmt.Println("Saved fund.json with P2WSH address")
 
 	// Save redeemScript to state.json as well
 	if state.HTLC == nil {
 		state.HTLC = &HTLC{}
 	}
 	state.HTLC.RedeemScript = redeemScriptHex
+	state.HTLC.Refund = refund
+	state.HTLC.Segwit = true
+	state.HTLC.Taproot = false
 
 	// Save state.json with helper
-	if err := SaveState(stateFile, &state); err != nil {
+	if err := SaveState(stateFile, snap, &state); err != nil {
 		return "", "", fmt.Errorf("failed to save state: %v", err)
 	}
 
@@ -0,0 +1,74 @@
+package scripts
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"example.com/m/musig"
+	"example.com/utils/statefile"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// GenerateTaprootFunding derives the channel's Taproot funding address from
+// the MuSig2 aggregate of Alice's and Bob's keys. Spends of it look like any
+// single-key spend; there is no script and so no refund branch.
+func GenerateTaprootFunding(stateFile, fundPath string) (string, error) {
+	var state State
+	snap, err := statefile.Load(stateFile, &state)
+	if err != nil {
+		return "", fmt.Errorf("failed to load state file: %v", err)
+	}
+	if state.Alice == nil || state.Bob == nil {
+		return "", fmt.Errorf("missing keys for alice or bob")
+	}
+
+	var keys []*btcec.PublicKey
+	for _, k := range []*KeyInfo{state.Alice, state.Bob} {
+		b, err := hex.DecodeString(k.PubKey)
+		if err != nil {
+			return "", fmt.Errorf("invalid pubkey %s: %v", k.PubKey, err)
+		}
+		pub, err := btcec.ParsePubKey(b)
+		if err != nil {
+			return "", fmt.Errorf("invalid pubkey %s: %v", k.PubKey, err)
+		}
+		keys = append(keys, pub)
+	}
+
+	outputKey, err := musig.OutputKey(keys)
+	if err != nil {
+		return "", err
+	}
+	address, err := btcutil.NewAddressTaproot(schnorr.SerializePubKey(outputKey), &chaincfg.RegressionNetParams)
+	if err != nil {
+		return "", fmt.Errorf("failed to create p2tr address: %v", err)
+	}
+	fmt.Println("Aggregate key:", hex.EncodeToString(schnorr.SerializePubKey(outputKey)))
+	fmt.Println("P2TR Address :", address.EncodeAddress())
+
+	fundBytes, err := json.MarshalIndent(FundData{Address: address.EncodeAddress()}, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal fund.json: %v", err)
+	}
+	if err := statefile.WriteFile(fundPath, fundBytes, 0644); err != nil {
+		return "", fmt.Errorf("failed to write fund.json: %v", err)
+	}
+	fmt.Println("Saved fund.json with P2TR address")
+
+	if state.HTLC == nil {
+		state.HTLC = &HTLC{}
+	}
+	state.HTLC.RedeemScript = ""
+	state.HTLC.Refund = nil
+	state.HTLC.Segwit = false
+	state.HTLC.Taproot = true
+
+	if err := SaveState(stateFile, snap, &state); err != nil {
+		return "", fmt.Errorf("failed to save state: %v", err)
+	}
+	return address.EncodeAddress(), nil
+}
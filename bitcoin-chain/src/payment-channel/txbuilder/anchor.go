@@ -0,0 +1,219 @@
+package txbuilder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"example.com/utils/rpc"
+	"example.com/utils/statefile"
+	"example.com/utils/txverify"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// A commitment is signed long before it is broadcast, with the fixed fee
+// of the time. On a channel with anchors the holder can still raise the
+// fee once it matters: a child spending the holder's anchor and an output
+// of its wallet pays for both, child pays for parent.
+
+// commitmentInput is the value of the funding output commitTx spends: the
+// channel's, or the one before a pending splice.
+func commitmentInput(state *State, commitTx *wire.MsgTx) (int64, error) {
+	op := commitTx.TxIn[0].PreviousOutPoint
+	for _, f := range []*HTLC{state.HTLC, spliceFunding(state)} {
+		if f != nil && f.Txid == op.Hash.String() && f.Vout == op.Index {
+			return toSat(f.Amount), nil
+		}
+	}
+	return 0, fmt.Errorf("commitment spends %s, not a funding output of the channel", op)
+}
+
+func spliceFunding(state *State) *HTLC {
+	if state.Channel == nil || state.Channel.Splice == nil {
+		return nil
+	}
+	return state.Channel.Splice.PrevFunding
+}
+
+func vsize(tx *wire.MsgTx) int64 {
+	return (blockchain.GetTransactionWeight(btcutil.NewTx(tx)) + 3) / 4
+}
+
+// BumpCommitment raises the fee of the commitment broadcast to force-close
+// the channel until it and the child together pay feeRate sat/vB, or the
+// node's estimate if feeRate is 0. The child spends the holder's anchor
+// and the largest unreserved output of its wallet, with the change going
+// back there.
+// A commitment the mempool turned away, as it does one paying less than
+// its minimum fee, is submitted with the child as a package; one already
+// in the mempool only needs the child.
+func BumpCommitment(statePath string, feeRate int64) (string, error) {
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return "", fmt.Errorf("failed to read state file: %v", err)
+	}
+	if state.Channel == nil || state.Channel.ForceClose == nil {
+		return "", fmt.Errorf("no force-close in progress")
+	}
+	if !policyOf(&state).Anchors {
+		return "", fmt.Errorf("the channel's commitments have no anchors")
+	}
+	fc := state.Channel.ForceClose
+	client := rpc.New(appConfig.RPC)
+	confs, found, err := commitmentConfirmations(client, &state, *fc)
+	if err != nil {
+		return "", err
+	}
+	if found && confs > 0 {
+		releaseBump(fc)
+		return "", fmt.Errorf("commitment %s already confirmed", fc.Txid)
+	}
+	if feeRate <= 0 {
+		feeRate = sweepFeeRate(client)
+	}
+
+	c := findCommitment(&state, fc.Commitment)
+	if c == nil {
+		return "", fmt.Errorf("commitment #%d not found", fc.Commitment)
+	}
+	txHex := c.AliceSignedTx
+	if fc.Holder == "bob" {
+		txHex = c.BobSignedTx
+	}
+	commitTx, err := decodeTx(txHex)
+	if err != nil {
+		return "", err
+	}
+	child, fee, err := buildBumpTx(&state, fc.Holder, commitTx, feeRate)
+	if err != nil {
+		return "", err
+	}
+	childHex, err := serializeTx(child)
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("Fee-bump tx (hex):", childHex)
+	if err := updateForceClose(statePath, func(s *ForceClose) { s.BumpTx = childHex }); err != nil {
+		return "", err
+	}
+	txid := child.TxHash().String()
+	if found {
+		if _, err := broadcastTx(childHex, "anchor-bump"); err != nil {
+			return "", fmt.Errorf("fee-bump broadcast failed: %v", err)
+		}
+	} else {
+		if err := client.SubmitPackage(txHex, childHex); err != nil {
+			return "", fmt.Errorf("failed to submit commitment %s with its fee bump: %v", fc.Txid, err)
+		}
+		fmt.Printf("Submitted commitment %s and fee-bump %s as a package\n", fc.Txid, txid)
+	}
+	fmt.Printf("Child pays %d sat, %d sat/vB for commitment and child\n", fee, feeRate)
+	return txid, updateForceClose(statePath, func(s *ForceClose) { s.BumpTxid = txid })
+}
+
+// buildBumpTx builds and signs the child of commitTx that spends holder's
+// anchor. It returns the child and its fee.
+func buildBumpTx(state *State, holder string, commitTx *wire.MsgTx, feeRate int64) (*wire.MsgTx, int64, error) {
+	witnessScript, pkScript, err := anchorScript(state, holder)
+	if err != nil {
+		return nil, 0, err
+	}
+	idx := -1
+	for i, out := range commitTx.TxOut {
+		if bytes.Equal(out.PkScript, pkScript) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, 0, fmt.Errorf("the commitment has no anchor for %s", holder)
+	}
+	funding, err := commitmentInput(state, commitTx)
+	if err != nil {
+		return nil, 0, err
+	}
+	parentFee := funding
+	for _, out := range commitTx.TxOut {
+		parentFee -= out.Value
+	}
+
+	priv, err := privFromHex(state.key(holder).PrivKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s privkey: %v", holder, err)
+	}
+	wallet := state.walletKey(holder)
+	walletPriv, err := privFromHex(wallet.PrivKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s wallet key: %v", holder, err)
+	}
+	utxo, err := reserveLargestUTXO(wallet.Address, bumpOwner(commitTx.TxHash().String()))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to pick a %s UTXO: %v", holder, err)
+	}
+	utxoHash, err := chainhash.NewHashFromStr(utxo.TxID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid txid %s: %v", utxo.TxID, err)
+	}
+	utxoScript, err := hex.DecodeString(utxo.ScriptPubKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid scriptPubKey: %v", err)
+	}
+	changeAddr, err := btcutil.DecodeAddress(wallet.Address, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s address: %v", holder, err)
+	}
+	changeScript, err := txscript.PayToAddrScript(changeAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	commitHash := commitTx.TxHash()
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&commitHash, uint32(idx)), nil, nil))
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(utxoHash, utxo.Vout), nil, nil))
+	prevOuts := map[wire.OutPoint]*wire.TxOut{
+		tx.TxIn[0].PreviousOutPoint: commitTx.TxOut[idx],
+		tx.TxIn[1].PreviousOutPoint: wire.NewTxOut(toSat(utxo.Amount), utxoScript),
+	}
+	amountIn := anchorSat + toSat(utxo.Amount)
+	tx.AddTxOut(wire.NewTxOut(amountIn, changeScript))
+
+	fetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
+	sign := func() error {
+		sig, err := txscript.RawTxInWitnessSignature(tx, txscript.NewTxSigHashes(tx, fetcher), 0, anchorSat, witnessScript, txscript.SigHashAll, priv)
+		if err != nil {
+			return fmt.Errorf("failed to sign anchor: %v", err)
+		}
+		// <sig> <witnessScript> takes the key path
+		tx.TxIn[0].Witness = wire.TxWitness{sig, witnessScript}
+		return signWalletInput(tx, 1, fetcher, walletPriv)
+	}
+
+	// sign once to learn the size, then again with the fee taken off
+	if err := sign(); err != nil {
+		return nil, 0, err
+	}
+	parentSize, childSize := vsize(commitTx), vsize(tx)
+	fee := feeRate*(parentSize+childSize) - parentFee
+	if fee < childSize {
+		return nil, 0, fmt.Errorf("the commitment already pays %d sat for %d vB, more than %d sat/vB", parentFee, parentSize, feeRate)
+	}
+	tx.TxOut[0].Value = amountIn - fee
+	if mempool.IsDust(tx.TxOut[0], mempool.DefaultMinRelayTxFee) {
+		return nil, 0, fmt.Errorf("%s's wallet output (%d sat) does not cover a %d sat fee", holder, toSat(utxo.Amount), fee)
+	}
+	if err := sign(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := txverify.Verify(tx, prevOuts, txverify.UnknownHeight); err != nil {
+		return nil, 0, fmt.Errorf("fee-bump tx rejected: %v", err)
+	}
+	return tx, fee, nil
+}
@@ -0,0 +1,250 @@
+package txbuilder
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"example.com/m/revocation"
+	"example.com/m/scripts"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// defaultToSelfDelay is how many blocks a party waits before spending its own
+// to_local output after a unilateral close.
+const defaultToSelfDelay = 144
+
+func randomHex() (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %v", err)
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func newChannelKeys() (*ChannelKeys, error) {
+	var vals [4]string
+	for i := range vals {
+		v, err := randomHex()
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return &ChannelKeys{
+		Seed:                 vals[0],
+		RevocationBaseSecret: vals[1],
+		DelayedBaseSecret:    vals[2],
+		HTLCBaseSecret:       vals[3],
+	}, nil
+}
+
+// ensureRevocation creates the commitment secrets for both parties the
+// first time a revocable commitment is built.
+func ensureRevocation(state *State) error {
+	if state.Revocation == nil {
+		state.Revocation = &Revocation{ToSelfDelay: defaultToSelfDelay}
+	}
+	var err error
+	if state.Revocation.Alice == nil {
+		if state.Revocation.Alice, err = newChannelKeys(); err != nil {
+			return err
+		}
+	}
+	if state.Revocation.Bob == nil {
+		if state.Revocation.Bob, err = newChannelKeys(); err != nil {
+			return err
+		}
+	}
+	// channels opened before HTLC outputs existed have no HTLC basepoint yet
+	for _, k := range []*ChannelKeys{state.Revocation.Alice, state.Revocation.Bob} {
+		if k.Seed != "" && k.HTLCBaseSecret == "" && k.HTLCBasepoint == "" {
+			if k.HTLCBaseSecret, err = randomHex(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (k *ChannelKeys) seed() ([32]byte, error) {
+	var seed [32]byte
+	b, err := hex.DecodeString(k.Seed)
+	if err != nil || len(b) != 32 {
+		return seed, fmt.Errorf("invalid commitment seed")
+	}
+	copy(seed[:], b)
+	return seed, nil
+}
+
+func privFromHex(s string) (*btcec.PrivateKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("invalid secret key")
+	}
+	priv, _ := btcec.PrivKeyFromBytes(b)
+	return priv, nil
+}
+
+// basepoint is the public half of secret, or the basepoint the
+// counterparty sent when only that is known.
+func basepoint(secret, public string) (*btcec.PublicKey, error) {
+	if secret != "" {
+		priv, err := privFromHex(secret)
+		if err != nil {
+			return nil, err
+		}
+		return priv.PubKey(), nil
+	}
+	return parsePubKey(public)
+}
+
+func parsePubKey(s string) (*btcec.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	return btcec.ParsePubKey(b)
+}
+
+func (k *ChannelKeys) revocationBasepoint() (*btcec.PublicKey, error) {
+	return basepoint(k.RevocationBaseSecret, k.RevocationBasepoint)
+}
+
+func (k *ChannelKeys) delayedBasepoint() (*btcec.PublicKey, error) {
+	return basepoint(k.DelayedBaseSecret, k.DelayedBasepoint)
+}
+
+func (k *ChannelKeys) htlcBasepoint() (*btcec.PublicKey, error) {
+	return basepoint(k.HTLCBaseSecret, k.HTLCBasepoint)
+}
+
+func (k *ChannelKeys) point(n int) (*btcec.PublicKey, error) {
+	if k.Seed == "" {
+		p, ok := k.Points[n]
+		if !ok {
+			return nil, fmt.Errorf("no per-commitment point for commitment %d", n)
+		}
+		return parsePubKey(p)
+	}
+	seed, err := k.seed()
+	if err != nil {
+		return nil, err
+	}
+	return revocation.PerCommitmentPoint(seed, uint64(n)), nil
+}
+
+func (k *ChannelKeys) secret(n int) ([32]byte, error) {
+	seed, err := k.seed()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return revocation.PerCommitmentSecret(seed, uint64(n)), nil
+}
+
+// parties returns the keys of holder and of its counterparty.
+func (r *Revocation) parties(holder string) (local, remote *ChannelKeys, err error) {
+	switch holder {
+	case "alice":
+		return r.Alice, r.Bob, nil
+	case "bob":
+		return r.Bob, r.Alice, nil
+	}
+	return nil, nil, fmt.Errorf("unknown party %q", holder)
+}
+
+// toLocalScript builds the witness script of holder's to_local output for
+// commitment n.
+func toLocalScript(state *State, holder string, n int) ([]byte, error) {
+	local, remote, err := state.Revocation.parties(holder)
+	if err != nil {
+		return nil, err
+	}
+	point, err := local.point(n)
+	if err != nil {
+		return nil, err
+	}
+	revBase, err := remote.revocationBasepoint()
+	if err != nil {
+		return nil, err
+	}
+	delayedBase, err := local.delayedBasepoint()
+	if err != nil {
+		return nil, err
+	}
+
+	revKey := revocation.RevocationPubKey(revBase, point)
+	delayedKey := revocation.DerivePubKey(delayedBase, point)
+	return scripts.ToLocalScript(revKey.SerializeCompressed(), delayedKey.SerializeCompressed(), state.Revocation.ToSelfDelay)
+}
+
+func p2wshScript(witnessScript []byte) ([]byte, error) {
+	hash := sha256.Sum256(witnessScript)
+	addr, err := btcutil.NewAddressWitnessScriptHash(hash[:], &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+func p2wpkhScript(pubKeyHex string) ([]byte, error) {
+	pub, err := hex.DecodeString(pubKeyHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pubkey: %v", err)
+	}
+	addr, err := btcutil.NewAddressWitnessPubKeyHash(btcutil.Hash160(pub), &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, err
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+// revokePrevious hands each party the other's secret for the commitment
+// before n, checking it against the point that commitment was built with.
+// After this an old commitment broadcast by either side can be punished.
+func revokePrevious(state *State, n int) error {
+	var old *Commitment
+	for i := range state.Commitments {
+		c := &state.Commitments[i]
+		if c.ID < n && c.AliceTx != "" && (old == nil || c.ID > old.ID) {
+			old = c
+		}
+	}
+	if old == nil || old.Revoked {
+		return nil
+	}
+	prev := old.ID
+	exchange := []struct {
+		from, to *ChannelKeys
+		name     string
+	}{
+		{state.Revocation.Alice, state.Revocation.Bob, "Alice"},
+		{state.Revocation.Bob, state.Revocation.Alice, "Bob"},
+	}
+	for _, e := range exchange {
+		secret, err := e.from.secret(prev)
+		if err != nil {
+			return err
+		}
+		point, err := e.from.point(prev)
+		if err != nil {
+			return err
+		}
+		if err := revocation.CheckSecret(secret, point); err != nil {
+			return fmt.Errorf("%s's secret for commitment %d: %v", e.name, prev, err)
+		}
+		if e.to.ReceivedSecrets == nil {
+			e.to.ReceivedSecrets = map[int]string{}
+		}
+		e.to.ReceivedSecrets[prev] = hex.EncodeToString(secret[:])
+		fmt.Printf("%s revoked commitment %d\n", e.name, prev)
+	}
+	old.Revoked = true
+	old.RevokedAt = time.Now().Format(time.RFC3339)
+	return nil
+}
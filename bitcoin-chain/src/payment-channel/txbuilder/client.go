@@ -6,14 +6,70 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
+
+	"example.com/utils/broadcast"
+	"example.com/utils/config"
 )
 
-const (
-	rpcUser     = "admin"
-	rpcPassword = "HouiWGc9wyj_2Fx2G9FYnQAr3AIXEeb-uRNRNITgKso"
+// RPC settings and fee policy, filled in from the config file by Configure.
+var (
+	rpcUser     string
+	rpcPassword string
 	rpcURL      = "http://127.0.0.1:8332"
+	fixedFee    = int64(500)
+	appConfig   *config.Config
 )
 
+func Configure(cfg *config.Config) {
+	rpcURL = cfg.RPC.URL
+	rpcUser = cfg.RPC.User
+	rpcPassword = cfg.RPC.Password
+	fixedFee = cfg.Fees.FixedFeeSat
+	appConfig = cfg
+}
+
+// dataPath resolves name, e.g. dataPath("data/fund.json"), under the configured data
+// directory rather than the working directory.
+func dataPath(name string) string {
+	if appConfig == nil {
+		return name
+	}
+	return filepath.Join(appConfig.DataDir, name)
+}
+
+// broadcastTx sends a signed tx through the shared broadcaster so it gets
+// the mempool preflight and is recorded in the swap database.
+func broadcastTx(txHex string, label string) (string, error) {
+	if appConfig == nil {
+		return "", fmt.Errorf("txbuilder is not configured")
+	}
+	b, err := broadcast.Open(appConfig)
+	if err != nil {
+		return "", err
+	}
+	defer b.Close()
+
+	res, err := b.Send(txHex, label)
+	if err != nil {
+		return "", err
+	}
+	return res.Txid, nil
+}
+
+// abandonTx keeps the shared broadcaster from sending txid again.
+func abandonTx(txid string) error {
+	if appConfig == nil {
+		return fmt.Errorf("txbuilder is not configured")
+	}
+	b, err := broadcast.Open(appConfig)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	return b.Abandon(txid)
+}
+
 type RPCRequest struct {
 	Jsonrpc string        `json:"jsonrpc"`
 	ID      string        `json:"id"`
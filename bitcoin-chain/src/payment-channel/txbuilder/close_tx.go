@@ -0,0 +1,195 @@
+package txbuilder
+
+import (
+	"fmt"
+
+	"example.com/utils/statefile"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// ClosingCounterOffer is the reply to theirs after our own last offer ours:
+// an offer strictly between the two, or theirs (done) once nothing is left
+// in between.
+func ClosingCounterOffer(ours, theirs int64) (int64, bool) {
+	if ours == theirs {
+		return theirs, true
+	}
+	next := (ours + theirs) / 2
+	if next == ours || next == theirs {
+		return theirs, true
+	}
+	return next, false
+}
+
+// negotiateClosingFee runs the closing_signed exchange of BOLT #2. Bob
+// funded the channel and pays the fee, so he offers first; every reply lies
+// strictly between the last two offers until both sides name the same fee.
+func negotiateClosingFee(bobOffer, aliceOffer int64) int64 {
+	fmt.Printf("Bob offers closing fee %d sat\n", bobOffer)
+	fmt.Printf("Alice offers closing fee %d sat\n", aliceOffer)
+
+	last, prev := aliceOffer, bobOffer
+	who := "Bob"
+	for {
+		next, done := ClosingCounterOffer(prev, last)
+		if done {
+			fmt.Printf("%s accepts %d sat\n", who, last)
+			return last
+		}
+		fmt.Printf("%s offers closing fee %d sat\n", who, next)
+		last, prev = next, last
+		if who == "Bob" {
+			who = "Alice"
+		} else {
+			who = "Bob"
+		}
+	}
+}
+
+// finalBalances returns the balances of the latest commitment both parties
+// signed, which is the state a mutual close settles.
+func finalBalances(state *State) (float64, float64) {
+	if c := latestSigned(state); c != nil {
+		return c.AliceBalance, c.BobBalance
+	}
+	return state.Channel.AliceBalance, state.Channel.BobBalance
+}
+
+// buildClosingTx spends the 2-of-2 output straight to both addresses. There
+// is no to_local delay and no OP_RETURN: nothing in it can be revoked.
+func buildClosingTx(state *State, aliceSat, bobSat int64) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx(2)
+
+	hash, err := chainhash.NewHashFromStr(state.HTLC.Txid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTLC txid: %v", err)
+	}
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, state.HTLC.Vout), nil, nil))
+
+	outputs := []struct {
+		name    string
+		address string
+		amount  int64
+	}{
+		{"Alice", state.Alice.Address, aliceSat},
+		{"Bob", state.Bob.Address, bobSat},
+	}
+	for _, o := range outputs {
+		addr, err := btcutil.DecodeAddress(o.address, &chaincfg.RegressionNetParams)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s address: %v", o.name, err)
+		}
+		pkScript, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, fmt.Errorf("output script error: %v", err)
+		}
+		out := wire.NewTxOut(o.amount, pkScript)
+		if mempool.IsDust(out, mempool.DefaultMinRelayTxFee) {
+			// a dust output would make the tx non-standard, it goes to fees
+			fmt.Printf("Dropping %s's dust output of %d sat\n", o.name, o.amount)
+			continue
+		}
+		tx.AddTxOut(out)
+	}
+	if len(tx.TxOut) == 0 {
+		return nil, fmt.Errorf("nothing left to pay out after fees")
+	}
+	return tx, nil
+}
+
+// closingTx builds the closing tx for the final balances with fee taken
+// from Bob, who funded the channel.
+func closingTx(state *State, fee int64) (*wire.MsgTx, int64, int64, error) {
+	aliceBalance, bobBalance := finalBalances(state)
+	aliceSat := toSat(aliceBalance)
+	bobSat := toSat(bobBalance) - fee
+	if bobSat < 0 {
+		return nil, 0, 0, fmt.Errorf("Bob's balance %.8f BTC cannot cover the closing fee", bobBalance)
+	}
+	if aliceSat+bobSat+fee != toSat(state.HTLC.Amount) {
+		return nil, 0, 0, fmt.Errorf("alice + bob + fee mismatch with HTLC amount")
+	}
+	tx, err := buildClosingTx(state, aliceSat, bobSat)
+	return tx, aliceSat, bobSat, err
+}
+
+// StartShutdown stops updates to the channel so it can be closed
+// cooperatively. The closing tx has no HTLC outputs, so nothing may be in
+// flight.
+func StartShutdown(state *State) error {
+	if err := RequireStatus(state, StatusOpen, StatusShuttingDown); err != nil {
+		return err
+	}
+	if len(state.Channel.HTLCs) > 0 {
+		return fmt.Errorf("%d HTLCs pending, settle or fail them first", len(state.Channel.HTLCs))
+	}
+	return setStatus(state, StatusShuttingDown)
+}
+
+// CloseChannel closes the channel cooperatively: both parties agree on a
+// fee, sign a closing tx paying the final balances and broadcast it.
+func CloseChannel(statePath string, bobFee, aliceFee int64) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		if state.Channel == nil || state.HTLC == nil {
+			return fmt.Errorf("channel is not initialized")
+		}
+		if err := StartShutdown(&state); err != nil {
+			return err
+		}
+
+		fee := negotiateClosingFee(bobFee, aliceFee)
+		tx, aliceSat, bobSat, err := closingTx(&state, fee)
+		if err != nil {
+			return err
+		}
+
+		funding, err := state.funding()
+		if err != nil {
+			return err
+		}
+		alicePrivKey, _ := btcec.PrivKeyFromBytes(decodeHex(state.Alice.PrivKey))
+		bobPrivKey, _ := btcec.PrivKeyFromBytes(decodeHex(state.Bob.PrivKey))
+		if _, err := signMultisig(tx, funding, alicePrivKey, bobPrivKey); err != nil {
+			return err
+		}
+		if err := verifyChannelSpend(tx, funding); err != nil {
+			return fmt.Errorf("closing tx rejected: %v", err)
+		}
+		if size := int64(mempool.GetTxVirtualSize(btcutil.NewTx(tx))); fee < size {
+			return fmt.Errorf("closing fee %d sat is below the relay minimum of %d sat", fee, size)
+		}
+
+		txHex, err := serializeTx(tx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Closing tx: Alice=%d sat, Bob=%d sat, fee=%d sat\n", aliceSat, bobSat, fee)
+		fmt.Println("Signed closing tx (hex):", txHex)
+
+		state.Channel.ClosingTx = txHex
+		state.Channel.AliceBalance, state.Channel.BobBalance = finalBalances(&state)
+		state.Channel.ClosingTxid = tx.TxHash().String()
+		if err := setStatus(&state, StatusClosingSigned); err != nil {
+			return err
+		}
+
+		// a failed broadcast keeps the signed tx; the channel is closed once
+		// it confirms
+		txid, err := broadcastTx(txHex, "channel-close")
+		if err != nil {
+			fmt.Printf("Broadcast failed, send the closing tx above yourself: %v\n", err)
+			return nil
+		}
+		state.Channel.ClosingTxid = txid
+		fmt.Println("Closing tx broadcast:", txid)
+		fmt.Println("The channel is closed once it confirms")
+		return nil
+	})
+}
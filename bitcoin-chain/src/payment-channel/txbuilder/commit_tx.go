@@ -3,104 +3,259 @@ package txbuilder
 import (
 	"bytes"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"os"
 	"time"
 
-	"github.com/btcsuite/btcd/btcutil"
-	"github.com/btcsuite/btcd/chaincfg"
+	"example.com/m/scripts"
+	"example.com/utils/statefile"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 )
 
-func CreateCommitmentTx(stateFile string, aliceBalance float64, bobBalance float64) error {
-	// read current state
-	data, err := os.ReadFile(stateFile)
+// anchorSat is the value of an anchor output, as in BOLT #3.
+const anchorSat = 330
+
+// commitmentFee is what Bob's balance pays towards each commitment: the
+// fixed fee, plus both anchors on a channel that has them.
+func commitmentFee(state *State) int64 {
+	if policyOf(state).Anchors {
+		return fixedFee + 2*anchorSat
+	}
+	return fixedFee
+}
+
+// anchorScript is the P2WSH script of party's anchor output.
+func anchorScript(state *State, party string) ([]byte, []byte, error) {
+	pub, err := hex.DecodeString(state.key(party).PubKey)
 	if err != nil {
-		return fmt.Errorf("cannot read state file: %v", err)
+		return nil, nil, fmt.Errorf("invalid %s pubkey: %v", party, err)
 	}
-	var state State
-	if err := json.Unmarshal(data, &state); err != nil {
-		return fmt.Errorf("invalid JSON: %v", err)
+	witnessScript, err := scripts.AnchorScript(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkScript, err := p2wshScript(witnessScript)
+	if err != nil {
+		return nil, nil, err
 	}
+	return witnessScript, pkScript, nil
+}
 
-	// update channel balances
-	if state.Channel == nil {
-		return fmt.Errorf("channel is not initialized")
+// toRemoteScript is the to_remote output paying party: P2WPKH, or on a
+// channel with anchors P2WSH of a script spendable after one confirmation,
+// whose witness script is returned too.
+func toRemoteScript(state *State, party string) ([]byte, []byte, error) {
+	if !policyOf(state).Anchors {
+		pkScript, err := p2wpkhScript(state.key(party).PubKey)
+		return nil, pkScript, err
 	}
-	state.Channel.AliceBalance = aliceBalance
-	state.Channel.BobBalance = bobBalance
+	pub, err := hex.DecodeString(state.key(party).PubKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s pubkey: %v", party, err)
+	}
+	witnessScript, err := scripts.ToRemoteScript(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkScript, err := p2wshScript(witnessScript)
+	if err != nil {
+		return nil, nil, err
+	}
+	return witnessScript, pkScript, nil
+}
 
-	fmt.Printf("Set ChannelState: Alice=%.8f BTC, Bob=%.8f BTC\n", aliceBalance, bobBalance)
+// buildCommitment creates holder's version of commitment n. The holder's
+// balance goes to a revocable, CSV-delayed to_local output, the other
+// party's balance to a to_remote output, and every HTLC that is not trimmed
+// to an output of its own. Balances below the channel's dust limit are
+// trimmed too. On a channel with anchors to_remote is locked for one block
+// and each party with an output, or any HTLC pending, also gets an anchor
+// keyed to its funding key.
+func buildCommitment(state *State, holder string, n int, aliceSat, bobSat int64, htlcs []ChannelHTLC, htlcFeeRate int64) (*wire.MsgTx, error) {
+	tx := wire.NewMsgTx(2) // CSV needs version 2
 
-	// amounts
-	totalAmount := int64(state.HTLC.Amount * 1e8)
-	fee := int64(500)
+	// input (from HTLC UTXO)
+	hash, err := chainhash.NewHashFromStr(state.HTLC.Txid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTLC txid: %v", err)
+	}
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, state.HTLC.Vout), nil, nil))
 
-	aliceAmountSat := int64(aliceBalance * 1e8)
-	bobAmountSat := int64(bobBalance*1e8) - fee
+	// state number, readable by both parties from the tx alone
+	factor, err := obscuringFactor(state)
+	if err != nil {
+		return nil, err
+	}
+	encodeStateNumber(tx, n, factor)
 
-	if aliceAmountSat+bobAmountSat+fee != totalAmount {
-		return fmt.Errorf("alice + bob + fee mismatch with HTLC amount")
+	localSat, remoteSat := aliceSat, bobSat
+	if holder == "bob" {
+		localSat, remoteSat = bobSat, aliceSat
 	}
+	policy := policyOf(state)
+	dust := policy.DustLimitSat
 
-	// build commitment tx
-	tx := wire.NewMsgTx(wire.TxVersion)
+	// to_local
+	if localSat >= dust {
+		witnessScript, err := toLocalScript(state, holder, n)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build to_local script: %v", err)
+		}
+		pkScript, err := p2wshScript(witnessScript)
+		if err != nil {
+			return nil, err
+		}
+		tx.AddTxOut(wire.NewTxOut(localSat, pkScript))
+	}
 
-	// input (from HTLC UTXO)
-	hash, err := chainhash.NewHashFromStr(state.HTLC.Txid)
-	if err != nil {
-		return fmt.Errorf("invalid HTLC txid: %v", err)
+	// to_remote
+	if remoteSat >= dust {
+		_, pkScript, err := toRemoteScript(state, counterparty(holder))
+		if err != nil {
+			return nil, fmt.Errorf("failed to build to_remote script: %v", err)
+		}
+		tx.AddTxOut(wire.NewTxOut(remoteSat, pkScript))
 	}
-	txIn := wire.NewTxIn(wire.NewOutPoint(hash, state.HTLC.Vout), nil, nil)
-	tx.AddTxIn(txIn)
 
-	// Bob output
-	bobAddr, _ := btcutil.DecodeAddress(state.Bob.Address, &chaincfg.RegressionNetParams)
-	bobScript, _ := txscript.PayToAddrScript(bobAddr)
-	tx.AddTxOut(wire.NewTxOut(bobAmountSat, bobScript))
+	// offered and received HTLCs
+	outs, err := htlcOutputs(state, holder, n, htlcs, htlcFeeRate)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range outs {
+		tx.AddTxOut(wire.NewTxOut(o.amount, o.pkScript))
+	}
 
-	// Alice output
-	aliceAddr, _ := btcutil.DecodeAddress(state.Alice.Address, &chaincfg.RegressionNetParams)
-	aliceScript, _ := txscript.PayToAddrScript(aliceAddr)
-	tx.AddTxOut(wire.NewTxOut(aliceAmountSat, aliceScript))
+	// anchors; one that is left out goes to fees
+	if policy.Anchors {
+		for _, a := range []struct {
+			party  string
+			hasOut bool
+		}{{holder, localSat >= dust}, {counterparty(holder), remoteSat >= dust}} {
+			if !a.hasOut && len(outs) == 0 {
+				continue
+			}
+			_, pkScript, err := anchorScript(state, a.party)
+			if err != nil {
+				return nil, err
+			}
+			tx.AddTxOut(wire.NewTxOut(anchorSat, pkScript))
+		}
+	}
 
 	// OP_RETURN with latest balances
-	opReturnData := fmt.Sprintf("alice:%.8f,bob:%.8f", aliceBalance, bobBalance)
+	opReturnData := fmt.Sprintf("alice:%.8f,bob:%.8f", float64(aliceSat)/1e8, float64(bobSat+commitmentFee(state))/1e8)
 	opReturnScript, err := txscript.NullDataScript([]byte(opReturnData))
 	if err != nil {
-		return fmt.Errorf("failed to build OP_RETURN script: %v", err)
+		return nil, fmt.Errorf("failed to build OP_RETURN script: %v", err)
 	}
 	tx.AddTxOut(wire.NewTxOut(0, opReturnScript))
 
-	// serialize
+	return tx, nil
+}
+
+func serializeTx(tx *wire.MsgTx) (string, error) {
 	var buf bytes.Buffer
 	if err := tx.Serialize(&buf); err != nil {
-		return fmt.Errorf("tx serialization failed: %v", err)
+		return "", fmt.Errorf("tx serialization failed: %v", err)
 	}
-	rawTx := hex.EncodeToString(buf.Bytes())
-
-	fmt.Println("Unsigned Commitment Transaction (hex):", rawTx)
+	return hex.EncodeToString(buf.Bytes()), nil
+}
 
-	// store to file for signing
-	if err := os.WriteFile("data/commit-unsigned.txt", []byte(rawTx), 0644); err != nil {
-		return fmt.Errorf("failed to write commit tx: %v", err)
+func CreateCommitmentTx(stateFile string, aliceBalance float64, bobBalance float64) error {
+	// read current state; the version is checked again when saving
+	var state State
+	snap, err := statefile.Load(stateFile, &state)
+	if err != nil {
+		return fmt.Errorf("cannot read state file: %v", err)
 	}
 
-	// update state with *latest* commitment only
-	state.Commitments = []Commitment{{
-		ID:           1,
-		AliceBalance: aliceBalance,
-		BobBalance:   bobBalance,
-		SignedTx:     rawTx,
-		Timestamp:    time.Now().Format(time.RFC3339),
-	}}
-	updated, _ := json.MarshalIndent(state, "", "  ")
-	_ = os.WriteFile(stateFile, updated, 0644)
+	// update channel balances
+	if state.Channel == nil {
+		return fmt.Errorf("channel is not initialized")
+	}
+	if err := RequireStatus(&state, StatusPendingOpen, StatusFundingBroadcast, StatusOpen); err != nil {
+		return err
+	}
+	state.Channel.AliceBalance = aliceBalance
+	state.Channel.BobBalance = bobBalance
 
-	fmt.Println("Stored latest commitment with OP_RETURN attached")
+	fmt.Printf("Set ChannelState: Alice=%.8f BTC, Bob=%.8f BTC\n", aliceBalance, bobBalance)
 
+	if _, err := addCommitment(&state); err != nil {
+		return err
+	}
+	if err := statefile.Save(stateFile, snap, &state); err != nil {
+		return fmt.Errorf("failed to save commitment: %w", err)
+	}
 	return nil
 }
+
+// addCommitment builds both versions of the next commitment from the
+// channel balances and pending HTLCs and appends it to the history.
+func addCommitment(state *State) (int, error) {
+	// commitments on the new funding output only hold if the splice
+	// confirms, so the balances stay put until it does or is aborted
+	if s := state.Channel.Splice; s.Pending() {
+		return 0, fmt.Errorf("splice %s has not confirmed yet, wait for it or run splice abort", s.Txid)
+	}
+	// amounts
+	totalAmount := toSat(state.HTLC.Amount)
+	fee := commitmentFee(state)
+
+	aliceAmountSat := toSat(state.Channel.AliceBalance)
+	bobAmountSat := toSat(state.Channel.BobBalance) - fee
+	var htlcSat int64
+	for _, h := range state.Channel.HTLCs {
+		htlcSat += toSat(h.Amount)
+	}
+
+	if aliceAmountSat+bobAmountSat+htlcSat+fee != totalAmount {
+		return 0, fmt.Errorf("alice + bob + HTLCs + fee mismatch with HTLC amount")
+	}
+	if err := checkPolicy(state, aliceAmountSat, bobAmountSat, state.Channel.HTLCs); err != nil {
+		return 0, err
+	}
+
+	if err := ensureRevocation(state); err != nil {
+		return 0, fmt.Errorf("failed to create commitment secrets: %v", err)
+	}
+	n := NextCommitmentNumber(state)
+	htlcs := append([]ChannelHTLC(nil), state.Channel.HTLCs...)
+	htlcFeeRate := appConfig.Fees.FeeRateSatVB
+
+	// one version of the commitment per holder
+	rawTxs := map[string]string{}
+	for _, holder := range []string{"alice", "bob"} {
+		tx, err := buildCommitment(state, holder, n, aliceAmountSat, bobAmountSat, htlcs, htlcFeeRate)
+		if err != nil {
+			return 0, err
+		}
+		rawTx, err := serializeTx(tx)
+		if err != nil {
+			return 0, err
+		}
+		rawTxs[holder] = rawTx
+
+		fmt.Printf("Unsigned %s commitment #%d (hex): %s\n", holder, n, rawTx)
+	}
+
+	state.Commitments = append(state.Commitments, Commitment{
+		ID:           n,
+		AliceBalance: state.Channel.AliceBalance,
+		BobBalance:   state.Channel.BobBalance,
+		AliceTx:      rawTxs["alice"],
+		BobTx:        rawTxs["bob"],
+		HTLCs:        htlcs,
+		HTLCFeeRate:  htlcFeeRate,
+		Timestamp:    time.Now().Format(time.RFC3339),
+	})
+
+	if n > 0 {
+		fmt.Printf("Stored commitment #%d, signing it revokes #%d\n", n, n-1)
+	} else {
+		fmt.Println("Stored commitment #0")
+	}
+	return n, nil
+}
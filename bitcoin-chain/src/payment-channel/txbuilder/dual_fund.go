@@ -0,0 +1,549 @@
+package txbuilder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"example.com/utils/rpc"
+	"example.com/utils/txverify"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// A dual-funded channel is opened with the interactive transaction
+// construction of BOLT #2: both parties add inputs and outputs to the
+// funding tx in turn, sign the first commitments, and only then sign their
+// own inputs. Every input is P2WPKH, so the txid the commitments spend is
+// fixed before anyone signs the funding tx.
+
+// InteractiveInput is an input one party adds to the funding tx. Bob, who
+// opens the channel, uses even serial IDs and Alice odd ones; the tx lists
+// inputs and outputs by serial ID.
+type InteractiveInput struct {
+	SerialID  uint64 `json:"serialId"`
+	Txid      string `json:"txid"`
+	Vout      uint32 `json:"vout"`
+	AmountSat int64  `json:"amountSat"`
+	PkScript  string `json:"pkScript"`
+}
+
+type InteractiveOutput struct {
+	SerialID  uint64 `json:"serialId"`
+	AmountSat int64  `json:"amountSat"`
+	PkScript  string `json:"pkScript"`
+}
+
+// InteractiveTx is the funding tx as the parties build it.
+type InteractiveTx struct {
+	Inputs  []InteractiveInput
+	Outputs []InteractiveOutput
+}
+
+// maxInteractiveItems bounds the inputs, and the outputs, of one funding tx.
+const maxInteractiveItems = 64
+
+func serialOwner(id uint64) string {
+	if id%2 == 0 {
+		return "bob"
+	}
+	return "alice"
+}
+
+// AddInput adds an input of party from, refusing serial IDs that are not
+// its own or already used and inputs that are not P2WPKH.
+func (t *InteractiveTx) AddInput(from string, in InteractiveInput) error {
+	if serialOwner(in.SerialID) != from {
+		return fmt.Errorf("%s cannot use serial ID %d", from, in.SerialID)
+	}
+	if len(t.Inputs) >= maxInteractiveItems {
+		return fmt.Errorf("more than %d inputs", maxInteractiveItems)
+	}
+	for _, o := range t.Inputs {
+		if o.SerialID == in.SerialID {
+			return fmt.Errorf("serial ID %d used twice", in.SerialID)
+		}
+		if o.Txid == in.Txid && o.Vout == in.Vout {
+			return fmt.Errorf("input %s:%d added twice", in.Txid, in.Vout)
+		}
+	}
+	if _, err := chainhash.NewHashFromStr(in.Txid); err != nil {
+		return fmt.Errorf("invalid txid %s: %v", in.Txid, err)
+	}
+	script, err := hex.DecodeString(in.PkScript)
+	if err != nil || !txscript.IsPayToWitnessPubKeyHash(script) {
+		return fmt.Errorf("input %s:%d is not P2WPKH", in.Txid, in.Vout)
+	}
+	if in.AmountSat <= 0 {
+		return fmt.Errorf("input %s:%d has no value", in.Txid, in.Vout)
+	}
+	t.Inputs = append(t.Inputs, in)
+	return nil
+}
+
+// AddOutput adds an output of party from, refusing serial IDs that are not
+// its own or already used and dust.
+func (t *InteractiveTx) AddOutput(from string, out InteractiveOutput) error {
+	if serialOwner(out.SerialID) != from {
+		return fmt.Errorf("%s cannot use serial ID %d", from, out.SerialID)
+	}
+	if len(t.Outputs) >= maxInteractiveItems {
+		return fmt.Errorf("more than %d outputs", maxInteractiveItems)
+	}
+	for _, o := range t.Outputs {
+		if o.SerialID == out.SerialID {
+			return fmt.Errorf("serial ID %d used twice", out.SerialID)
+		}
+	}
+	script, err := hex.DecodeString(out.PkScript)
+	if err != nil {
+		return fmt.Errorf("invalid output script: %v", err)
+	}
+	if mempool.IsDust(wire.NewTxOut(out.AmountSat, script), mempool.DefaultMinRelayTxFee) {
+		return fmt.Errorf("output %d of %d sat is dust", out.SerialID, out.AmountSat)
+	}
+	t.Outputs = append(t.Outputs, out)
+	return nil
+}
+
+// Build returns the unsigned tx, inputs and outputs in serial ID order, and
+// the outputs its inputs spend.
+func (t *InteractiveTx) Build() (*wire.MsgTx, map[wire.OutPoint]*wire.TxOut, error) {
+	inputs := append([]InteractiveInput(nil), t.Inputs...)
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].SerialID < inputs[j].SerialID })
+	outputs := append([]InteractiveOutput(nil), t.Outputs...)
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].SerialID < outputs[j].SerialID })
+
+	tx := wire.NewMsgTx(2)
+	prevOuts := map[wire.OutPoint]*wire.TxOut{}
+	for _, in := range inputs {
+		hash, err := chainhash.NewHashFromStr(in.Txid)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid txid %s: %v", in.Txid, err)
+		}
+		script, err := hex.DecodeString(in.PkScript)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid input script: %v", err)
+		}
+		op := wire.NewOutPoint(hash, in.Vout)
+		tx.AddTxIn(wire.NewTxIn(op, nil, nil))
+		prevOuts[*op] = wire.NewTxOut(in.AmountSat, script)
+	}
+	for _, out := range outputs {
+		script, err := hex.DecodeString(out.PkScript)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid output script: %v", err)
+		}
+		tx.AddTxOut(wire.NewTxOut(out.AmountSat, script))
+	}
+	return tx, prevOuts, nil
+}
+
+// Weights for the funding fee. A P2WPKH input is 41 bytes with a witness
+// of at most 108 weight units; an output is 9 bytes and its script. The
+// version, locktime, counts and segwit marker are paid by Bob, who opens
+// the channel.
+const (
+	p2wpkhInputWeight     = 4*41 + 108
+	fundingTxCommonWeight = 4*10 + 2
+)
+
+func outputWeight(pkScript []byte) int64 {
+	return 4 * int64(9+len(pkScript))
+}
+
+// fundingFee is what feeRate sat/vB comes to for weight weight units.
+func fundingFee(feeRate, weight int64) int64 {
+	return (feeRate*weight + 3) / 4
+}
+
+// weightOf is the weight party's inputs and outputs add to the tx, plus
+// the common fields for Bob.
+func (t *InteractiveTx) weightOf(party string) int64 {
+	var w int64
+	if party == "bob" {
+		w = fundingTxCommonWeight
+	}
+	for _, in := range t.Inputs {
+		if serialOwner(in.SerialID) == party {
+			w += p2wpkhInputWeight
+		}
+	}
+	for _, out := range t.Outputs {
+		if serialOwner(out.SerialID) == party {
+			script, _ := hex.DecodeString(out.PkScript)
+			w += outputWeight(script)
+		}
+	}
+	return w
+}
+
+// paidBy is what party puts into the tx: its inputs less its outputs other
+// than the funding output.
+func (t *InteractiveTx) paidBy(party string, fundingScript string) int64 {
+	var sat int64
+	for _, in := range t.Inputs {
+		if serialOwner(in.SerialID) == party {
+			sat += in.AmountSat
+		}
+	}
+	for _, out := range t.Outputs {
+		if serialOwner(out.SerialID) == party && out.PkScript != fundingScript {
+			sat -= out.AmountSat
+		}
+	}
+	return sat
+}
+
+// ProposeDualFundedPolicy is the policy Bob proposes for a dual-funded
+// channel he puts amountSat into. Only its dust and in-flight limits
+// count; DualFundedPolicy sets the reserves once the capacity is known.
+func ProposeDualFundedPolicy(amountSat int64) *ChannelPolicy {
+	p := derivePolicy(amountSat)
+	// the capacity is not known yet, a limit of 0 becomes the capacity
+	p.MaxHTLCInFlightSat = nodePolicy().MaxHTLCInFlightSat
+	return p
+}
+
+// DualFundedPolicy is the policy of a dual-funded channel of capacitySat:
+// the dust and in-flight limits Bob proposed, and both reserves at 1% of
+// the capacity as BOLT #2 fixes them, so neither side has to propose one.
+func DualFundedPolicy(proposed *ChannelPolicy, capacitySat int64) (*ChannelPolicy, error) {
+	if proposed == nil {
+		return nil, fmt.Errorf("no channel policy proposed")
+	}
+	if min := nodePolicy().MinChannelSat; capacitySat < min {
+		return nil, fmt.Errorf("channel of %d sat is below the minimum channel size of %d sat", capacitySat, min)
+	}
+	p := *proposed
+	reserve := max(capacitySat/100, p.DustLimitSat)
+	p.AliceReserveSat, p.BobReserveSat = reserve, reserve
+	if p.MaxHTLCInFlightSat <= 0 || p.MaxHTLCInFlightSat > capacitySat {
+		p.MaxHTLCInFlightSat = capacitySat
+	}
+	return &p, nil
+}
+
+// maxFundingFeeRateFactor is how far above our own estimate a funding fee
+// rate the opener proposes may be.
+const maxFundingFeeRateFactor = 4
+
+// FundingFeeRate is the fee rate in sat/vB Bob proposes for a dual-funded
+// funding tx: the node's estimate, or the configured rate without one.
+func FundingFeeRate() int64 {
+	return sweepFeeRate(rpc.New(appConfig.RPC))
+}
+
+// AcceptFundingFeeRate checks the fee rate Bob proposed, which Alice pays
+// for her own inputs and outputs.
+func AcceptFundingFeeRate(feeRate int64) error {
+	if feeRate < 1 {
+		return fmt.Errorf("funding fee rate of %d sat/vB is below the relay minimum", feeRate)
+	}
+	if ours := FundingFeeRate(); feeRate > maxFundingFeeRateFactor*ours {
+		return fmt.Errorf("funding fee rate of %d sat/vB is more than %d times our estimate of %d sat/vB", feeRate, maxFundingFeeRateFactor, ours)
+	}
+	return nil
+}
+
+// DualFundContribution is what this node adds to a dual-funded channel a
+// peer opens with it.
+func DualFundContribution() int64 {
+	return nodePolicy().ContributeSat
+}
+
+// SetupDualFunding is SetupFunding for a channel both parties put money
+// into; each starts out owning what it put in.
+func SetupDualFunding(state *State, aliceSat, bobSat int64, policy *ChannelPolicy) error {
+	if aliceSat < 0 || bobSat <= 0 {
+		return fmt.Errorf("invalid contributions: alice %d sat, bob %d sat", aliceSat, bobSat)
+	}
+	if err := SetupFunding(state, aliceSat+bobSat, policy); err != nil {
+		return err
+	}
+	state.Channel.AliceBalance = float64(aliceSat) / 1e8
+	state.Channel.BobBalance = float64(bobSat) / 1e8
+	return nil
+}
+
+// FundingContribution picks unreserved outputs of our wallet's P2WPKH
+// address to put amountSat into the funding tx, plus feeRate sat/vB for
+// the weight of what we add, with the change going back there, and
+// reserves them for the channel. Bob also adds the funding output itself.
+// Nothing is added for an amount of 0.
+func FundingContribution(state *State, amountSat, feeRate int64) ([]InteractiveInput, []InteractiveOutput, error) {
+	if state.Self == "" {
+		return nil, nil, fmt.Errorf("state is not a peer node state")
+	}
+	next := uint64(0)
+	if state.Self == "alice" {
+		next = 1
+	}
+	serial := func() uint64 {
+		id := next
+		next += 2
+		return id
+	}
+
+	f, err := state.funding()
+	if err != nil {
+		return nil, nil, err
+	}
+	fundingScript, err := f.pkScript()
+	if err != nil {
+		return nil, nil, err
+	}
+	var outputs []InteractiveOutput
+	if state.Self == "bob" {
+		outputs = append(outputs, InteractiveOutput{SerialID: serial(), AmountSat: f.amount, PkScript: hex.EncodeToString(fundingScript)})
+	}
+	if amountSat == 0 {
+		return nil, outputs, nil
+	}
+
+	wallet := state.walletKey(state.Self)
+	utxos, pkScript, err := scanP2WPKH(rpc.New(appConfig.RPC), wallet.PubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(utxos, func(i, j int) bool { return utxos[i].Amount > utxos[j].Amount })
+	// the weight so far: the funding output and common fields for Bob, and
+	// a change output
+	weight := outputWeight(pkScript)
+	if state.Self == "bob" {
+		weight += fundingTxCommonWeight
+		for _, out := range outputs {
+			script, _ := hex.DecodeString(out.PkScript)
+			weight += outputWeight(script)
+		}
+	}
+	need := amountSat + fundingFee(feeRate, weight)
+	var inputs []InteractiveInput
+	var amountIn int64
+	_, err = reserveUTXOs(wallet.Address, fundingOwner(fundingScript), utxos, func(free []UnspentOutput) ([]UnspentOutput, error) {
+		var picked []UnspentOutput
+		for _, u := range free {
+			if amountIn >= need {
+				break
+			}
+			weight += p2wpkhInputWeight
+			need = amountSat + fundingFee(feeRate, weight)
+			inputs = append(inputs, InteractiveInput{
+				SerialID:  serial(),
+				Txid:      u.TxID,
+				Vout:      u.Vout,
+				AmountSat: toSat(u.Amount),
+				PkScript:  u.ScriptPubKey,
+			})
+			amountIn += toSat(u.Amount)
+			picked = append(picked, u)
+		}
+		if amountIn < need {
+			return nil, fmt.Errorf("insufficient unreserved P2WPKH funds (need %d, have %d)", need, amountIn)
+		}
+		return picked, nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if change := wire.NewTxOut(amountIn-need, pkScript); !mempool.IsDust(change, mempool.DefaultMinRelayTxFee) {
+		outputs = append(outputs, InteractiveOutput{SerialID: serial(), AmountSat: change.Value, PkScript: hex.EncodeToString(pkScript)})
+	}
+	return inputs, outputs, nil
+}
+
+// scanP2WPKH returns the unspent outputs paying pubKey's P2WPKH script,
+// and that script.
+func scanP2WPKH(client *rpc.Client, pubKey string) ([]UnspentOutput, []byte, error) {
+	pkScript, err := p2wpkhScript(pubKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := client.Call("scantxoutset", "start", []string{"wpkh(" + pubKey + ")"})
+	if err != nil {
+		return nil, nil, fmt.Errorf("scantxoutset failed: %v", err)
+	}
+	var scan ScanTxOutResult
+	if err := json.Unmarshal(raw, &scan); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode scantxoutset result: %v", err)
+	}
+	var utxos []UnspentOutput
+	for _, u := range scan.Unspents {
+		if script, err := hex.DecodeString(u.ScriptPubKey); err == nil && bytes.Equal(script, pkScript) {
+			utxos = append(utxos, u)
+		}
+	}
+	return utxos, pkScript, nil
+}
+
+// CompleteFundingTx checks the funding tx both parties built: one output
+// pays the channel its capacity, the counterparty's inputs are unspent
+// outputs with the amount and script it claims, and each party's inputs
+// cover what it put in plus feeRate sat/vB for the weight of its own inputs
+// and outputs. It records the funding outpoint and returns the unsigned tx
+// with the outputs its inputs spend. It runs before any commitment is
+// signed, so a peer lying about its inputs gets no signature.
+func CompleteFundingTx(state *State, t *InteractiveTx, feeRate int64) (*wire.MsgTx, map[wire.OutPoint]*wire.TxOut, error) {
+	f, err := state.funding()
+	if err != nil {
+		return nil, nil, err
+	}
+	pkScript, err := f.pkScript()
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, prevOuts, err := t.Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	vout := -1
+	for i, out := range tx.TxOut {
+		if !bytes.Equal(out.PkScript, pkScript) {
+			continue
+		}
+		if vout >= 0 {
+			return nil, nil, fmt.Errorf("funding tx pays the channel twice")
+		}
+		vout = i
+	}
+	if vout < 0 {
+		return nil, nil, fmt.Errorf("funding tx does not pay the channel")
+	}
+	if tx.TxOut[vout].Value != f.amount {
+		return nil, nil, fmt.Errorf("funding output of %d sat, the channel has %d sat", tx.TxOut[vout].Value, f.amount)
+	}
+
+	if err := checkRemoteInputs(rpc.New(appConfig.RPC), t.ownInputs(counterparty(state.Self))); err != nil {
+		return nil, nil, err
+	}
+
+	contributions := map[string]int64{
+		"alice": toSat(state.Channel.AliceBalance),
+		"bob":   toSat(state.Channel.BobBalance),
+	}
+	for _, party := range []string{"alice", "bob"} {
+		owed := contributions[party] + fundingFee(feeRate, t.weightOf(party))
+		if paid := t.paidBy(party, hex.EncodeToString(pkScript)); paid < owed {
+			return nil, nil, fmt.Errorf("%s's inputs put %d sat into the funding tx, it owes %d sat", party, paid, owed)
+		}
+	}
+
+	state.HTLC.Txid = tx.TxHash().String()
+	state.HTLC.Vout = uint32(vout)
+	return tx, prevOuts, nil
+}
+
+// checkRemoteInputs makes sure every input the counterparty added spends
+// an unspent output with the amount and script it gave.
+func checkRemoteInputs(client *rpc.Client, inputs []InteractiveInput) error {
+	for _, in := range inputs {
+		out, err := client.GetTxOut(in.Txid, in.Vout)
+		if err != nil {
+			return fmt.Errorf("failed to look up input %s:%d: %v", in.Txid, in.Vout, err)
+		}
+		if out == nil {
+			return fmt.Errorf("input %s:%d is spent or does not exist", in.Txid, in.Vout)
+		}
+		if amount := toSat(out.Value); amount != in.AmountSat {
+			return fmt.Errorf("input %s:%d holds %d sat, not %d sat", in.Txid, in.Vout, amount, in.AmountSat)
+		}
+		if !strings.EqualFold(out.ScriptPubKey.Hex, in.PkScript) {
+			return fmt.Errorf("input %s:%d pays %s, not %s", in.Txid, in.Vout, out.ScriptPubKey.Hex, in.PkScript)
+		}
+	}
+	return nil
+}
+
+// inputIndex is where in tx the input spends.
+func inputIndex(tx *wire.MsgTx, in InteractiveInput) (int, error) {
+	for i, txIn := range tx.TxIn {
+		op := txIn.PreviousOutPoint
+		if op.Hash.String() == in.Txid && op.Index == in.Vout {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("input %s:%d is not in the funding tx", in.Txid, in.Vout)
+}
+
+// ownInputs are party's inputs of t in serial ID order, the order
+// tx_signatures carries their witnesses in.
+func (t *InteractiveTx) ownInputs(party string) []InteractiveInput {
+	var inputs []InteractiveInput
+	for _, in := range t.Inputs {
+		if serialOwner(in.SerialID) == party {
+			inputs = append(inputs, in)
+		}
+	}
+	sort.Slice(inputs, func(i, j int) bool { return inputs[i].SerialID < inputs[j].SerialID })
+	return inputs
+}
+
+// SignFundingInputs signs our inputs of the funding tx and returns their
+// witnesses, hex items in serial ID order.
+func SignFundingInputs(state *State, t *InteractiveTx, tx *wire.MsgTx, prevOuts map[wire.OutPoint]*wire.TxOut) ([][]string, error) {
+	priv, err := privFromHex(state.walletKey(state.Self).PrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s privkey: %v", state.Self, err)
+	}
+	fetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
+	var witnesses [][]string
+	for _, in := range t.ownInputs(state.Self) {
+		i, err := inputIndex(tx, in)
+		if err != nil {
+			return nil, err
+		}
+		if err := signWalletInput(tx, i, fetcher, priv); err != nil {
+			return nil, err
+		}
+		var items []string
+		for _, item := range tx.TxIn[i].Witness {
+			items = append(items, hex.EncodeToString(item))
+		}
+		witnesses = append(witnesses, items)
+	}
+	return witnesses, nil
+}
+
+// AddFundingWitnesses puts the counterparty's witnesses on its inputs of
+// the funding tx.
+func AddFundingWitnesses(state *State, t *InteractiveTx, tx *wire.MsgTx, witnesses [][]string) error {
+	inputs := t.ownInputs(counterparty(state.Self))
+	if len(witnesses) != len(inputs) {
+		return fmt.Errorf("%d witnesses for %d inputs", len(witnesses), len(inputs))
+	}
+	for k, in := range inputs {
+		i, err := inputIndex(tx, in)
+		if err != nil {
+			return err
+		}
+		var witness wire.TxWitness
+		for _, item := range witnesses[k] {
+			b, err := hex.DecodeString(item)
+			if err != nil {
+				return fmt.Errorf("invalid witness for %s:%d: %v", in.Txid, in.Vout, err)
+			}
+			witness = append(witness, b)
+		}
+		tx.TxIn[i].Witness = witness
+	}
+	return nil
+}
+
+// FinishFundingTx verifies every input of the fully signed funding tx and
+// keeps it in the state for BroadcastFundingTx.
+func FinishFundingTx(state *State, tx *wire.MsgTx, prevOuts map[wire.OutPoint]*wire.TxOut) error {
+	if err := txverify.Verify(tx, prevOuts, txverify.UnknownHeight); err != nil {
+		return fmt.Errorf("funding tx rejected: %v", err)
+	}
+	txHex, err := serializeTx(tx)
+	if err != nil {
+		return err
+	}
+	state.HTLC.SignedTx = txHex
+	return nil
+}
@@ -0,0 +1,365 @@
+package txbuilder
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"example.com/m/revocation"
+	"example.com/utils/rpc"
+	"example.com/utils/statefile"
+	"example.com/utils/txverify"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// sweepConfTarget is the confirmation target asked of estimatesmartfee.
+const sweepConfTarget = 6
+
+// latestSigned returns the newest commitment both parties have signed and
+// neither has revoked, or nil.
+func latestSigned(state *State) *Commitment {
+	for i := len(state.Commitments) - 1; i >= 0; i-- {
+		c := &state.Commitments[i]
+		if c.signed(state.Self) && !c.Revoked {
+			return c
+		}
+	}
+	return nil
+}
+
+// sweepFeeRate asks the node for a fee rate and falls back to the
+// configured one when it has no estimate.
+func sweepFeeRate(client *rpc.Client) int64 {
+	rate, err := client.EstimateFeeRate(sweepConfTarget)
+	if err != nil {
+		fmt.Printf("No fee estimate (%v), using %d sat/vB\n", err, appConfig.Fees.FeeRateSatVB)
+		return appConfig.Fees.FeeRateSatVB
+	}
+	return rate
+}
+
+// BuildSweepTx spends holder's to_local output of its commitment n through
+// the delayed branch once to_self_delay blocks have passed. It returns nil
+// if the commitment has no to_local output.
+func BuildSweepTx(state *State, holder string, n int, commitTx *wire.MsgTx, feeRate int64) (*wire.MsgTx, error) {
+	local, _, err := state.Revocation.parties(holder)
+	if err != nil {
+		return nil, err
+	}
+	witnessScript, err := toLocalScript(state, holder, n)
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := p2wshScript(witnessScript)
+	if err != nil {
+		return nil, err
+	}
+	idx := -1
+	for i, out := range commitTx.TxOut {
+		if bytes.Equal(out.PkScript, pkScript) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, nil
+	}
+	prev := commitTx.TxOut[idx]
+
+	point, err := local.point(n)
+	if err != nil {
+		return nil, err
+	}
+	delayedBase, err := privFromHex(local.DelayedBaseSecret)
+	if err != nil {
+		return nil, err
+	}
+	delayedPriv := revocation.DerivePrivKey(delayedBase, point)
+
+	key := state.key(holder)
+	destAddr, err := btcutil.DecodeAddress(key.Address, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s address: %v", holder, err)
+	}
+	destScript, err := txscript.PayToAddrScript(destAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	commitHash := commitTx.TxHash()
+	op := wire.NewOutPoint(&commitHash, uint32(idx))
+	tx := wire.NewMsgTx(2) // CSV needs version 2
+	in := wire.NewTxIn(op, nil, nil)
+	in.Sequence = uint32(state.Revocation.ToSelfDelay)
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(prev.Value, destScript))
+
+	prevOuts := map[wire.OutPoint]*wire.TxOut{*op: prev}
+	fetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
+	sign := func() error {
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		sig, err := txscript.RawTxInWitnessSignature(tx, sigHashes, 0, prev.Value, witnessScript, txscript.SigHashAll, delayedPriv)
+		if err != nil {
+			return fmt.Errorf("failed to sign to_local: %v", err)
+		}
+		// <delayed_sig> <> <witnessScript> takes the OP_ELSE branch
+		in.Witness = wire.TxWitness{sig, nil, witnessScript}
+		return nil
+	}
+
+	// sign once to learn the size, then again with the fee taken off
+	if err := sign(); err != nil {
+		return nil, err
+	}
+	vsize := (blockchain.GetTransactionWeight(btcutil.NewTx(tx)) + 3) / 4
+	fee := feeRate * vsize
+	tx.TxOut[0].Value = prev.Value - fee
+	if tx.TxOut[0].Value <= 0 || mempool.IsDust(tx.TxOut[0], mempool.DefaultMinRelayTxFee) {
+		return nil, fmt.Errorf("to_local output (%d sat) does not cover a %d sat fee", prev.Value, fee)
+	}
+	if err := sign(); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Sweep fee: %d sat (%d vB at %d sat/vB)\n", fee, vsize, feeRate)
+
+	if err := txverify.Verify(tx, prevOuts, txverify.UnknownHeight); err != nil {
+		return nil, fmt.Errorf("sweep tx rejected: %v", err)
+	}
+	return tx, nil
+}
+
+// startForceClose broadcasts holder's latest signed commitment and records
+// the close in state, or returns the close already in progress. On a
+// channel with anchors the close is recorded even if the mempool turns the
+// commitment away, so channel bump can submit it with a child.
+func startForceClose(statePath, holder string) (ForceClose, error) {
+	var state State
+	var fc ForceClose
+	err := statefile.Update(statePath, &state, func() error {
+		if state.Channel == nil || state.Revocation == nil {
+			return fmt.Errorf("channel has no revocable commitments")
+		}
+		if existing := state.Channel.ForceClose; existing != nil {
+			if existing.Holder != holder {
+				return fmt.Errorf("channel is being force-closed by %s", existing.Holder)
+			}
+			fc = *existing
+			return nil
+		}
+		if StatusOf(&state) == StatusClosed {
+			return fmt.Errorf("channel already closed by %s", state.Channel.ClosingTxid)
+		}
+		if err := RequireStatus(&state, StatusFundingBroadcast, StatusOpen, StatusShuttingDown, StatusClosingSigned); err != nil {
+			return err
+		}
+
+		c := latestSigned(&state)
+		if c == nil {
+			return fmt.Errorf("no fully signed commitment to broadcast")
+		}
+		txHex := c.AliceSignedTx
+		if holder == "bob" {
+			txHex = c.BobSignedTx
+		}
+		txid, err := broadcastTx(txHex, "force-close")
+		switch {
+		case err == nil:
+			fmt.Printf("Broadcast %s commitment #%d: %s\n", holder, c.ID, txid)
+		case policyOf(&state).Anchors:
+			commitTx, decodeErr := decodeTx(txHex)
+			if decodeErr != nil {
+				return decodeErr
+			}
+			txid = commitTx.TxHash().String()
+			fmt.Printf("Commitment #%d (%s) was not accepted: %v\nRun channel bump to submit it with a fee-bump child\n", c.ID, txid, err)
+		default:
+			return fmt.Errorf("commitment broadcast failed: %v", err)
+		}
+
+		fc = ForceClose{
+			Holder:      holder,
+			Commitment:  c.ID,
+			Txid:        txid,
+			BroadcastAt: time.Now().Format(time.RFC3339),
+		}
+		if err := setStatus(&state, StatusForceClosing); err != nil {
+			return err
+		}
+		state.Channel.ForceClose = &fc
+		state.Channel.ClosingTxid = txid
+		state.Channel.AliceBalance = c.AliceBalance
+		state.Channel.BobBalance = c.BobBalance
+		return nil
+	})
+	return fc, err
+}
+
+func updateForceClose(statePath string, fn func(fc *ForceClose)) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		if state.Channel == nil || state.Channel.ForceClose == nil {
+			return fmt.Errorf("no force-close in progress")
+		}
+		fn(state.Channel.ForceClose)
+		return nil
+	})
+}
+
+// finishForceClose records the sweep of to_local, which ends the channel.
+func finishForceClose(statePath, sweepTxid string) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		if state.Channel == nil || state.Channel.ForceClose == nil {
+			return fmt.Errorf("no force-close in progress")
+		}
+		state.Channel.ForceClose.SweepTxid = sweepTxid
+		releaseBump(state.Channel.ForceClose)
+		return setStatus(&state, StatusClosed)
+	})
+}
+
+// ForceCloseChannel closes the channel unilaterally with holder's latest
+// commitment, then polls the node every interval until the to_local output
+// matures and sweeps it. Running it again resumes an interrupted close.
+func ForceCloseChannel(statePath string, holder string, interval time.Duration) error {
+	if holder != "alice" && holder != "bob" {
+		return fmt.Errorf("holder must be alice or bob")
+	}
+	fc, err := startForceClose(statePath, holder)
+	if err != nil {
+		return err
+	}
+	if fc.SweepTxid != "" {
+		fmt.Println("to_local already swept by", fc.SweepTxid)
+		return nil
+	}
+
+	client := rpc.New(appConfig.RPC)
+	for {
+		var state State
+		if _, err := statefile.Load(statePath, &state); err != nil {
+			return fmt.Errorf("failed to read state file: %v", err)
+		}
+		delay := int64(state.Revocation.ToSelfDelay)
+
+		confs, found, err := commitmentConfirmations(client, &state, fc)
+		switch {
+		case err != nil:
+			fmt.Printf("Failed to look up commitment %s: %v\n", fc.Txid, err)
+		case !found:
+			// dropped from the mempool, send it again
+			fmt.Printf("Commitment %s not found, rebroadcasting\n", fc.Txid)
+			if c := findCommitment(&state, fc.Commitment); c != nil {
+				txHex := c.AliceSignedTx
+				if holder == "bob" {
+					txHex = c.BobSignedTx
+				}
+				if _, err := broadcastTx(txHex, "force-close"); err != nil {
+					fmt.Println("Rebroadcast failed:", err)
+					if policyOf(&state).Anchors {
+						fmt.Println("Run channel bump to submit it with a fee-bump child")
+					}
+				}
+			}
+		case confs == 0:
+			fmt.Println("Commitment in mempool, waiting for confirmation")
+		case confs < delay:
+			if fc.ConfirmedHeight == 0 {
+				if height, err := client.GetBlockCount(); err == nil {
+					fc.ConfirmedHeight = height - confs + 1
+					updateForceClose(statePath, func(s *ForceClose) { s.ConfirmedHeight = fc.ConfirmedHeight })
+					releaseBump(&fc)
+				}
+			}
+			fmt.Printf("Commitment has %d/%d confirmations, to_local matures in %d blocks\n", confs, delay, delay-confs)
+		default:
+			return sweepToLocal(statePath, &state, fc, client)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func findCommitment(state *State, n int) *Commitment {
+	for i := range state.Commitments {
+		if state.Commitments[i].ID == n {
+			return &state.Commitments[i]
+		}
+	}
+	return nil
+}
+
+// updateCommitment applies fn to commitment #n in the state file.
+func updateCommitment(statePath string, n int, fn func(c *Commitment)) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		c := findCommitment(&state, n)
+		if c == nil {
+			return fmt.Errorf("commitment #%d not found", n)
+		}
+		fn(c)
+		return nil
+	})
+}
+
+// commitmentConfirmations asks gettxout for the outputs of fc's commitment,
+// which works without txindex as long as one of them is unspent. to_local
+// stays unspent until we sweep it.
+func commitmentConfirmations(client *rpc.Client, state *State, fc ForceClose) (int64, bool, error) {
+	c := findCommitment(state, fc.Commitment)
+	if c == nil {
+		return 0, false, fmt.Errorf("commitment #%d not found", fc.Commitment)
+	}
+	txHex := c.AliceSignedTx
+	if fc.Holder == "bob" {
+		txHex = c.BobSignedTx
+	}
+	commitTx, err := decodeTx(txHex)
+	if err != nil {
+		return 0, false, err
+	}
+	return client.GetTxConfirmations(fc.Txid, len(commitTx.TxOut))
+}
+
+func sweepToLocal(statePath string, state *State, fc ForceClose, client *rpc.Client) error {
+	c := findCommitment(state, fc.Commitment)
+	if c == nil {
+		return fmt.Errorf("commitment #%d not found", fc.Commitment)
+	}
+	txHex := c.AliceSignedTx
+	if fc.Holder == "bob" {
+		txHex = c.BobSignedTx
+	}
+	commitTx, err := decodeTx(txHex)
+	if err != nil {
+		return err
+	}
+
+	sweep, err := BuildSweepTx(state, fc.Holder, fc.Commitment, commitTx, sweepFeeRate(client))
+	if err != nil {
+		return err
+	}
+	if sweep == nil {
+		fmt.Printf("Commitment #%d has no to_local output for %s, nothing to sweep\n", fc.Commitment, fc.Holder)
+		return finishForceClose(statePath, "")
+	}
+	sweepHex, err := serializeTx(sweep)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Sweep tx (hex):", sweepHex)
+	if err := updateForceClose(statePath, func(fc *ForceClose) { fc.SweepTx = sweepHex }); err != nil {
+		return err
+	}
+
+	txid, err := broadcastTx(sweepHex, "force-close-sweep")
+	if err != nil {
+		return fmt.Errorf("sweep broadcast failed: %v", err)
+	}
+	fmt.Println("Swept to_local by", txid)
+	return finishForceClose(statePath, txid)
+}
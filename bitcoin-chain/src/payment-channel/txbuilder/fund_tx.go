@@ -1,31 +1,26 @@
 package txbuilder
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
 
 	"example.com/m/utils"
+	"example.com/utils/statefile"
 )
 
 func FundChannel(statePath string) {
 	// Load funding data
-	raw, err := os.ReadFile("data/fund.json")
+	input, err := loadFund()
 	if err != nil {
-		panic(fmt.Errorf("failed to read fund.json: %v", err))
+		panic(err)
 	}
-	var input FundInput
-	if err := json.Unmarshal(raw, &input); err != nil {
-		panic(fmt.Errorf("invalid fund.json format: %v", err))
+	policy, err := NewChannelPolicy(toSat(input.Amount))
+	if err != nil {
+		fmt.Println("Funding refused:", err)
+		return
 	}
 
-	// Load RPC credentials (or put in .env)
-	rpcURL := "http://127.0.0.1:8332"
-	rpcUser := "admin"
-	rpcPass := "HouiWGc9wyj_2Fx2G9FYnQAr3AIXEeb-uRNRNITgKso"
-
 	// Send BTC
-	txid, vout, err := utils.SendToAddressWithDetails(rpcURL, rpcUser, rpcPass, input.Address, input.Amount)
+	txid, vout, err := utils.SendToAddressWithDetails(rpcURL, rpcUser, rpcPassword, input.Address, input.Amount)
 	if err != nil {
 		fmt.Println("Funding failed:", err)
 		return
@@ -36,11 +31,20 @@ func FundChannel(statePath string) {
 	fmt.Println("Vout:", vout)
 
 	// Store UTXO info for later use (in commitment/refund tx)
-	utxo := UTXORecord{
-		TxID:   txid,
-		Vout:   vout,
-		Amount: input.Amount,
+	var state State
+	err = statefile.Update(statePath, &state, func() error {
+		if state.HTLC == nil {
+			state.HTLC = &HTLC{}
+		}
+		state.HTLC.Txid = txid
+		state.HTLC.Vout = vout
+		state.HTLC.Amount = input.Amount
+		if state.Channel == nil {
+			state.Channel = &ChannelState{BobBalance: input.Amount, Policy: policy}
+		}
+		return setStatus(&state, StatusFundingBroadcast)
+	})
+	if err != nil {
+		fmt.Println("Failed to record funding UTXO:", err)
 	}
-	utxoBytes, _ := json.MarshalIndent(utxo, "", "  ")
-	_ = os.WriteFile(statePath, utxoBytes, 0644)
 }
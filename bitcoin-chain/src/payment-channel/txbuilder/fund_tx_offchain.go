@@ -3,10 +3,9 @@ package txbuilder
 import (
 	"bytes"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"os"
 
+	"example.com/utils/statefile"
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -16,89 +15,149 @@ import (
 )
 
 func InitChannelState(statePath string, bobFundAmount float64) error {
-	data, err := os.ReadFile(statePath)
-	if err != nil {
-		return fmt.Errorf("failed to read %s: %v", statePath, err)
-	}
-
 	var state State
-	if err := json.Unmarshal(data, &state); err != nil {
-		return fmt.Errorf("failed to parse %s: %v", statePath, err)
-	}
-
-	if state.Channel == nil {
+	initialized := false
+	err := statefile.Update(statePath, &state, func() error {
+		if state.Channel != nil {
+			return nil
+		}
+		policy, err := NewChannelPolicy(toSat(bobFundAmount))
+		if err != nil {
+			return err
+		}
 		state.Channel = &ChannelState{
 			AliceBalance: 0,
 			BobBalance:   bobFundAmount,
+			Policy:       policy,
 		}
-		fmt.Printf("Initialized channel balances: Alice=0 BTC, Bob=%.8f BTC\n", bobFundAmount)
+		initialized = true
+		return setStatus(&state, StatusPendingOpen)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %v", statePath, err)
+	}
 
-		updated, err := json.MarshalIndent(state, "", "  ")
-		if err != nil {
-			return fmt.Errorf("failed to marshal updated state: %v", err)
-		}
-		if err := os.WriteFile(statePath, updated, 0644); err != nil {
-			return fmt.Errorf("failed to write updated state: %v", err)
-		}
+	if initialized {
+		fmt.Printf("Initialized channel balances: Alice=0 BTC, Bob=%.8f BTC\n", bobFundAmount)
 	} else {
 		fmt.Println("ChannelState already exists, skipping initialization.")
 	}
-
 	return nil
 }
 
+// FundMultisigFromBobOffchain builds and signs the funding tx without
+// broadcasting it. Its txid is recorded right away so commitments and the
+// refund can be signed before any money is locked in the channel.
 func FundMultisigFromBobOffchain(statePath string, amount float64) error {
+	if _, err := NewChannelPolicy(toSat(amount)); err != nil {
+		return err
+	}
+
 	// Update json
-	UpdateFund(amount)
+	if err := UpdateFund(amount); err != nil {
+		return err
+	}
 	if err := UpdateHTLCAmount(statePath, amount); err != nil {
 		return fmt.Errorf("failed to update HTLC amount in state.json: %v", err)
 	}
 
 	// Load fund destination
-	fundRaw, err := os.ReadFile("data/fund.json")
+	fund, err := loadFund()
 	if err != nil {
-		return fmt.Errorf("failed to read fund.json: %v", err)
-	}
-	var fund FundData
-	if err := json.Unmarshal(fundRaw, &fund); err != nil {
-		return fmt.Errorf("invalid fund.json: %v", err)
+		return err
 	}
 
 	// Load Bob's key
-	stateRaw, err := os.ReadFile(statePath)
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return fmt.Errorf("failed to load state.json: %v", err)
+	}
+
+	// Output to multisig
+	addr, err := btcutil.DecodeAddress(fund.Address, &chaincfg.RegressionNetParams)
 	if err != nil {
-		return fmt.Errorf("failed to read state.json: %v", err)
+		return fmt.Errorf("invalid multisig address: %v", err)
 	}
-	var state State
-	if err := json.Unmarshal(stateRaw, &state); err != nil {
-		return fmt.Errorf("failed to parse state.json: %v", err)
+	script, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return fmt.Errorf("failed to create output script: %v", err)
+	}
+	tx, err := signedFundingTx(&state, script, int64(fund.Amount*1e8))
+	if err != nil {
+		return err
 	}
-	privBytes, _ := hex.DecodeString(state.Bob.PrivKey)
-	privKey, _ := btcec.PrivKeyFromBytes(privBytes)
 
-	// Load Bob's UTXO
-	scanResult, err := GetBobUTXOFromScantxoutset(state.Bob.Address)
+	// Serialize transaction (do NOT broadcast)
+	var buf bytes.Buffer
+	tx.Serialize(&buf)
+	txHex := hex.EncodeToString(buf.Bytes())
+
+	fmt.Println("\nSigned raw funding transaction (off-chain):")
+	fmt.Println(txHex)
+
+	if err := UpdateHTLCTx(statePath, txHex, tx.TxHash().String(), 0); err != nil {
+		return err
+	}
+	if err := InitChannelState(statePath, amount); err != nil {
+		return fmt.Errorf("failed to initialize ChannelState: %v", err)
+	}
+
+	fmt.Println("Sign the first commitment and the refund, then run fund broadcast")
+	return nil
+}
+
+// BroadcastFundingTx sends the funding tx the channel's state holds, saved
+// there by FundMultisigFromBobOffchain or a peer node's funding flow.
+func BroadcastFundingTx(statePath string) error {
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	if state.HTLC == nil || state.HTLC.SignedTx == "" {
+		return fmt.Errorf("missing funding tx, run fund offchain first")
+	}
+	txHex := state.HTLC.SignedTx
+	tx, err := decodeTx(txHex)
 	if err != nil {
-		return fmt.Errorf("failed to scan Bob UTXOs: %v", err)
+		return err
 	}
-	if len(scanResult.Unspents) == 0 {
-		return fmt.Errorf("no UTXO found for Bob")
+	if tx.TxHash().String() != state.HTLC.Txid {
+		return fmt.Errorf("funding tx does not match the txid the channel was signed against")
+	}
+	if latestSigned(&state) == nil && state.HTLC.Refund == nil {
+		return fmt.Errorf("no signed commitment or refund path yet, the funds could get stuck")
 	}
 
-	// pick largest UTXO
-	var utxo = scanResult.Unspents[0]
-	for _, u := range scanResult.Unspents {
-		if u.Amount > utxo.Amount {
-			utxo = u
-		}
+	txid, err := broadcastTx(txHex, "channel-fund")
+	if err != nil {
+		return err
+	}
+	fmt.Println("Funding tx broadcast:", txid)
+	var updated State
+	return statefile.Update(statePath, &updated, func() error {
+		return setStatus(&updated, StatusFundingBroadcast)
+	})
+}
+
+// signedFundingTx spends Bob's largest unreserved UTXO to pkScript, with
+// the change going back to Bob, and signs it. The UTXO stays reserved for
+// the channel so no other funding tx spends it.
+func signedFundingTx(state *State, pkScript []byte, amountOut int64) (*wire.MsgTx, error) {
+	wallet := state.walletKey("bob")
+	privBytes, _ := hex.DecodeString(wallet.PrivKey)
+	privKey, _ := btcec.PrivKeyFromBytes(privBytes)
+
+	// Load Bob's UTXO
+	utxo, err := reserveLargestUTXO(wallet.Address, fundingOwner(pkScript))
+	if err != nil {
+		return nil, fmt.Errorf("failed to pick a Bob UTXO: %v", err)
 	}
 
 	amountIn := int64(utxo.Amount * 1e8)
-	amountOut := int64(fund.Amount * 1e8)
-	fee := int64(500) // fixed fee
+	fee := fixedFee
 
 	if amountIn < amountOut+fee {
-		return fmt.Errorf("insufficient balance (need %d, have %d)", amountOut+fee, amountIn)
+		return nil, fmt.Errorf("insufficient balance (need %d, have %d)", amountOut+fee, amountIn)
 	}
 
 	tx := wire.NewMsgTx(wire.TxVersion)
@@ -106,45 +165,45 @@ func FundMultisigFromBobOffchain(statePath string, amount float64) error {
 	outPoint := wire.NewOutPoint(txHash, utxo.Vout)
 	txIn := wire.NewTxIn(outPoint, nil, nil)
 	tx.AddTxIn(txIn)
-
-	// Output to multisig
-	addr, err := btcutil.DecodeAddress(fund.Address, &chaincfg.RegressionNetParams)
-	if err != nil {
-		return fmt.Errorf("invalid multisig address: %v", err)
-	}
-	script, err := txscript.PayToAddrScript(addr)
-	if err != nil {
-		return fmt.Errorf("failed to create output script: %v", err)
-	}
-	txOut := wire.NewTxOut(amountOut, script)
-	tx.AddTxOut(txOut)
+	tx.AddTxOut(wire.NewTxOut(amountOut, pkScript))
 
 	// Change back to Bob
-	changeAddr, _ := btcutil.DecodeAddress(state.Bob.Address, &chaincfg.RegressionNetParams)
+	changeAddr, _ := btcutil.DecodeAddress(wallet.Address, &chaincfg.RegressionNetParams)
 	changeScript, _ := txscript.PayToAddrScript(changeAddr)
 	tx.AddTxOut(wire.NewTxOut(amountIn-amountOut-fee, changeScript))
 
 	scriptPubKey, _ := hex.DecodeString(utxo.ScriptPubKey)
+	fetcher := txscript.NewCannedPrevOutputFetcher(scriptPubKey, amountIn)
+	if err := signWalletInput(tx, 0, fetcher, privKey); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// signWalletInput signs input i of tx, which spends a P2WPKH or P2PKH
+// output of privKey. The segwit sighash needs prevOuts to cover every
+// input of tx.
+func signWalletInput(tx *wire.MsgTx, i int, prevOuts txscript.PrevOutputFetcher, privKey *btcec.PrivateKey) error {
+	prev := prevOuts.FetchPrevOutput(tx.TxIn[i].PreviousOutPoint)
+	if prev == nil {
+		return fmt.Errorf("unknown output spent by input %d", i)
+	}
+	if txscript.IsPayToWitnessPubKeyHash(prev.PkScript) {
+		witness, err := txscript.WitnessSignature(tx, txscript.NewTxSigHashes(tx, prevOuts), i, prev.Value, prev.PkScript, txscript.SigHashAll, privKey, true)
+		if err != nil {
+			return fmt.Errorf("signing error: %v", err)
+		}
+		tx.TxIn[i].Witness = witness
+		return nil
+	}
 	sigScript, err := txscript.SignatureScript(
-		tx, 0, scriptPubKey, txscript.SigHashAll, privKey, true,
+		tx, i, prev.PkScript, txscript.SigHashAll, privKey, true,
 	)
 	if err != nil {
 		return fmt.Errorf("signing error: %v", err)
 	}
-	tx.TxIn[0].SignatureScript = sigScript
-
-	// Serialize transaction (do NOT broadcast)
-	var buf bytes.Buffer
-	tx.Serialize(&buf)
-	txHex := hex.EncodeToString(buf.Bytes())
-
-	fmt.Println("\nSigned raw funding transaction (off-chain):")
-	fmt.Println(txHex)
-	_ = os.WriteFile("data/funding-tx-hex.txt", []byte(txHex), 0644)
-
-	if err := InitChannelState(statePath, amount); err != nil {
-		return fmt.Errorf("failed to initialize ChannelState: %v", err)
-	}
-
+	tx.TxIn[i].SignatureScript = sigScript
+	// a third party can re-encode a legacy signature and change the txid
+	fmt.Println("Warning: wallet input is not segwit, the txid can change until it confirms")
 	return nil
 }
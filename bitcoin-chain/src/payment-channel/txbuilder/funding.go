@@ -0,0 +1,194 @@
+package txbuilder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"example.com/m/musig"
+	"example.com/m/scripts"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// fundingOutput is the channel's 2-of-2 output as seen by the code that
+// spends it. New channels use P2WSH or a MuSig2 Taproot key; P2SH is kept
+// for older state files.
+type fundingOutput struct {
+	script []byte
+	amount int64
+	segwit bool
+	// taproot outputs have no script, only the signer set behind the key
+	taproot bool
+	keys    []*btcec.PublicKey
+	// whether Alice's key comes first in the multisig, which fixes the
+	// order of the signatures (keys are sorted per BIP67 for P2WSH)
+	aliceFirst bool
+}
+
+func (s *State) funding() (*fundingOutput, error) {
+	if s.HTLC == nil || (s.HTLC.RedeemScript == "" && !s.HTLC.Taproot) {
+		return nil, fmt.Errorf("channel has no funding script, run multisig first")
+	}
+	amount, err := btcutil.NewAmount(s.HTLC.Amount)
+	if err != nil {
+		return nil, fmt.Errorf("invalid channel amount: %v", err)
+	}
+	alicePub, err := hex.DecodeString(s.Alice.PubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alice pubkey: %v", err)
+	}
+	bobPub, err := hex.DecodeString(s.Bob.PubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bob pubkey: %v", err)
+	}
+
+	if s.HTLC.Taproot {
+		f := &fundingOutput{amount: int64(amount), taproot: true}
+		for _, b := range [][]byte{alicePub, bobPub} {
+			pub, err := btcec.ParsePubKey(b)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pubkey: %v", err)
+			}
+			f.keys = append(f.keys, pub)
+		}
+		return f, nil
+	}
+
+	script, err := hex.DecodeString(s.HTLC.RedeemScript)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redeem script: %v", err)
+	}
+	return &fundingOutput{
+		script:     script,
+		amount:     int64(amount),
+		segwit:     s.HTLC.Segwit,
+		aliceFirst: bytes.Index(script, alicePub) < bytes.Index(script, bobPub),
+	}, nil
+}
+
+func (f *fundingOutput) pkScript() ([]byte, error) {
+	if f.taproot {
+		key, err := musig.OutputKey(f.keys)
+		if err != nil {
+			return nil, err
+		}
+		return txscript.PayToTaprootScript(key)
+	}
+
+	var addr btcutil.Address
+	var err error
+	if f.segwit {
+		hash := sha256.Sum256(f.script)
+		addr, err = btcutil.NewAddressWitnessScriptHash(hash[:], &chaincfg.RegressionNetParams)
+	} else {
+		addr, err = btcutil.NewAddressScriptHash(f.script, &chaincfg.RegressionNetParams)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive channel address: %v", err)
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+// sigHash is the digest both parties sign for input 0 of tx: BIP341 for a
+// Taproot key spend, BIP143 for P2WSH (both commit to the amount), the
+// legacy one for P2SH.
+func (f *fundingOutput) sigHash(tx *wire.MsgTx) ([]byte, error) {
+	if !f.segwit && !f.taproot {
+		return txscript.CalcSignatureHash(f.script, txscript.SigHashAll, tx, 0)
+	}
+	pkScript, err := f.pkScript()
+	if err != nil {
+		return nil, err
+	}
+	fetcher := txscript.NewCannedPrevOutputFetcher(pkScript, f.amount)
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+	if f.taproot {
+		return txscript.CalcTaprootSignatureHash(sigHashes, txscript.SigHashDefault, tx, 0, fetcher)
+	}
+	return txscript.CalcWitnessSigHash(f.script, sigHashes, txscript.SigHashAll, tx, 0, f.amount)
+}
+
+// message is sigHash as the fixed-size array MuSig2 signs.
+func (f *fundingOutput) message(tx *wire.MsgTx) ([32]byte, error) {
+	var msg [32]byte
+	h, err := f.sigHash(tx)
+	if err != nil {
+		return msg, err
+	}
+	copy(msg[:], h)
+	return msg, nil
+}
+
+// setKeySpend sets the witness of a Taproot key spend: the aggregated
+// signature alone, with the default sighash type left implicit.
+func (f *fundingOutput) setKeySpend(tx *wire.MsgTx, sig *schnorr.Signature) {
+	tx.TxIn[0].SignatureScript = nil
+	tx.TxIn[0].Witness = wire.TxWitness{sig.Serialize()}
+}
+
+// setMultisigSpend places both signatures in key order, plus the OP_IF
+// selector when the script has a refund branch. The leading empty element
+// is the extra item OP_CHECKMULTISIG pops.
+func (f *fundingOutput) setMultisigSpend(tx *wire.MsgTx, aliceSig, bobSig []byte) error {
+	if f.taproot {
+		return fmt.Errorf("taproot funding is spent with one MuSig2 signature")
+	}
+	first, second := aliceSig, bobSig
+	if !f.aliceFirst {
+		first, second = bobSig, aliceSig
+	}
+	if f.segwit {
+		witness := wire.TxWitness{nil, first, second}
+		if scripts.HasRefundBranch(f.script) {
+			witness = append(witness, []byte{1})
+		}
+		tx.TxIn[0].Witness = append(witness, f.script)
+		tx.TxIn[0].SignatureScript = nil
+		return nil
+	}
+	scriptSig, err := multisigScriptSig(first, second, f.script)
+	if err != nil {
+		return fmt.Errorf("failed to build scriptSig: %v", err)
+	}
+	tx.TxIn[0].SignatureScript = scriptSig
+	return nil
+}
+
+// setRefundSpend takes the OP_ELSE branch with Bob's signature alone.
+func (f *fundingOutput) setRefundSpend(tx *wire.MsgTx, bobSig []byte) error {
+	if f.taproot {
+		return fmt.Errorf("taproot funding has no refund branch")
+	}
+	if f.segwit {
+		tx.TxIn[0].Witness = wire.TxWitness{bobSig, nil, f.script}
+		tx.TxIn[0].SignatureScript = nil
+		return nil
+	}
+	scriptSig, err := txscript.NewScriptBuilder().
+		AddData(bobSig).
+		AddOp(txscript.OP_0).
+		AddData(f.script).
+		Script()
+	if err != nil {
+		return fmt.Errorf("failed to build scriptSig: %v", err)
+	}
+	tx.TxIn[0].SignatureScript = scriptSig
+	return nil
+}
+
+// prevOuts maps the funding outpoint spent by input 0 of tx to its output.
+func (f *fundingOutput) prevOuts(tx *wire.MsgTx) (map[wire.OutPoint]*wire.TxOut, error) {
+	pkScript, err := f.pkScript()
+	if err != nil {
+		return nil, err
+	}
+	return map[wire.OutPoint]*wire.TxOut{
+		tx.TxIn[0].PreviousOutPoint: wire.NewTxOut(f.amount, pkScript),
+	}, nil
+}
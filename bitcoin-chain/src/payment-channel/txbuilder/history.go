@@ -0,0 +1,152 @@
+package txbuilder
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"example.com/utils/statefile"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// obscuringFactor hides the commitment number from outside observers while
+// letting both parties recover it from the transaction (BOLT #3): the lower
+// 48 bits of SHA256(opener pubkey || accepter pubkey). Bob opens the channel.
+func obscuringFactor(state *State) (uint64, error) {
+	bob, err := hex.DecodeString(state.Bob.PubKey)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bob pubkey: %v", err)
+	}
+	alice, err := hex.DecodeString(state.Alice.PubKey)
+	if err != nil {
+		return 0, fmt.Errorf("invalid alice pubkey: %v", err)
+	}
+	h := sha256.Sum256(append(bob, alice...))
+	return binary.BigEndian.Uint64(h[24:]) & (1<<48 - 1), nil
+}
+
+// encodeStateNumber stores the obscured number n in the upper 24 bits of the
+// input sequence (prefix 0x80, which also disables relative locktime) and
+// the lower 24 bits of the locktime (prefix 0x20, a timestamp in the past).
+func encodeStateNumber(tx *wire.MsgTx, n int, factor uint64) {
+	obscured := uint64(n) ^ factor
+	tx.TxIn[0].Sequence = 0x80<<24 | uint32(obscured>>24)&0xffffff
+	tx.LockTime = 0x20<<24 | uint32(obscured)&0xffffff
+}
+
+// DecodeStateNumber recovers the commitment number from a commitment tx, or
+// returns false if the tx does not carry one.
+func DecodeStateNumber(tx *wire.MsgTx, factor uint64) (int, bool) {
+	if len(tx.TxIn) != 1 || tx.TxIn[0].Sequence>>24 != 0x80 || tx.LockTime>>24 != 0x20 {
+		return 0, false
+	}
+	obscured := uint64(tx.TxIn[0].Sequence&0xffffff)<<24 | uint64(tx.LockTime&0xffffff)
+	return int(obscured ^ factor), true
+}
+
+// NextCommitmentNumber never reuses a number, even if the history was
+// started in the old single-entry format.
+func NextCommitmentNumber(state *State) int {
+	if len(state.Commitments) == 0 {
+		return 0
+	}
+	return state.Commitments[len(state.Commitments)-1].ID + 1
+}
+
+// signed reports whether the commitment is complete. A peer node (self set)
+// only ever holds the signed version of its own transaction.
+func (c *Commitment) signed(self string) bool {
+	switch self {
+	case "alice":
+		return c.AliceSignedTx != ""
+	case "bob":
+		return c.BobSignedTx != ""
+	}
+	return c.AliceSignedTx != "" && c.BobSignedTx != ""
+}
+
+func (c *Commitment) status(self string) string {
+	switch {
+	case c.Revoked:
+		return "revoked"
+	case c.signed(self):
+		return "signed"
+	}
+	return "unsigned"
+}
+
+// PrintHistory lists every commitment the channel has gone through.
+func PrintHistory(statePath string) error {
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	if len(state.Commitments) == 0 {
+		fmt.Println("No commitments yet")
+		return nil
+	}
+
+	fmt.Printf("%-4s %-14s %-14s %-9s %s\n", "#", "Alice (BTC)", "Bob (BTC)", "Status", "Created")
+	for _, c := range state.Commitments {
+		fmt.Printf("%-4d %-14.8f %-14.8f %-9s %s\n", c.ID, c.AliceBalance, c.BobBalance, c.status(state.Self), c.Timestamp)
+	}
+	return nil
+}
+
+// ShowCommitment prints one commitment with both versions of its
+// transaction and the signatures collected for each.
+func ShowCommitment(statePath string, n int) error {
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	for _, c := range state.Commitments {
+		if c.ID != n {
+			continue
+		}
+		fmt.Printf("Commitment #%d (%s)\n", c.ID, c.status(state.Self))
+		fmt.Printf("  Balances : Alice=%.8f BTC, Bob=%.8f BTC\n", c.AliceBalance, c.BobBalance)
+		fmt.Printf("  Created  : %s\n", c.Timestamp)
+		if c.SignedAt != "" {
+			fmt.Printf("  Signed   : %s\n", c.SignedAt)
+		}
+		if c.RevokedAt != "" {
+			fmt.Printf("  Revoked  : %s\n", c.RevokedAt)
+		}
+		for _, h := range c.HTLCs {
+			fmt.Printf("  HTLC %-4d: %s pays %.8f BTC, hash %s, expiry %d\n", h.ID, h.Offerer, h.Amount, h.Hash, h.Expiry)
+		}
+		versions := []struct {
+			holder           string
+			unsigned, signed string
+			sigs             *CommitmentSigs
+		}{
+			{"alice", c.AliceTx, c.AliceSignedTx, c.AliceTxSigs},
+			{"bob", c.BobTx, c.BobSignedTx, c.BobTxSigs},
+		}
+		for _, v := range versions {
+			fmt.Printf("  %s's commitment:\n", v.holder)
+			if v.unsigned != "" {
+				fmt.Printf("    unsigned  : %s\n", v.unsigned)
+			}
+			if v.sigs != nil {
+				fmt.Printf("    alice sig : %s\n", v.sigs.Alice)
+				fmt.Printf("    bob sig   : %s\n", v.sigs.Bob)
+			}
+			if v.signed != "" {
+				// the scriptSig is part of the txid, so only the signed tx has its final id
+				if tx, err := decodeTx(v.signed); err == nil {
+					fmt.Printf("    txid      : %s\n", tx.TxHash())
+				}
+				fmt.Printf("    signed    : %s\n", v.signed)
+			}
+		}
+		if c.SignedTx != "" {
+			fmt.Printf("  legacy tx: %s\n", c.SignedTx)
+		}
+		return nil
+	}
+	return fmt.Errorf("commitment #%d not found", n)
+}
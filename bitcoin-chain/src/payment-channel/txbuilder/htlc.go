@@ -0,0 +1,654 @@
+package txbuilder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+
+	"example.com/m/revocation"
+	"example.com/m/scripts"
+	"example.com/utils/rpc"
+	"example.com/utils/statefile"
+	"example.com/utils/txverify"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Expected weights of the second-stage transactions (BOLT #3), used to fix
+// their fee when the commitment is built.
+const (
+	htlcTimeoutWeight = 663
+	htlcSuccessWeight = 703
+)
+
+func toSat(btc float64) int64 {
+	return int64(math.Round(btc * 1e8))
+}
+
+// htlcOutput is one HTLC as it appears on a holder's commitment.
+type htlcOutput struct {
+	htlc     ChannelHTLC
+	script   []byte
+	pkScript []byte
+	amount   int64
+	fee      int64 // of the second-stage tx
+	offered  bool  // paid by the holder, so it leaves through HTLC-timeout
+}
+
+// htlcKeys derives the keys of the HTLC outputs on holder's commitment n,
+// and the private HTLC keys of whichever side's secrets we hold (nil
+// otherwise).
+func htlcKeys(state *State, holder string, n int) (scripts.HTLCKeys, *btcec.PrivateKey, *btcec.PrivateKey, error) {
+	var keys scripts.HTLCKeys
+	local, remote, err := state.Revocation.parties(holder)
+	if err != nil {
+		return keys, nil, nil, err
+	}
+	point, err := local.point(n)
+	if err != nil {
+		return keys, nil, nil, err
+	}
+	revBase, err := remote.revocationBasepoint()
+	if err != nil {
+		return keys, nil, nil, err
+	}
+	localBase, err := local.htlcBasepoint()
+	if err != nil {
+		return keys, nil, nil, fmt.Errorf("missing HTLC basepoint: %v", err)
+	}
+	remoteBase, err := remote.htlcBasepoint()
+	if err != nil {
+		return keys, nil, nil, fmt.Errorf("missing HTLC basepoint: %v", err)
+	}
+
+	keys.Revocation = revocation.RevocationPubKey(revBase, point).SerializeCompressed()
+	keys.Local = revocation.DerivePubKey(localBase, point).SerializeCompressed()
+	keys.Remote = revocation.DerivePubKey(remoteBase, point).SerializeCompressed()
+
+	var localPriv, remotePriv *btcec.PrivateKey
+	if local.HTLCBaseSecret != "" {
+		base, err := privFromHex(local.HTLCBaseSecret)
+		if err != nil {
+			return keys, nil, nil, err
+		}
+		localPriv = revocation.DerivePrivKey(base, point)
+	}
+	if remote.HTLCBaseSecret != "" {
+		base, err := privFromHex(remote.HTLCBaseSecret)
+		if err != nil {
+			return keys, nil, nil, err
+		}
+		remotePriv = revocation.DerivePrivKey(base, point)
+	}
+	return keys, localPriv, remotePriv, nil
+}
+
+// htlcOutputs returns the HTLC outputs of holder's commitment n in the order
+// they are added to the transaction. HTLCs too small to pay for their
+// second-stage tx are trimmed: they get no output and go to fees if the
+// commitment is broadcast.
+func htlcOutputs(state *State, holder string, n int, htlcs []ChannelHTLC, feeRate int64) ([]htlcOutput, error) {
+	if len(htlcs) == 0 {
+		return nil, nil
+	}
+	keys, _, _, err := htlcKeys(state, holder, n)
+	if err != nil {
+		return nil, err
+	}
+
+	var outs []htlcOutput
+	for _, h := range htlcs {
+		hash, err := hex.DecodeString(h.Hash)
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("HTLC %d has an invalid payment hash", h.ID)
+		}
+		out := htlcOutput{htlc: h, amount: toSat(h.Amount), offered: h.Offerer == holder}
+		if out.offered {
+			out.script, err = scripts.OfferedHTLCScript(keys, hash)
+			out.fee = feeRate * htlcTimeoutWeight / 4
+		} else {
+			out.script, err = scripts.ReceivedHTLCScript(keys, hash, h.Expiry)
+			out.fee = feeRate * htlcSuccessWeight / 4
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to build HTLC %d script: %v", h.ID, err)
+		}
+		if out.pkScript, err = p2wshScript(out.script); err != nil {
+			return nil, err
+		}
+		if out.amount-out.fee <= 0 || mempool.IsDust(wire.NewTxOut(out.amount-out.fee, out.pkScript), mempool.DefaultMinRelayTxFee) {
+			continue
+		}
+		outs = append(outs, out)
+	}
+	return outs, nil
+}
+
+// locateHTLCs finds the output index of each HTLC output in commitTx. Two
+// HTLCs with the same terms share a script, so each index is used once.
+func locateHTLCs(commitTx *wire.MsgTx, outs []htlcOutput) (map[int]int, error) {
+	idx := map[int]int{}
+	used := map[int]bool{}
+	for _, o := range outs {
+		found := false
+		for i, txOut := range commitTx.TxOut {
+			if !used[i] && bytes.Equal(txOut.PkScript, o.pkScript) {
+				idx[o.htlc.ID] = i
+				used[i] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("HTLC %d has no output in commitment %s", o.htlc.ID, commitTx.TxHash())
+		}
+	}
+	return idx, nil
+}
+
+// buildSecondStage creates the unsigned HTLC-timeout (offered) or
+// HTLC-success (received) tx spending an HTLC output of holder's commitment
+// n. Its output is locked like to_local, so BuildSweepTx can sweep it once
+// to_self_delay has passed.
+func buildSecondStage(state *State, holder string, n int, commitTx *wire.MsgTx, vout int, o htlcOutput) (*wire.MsgTx, error) {
+	witnessScript, err := toLocalScript(state, holder, n)
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := p2wshScript(witnessScript)
+	if err != nil {
+		return nil, err
+	}
+
+	commitHash := commitTx.TxHash()
+	tx := wire.NewMsgTx(2)
+	in := wire.NewTxIn(wire.NewOutPoint(&commitHash, uint32(vout)), nil, nil)
+	in.Sequence = 0
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(o.amount-o.fee, pkScript))
+	if o.offered {
+		// the holder only gets its payment back after the expiry
+		tx.LockTime = o.htlc.Expiry
+	}
+	return tx, nil
+}
+
+func signSecondStage(tx *wire.MsgTx, o htlcOutput, priv *btcec.PrivateKey) ([]byte, error) {
+	fetcher := txscript.NewCannedPrevOutputFetcher(o.pkScript, o.amount)
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+	return txscript.RawTxInWitnessSignature(tx, sigHashes, 0, o.amount, o.script, txscript.SigHashAll, priv)
+}
+
+// signHTLCs has the counterparty sign the second-stage tx of every HTLC
+// output on holder's signed commitment c, as commitment_signed does in
+// BOLT #2. Without these the holder could not get an HTLC off its own
+// commitment.
+func signHTLCs(state *State, holder string, c *Commitment, commitTx *wire.MsgTx) ([]HTLCSig, error) {
+	outs, err := htlcOutputs(state, holder, c.ID, c.HTLCs, c.HTLCFeeRate)
+	if err != nil || len(outs) == 0 {
+		return nil, err
+	}
+	_, _, remotePriv, err := htlcKeys(state, holder, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if remotePriv == nil {
+		return nil, fmt.Errorf("no HTLC key to sign %s's second-stage txs", holder)
+	}
+	idx, err := locateHTLCs(commitTx, outs)
+	if err != nil {
+		return nil, err
+	}
+
+	var sigs []HTLCSig
+	for _, o := range outs {
+		tx, err := buildSecondStage(state, holder, c.ID, commitTx, idx[o.htlc.ID], o)
+		if err != nil {
+			return nil, err
+		}
+		sig, err := signSecondStage(tx, o, remotePriv)
+		if err != nil {
+			return nil, fmt.Errorf("failed to sign HTLC %d: %v", o.htlc.ID, err)
+		}
+		sigs = append(sigs, HTLCSig{ID: o.htlc.ID, Holder: holder, Sig: hex.EncodeToString(sig)})
+	}
+	return sigs, nil
+}
+
+// BuildHTLCTx completes holder's second-stage tx for HTLC id on its
+// commitment c: HTLC-success with the preimage for an HTLC paid to holder,
+// HTLC-timeout (valid from the expiry) for one holder offered.
+func BuildHTLCTx(state *State, holder string, c *Commitment, id int, preimage []byte) (*wire.MsgTx, error) {
+	txHex := c.AliceSignedTx
+	if holder == "bob" {
+		txHex = c.BobSignedTx
+	}
+	commitTx, err := decodeTx(txHex)
+	if err != nil {
+		return nil, err
+	}
+	outs, err := htlcOutputs(state, holder, c.ID, c.HTLCs, c.HTLCFeeRate)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := locateHTLCs(commitTx, outs)
+	if err != nil {
+		return nil, err
+	}
+	var o *htlcOutput
+	for i := range outs {
+		if outs[i].htlc.ID == id {
+			o = &outs[i]
+		}
+	}
+	if o == nil {
+		return nil, fmt.Errorf("commitment #%d has no output for HTLC %d", c.ID, id)
+	}
+	if !o.offered {
+		// the script tells the preimage from a signature by its size
+		if len(preimage) != 32 {
+			return nil, fmt.Errorf("HTLC-success needs a 32-byte preimage, got %d bytes", len(preimage))
+		}
+		hash := sha256.Sum256(preimage)
+		if hex.EncodeToString(hash[:]) != o.htlc.Hash {
+			return nil, fmt.Errorf("preimage does not match HTLC %d", id)
+		}
+	}
+
+	var remoteSig []byte
+	for _, s := range c.HTLCSigs {
+		if s.ID == id && s.Holder == holder {
+			remoteSig, err = hex.DecodeString(s.Sig)
+			if err != nil {
+				return nil, fmt.Errorf("invalid stored HTLC signature: %v", err)
+			}
+		}
+	}
+	if remoteSig == nil {
+		return nil, fmt.Errorf("no counterparty signature for HTLC %d, sign the commitment first", id)
+	}
+
+	tx, err := buildSecondStage(state, holder, c.ID, commitTx, idx[id], *o)
+	if err != nil {
+		return nil, err
+	}
+	_, localPriv, _, err := htlcKeys(state, holder, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if localPriv == nil {
+		return nil, fmt.Errorf("no HTLC key for %s", holder)
+	}
+	localSig, err := signSecondStage(tx, *o, localPriv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign HTLC %d: %v", id, err)
+	}
+	// 0 <remote_sig> <local_sig> <preimage or empty>; the leading 0 is the
+	// extra item OP_CHECKMULTISIG pops
+	var last []byte
+	if !o.offered {
+		last = preimage
+	}
+	tx.TxIn[0].Witness = wire.TxWitness{nil, remoteSig, localSig, last, o.script}
+
+	prevOuts := map[wire.OutPoint]*wire.TxOut{
+		tx.TxIn[0].PreviousOutPoint: commitTx.TxOut[idx[id]],
+	}
+	if err := txverify.Verify(tx, prevOuts, txverify.UnknownHeight); err != nil {
+		return nil, fmt.Errorf("HTLC tx rejected: %v", err)
+	}
+	return tx, nil
+}
+
+func findHTLC(htlcs []ChannelHTLC, id int) int {
+	for i := range htlcs {
+		if htlcs[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// committedHTLC returns HTLC id if both parties have signed a commitment
+// carrying it; only then can it be settled or failed.
+func committedHTLC(state *State, id int) (ChannelHTLC, error) {
+	i := findHTLC(state.Channel.HTLCs, id)
+	if i < 0 {
+		return ChannelHTLC{}, fmt.Errorf("no pending HTLC %d", id)
+	}
+	c := latestSigned(state)
+	if c == nil || findHTLC(c.HTLCs, id) < 0 {
+		return ChannelHTLC{}, fmt.Errorf("HTLC %d is not on a signed commitment yet, run sign first", id)
+	}
+	return state.Channel.HTLCs[i], nil
+}
+
+// updateHTLCs applies fn to the open channel and builds the commitment for
+// the result.
+func updateHTLCs(statePath string, fn func(state *State) error) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		if state.Channel == nil || state.HTLC == nil {
+			return fmt.Errorf("channel is not initialized")
+		}
+		if err := RequireStatus(&state, StatusOpen); err != nil {
+			return err
+		}
+		if err := fn(&state); err != nil {
+			return err
+		}
+		_, err := addCommitment(&state)
+		return err
+	})
+}
+
+// AddHTLC moves amount from offerer's balance into an HTLC the other party
+// can claim with the preimage of hash until expiry.
+func AddHTLC(statePath string, offerer string, hashHex string, expiry uint32, amount float64) error {
+	if offerer != "alice" && offerer != "bob" {
+		return fmt.Errorf("offerer must be alice or bob")
+	}
+	hash, err := hex.DecodeString(hashHex)
+	if err != nil || len(hash) != 32 {
+		return fmt.Errorf("invalid hashlock: must be 32-byte hex string")
+	}
+	if expiry == 0 || expiry >= 500000000 {
+		return fmt.Errorf("expiry must be a block height")
+	}
+	amountSat := toSat(amount)
+	if amountSat <= 0 {
+		return fmt.Errorf("HTLC amount must be positive")
+	}
+
+	return updateHTLCs(statePath, func(state *State) error {
+		balance := &state.Channel.AliceBalance
+		if offerer == "bob" {
+			balance = &state.Channel.BobBalance
+		}
+		if toSat(*balance) < amountSat {
+			return fmt.Errorf("%s's balance %.8f BTC cannot cover %.8f BTC", offerer, *balance, amount)
+		}
+		*balance = float64(toSat(*balance)-amountSat) / 1e8
+
+		h := ChannelHTLC{
+			ID:      state.Channel.NextHTLCID,
+			Offerer: offerer,
+			Amount:  float64(amountSat) / 1e8,
+			Hash:    hex.EncodeToString(hash),
+			Expiry:  expiry,
+		}
+		state.Channel.NextHTLCID++
+		state.Channel.HTLCs = append(state.Channel.HTLCs, h)
+		fmt.Printf("Added HTLC %d: %s pays %.8f BTC to %s, expires at block %d\n",
+			h.ID, offerer, h.Amount, counterparty(offerer), expiry)
+		return nil
+	})
+}
+
+// SettleHTLC pays HTLC id to its receiver, who has shown the preimage.
+func SettleHTLC(statePath string, id int, preimageHex string) error {
+	preimage, err := hex.DecodeString(preimageHex)
+	if err != nil {
+		return fmt.Errorf("invalid preimage hex: %v", err)
+	}
+	return updateHTLCs(statePath, func(state *State) error {
+		h, err := committedHTLC(state, id)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(preimage)
+		if hex.EncodeToString(hash[:]) != h.Hash {
+			return fmt.Errorf("preimage does not match HTLC %d", id)
+		}
+		return removeHTLC(state, h, counterparty(h.Offerer))
+	})
+}
+
+// FailHTLC returns HTLC id to its offerer.
+func FailHTLC(statePath string, id int) error {
+	return updateHTLCs(statePath, func(state *State) error {
+		h, err := committedHTLC(state, id)
+		if err != nil {
+			return err
+		}
+		return removeHTLC(state, h, h.Offerer)
+	})
+}
+
+func removeHTLC(state *State, h ChannelHTLC, payee string) error {
+	balance := &state.Channel.AliceBalance
+	if payee == "bob" {
+		balance = &state.Channel.BobBalance
+	}
+	*balance = float64(toSat(*balance)+toSat(h.Amount)) / 1e8
+
+	i := findHTLC(state.Channel.HTLCs, h.ID)
+	state.Channel.HTLCs = append(state.Channel.HTLCs[:i], state.Channel.HTLCs[i+1:]...)
+	fmt.Printf("HTLC %d: %.8f BTC to %s\n", h.ID, h.Amount, payee)
+	return nil
+}
+
+// BuildRemoteHTLCClaim spends HTLC id straight off the counterparty's
+// commitment c, which needs no second-stage tx: claimer takes an HTLC paid
+// to it with the preimage, or one it offered back after the expiry. The
+// output goes to claimer's address.
+func BuildRemoteHTLCClaim(state *State, claimer string, c *Commitment, id int, preimage []byte, feeRate int64) (*wire.MsgTx, error) {
+	holder := counterparty(claimer)
+	commitTx, err := commitmentTx(c, holder)
+	if err != nil {
+		return nil, err
+	}
+	outs, err := htlcOutputs(state, holder, c.ID, c.HTLCs, c.HTLCFeeRate)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := locateHTLCs(commitTx, outs)
+	if err != nil {
+		return nil, err
+	}
+	var o *htlcOutput
+	for i := range outs {
+		if outs[i].htlc.ID == id {
+			o = &outs[i]
+		}
+	}
+	if o == nil {
+		return nil, fmt.Errorf("%s's commitment #%d has no output for HTLC %d", holder, c.ID, id)
+	}
+	// offered by the holder means paid to the claimer
+	if o.offered {
+		if len(preimage) != 32 {
+			return nil, fmt.Errorf("claiming HTLC %d needs its 32-byte preimage, got %d bytes", id, len(preimage))
+		}
+		hash := sha256.Sum256(preimage)
+		if hex.EncodeToString(hash[:]) != o.htlc.Hash {
+			return nil, fmt.Errorf("preimage does not match HTLC %d", id)
+		}
+	}
+
+	// on the holder's commitment the claimer's key is the remote one
+	_, _, priv, err := htlcKeys(state, holder, c.ID)
+	if err != nil {
+		return nil, err
+	}
+	if priv == nil {
+		return nil, fmt.Errorf("no HTLC key for %s", claimer)
+	}
+	destAddr, err := btcutil.DecodeAddress(state.key(claimer).Address, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s address: %v", claimer, err)
+	}
+	destScript, err := txscript.PayToAddrScript(destAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	prev := commitTx.TxOut[idx[id]]
+	commitHash := commitTx.TxHash()
+	tx := wire.NewMsgTx(2)
+	in := wire.NewTxIn(wire.NewOutPoint(&commitHash, uint32(idx[id])), nil, nil)
+	if !o.offered {
+		// the CLTV branch needs a final-but-not-max sequence
+		tx.LockTime = o.htlc.Expiry
+		in.Sequence = wire.MaxTxInSequenceNum - 1
+	}
+	tx.AddTxIn(in)
+	tx.AddTxOut(wire.NewTxOut(prev.Value, destScript))
+
+	prevOuts := map[wire.OutPoint]*wire.TxOut{in.PreviousOutPoint: prev}
+	fetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
+	sign := func() error {
+		sig, err := txscript.RawTxInWitnessSignature(tx, txscript.NewTxSigHashes(tx, fetcher), 0, prev.Value, o.script, txscript.SigHashAll, priv)
+		if err != nil {
+			return fmt.Errorf("failed to sign HTLC %d: %v", id, err)
+		}
+		// <remote_sig> <preimage> takes the offered script's preimage
+		// branch, <remote_sig> <> the received script's timeout branch
+		var last []byte
+		if o.offered {
+			last = preimage
+		}
+		in.Witness = wire.TxWitness{sig, last, o.script}
+		return nil
+	}
+
+	// sign once to learn the size, then again with the fee taken off
+	if err := sign(); err != nil {
+		return nil, err
+	}
+	fee := feeRate * vsize(tx)
+	tx.TxOut[0].Value = prev.Value - fee
+	if tx.TxOut[0].Value <= 0 || mempool.IsDust(tx.TxOut[0], mempool.DefaultMinRelayTxFee) {
+		return nil, fmt.Errorf("HTLC %d (%d sat) does not cover a %d sat fee", id, prev.Value, fee)
+	}
+	if err := sign(); err != nil {
+		return nil, err
+	}
+	if err := txverify.Verify(tx, prevOuts, txverify.UnknownHeight); err != nil {
+		return nil, fmt.Errorf("HTLC claim tx rejected: %v", err)
+	}
+	return tx, nil
+}
+
+// commitmentTx decodes holder's version of commitment c, signed if we have
+// it. The counterparty's signed copy is never sent to us, but under a
+// segwit funding output the unsigned one has the same txid and outputs.
+func commitmentTx(c *Commitment, holder string) (*wire.MsgTx, error) {
+	signed, unsigned := c.AliceSignedTx, c.AliceTx
+	if holder == "bob" {
+		signed, unsigned = c.BobSignedTx, c.BobTx
+	}
+	if signed != "" {
+		return decodeTx(signed)
+	}
+	if unsigned == "" {
+		return nil, fmt.Errorf("no %s commitment #%d", holder, c.ID)
+	}
+	return decodeTx(unsigned)
+}
+
+// remoteOnChain reports whether the counterparty of claimer has broadcast
+// its version of commitment c.
+func remoteOnChain(claimer string, c *Commitment) bool {
+	if appConfig == nil {
+		return false
+	}
+	tx, err := commitmentTx(c, counterparty(claimer))
+	if err != nil {
+		return false
+	}
+	_, found, err := rpc.New(appConfig.RPC).GetTxConfirmations(tx.TxHash().String(), len(tx.TxOut))
+	return err == nil && found
+}
+
+// ClaimHTLC takes HTLC id off whichever commitment closed the channel. On
+// holder's own commitment (its force-close, or else its latest signed one)
+// it builds the second-stage tx and keeps it with the commitment as
+// <success|timeout>-<id>; on the counterparty's it spends the output
+// directly and keeps it as remote-<success|timeout>-<id>. The tx is
+// broadcast right away once the commitment is known to be out.
+func ClaimHTLC(statePath string, holder string, id int, preimageHex string) error {
+	if holder != "alice" && holder != "bob" {
+		return fmt.Errorf("holder must be alice or bob")
+	}
+	preimage, err := hex.DecodeString(preimageHex)
+	if err != nil {
+		return fmt.Errorf("invalid preimage hex: %v", err)
+	}
+
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	if state.Channel == nil || state.Revocation == nil {
+		return fmt.Errorf("channel has no revocable commitments")
+	}
+	fc := state.Channel.ForceClose
+	var c *Commitment
+	remote := false
+	switch {
+	case fc != nil && fc.Holder == holder:
+		c = findCommitment(&state, fc.Commitment)
+	case fc != nil:
+		c = findCommitment(&state, fc.Commitment)
+		remote = true
+	default:
+		c = latestSigned(&state)
+		remote = c != nil && remoteOnChain(holder, c)
+	}
+	if c == nil {
+		return fmt.Errorf("no signed commitment for %s", holder)
+	}
+
+	var tx *wire.MsgTx
+	if remote {
+		tx, err = BuildRemoteHTLCClaim(&state, holder, c, id, preimage, sweepFeeRate(rpc.New(appConfig.RPC)))
+	} else {
+		tx, err = BuildHTLCTx(&state, holder, c, id, preimage)
+	}
+	if err != nil {
+		return err
+	}
+	txHex, err := serializeTx(tx)
+	if err != nil {
+		return err
+	}
+	kind := "success"
+	if tx.LockTime != 0 {
+		kind = "timeout"
+	}
+	if remote {
+		kind = "remote-" + kind
+	}
+	owner := holder
+	if remote {
+		owner = counterparty(holder)
+	}
+	fmt.Printf("HTLC-%s tx for HTLC %d on %s commitment #%d (hex): %s\n", kind, id, owner, c.ID, txHex)
+	err = updateCommitment(statePath, c.ID, func(c *Commitment) {
+		if c.HTLCTxs == nil {
+			c.HTLCTxs = make(map[string]string)
+		}
+		c.HTLCTxs[fmt.Sprintf("%s-%d", kind, id)] = txHex
+	})
+	if err != nil {
+		return err
+	}
+
+	if fc == nil && !remote {
+		fmt.Println("Broadcast it after the commitment confirms")
+		return nil
+	}
+	txid, err := broadcastTx(txHex, "htlc-"+kind)
+	if err != nil {
+		return fmt.Errorf("broadcast failed: %v", err)
+	}
+	fmt.Println("Broadcast HTLC tx", txid)
+	return nil
+}
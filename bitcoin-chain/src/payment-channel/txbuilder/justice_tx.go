@@ -0,0 +1,367 @@
+package txbuilder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"example.com/m/revocation"
+	"example.com/m/watchtower"
+	"example.com/utils/rpc"
+	"example.com/utils/statefile"
+	"example.com/utils/txverify"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+func counterparty(role string) string {
+	if role == "alice" {
+		return "bob"
+	}
+	return "alice"
+}
+
+func (s *State) key(role string) *KeyInfo {
+	if role == "alice" {
+		return s.Alice
+	}
+	return s.Bob
+}
+
+// findRevokedState matches the outputs of a commitment broadcast by cheater
+// against every commitment number whose secret we hold. It returns the state
+// number, the secret and the index of the to_local output, or -1 if to_local
+// was trimmed and only the commitment's HTLC outputs match.
+func findRevokedState(state *State, victim string, commitTx *wire.MsgTx) (int, [32]byte, int, error) {
+	var secret [32]byte
+	ours, _, err := state.Revocation.parties(victim)
+	if err != nil {
+		return 0, secret, 0, err
+	}
+	cheater := counterparty(victim)
+
+	// try the number encoded in locktime/sequence first, then every secret
+	candidates := map[int]string{}
+	if factor, err := obscuringFactor(state); err == nil {
+		if n, ok := DecodeStateNumber(commitTx, factor); ok {
+			if s, ok := ours.ReceivedSecrets[n]; ok {
+				candidates[n] = s
+			} else {
+				return 0, secret, 0, fmt.Errorf("commitment #%d has not been revoked", n)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = ours.ReceivedSecrets
+	}
+
+	for n, secretHex := range candidates {
+		witnessScript, err := toLocalScript(state, cheater, n)
+		if err != nil {
+			return 0, secret, 0, err
+		}
+		pkScript, err := p2wshScript(witnessScript)
+		if err != nil {
+			return 0, secret, 0, err
+		}
+		idx := -1
+		for i, out := range commitTx.TxOut {
+			if bytes.Equal(out.PkScript, pkScript) {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			matched, err := matchesHTLCs(state, cheater, n, commitTx)
+			if err != nil {
+				return 0, secret, 0, err
+			}
+			if !matched {
+				continue
+			}
+		}
+		b, err := hex.DecodeString(secretHex)
+		if err != nil || len(b) != 32 {
+			return 0, secret, 0, fmt.Errorf("stored secret for commitment %d is invalid", n)
+		}
+		copy(secret[:], b)
+		return n, secret, idx, nil
+	}
+	return 0, secret, 0, fmt.Errorf("transaction %s is not a revoked %s commitment", commitTx.TxHash(), cheater)
+}
+
+// matchesHTLCs reports whether commitTx has the HTLC outputs of cheater's
+// commitment n, which identify it when its to_local output was trimmed.
+func matchesHTLCs(state *State, cheater string, n int, commitTx *wire.MsgTx) (bool, error) {
+	c := findCommitment(state, n)
+	if c == nil {
+		return false, nil
+	}
+	outs, err := htlcOutputs(state, cheater, n, c.HTLCs, c.HTLCFeeRate)
+	if err != nil || len(outs) == 0 {
+		return false, err
+	}
+	_, err = locateHTLCs(commitTx, outs)
+	return err == nil, nil
+}
+
+// BuildJusticeTx sweeps every output of a revoked commitment broadcast by the
+// counterparty of victim to victim's address. The to_local and HTLC outputs
+// are spent through their revocation branches, the to_remote output with
+// victim's own key, one block after the commitment on a channel with
+// anchors. The HTLC outputs are swept even when to_local was trimmed. The
+// fee is feeRate sat/vB of the signed tx.
+// It returns the signed transaction and the revoked state number.
+func BuildJusticeTx(state *State, victim string, commitTx *wire.MsgTx, feeRate int64) (*wire.MsgTx, int, error) {
+	if state.Revocation == nil {
+		return nil, 0, fmt.Errorf("channel has no revocation data")
+	}
+	n, secret, toLocalIdx, err := findRevokedState(state, victim, commitTx)
+	if err != nil {
+		return nil, 0, err
+	}
+	cheater := counterparty(victim)
+	fmt.Printf("Found revoked %s commitment #%d\n", cheater, n)
+
+	ours, _, _ := state.Revocation.parties(victim)
+	revBase, err := privFromHex(ours.RevocationBaseSecret)
+	if err != nil {
+		return nil, 0, err
+	}
+	revPriv := revocation.RevocationPrivKey(revBase, secret)
+
+	toLocalScript, err := toLocalScript(state, cheater, n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// HTLC outputs of a revoked state belong to the victim as well
+	htlcScripts := map[int][]byte{}
+	if c := findCommitment(state, n); c != nil {
+		outs, err := htlcOutputs(state, cheater, n, c.HTLCs, c.HTLCFeeRate)
+		if err != nil {
+			return nil, 0, err
+		}
+		idx, err := locateHTLCs(commitTx, outs)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, o := range outs {
+			htlcScripts[idx[o.htlc.ID]] = o.script
+		}
+	}
+
+	victimKey := state.key(victim)
+	victimPriv, err := privFromHex(victimKey.PrivKey)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s privkey: %v", victim, err)
+	}
+	toRemoteWitness, toRemotePkScript, err := toRemoteScript(state, victim)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// collect the outputs we can take
+	commitHash := commitTx.TxHash()
+	prevOuts := map[wire.OutPoint]*wire.TxOut{}
+	tx := wire.NewMsgTx(2)
+	var total int64
+	for i, out := range commitTx.TxOut {
+		if i != toLocalIdx && htlcScripts[i] == nil && !bytes.Equal(out.PkScript, toRemotePkScript) {
+			continue
+		}
+		op := wire.NewOutPoint(&commitHash, uint32(i))
+		in := wire.NewTxIn(op, nil, nil)
+		if toRemoteWitness != nil && bytes.Equal(out.PkScript, toRemotePkScript) {
+			in.Sequence = 1 // 1 OP_CHECKSEQUENCEVERIFY
+		}
+		tx.AddTxIn(in)
+		prevOuts[*op] = out
+		total += out.Value
+	}
+
+	destAddr, err := btcutil.DecodeAddress(victimKey.Address, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s address: %v", victim, err)
+	}
+	destScript, err := txscript.PayToAddrScript(destAddr)
+	if err != nil {
+		return nil, 0, err
+	}
+	tx.AddTxOut(wire.NewTxOut(total, destScript))
+
+	// sign each input with BIP143
+	fetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
+	sign := func() error {
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		for i, in := range tx.TxIn {
+			prev := prevOuts[in.PreviousOutPoint]
+			if int(in.PreviousOutPoint.Index) == toLocalIdx {
+				sig, err := txscript.RawTxInWitnessSignature(tx, sigHashes, i, prev.Value, toLocalScript, txscript.SigHashAll, revPriv)
+				if err != nil {
+					return fmt.Errorf("failed to sign to_local: %v", err)
+				}
+				// <revocation_sig> 1 <witnessScript> takes the OP_IF branch
+				in.Witness = wire.TxWitness{sig, {1}, toLocalScript}
+				continue
+			}
+			if script := htlcScripts[int(in.PreviousOutPoint.Index)]; script != nil {
+				sig, err := txscript.RawTxInWitnessSignature(tx, sigHashes, i, prev.Value, script, txscript.SigHashAll, revPriv)
+				if err != nil {
+					return fmt.Errorf("failed to sign HTLC output: %v", err)
+				}
+				// <revocation_sig> <revocationpubkey> <witnessScript>
+				in.Witness = wire.TxWitness{sig, revPriv.PubKey().SerializeCompressed(), script}
+				continue
+			}
+			if toRemoteWitness != nil {
+				sig, err := txscript.RawTxInWitnessSignature(tx, sigHashes, i, prev.Value, toRemoteWitness, txscript.SigHashAll, victimPriv)
+				if err != nil {
+					return fmt.Errorf("failed to sign to_remote: %v", err)
+				}
+				in.Witness = wire.TxWitness{sig, toRemoteWitness}
+				continue
+			}
+			witness, err := txscript.WitnessSignature(tx, sigHashes, i, prev.Value, prev.PkScript, txscript.SigHashAll, victimPriv, true)
+			if err != nil {
+				return fmt.Errorf("failed to sign to_remote: %v", err)
+			}
+			in.Witness = witness
+		}
+		return nil
+	}
+
+	// sign once to learn the size, then again with the fee taken off
+	if err := sign(); err != nil {
+		return nil, 0, err
+	}
+	fee := feeRate * vsize(tx)
+	tx.TxOut[0].Value = total - fee
+	if tx.TxOut[0].Value <= 0 || mempool.IsDust(tx.TxOut[0], mempool.DefaultMinRelayTxFee) {
+		return nil, 0, fmt.Errorf("revoked outputs (%d sat) do not cover a %d sat fee", total, fee)
+	}
+	if err := sign(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := txverify.Verify(tx, prevOuts, txverify.UnknownHeight); err != nil {
+		return nil, 0, fmt.Errorf("justice tx rejected: %v", err)
+	}
+	return tx, n, nil
+}
+
+// JusticeTransaction builds the penalty transaction for a revoked commitment
+// that the counterparty of role broadcast, and keeps it with the revoked
+// commitment.
+func JusticeTransaction(statePath string, role string, commitTxHex string) error {
+	if role != "alice" && role != "bob" {
+		return fmt.Errorf("role must be alice or bob")
+	}
+
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	commitTx, err := decodeTx(commitTxHex)
+	if err != nil {
+		return err
+	}
+
+	tx, n, err := BuildJusticeTx(&state, role, commitTx, sweepFeeRate(rpc.New(appConfig.RPC)))
+	if err != nil {
+		return err
+	}
+	txHex, err := serializeTx(tx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Justice tx for revoked commitment #%d (hex): %s\n", n, txHex)
+	if findCommitment(&state, n) == nil {
+		// revoked before the state kept its commitments
+		return nil
+	}
+	return updateCommitment(statePath, n, func(c *Commitment) { c.JusticeTx = txHex })
+}
+
+// PushJusticeToTower registers the channel funding outpoint with a
+// watchtower and uploads a justice tx for every commitment the counterparty
+// of role has revoked, so the tower can react while we are offline.
+func PushJusticeToTower(statePath string, role string, tower *watchtower.Client) error {
+	if role != "alice" && role != "bob" {
+		return fmt.Errorf("role must be alice or bob")
+	}
+
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+	if state.HTLC == nil || state.HTLC.Txid == "" {
+		return fmt.Errorf("channel is not funded")
+	}
+	if state.Revocation == nil {
+		return fmt.Errorf("channel has no revocation data")
+	}
+	funding, err := state.funding()
+	if err != nil {
+		return err
+	}
+
+	outpoint := fmt.Sprintf("%s:%d", state.HTLC.Txid, state.HTLC.Vout)
+	if err := tower.Register(outpoint); err != nil {
+		return err
+	}
+	fmt.Println("Registered funding outpoint", outpoint)
+
+	ours, _, _ := state.Revocation.parties(role)
+	// the tower broadcasts these as they are, so they carry today's estimate
+	feeRate := sweepFeeRate(rpc.New(appConfig.RPC))
+	uploaded := 0
+	for _, c := range state.Commitments {
+		if _, revoked := ours.ReceivedSecrets[c.ID]; !revoked {
+			continue
+		}
+		// Only the counterparty holds its own signed commitment. Under a
+		// segwit or taproot funding output the witness does not change the
+		// txid, so the unsigned copy we countersigned is enough.
+		theirTx := c.BobTx
+		if role == "bob" {
+			theirTx = c.AliceTx
+		}
+		if !funding.segwit && !funding.taproot {
+			theirTx = c.BobSignedTx
+			if role == "bob" {
+				theirTx = c.AliceSignedTx
+			}
+		}
+		if theirTx == "" {
+			continue
+		}
+		commitTx, err := decodeTx(theirTx)
+		if err != nil {
+			return fmt.Errorf("commitment #%d: %v", c.ID, err)
+		}
+
+		justice, _, err := BuildJusticeTx(&state, role, commitTx, feeRate)
+		if err != nil {
+			// nothing to punish, e.g. the cheater had no balance then
+			fmt.Printf("Skipping commitment #%d: %v\n", c.ID, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := justice.Serialize(&buf); err != nil {
+			return err
+		}
+		if err := tower.Upload(commitTx.TxHash(), buf.Bytes()); err != nil {
+			return fmt.Errorf("commitment #%d: %v", c.ID, err)
+		}
+		uploaded++
+	}
+
+	fmt.Printf("Uploaded %d justice blobs to %s\n", uploaded, tower.URL)
+	return nil
+}
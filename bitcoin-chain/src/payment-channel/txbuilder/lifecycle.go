@@ -0,0 +1,388 @@
+package txbuilder
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"example.com/utils/rpc"
+	"example.com/utils/statefile"
+)
+
+// ChannelStatus is where a channel is in its lifecycle. It is stored in the
+// channel record and only changes through setStatus.
+type ChannelStatus string
+
+const (
+	// StatusNone means the state file has no channel yet.
+	StatusNone ChannelStatus = ""
+	// StatusPendingOpen: the funding output is known but not broadcast;
+	// the first commitment (or refund) gets signed here.
+	StatusPendingOpen ChannelStatus = "PendingOpen"
+	// StatusFundingBroadcast: the funding tx is out but not confirmed.
+	StatusFundingBroadcast ChannelStatus = "FundingBroadcast"
+	StatusOpen             ChannelStatus = "Open"
+	// StatusShuttingDown: a cooperative close has started, no more updates.
+	StatusShuttingDown ChannelStatus = "ShuttingDown"
+	// StatusClosingSigned: both signatures on the closing tx are in hand.
+	StatusClosingSigned ChannelStatus = "ClosingSigned"
+	// StatusForceClosing: a commitment is on chain and our delayed output
+	// has not been swept yet.
+	StatusForceClosing ChannelStatus = "ForceClosing"
+	StatusClosed       ChannelStatus = "Closed"
+)
+
+func (s ChannelStatus) String() string {
+	if s == StatusNone {
+		return "None"
+	}
+	return string(s)
+}
+
+// channelTransitions lists the statuses each status may move to.
+var channelTransitions = map[ChannelStatus][]ChannelStatus{
+	StatusNone:             {StatusPendingOpen, StatusFundingBroadcast},
+	StatusPendingOpen:      {StatusFundingBroadcast},
+	StatusFundingBroadcast: {StatusOpen, StatusForceClosing},
+	StatusOpen:             {StatusShuttingDown, StatusForceClosing},
+	StatusShuttingDown:     {StatusClosingSigned, StatusForceClosing},
+	StatusClosingSigned:    {StatusClosed, StatusForceClosing},
+	StatusForceClosing:     {StatusClosed},
+}
+
+func canTransition(from, to ChannelStatus) bool {
+	for _, s := range channelTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusOf returns the channel's status. State files written before the
+// status was stored get one derived from the older fields.
+func StatusOf(state *State) ChannelStatus {
+	c := state.Channel
+	switch {
+	case c == nil:
+		return StatusNone
+	case c.Status != "":
+		return c.Status
+	case c.ForceClose != nil && c.ForceClose.SweepTxid == "":
+		return StatusForceClosing
+	case c.Closed || c.ForceClose != nil:
+		return StatusClosed
+	}
+	// whether the funding tx went out is unknown, refreshChannelStatus
+	// finds out from the node
+	return StatusPendingOpen
+}
+
+// setStatus moves the channel to status to, refusing transitions the
+// lifecycle does not allow.
+func setStatus(state *State, to ChannelStatus) error {
+	from := StatusOf(state)
+	if from == to && state.Channel.Status != "" {
+		return nil
+	}
+	if from != to && !canTransition(from, to) {
+		return fmt.Errorf("channel cannot go from %s to %s", from, to)
+	}
+	if state.Channel == nil {
+		state.Channel = &ChannelState{}
+	}
+	state.Channel.Status = to
+	state.Channel.StatusAt = time.Now().Format(time.RFC3339)
+	state.Channel.Closed = false // superseded by Status
+	return nil
+}
+
+// RequireStatus fails unless the channel is in one of allowed.
+func RequireStatus(state *State, allowed ...ChannelStatus) error {
+	status := StatusOf(state)
+	for _, s := range allowed {
+		if s == status {
+			return nil
+		}
+	}
+	names := make([]string, len(allowed))
+	for i, s := range allowed {
+		names[i] = s.String()
+	}
+	if status == StatusNone {
+		return fmt.Errorf("no channel yet, expected %s", strings.Join(names, " or "))
+	}
+	return fmt.Errorf("channel is %s, expected %s", status, strings.Join(names, " or "))
+}
+
+// fundingConfirmations is how deep the funding tx must be before the
+// channel is open, and closingConfirmations how deep the closing tx must be
+// before it is closed.
+const (
+	fundingConfirmations = 1
+	closingConfirmations = 1
+)
+
+// closingOutputs is the most outputs a closing tx has, one per party.
+const closingOutputs = 2
+
+// RefreshChannelStatus asks the node about the transactions the channel is
+// waiting for: the funding output while opening and the closing tx once
+// signed. Both are looked up with gettxout, so the node needs no txindex;
+// once gettxout no longer finds them, the tx that spent the funding output
+// tells what happened. It reports whether the status changed. The node
+// being unreachable is not an error, the status just stays as it is.
+func RefreshChannelStatus(state *State) (bool, error) {
+	status := StatusOf(state)
+	if appConfig == nil || state.HTLC == nil || state.HTLC.Txid == "" {
+		return false, nil
+	}
+	client := rpc.New(appConfig.RPC)
+	switch status {
+	case StatusPendingOpen, StatusFundingBroadcast:
+		// an unspent funding output the node knows of is at least in its
+		// mempool
+		out, err := client.GetTxOut(state.HTLC.Txid, state.HTLC.Vout)
+		if err != nil {
+			return false, nil
+		}
+		if out == nil {
+			return fundingSpent(client, state, status)
+		}
+		if err := setStatus(state, StatusFundingBroadcast); err != nil {
+			return false, err
+		}
+		if out.Confirmations >= fundingConfirmations {
+			if err := setStatus(state, StatusOpen); err != nil {
+				return false, err
+			}
+		}
+	case StatusClosingSigned:
+		if state.Channel.ClosingTxid == "" {
+			return false, nil
+		}
+		confs, found, err := client.GetTxConfirmations(state.Channel.ClosingTxid, closingOutputs)
+		if err != nil {
+			return false, nil
+		}
+		if !found {
+			// every output of the closing tx may have been spent already
+			return fundingSpent(client, state, status)
+		}
+		if confs < closingConfirmations {
+			return false, nil
+		}
+		if err := setStatus(state, StatusClosed); err != nil {
+			return false, err
+		}
+	}
+	return StatusOf(state) != status, nil
+}
+
+// fundingSpent moves a channel whose funding output gettxout no longer
+// finds on by the tx that spent it: our closing tx closes the channel once
+// it confirms, any other spend is a commitment or refund and force-closes
+// it. Nothing changes while the output does not exist yet.
+func fundingSpent(client *rpc.Client, state *State, status ChannelStatus) (bool, error) {
+	// the funding output cannot be spent in a block mined before the
+	// channel got to status, which saves scanning the whole chain for a
+	// funding tx that was never broadcast
+	since, err := time.Parse(time.RFC3339, state.Channel.StatusAt)
+	if err != nil && status != StatusClosingSigned {
+		return false, nil
+	}
+	spend, height, err := client.FindSpendSince(state.HTLC.Txid, state.HTLC.Vout, since)
+	if err != nil || spend == nil {
+		return false, nil
+	}
+
+	if spend.Txid == state.Channel.ClosingTxid {
+		if height == 0 {
+			return false, nil
+		}
+		tip, err := client.GetBlockCount()
+		if err != nil || tip-height+1 < closingConfirmations {
+			return false, nil
+		}
+		if err := setStatus(state, StatusClosed); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if status == StatusPendingOpen {
+		if err := setStatus(state, StatusFundingBroadcast); err != nil {
+			return false, err
+		}
+	}
+	if err := setStatus(state, StatusForceClosing); err != nil {
+		return false, err
+	}
+	state.Channel.ClosingTxid = spend.Txid
+
+	holder, c := spendingCommitment(state, spend.Txid)
+	switch {
+	case c == nil:
+		fmt.Printf("Funding output %s:%d was spent by %s, which is none of the channel's commitments\n", state.HTLC.Txid, state.HTLC.Vout, spend.Txid)
+	case c.Revoked && holder != state.Self:
+		fmt.Printf("%s broadcast revoked commitment #%d (%s), run justice to take its outputs\n", holder, c.ID, spend.Txid)
+	default:
+		// resumed by channel force-close like a close we started
+		state.Channel.ForceClose = &ForceClose{
+			Holder:      holder,
+			Commitment:  c.ID,
+			Txid:        spend.Txid,
+			BroadcastAt: time.Now().Format(time.RFC3339),
+		}
+		fmt.Printf("%s's commitment #%d (%s) closed the channel, run channel force-close %s to sweep to_local\n", holder, c.ID, spend.Txid, holder)
+	}
+	return true, nil
+}
+
+// spendingCommitment returns the commitment with txid and whose version of
+// it that is, or a nil commitment if txid is none of them.
+func spendingCommitment(state *State, txid string) (string, *Commitment) {
+	for i := range state.Commitments {
+		c := &state.Commitments[i]
+		for _, holder := range []string{"alice", "bob"} {
+			tx, err := commitmentTx(c, holder)
+			if err == nil && tx.TxHash().String() == txid {
+				return holder, c
+			}
+		}
+	}
+	return "", nil
+}
+
+var (
+	funded = []ChannelStatus{StatusFundingBroadcast, StatusOpen, StatusShuttingDown, StatusClosingSigned}
+	// preOpen is everything before the funding tx confirms; commitments
+	// and the refund are signed here so the funds can never get stuck
+	preOpen = []ChannelStatus{StatusPendingOpen, StatusFundingBroadcast}
+)
+
+func statuses(groups ...[]ChannelStatus) []ChannelStatus {
+	var out []ChannelStatus
+	for _, g := range groups {
+		out = append(out, g...)
+	}
+	return out
+}
+
+// commandStatuses lists the statuses each channel subcommand may run in.
+// Subcommands that are not listed do not touch the channel.
+var commandStatuses = map[string][]ChannelStatus{
+	"fund":                {StatusNone, StatusPendingOpen},
+	"fund offchain":       {StatusNone, StatusPendingOpen},
+	"fund broadcast":      {StatusPendingOpen},
+	"multisig":            {StatusNone, StatusPendingOpen},
+	"commit":              statuses(preOpen, []ChannelStatus{StatusOpen}),
+	"pay":                 {StatusOpen},
+	"sign":                statuses(preOpen, []ChannelStatus{StatusOpen}),
+	"cosign":              statuses(preOpen, []ChannelStatus{StatusOpen}),
+	"settle":              funded,
+	"refund":              funded,
+	"close":               {StatusOpen, StatusShuttingDown},
+	"htlc add":            {StatusOpen},
+	"htlc settle":         {StatusOpen},
+	"htlc fail":           {StatusOpen},
+	"htlc claim":          statuses(funded, []ChannelStatus{StatusForceClosing}),
+	"channel force-close": statuses(funded, []ChannelStatus{StatusForceClosing}),
+	"channel bump":        {StatusForceClosing},
+	"justice":             statuses(funded, []ChannelStatus{StatusForceClosing, StatusClosed}),
+	"tower push":          funded,
+	"peer open":           {StatusNone},
+	"peer update":         {StatusOpen},
+	"peer pay":            {StatusOpen},
+	"peer close":          {StatusOpen, StatusShuttingDown},
+	"splice in":           {StatusOpen},
+	"splice out":          {StatusOpen},
+	"splice abort":        {StatusOpen},
+}
+
+// bothKeys are the subcommands that sign for both parties in one process;
+// a peer node updates and closes through the peer subcommands instead.
+var bothKeys = map[string]bool{
+	"commit": true, "sign": true, "close": true, "pay": true,
+	"htlc add": true, "htlc settle": true, "htlc fail": true,
+	"splice in": true, "splice out": true, "splice abort": true,
+}
+
+// RefreshStateFile loads the state at statePath and saves it back only if
+// RefreshChannelStatus moved the channel on, which it reports, or a
+// pending splice confirmed.
+func RefreshStateFile(statePath string, state *State) (bool, error) {
+	snap, err := statefile.Load(statePath, state)
+	if err != nil {
+		return false, fmt.Errorf("failed to read state file: %v", err)
+	}
+	changed, err := RefreshChannelStatus(state)
+	if err != nil {
+		return false, err
+	}
+	if locked := lockSplice(state); !changed && !locked {
+		return false, nil
+	}
+	return changed, statefile.Save(statePath, snap, state)
+}
+
+// CheckCommand refreshes the channel status and fails if the subcommand in
+// args may not run in it.
+func CheckCommand(statePath string, args []string) error {
+	name := args[0]
+	if len(args) > 1 {
+		if _, ok := commandStatuses[args[0]+" "+args[1]]; ok {
+			name = args[0] + " " + args[1]
+		}
+	}
+	allowed, ok := commandStatuses[name]
+	if !ok {
+		return nil
+	}
+	var state State
+	changed, err := RefreshStateFile(statePath, &state)
+	if err != nil {
+		return err
+	}
+	if changed {
+		fmt.Println("Channel is now", StatusOf(&state))
+	}
+	if bothKeys[name] && state.Self != "" {
+		return fmt.Errorf("cannot run %s: the state belongs to %s's peer node, use the peer subcommands", name, state.Self)
+	}
+	if err := RequireStatus(&state, allowed...); err != nil {
+		return fmt.Errorf("cannot run %s: %v", name, err)
+	}
+	return nil
+}
+
+// PrintStatus shows the channel's lifecycle status after refreshing it.
+func PrintStatus(statePath string) error {
+	var state State
+	if _, err := RefreshStateFile(statePath, &state); err != nil {
+		return err
+	}
+	fmt.Println("Status:", StatusOf(&state))
+	if c := state.Channel; c != nil {
+		if c.StatusAt != "" {
+			fmt.Println("Since: ", c.StatusAt)
+		}
+		fmt.Printf("Alice:  %.8f BTC\nBob:    %.8f BTC\n", c.AliceBalance, c.BobBalance)
+		p := policyOf(&state)
+		fmt.Printf("Policy: reserve Alice %d sat, Bob %d sat; dust limit %d sat; HTLCs in flight up to %d sat\n",
+			p.AliceReserveSat, p.BobReserveSat, p.DustLimitSat, p.MaxHTLCInFlightSat)
+		if p.Anchors {
+			fmt.Printf("Anchors: %d sat per party, paid by Bob with the commitment fee\n", anchorSat)
+		}
+		if s := c.Splice; s.Pending() {
+			fmt.Printf("Splice: %s pending, commitment #%d on %s:%d stays valid until it confirms\n",
+				s.Txid, s.PrevCommitment, s.PrevFunding.Txid, s.PrevFunding.Vout)
+		} else if s != nil {
+			fmt.Printf("Splice: %s confirmed %s\n", s.Txid, s.LockedAt)
+		}
+		if c.ClosingTxid != "" {
+			fmt.Println("Closed by", c.ClosingTxid)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package txbuilder
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"example.com/m/musig"
+	"example.com/utils/statefile"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr/musig2"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// signMusig runs both MuSig2 rounds in one process when both keys are at
+// hand. The nonces never leave memory. The partial signatures are returned
+// for the commitment history.
+func signMusig(tx *wire.MsgTx, f *fundingOutput, alicePrivKey, bobPrivKey *btcec.PrivateKey) (*CommitmentSigs, error) {
+	msg, err := f.message(tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate sighash: %v", err)
+	}
+	aliceNonce, err := musig.NewNonce(alicePrivKey, msg)
+	if err != nil {
+		return nil, err
+	}
+	bobNonce, err := musig.NewNonce(bobPrivKey, msg)
+	if err != nil {
+		return nil, err
+	}
+	pubNonces := [][musig2.PubNonceSize]byte{aliceNonce.PubNonce, bobNonce.PubNonce}
+
+	alicePsig, err := musig.Sign(aliceNonce.SecNonce, alicePrivKey, f.keys, pubNonces, msg)
+	if err != nil {
+		return nil, err
+	}
+	bobPsig, err := musig.Sign(bobNonce.SecNonce, bobPrivKey, f.keys, pubNonces, msg)
+	if err != nil {
+		return nil, err
+	}
+	f.setKeySpend(tx, musig.Combine(bobPsig, []*musig2.PartialSignature{alicePsig}, f.keys, msg))
+
+	aliceBytes, err := musig.EncodePartial(alicePsig)
+	if err != nil {
+		return nil, err
+	}
+	bobBytes, err := musig.EncodePartial(bobPsig)
+	if err != nil {
+		return nil, err
+	}
+	return &CommitmentSigs{
+		Alice: hex.EncodeToString(aliceBytes),
+		Bob:   hex.EncodeToString(bobBytes),
+	}, nil
+}
+
+// loadBobCommitment returns the latest commitment, whose Bob version
+// Alice and Bob sign together, that version and the MuSig2 message for it.
+func loadBobCommitment(state *State, f *fundingOutput) (*Commitment, *wire.MsgTx, [32]byte, error) {
+	var msg [32]byte
+	c, tx, err := cosignedCommitment(state)
+	if err != nil {
+		return nil, nil, msg, err
+	}
+	msg, err = f.message(tx)
+	if err != nil {
+		return nil, nil, msg, fmt.Errorf("failed to calculate sighash: %v", err)
+	}
+	return c, tx, msg, nil
+}
+
+// MusigNonce is the first signing round for a Taproot channel: role creates
+// a nonce for Bob's current commitment and keeps it with the commitment;
+// the public half is for the other party.
+func MusigNonce(statePath string, role string) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		funding, err := state.funding()
+		if err != nil {
+			return err
+		}
+		if !funding.taproot {
+			return fmt.Errorf("channel is not Taproot funded, no nonces needed")
+		}
+		key := state.key(role)
+		if key == nil || (role != "alice" && role != "bob") {
+			return fmt.Errorf("role must be alice or bob")
+		}
+		priv, err := privFromHex(key.PrivKey)
+		if err != nil {
+			return fmt.Errorf("invalid %s privkey: %v", role, err)
+		}
+
+		c, _, msg, err := loadBobCommitment(&state, funding)
+		if err != nil {
+			return err
+		}
+		nonce, err := musig.NewNonce(priv, msg)
+		if err != nil {
+			return err
+		}
+
+		// a nonce already waiting here is simply replaced; it was never used
+		if c.Nonces == nil {
+			c.Nonces = make(map[string]*SigningNonce)
+		}
+		c.Nonces[role] = &SigningNonce{
+			Message:  hex.EncodeToString(msg[:]),
+			SecNonce: hex.EncodeToString(nonce.SecNonce[:]),
+			PubNonce: hex.EncodeToString(nonce.PubNonce[:]),
+			Created:  time.Now().Format(time.RFC3339),
+		}
+		fmt.Printf("%s's public nonce for commitment #%d: %x\n", role, c.ID, nonce.PubNonce[:])
+		return nil
+	})
+}
+
+// takeSecNonce hands out role's secret nonce for msg and removes it from
+// c. The caller saves c together with the partial signature the nonce
+// makes, so the nonce is gone before that signature exists anywhere.
+func takeSecNonce(c *Commitment, role string, msg [32]byte) ([musig2.SecNonceSize]byte, error) {
+	var secNonce [musig2.SecNonceSize]byte
+	stored := c.Nonces[role]
+	if stored == nil || stored.SecNonce == "" {
+		return secNonce, fmt.Errorf("no nonce for %s, run cosign nonce %s first", role, role)
+	}
+	if stored.Message != hex.EncodeToString(msg[:]) {
+		return secNonce, fmt.Errorf("%s's nonce was made for another transaction, run cosign nonce %s again", role, role)
+	}
+	b, err := hex.DecodeString(stored.SecNonce)
+	if err != nil || len(b) != musig2.SecNonceSize {
+		return secNonce, fmt.Errorf("invalid secret nonce")
+	}
+	stored.SecNonce = ""
+	copy(secNonce[:], b)
+	return secNonce, nil
+}
+
+func readPubNonce(c *Commitment, role string) ([musig2.PubNonceSize]byte, error) {
+	var pubNonce [musig2.PubNonceSize]byte
+	stored := c.Nonces[role]
+	if stored == nil {
+		return pubNonce, fmt.Errorf("missing %s's public nonce, run cosign nonce %s first", role, role)
+	}
+	b, err := hex.DecodeString(stored.PubNonce)
+	if err != nil || len(b) != musig2.PubNonceSize {
+		return pubNonce, fmt.Errorf("invalid public nonce from %s", role)
+	}
+	copy(pubNonce[:], b)
+	return pubNonce, nil
+}
+
+func readPubNonces(c *Commitment) ([][musig2.PubNonceSize]byte, error) {
+	alice, err := readPubNonce(c, "alice")
+	if err != nil {
+		return nil, err
+	}
+	bob, err := readPubNonce(c, "bob")
+	if err != nil {
+		return nil, err
+	}
+	return [][musig2.PubNonceSize]byte{alice, bob}, nil
+}
+
+// musigSignAlice is the Taproot version of SignCommitmentTxAlice: with both
+// public nonces exchanged, Alice hands over her partial signature.
+func musigSignAlice(state *State, f *fundingOutput) error {
+	c, _, msg, err := loadBobCommitment(state, f)
+	if err != nil {
+		return err
+	}
+	pubNonces, err := readPubNonces(c)
+	if err != nil {
+		return err
+	}
+	alicePriv, err := privFromHex(state.Alice.PrivKey)
+	if err != nil {
+		return fmt.Errorf("invalid alice privkey: %v", err)
+	}
+	secNonce, err := takeSecNonce(c, "alice", msg)
+	if err != nil {
+		return err
+	}
+
+	psig, err := musig.Sign(secNonce, alicePriv, f.keys, pubNonces, msg)
+	if err != nil {
+		return err
+	}
+	b, err := musig.EncodePartial(psig)
+	if err != nil {
+		return err
+	}
+	c.BobTxSigs = &CommitmentSigs{Alice: hex.EncodeToString(b)}
+	fmt.Printf("Alice’s partial signature for commitment #%d saved to the state\n", c.ID)
+	return nil
+}
+
+// musigSignBob is the Taproot version of SignCommitmentTxBob: Bob checks
+// Alice's partial signature, adds his own and completes the key spend.
+func musigSignBob(state *State, f *fundingOutput) error {
+	c, tx, msg, err := loadBobCommitment(state, f)
+	if err != nil {
+		return err
+	}
+	pubNonces, err := readPubNonces(c)
+	if err != nil {
+		return err
+	}
+
+	if c.BobTxSigs == nil || c.BobTxSigs.Alice == "" {
+		return fmt.Errorf("no signature from Alice for commitment #%d, run cosign alice first", c.ID)
+	}
+	b, err := hex.DecodeString(c.BobTxSigs.Alice)
+	if err != nil {
+		return fmt.Errorf("invalid Alice sig hex: %v", err)
+	}
+	alicePsig, err := musig.DecodePartial(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse Alice's sig: %v", err)
+	}
+	if err := musig.Verify(alicePsig, f.keys[0], pubNonces[0], f.keys, pubNonces, msg); err != nil {
+		return fmt.Errorf("Alice signature invalid: %v", err)
+	}
+	fmt.Println("Alice's signature verified")
+
+	bobPriv, err := privFromHex(state.Bob.PrivKey)
+	if err != nil {
+		return fmt.Errorf("invalid bob privkey: %v", err)
+	}
+	secNonce, err := takeSecNonce(c, "bob", msg)
+	if err != nil {
+		return err
+	}
+	bobPsig, err := musig.Sign(secNonce, bobPriv, f.keys, pubNonces, msg)
+	if err != nil {
+		return err
+	}
+
+	f.setKeySpend(tx, musig.Combine(bobPsig, []*musig2.PartialSignature{alicePsig}, f.keys, msg))
+	if err := verifyChannelSpend(tx, f); err != nil {
+		return fmt.Errorf("signed commitment rejected: %v", err)
+	}
+
+	finalHex, err := serializeTx(tx)
+	if err != nil {
+		return err
+	}
+	bobBytes, err := musig.EncodePartial(bobPsig)
+	if err != nil {
+		return err
+	}
+	c.BobTxSigs.Bob = hex.EncodeToString(bobBytes)
+	c.BobSignedTx = finalHex
+	fmt.Println("Bob finalized signed commitment tx:", finalHex)
+	return nil
+}
@@ -0,0 +1,136 @@
+package txbuilder
+
+import (
+	"fmt"
+
+	"example.com/utils/statefile"
+)
+
+// Payment is an off-chain payment from Payer to the other party, completed
+// once commitment Commitment is signed and the one before it revoked.
+type Payment struct {
+	Payer      string `json:"payer"`
+	AmountSat  int64  `json:"amountSat"`
+	Commitment int    `json:"commitment"`
+	// balances after the payment; Bob's includes the commitment fee
+	AliceSat int64 `json:"aliceSat"`
+	BobSat   int64 `json:"bobSat"`
+}
+
+// PaymentBalances returns the channel balances after payer pays amountSat
+// to the other party. The payer must keep its reserve and the payee's
+// output must not be trimmed as dust; the commitment fee comes out of Bob's
+// balance.
+func PaymentBalances(state *State, payer string, amountSat int64) (aliceSat, bobSat int64, err error) {
+	if payer != "alice" && payer != "bob" {
+		return 0, 0, fmt.Errorf("payer must be alice or bob")
+	}
+	if state.Channel == nil || state.HTLC == nil {
+		return 0, 0, fmt.Errorf("channel is not initialized")
+	}
+	if amountSat <= 0 {
+		return 0, 0, fmt.Errorf("amount must be positive")
+	}
+	aliceSat, bobSat = toSat(state.Channel.AliceBalance), toSat(state.Channel.BobBalance)
+
+	// outputs are what each party gets on the commitment
+	payerOut, payeeOut := aliceSat, bobSat-commitmentFee(state)
+	if payer == "bob" {
+		payerOut, payeeOut = payeeOut, payerOut
+	}
+	policy := policyOf(state)
+	if reserve := policy.reserve(payer); payerOut-amountSat < reserve {
+		return 0, 0, fmt.Errorf("%s can pay at most %d sat and keep the channel reserve of %d sat", payer, max(payerOut-reserve, 0), reserve)
+	}
+	if payeeOut+amountSat < policy.DustLimitSat {
+		return 0, 0, fmt.Errorf("%s's output would be %d sat, below the dust limit of %d sat", counterparty(payer), payeeOut+amountSat, policy.DustLimitSat)
+	}
+
+	if payer == "alice" {
+		return aliceSat - amountSat, bobSat + amountSat, nil
+	}
+	return aliceSat + amountSat, bobSat - amountSat, nil
+}
+
+// Pay moves amountSat from payer to the other party on a channel whose
+// state holds both keys: it builds the next commitment, signs both versions
+// and revokes the previous one in a single state file update, so either
+// all of it happens or none.
+func Pay(statePath, payer string, amountSat int64) (*Payment, error) {
+	var state State
+	var p *Payment
+	err := statefile.Update(statePath, &state, func() error {
+		if state.Self != "" {
+			return fmt.Errorf("the state belongs to %s's peer node, pay through the peer", state.Self)
+		}
+		if err := RequireStatus(&state, StatusOpen); err != nil {
+			return err
+		}
+		aliceSat, bobSat, err := PaymentBalances(&state, payer, amountSat)
+		if err != nil {
+			return err
+		}
+		state.Channel.AliceBalance = float64(aliceSat) / 1e8
+		state.Channel.BobBalance = float64(bobSat) / 1e8
+		n, err := addCommitment(&state)
+		if err != nil {
+			return err
+		}
+		if err := signLatestCommitment(&state); err != nil {
+			return err
+		}
+		p = &Payment{Payer: payer, AmountSat: amountSat, Commitment: n, AliceSat: aliceSat, BobSat: bobSat}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ApprovedUpdate is one balance update the peer may ask for.
+type ApprovedUpdate struct {
+	AliceSat int64 `json:"aliceSat"`
+	BobSat   int64 `json:"bobSat"`
+}
+
+// ApproveUpdate lets the peer of self's node move the channel to the given
+// balances once, even though that lowers self's side.
+func ApproveUpdate(statePath, self string, aliceSat, bobSat int64) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		if state.Self != self {
+			return fmt.Errorf("state file does not belong to %s's node", self)
+		}
+		if err := RequireStatus(&state, StatusOpen); err != nil {
+			return err
+		}
+		if aliceSat < 0 || bobSat < 0 {
+			return fmt.Errorf("balances must not be negative")
+		}
+		state.Channel.Approved = &ApprovedUpdate{AliceSat: aliceSat, BobSat: bobSat}
+		fmt.Printf("Approved an update to Alice=%d sat, Bob=%d sat\n", aliceSat, bobSat)
+		return nil
+	})
+}
+
+// CheckUpdate decides whether our node countersigns the balances the peer
+// proposed. A payment to us is always fine; anything that lowers our side
+// needs the user's approval first, which it then uses up.
+func CheckUpdate(state *State, aliceSat, bobSat int64) error {
+	if state.Channel == nil {
+		return fmt.Errorf("channel is not initialized")
+	}
+	ours, proposed := toSat(state.Channel.AliceBalance), aliceSat
+	if state.Self == "bob" {
+		ours, proposed = toSat(state.Channel.BobBalance), bobSat
+	}
+	if proposed >= ours {
+		return nil
+	}
+	if a := state.Channel.Approved; a != nil && a.AliceSat == aliceSat && a.BobSat == bobSat {
+		state.Channel.Approved = nil
+		return nil
+	}
+	return fmt.Errorf("update lowers %s's balance from %d to %d sat without approval", state.Self, ours, proposed)
+}
@@ -0,0 +1,596 @@
+package txbuilder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"example.com/m/revocation"
+	"example.com/m/scripts"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// The functions in this file run one party's side of the channel for a peer
+// node, whose state holds its own keys and secrets and only the public keys
+// of the counterparty. Each party signs the other's version of a commitment
+// and completes its own with the signature it gets back.
+
+// PartyKeys are the public keys a party sends when a channel is opened
+// (open_channel, accept_channel): its funding key and payout address, its
+// basepoints and the points of its first two commitments.
+type PartyKeys struct {
+	FundingPubKey       string `json:"fundingPubKey"`
+	Address             string `json:"address"`
+	RevocationBasepoint string `json:"revocationBasepoint"`
+	DelayedBasepoint    string `json:"delayedBasepoint"`
+	HTLCBasepoint       string `json:"htlcBasepoint"`
+	FirstPoint          string `json:"firstPerCommitmentPoint"`
+	SecondPoint         string `json:"secondPerCommitmentPoint"`
+}
+
+func pubHex(pub *btcec.PublicKey) string {
+	return hex.EncodeToString(pub.SerializeCompressed())
+}
+
+func (r *Revocation) own(self string) **ChannelKeys {
+	if self == "alice" {
+		return &r.Alice
+	}
+	return &r.Bob
+}
+
+// ChannelID identifies a funded channel as BOLT #2 does: the funding txid
+// in wire byte order with the output index XORed into the last two bytes.
+func ChannelID(state *State) (string, error) {
+	if state.HTLC == nil || state.HTLC.Txid == "" {
+		return "", fmt.Errorf("channel is not funded")
+	}
+	h, err := chainhash.NewHashFromStr(state.HTLC.Txid)
+	if err != nil {
+		return "", fmt.Errorf("invalid funding txid: %v", err)
+	}
+	id := h[:]
+	id[30] ^= byte(state.HTLC.Vout >> 8)
+	id[31] ^= byte(state.HTLC.Vout)
+	return hex.EncodeToString(id), nil
+}
+
+// Local and Remote are the node's own party and its counterparty on a peer
+// node's state.
+func (s *State) Local() *KeyInfo {
+	return s.key(s.Self)
+}
+
+func (s *State) Remote() *KeyInfo {
+	return s.key(counterparty(s.Self))
+}
+
+// walletKey is the key whose coins role spends on chain and whose address
+// takes the change: the node's wallet in a managed channel, else role's
+// channel key.
+func (s *State) walletKey(role string) *KeyInfo {
+	if s.Wallet != nil && role == s.Self {
+		return s.Wallet
+	}
+	return s.key(role)
+}
+
+// LocalPartyKeys turns state into self's peer node state and returns the
+// keys self sends to the counterparty, creating its secrets on first use.
+func LocalPartyKeys(state *State, self string) (*PartyKeys, error) {
+	if self != "alice" && self != "bob" {
+		return nil, fmt.Errorf("role must be alice or bob")
+	}
+	key := state.key(self)
+	if key == nil || key.PrivKey == "" {
+		return nil, fmt.Errorf("no %s key, run init %s first", self, self)
+	}
+	if other := state.key(counterparty(self)); other != nil && other.PrivKey != "" {
+		return nil, fmt.Errorf("state holds %s's private key, a peer node only has its own", counterparty(self))
+	}
+	state.Self = self
+
+	if state.Revocation == nil {
+		state.Revocation = &Revocation{ToSelfDelay: defaultToSelfDelay}
+	}
+	own := state.Revocation.own(self)
+	if *own == nil {
+		k, err := newChannelKeys()
+		if err != nil {
+			return nil, err
+		}
+		*own = k
+	}
+	k := *own
+
+	revBase, err := k.revocationBasepoint()
+	if err != nil {
+		return nil, err
+	}
+	delayedBase, err := k.delayedBasepoint()
+	if err != nil {
+		return nil, err
+	}
+	htlcBase, err := k.htlcBasepoint()
+	if err != nil {
+		return nil, err
+	}
+	first, err := k.point(0)
+	if err != nil {
+		return nil, err
+	}
+	second, err := k.point(1)
+	if err != nil {
+		return nil, err
+	}
+	return &PartyKeys{
+		FundingPubKey:       key.PubKey,
+		Address:             key.Address,
+		RevocationBasepoint: pubHex(revBase),
+		DelayedBasepoint:    pubHex(delayedBase),
+		HTLCBasepoint:       pubHex(htlcBase),
+		FirstPoint:          pubHex(first),
+		SecondPoint:         pubHex(second),
+	}, nil
+}
+
+// SetCounterparty stores the keys the other node sent. toSelfDelay is the
+// delay both parties' to_local outputs use.
+func SetCounterparty(state *State, k *PartyKeys, toSelfDelay uint16) error {
+	if state.Self == "" || state.Revocation == nil {
+		return fmt.Errorf("state is not a peer node state")
+	}
+	for _, p := range []string{k.FundingPubKey, k.RevocationBasepoint, k.DelayedBasepoint, k.HTLCBasepoint, k.FirstPoint, k.SecondPoint} {
+		if _, err := parsePubKey(p); err != nil {
+			return fmt.Errorf("counterparty sent %v", err)
+		}
+	}
+	if _, err := btcutil.DecodeAddress(k.Address, &chaincfg.RegressionNetParams); err != nil {
+		return fmt.Errorf("counterparty sent invalid address: %v", err)
+	}
+	if toSelfDelay == 0 {
+		return fmt.Errorf("to_self_delay must be positive")
+	}
+
+	other := counterparty(state.Self)
+	info := &KeyInfo{PubKey: k.FundingPubKey, Address: k.Address}
+	if other == "alice" {
+		state.Alice = info
+	} else {
+		state.Bob = info
+	}
+	*state.Revocation.own(other) = &ChannelKeys{
+		RevocationBasepoint: k.RevocationBasepoint,
+		DelayedBasepoint:    k.DelayedBasepoint,
+		HTLCBasepoint:       k.HTLCBasepoint,
+		Points:              map[int]string{0: k.FirstPoint, 1: k.SecondPoint},
+	}
+	state.Revocation.ToSelfDelay = toSelfDelay
+	return nil
+}
+
+// SetupFunding derives the P2WSH 2-of-2 from both funding keys for a
+// channel of amountSat under policy, which Bob funds and starts out owning.
+func SetupFunding(state *State, amountSat int64, policy *ChannelPolicy) error {
+	alicePub, err := hex.DecodeString(state.Alice.PubKey)
+	if err != nil {
+		return fmt.Errorf("invalid alice pubkey: %v", err)
+	}
+	bobPub, err := hex.DecodeString(state.Bob.PubKey)
+	if err != nil {
+		return fmt.Errorf("invalid bob pubkey: %v", err)
+	}
+	script, err := scripts.FundingScript(alicePub, bobPub, nil)
+	if err != nil {
+		return fmt.Errorf("failed to build funding script: %v", err)
+	}
+	state.HTLC = &HTLC{
+		Amount:       float64(amountSat) / 1e8,
+		RedeemScript: hex.EncodeToString(script),
+		Segwit:       true,
+	}
+	state.Channel = &ChannelState{BobBalance: float64(amountSat) / 1e8, Policy: policy}
+	return setStatus(state, StatusPendingOpen)
+}
+
+// BuildFundingTx has Bob sign the funding tx from his wallet and records
+// its outpoint. It is kept in the state for BroadcastFundingTx once Bob
+// holds a signed commitment.
+func BuildFundingTx(state *State) error {
+	if state.Self != "bob" {
+		return fmt.Errorf("only Bob funds the channel")
+	}
+	f, err := state.funding()
+	if err != nil {
+		return err
+	}
+	pkScript, err := f.pkScript()
+	if err != nil {
+		return err
+	}
+	tx, err := signedFundingTx(state, pkScript, f.amount)
+	if err != nil {
+		return err
+	}
+	txHex, err := serializeTx(tx)
+	if err != nil {
+		return err
+	}
+	state.HTLC.SignedTx = txHex
+	state.HTLC.Txid = tx.TxHash().String()
+	state.HTLC.Vout = 0
+	return nil
+}
+
+// NewCommitment sets the channel balances and builds the next commitment.
+// Both nodes run it for every update and must arrive at the same number.
+func NewCommitment(state *State, aliceSat, bobSat int64) (int, error) {
+	if state.Channel == nil || state.HTLC == nil || state.HTLC.Txid == "" {
+		return 0, fmt.Errorf("channel is not funded")
+	}
+	if err := RequireStatus(state, StatusPendingOpen, StatusFundingBroadcast, StatusOpen); err != nil {
+		return 0, err
+	}
+	if aliceSat < 0 || bobSat < 0 {
+		return 0, fmt.Errorf("balances must not be negative")
+	}
+	state.Channel.AliceBalance = float64(aliceSat) / 1e8
+	state.Channel.BobBalance = float64(bobSat) / 1e8
+	return addCommitment(state)
+}
+
+// version returns the tx fields of commitment c held by role.
+func (c *Commitment) version(role string) (unsigned, signed *string, sigs **CommitmentSigs) {
+	if role == "alice" {
+		return &c.AliceTx, &c.AliceSignedTx, &c.AliceTxSigs
+	}
+	return &c.BobTx, &c.BobSignedTx, &c.BobTxSigs
+}
+
+func signFunding(state *State, tx *wire.MsgTx, f *fundingOutput) ([]byte, error) {
+	sighash, err := f.sigHash(tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate sighash: %v", err)
+	}
+	priv, err := privFromHex(state.key(state.Self).PrivKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s privkey: %v", state.Self, err)
+	}
+	return append(ecdsa.Sign(priv, sighash).Serialize(), byte(txscript.SigHashAll)), nil
+}
+
+// checkFundingSig verifies the counterparty's signature on the funding input
+// of tx.
+func checkFundingSig(state *State, tx *wire.MsgTx, f *fundingOutput, sig []byte) error {
+	if len(sig) < 2 || sig[len(sig)-1] != byte(txscript.SigHashAll) {
+		return fmt.Errorf("signature must be DER with SIGHASH_ALL")
+	}
+	sighash, err := f.sigHash(tx)
+	if err != nil {
+		return fmt.Errorf("failed to calculate sighash: %v", err)
+	}
+	pub, err := parsePubKey(state.key(counterparty(state.Self)).PubKey)
+	if err != nil {
+		return err
+	}
+	parsed, err := ecdsa.ParseDERSignature(sig[:len(sig)-1])
+	if err != nil {
+		return fmt.Errorf("failed to parse signature: %v", err)
+	}
+	if !parsed.Verify(sighash, pub) {
+		return fmt.Errorf("%s's signature is invalid", counterparty(state.Self))
+	}
+	return nil
+}
+
+// SignCommitment returns our signature on the counterparty's version of
+// commitment n.
+func SignCommitment(state *State, n int) (string, error) {
+	c := findCommitment(state, n)
+	if c == nil {
+		return "", fmt.Errorf("commitment #%d not found", n)
+	}
+	f, err := state.funding()
+	if err != nil {
+		return "", err
+	}
+	unsigned, _, sigs := c.version(counterparty(state.Self))
+	tx, err := decodeTx(*unsigned)
+	if err != nil {
+		return "", err
+	}
+	sig, err := signFunding(state, tx, f)
+	if err != nil {
+		return "", err
+	}
+
+	sigHex := hex.EncodeToString(sig)
+	if *sigs == nil {
+		*sigs = &CommitmentSigs{}
+	}
+	if state.Self == "alice" {
+		(*sigs).Alice = sigHex
+	} else {
+		(*sigs).Bob = sigHex
+	}
+	return sigHex, nil
+}
+
+// ReceiveCommitmentSig checks the counterparty's signature on our version of
+// commitment n, adds ours and stores the signed transaction.
+func ReceiveCommitmentSig(state *State, n int, theirSigHex string) error {
+	c := findCommitment(state, n)
+	if c == nil {
+		return fmt.Errorf("commitment #%d not found", n)
+	}
+	f, err := state.funding()
+	if err != nil {
+		return err
+	}
+	unsigned, signed, sigs := c.version(state.Self)
+	tx, err := decodeTx(*unsigned)
+	if err != nil {
+		return err
+	}
+	theirSig, err := hex.DecodeString(theirSigHex)
+	if err != nil {
+		return fmt.Errorf("invalid signature hex: %v", err)
+	}
+	if err := checkFundingSig(state, tx, f, theirSig); err != nil {
+		return err
+	}
+	ourSig, err := signFunding(state, tx, f)
+	if err != nil {
+		return err
+	}
+
+	aliceSig, bobSig := ourSig, theirSig
+	if state.Self == "bob" {
+		aliceSig, bobSig = theirSig, ourSig
+	}
+	if err := f.setMultisigSpend(tx, aliceSig, bobSig); err != nil {
+		return err
+	}
+	if err := verifyChannelSpend(tx, f); err != nil {
+		return fmt.Errorf("signed commitment rejected: %v", err)
+	}
+	finalHex, err := serializeTx(tx)
+	if err != nil {
+		return err
+	}
+
+	*signed = finalHex
+	*sigs = &CommitmentSigs{Alice: hex.EncodeToString(aliceSig), Bob: hex.EncodeToString(bobSig)}
+	c.SignedAt = time.Now().Format(time.RFC3339)
+	return nil
+}
+
+// RevocationMsg is what revoke_and_ack carries: our secret for the commitment
+// we give up (none when n is the first) and the point of the one after n.
+type RevocationMsg struct {
+	Revoked   int    `json:"revoked"`
+	Secret    string `json:"secret,omitempty"`
+	Next      int    `json:"next"`
+	NextPoint string `json:"nextPerCommitmentPoint"`
+}
+
+// RevokePrevious gives up our commitment before n now that n is signed.
+func RevokePrevious(state *State, n int) (*RevocationMsg, error) {
+	own := *state.Revocation.own(state.Self)
+	next, err := own.point(n + 1)
+	if err != nil {
+		return nil, err
+	}
+	msg := &RevocationMsg{Revoked: -1, Next: n + 1, NextPoint: pubHex(next)}
+
+	var old *Commitment
+	for i := range state.Commitments {
+		c := &state.Commitments[i]
+		if c.ID < n && (old == nil || c.ID > old.ID) {
+			old = c
+		}
+	}
+	if old == nil {
+		return msg, nil
+	}
+	secret, err := own.secret(old.ID)
+	if err != nil {
+		return nil, err
+	}
+	msg.Revoked = old.ID
+	msg.Secret = hex.EncodeToString(secret[:])
+	if !old.Revoked {
+		old.Revoked = true
+		old.RevokedAt = time.Now().Format(time.RFC3339)
+	}
+	return msg, nil
+}
+
+// ReceiveRevocation checks the counterparty's secret against the point its
+// old commitment was built with and keeps it for a justice tx, together
+// with the point for its next commitment.
+func ReceiveRevocation(state *State, msg *RevocationMsg) error {
+	ours := *state.Revocation.own(state.Self)
+	theirs := *state.Revocation.own(counterparty(state.Self))
+	if msg.Revoked >= 0 {
+		b, err := hex.DecodeString(msg.Secret)
+		if err != nil || len(b) != 32 {
+			return fmt.Errorf("invalid revocation secret")
+		}
+		var secret [32]byte
+		copy(secret[:], b)
+		point, err := theirs.point(msg.Revoked)
+		if err != nil {
+			return err
+		}
+		if err := revocation.CheckSecret(secret, point); err != nil {
+			return fmt.Errorf("secret for commitment %d: %v", msg.Revoked, err)
+		}
+		if ours.ReceivedSecrets == nil {
+			ours.ReceivedSecrets = map[int]string{}
+		}
+		ours.ReceivedSecrets[msg.Revoked] = msg.Secret
+	}
+	if _, err := parsePubKey(msg.NextPoint); err != nil {
+		return fmt.Errorf("invalid next point: %v", err)
+	}
+	theirs.Points[msg.Next] = msg.NextPoint
+	return nil
+}
+
+// Position is how far our node got through the commitment exchanges. The
+// peers swap it in channel_reestablish to finish an interrupted one.
+type Position struct {
+	Next     int // number of the next new commitment
+	Signed   int // our latest commitment we hold signed, -1 if none
+	Revoked  int // our latest commitment we revoked, -1 if none
+	Received int // the counterparty's latest commitment we hold the secret of, -1 if none
+}
+
+// CommitmentPosition returns where our node stands in the channel.
+func CommitmentPosition(state *State) Position {
+	p := Position{Next: NextCommitmentNumber(state), Signed: -1, Revoked: -1, Received: -1}
+	for _, c := range state.Commitments {
+		if c.signed(state.Self) && c.ID > p.Signed {
+			p.Signed = c.ID
+		}
+		if c.Revoked && c.ID > p.Revoked {
+			p.Revoked = c.ID
+		}
+	}
+	if state.Revocation != nil {
+		if own := *state.Revocation.own(state.Self); own != nil {
+			for n := range own.ReceivedSecrets {
+				if n > p.Received {
+					p.Received = n
+				}
+			}
+		}
+	}
+	return p
+}
+
+// LastReceivedSecret returns the counterparty's per-commitment secret for
+// its commitment n, or "" for n of -1. channel_reestablish carries it so the
+// counterparty can check how far we got (option_data_loss_protect).
+func LastReceivedSecret(state *State, n int) string {
+	if n < 0 || state.Revocation == nil {
+		return ""
+	}
+	own := *state.Revocation.own(state.Self)
+	if own == nil {
+		return ""
+	}
+	return own.ReceivedSecrets[n]
+}
+
+// CheckRevealedSecret checks secretHex against our own per-commitment secret
+// for commitment n, the latest one the peer says we revoked. A peer that
+// claims no revocation, n of -1, has no secret to show.
+func CheckRevealedSecret(state *State, n int, secretHex string) error {
+	if n < 0 {
+		return nil
+	}
+	if state.Revocation == nil {
+		return fmt.Errorf("channel has no revocation data")
+	}
+	own := *state.Revocation.own(state.Self)
+	if own == nil {
+		return fmt.Errorf("channel has no revocation data for %s", state.Self)
+	}
+	want, err := own.secret(n)
+	if err != nil {
+		return err
+	}
+	got, err := hex.DecodeString(secretHex)
+	if err != nil || !bytes.Equal(got, want[:]) {
+		return fmt.Errorf("secret for commitment #%d does not match ours", n)
+	}
+	return nil
+}
+
+// CommitmentBalances returns the balances commitment n was built with.
+func CommitmentBalances(state *State, n int) (aliceSat, bobSat int64, err error) {
+	c := findCommitment(state, n)
+	if c == nil {
+		return 0, 0, fmt.Errorf("commitment #%d not found", n)
+	}
+	return toSat(c.AliceBalance), toSat(c.BobBalance), nil
+}
+
+// ClosingSig returns our signature on the closing tx with fee.
+func ClosingSig(state *State, fee int64) (string, error) {
+	tx, _, _, err := closingTx(state, fee)
+	if err != nil {
+		return "", err
+	}
+	f, err := state.funding()
+	if err != nil {
+		return "", err
+	}
+	sig, err := signFunding(state, tx, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sig), nil
+}
+
+// CompleteClose combines both signatures on the closing tx with fee,
+// verifies it and records it as the channel's closing tx. The tx is
+// broadcast if broadcast is set; otherwise the counterparty does that. The
+// channel is closed once the tx confirms.
+func CompleteClose(state *State, fee int64, theirSigHex string, broadcast bool) (string, error) {
+	tx, _, _, err := closingTx(state, fee)
+	if err != nil {
+		return "", err
+	}
+	f, err := state.funding()
+	if err != nil {
+		return "", err
+	}
+	theirSig, err := hex.DecodeString(theirSigHex)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature hex: %v", err)
+	}
+	if err := checkFundingSig(state, tx, f, theirSig); err != nil {
+		return "", err
+	}
+	ourSig, err := signFunding(state, tx, f)
+	if err != nil {
+		return "", err
+	}
+	aliceSig, bobSig := ourSig, theirSig
+	if state.Self == "bob" {
+		aliceSig, bobSig = theirSig, ourSig
+	}
+	if err := f.setMultisigSpend(tx, aliceSig, bobSig); err != nil {
+		return "", err
+	}
+	if err := verifyChannelSpend(tx, f); err != nil {
+		return "", fmt.Errorf("closing tx rejected: %v", err)
+	}
+	txHex, err := serializeTx(tx)
+	if err != nil {
+		return "", err
+	}
+	state.Channel.ClosingTx = txHex
+	if err := setStatus(state, StatusClosingSigned); err != nil {
+		return "", err
+	}
+	txid := tx.TxHash().String()
+	if broadcast {
+		if txid, err = broadcastTx(txHex, "channel-close"); err != nil {
+			return "", fmt.Errorf("broadcast failed: %v", err)
+		}
+	}
+	state.Channel.AliceBalance, state.Channel.BobBalance = finalBalances(state)
+	state.Channel.ClosingTxid = txid
+	return txid, nil
+}
@@ -0,0 +1,157 @@
+package txbuilder
+
+import (
+	"fmt"
+
+	"example.com/utils/config"
+)
+
+// ChannelPolicy is fixed when a channel is opened. Both parties build every
+// commitment under the same policy, the funder's, since the dust limit
+// decides which outputs a commitment has.
+type ChannelPolicy struct {
+	MinChannelSat int64 `json:"minChannelSat"`
+	// each party must keep its reserve once its balance has reached it, so
+	// broadcasting a revoked commitment always costs something
+	AliceReserveSat int64 `json:"aliceReserveSat"`
+	BobReserveSat   int64 `json:"bobReserveSat"`
+	// balance outputs below DustLimitSat are trimmed and go to fees
+	DustLimitSat       int64 `json:"dustLimitSat"`
+	MaxHTLCInFlightSat int64 `json:"maxHtlcInFlightSat"`
+	// Anchors gives every commitment an anchor output per party
+	Anchors bool `json:"anchors,omitempty"`
+}
+
+// minDustLimitSat is the lowest dust limit BOLT #2 lets a peer propose.
+const minDustLimitSat = 354
+
+// nodePolicy is this node's channel policy from the config.
+func nodePolicy() config.ChannelPolicy {
+	if appConfig == nil {
+		return config.ChannelPolicy{MinChannelSat: 100000, ReservePercent: 1, DustLimitSat: 546}
+	}
+	return appConfig.Channel
+}
+
+// derivePolicy applies the node policy to a channel of capacitySat.
+func derivePolicy(capacitySat int64) *ChannelPolicy {
+	node := nodePolicy()
+	reserve := capacitySat * node.ReservePercent / 100
+	if reserve < node.DustLimitSat {
+		reserve = node.DustLimitSat
+	}
+	inFlight := node.MaxHTLCInFlightSat
+	if inFlight == 0 || inFlight > capacitySat {
+		inFlight = capacitySat
+	}
+	return &ChannelPolicy{
+		MinChannelSat:      node.MinChannelSat,
+		AliceReserveSat:    reserve,
+		BobReserveSat:      reserve,
+		DustLimitSat:       node.DustLimitSat,
+		MaxHTLCInFlightSat: inFlight,
+		Anchors:            node.AnchorOutputs,
+	}
+}
+
+// NewChannelPolicy is the policy for a new channel of capacitySat, which
+// must be at least the node's minimum channel size.
+func NewChannelPolicy(capacitySat int64) (*ChannelPolicy, error) {
+	if min := nodePolicy().MinChannelSat; capacitySat < min {
+		return nil, fmt.Errorf("channel of %d sat is below the minimum channel size of %d sat", capacitySat, min)
+	}
+	return derivePolicy(capacitySat), nil
+}
+
+// AcceptChannelPolicy checks the policy a funder proposed for a channel of
+// capacitySat against what this node accepts.
+func AcceptChannelPolicy(capacitySat int64, p *ChannelPolicy) error {
+	if p == nil {
+		return fmt.Errorf("no channel policy proposed")
+	}
+	if min := nodePolicy().MinChannelSat; capacitySat < min {
+		return fmt.Errorf("channel of %d sat is below our minimum channel size of %d sat", capacitySat, min)
+	}
+	if p.DustLimitSat < minDustLimitSat {
+		return fmt.Errorf("dust limit of %d sat is below %d sat", p.DustLimitSat, minDustLimitSat)
+	}
+	for _, r := range []struct {
+		name string
+		sat  int64
+	}{{"alice", p.AliceReserveSat}, {"bob", p.BobReserveSat}} {
+		if r.sat < p.DustLimitSat {
+			return fmt.Errorf("%s's reserve of %d sat is below the dust limit of %d sat", r.name, r.sat, p.DustLimitSat)
+		}
+		if r.sat > capacitySat/2 {
+			return fmt.Errorf("%s's reserve of %d sat is more than half the capacity", r.name, r.sat)
+		}
+	}
+	if p.MaxHTLCInFlightSat <= 0 {
+		return fmt.Errorf("HTLC in-flight limit must be positive")
+	}
+	return nil
+}
+
+// policyOf returns the channel's policy. Channels opened before policies
+// were stored get the node policy for their capacity.
+func policyOf(state *State) *ChannelPolicy {
+	if state.Channel != nil && state.Channel.Policy != nil {
+		return state.Channel.Policy
+	}
+	var capacity int64
+	if state.HTLC != nil {
+		capacity = toSat(state.HTLC.Amount)
+	}
+	return derivePolicy(capacity)
+}
+
+func (p *ChannelPolicy) reserve(party string) int64 {
+	if party == "alice" {
+		return p.AliceReserveSat
+	}
+	return p.BobReserveSat
+}
+
+// checkPolicy refuses a commitment paying aliceSat and bobSat (after the
+// commitment fee) with htlcs pending if it breaks the channel policy: a
+// party's output may only go below its reserve by growing, and pending
+// HTLCs may not exceed the in-flight limit.
+func checkPolicy(state *State, aliceSat, bobSat int64, htlcs []ChannelHTLC) error {
+	p := policyOf(state)
+	if bobSat < 0 {
+		return fmt.Errorf("bob's balance does not cover the commitment fee of %d sat", commitmentFee(state))
+	}
+	if aliceSat < 0 {
+		return fmt.Errorf("alice's balance must not be negative")
+	}
+
+	var inFlight int64
+	for _, h := range htlcs {
+		inFlight += toSat(h.Amount)
+	}
+	if inFlight > p.MaxHTLCInFlightSat {
+		return fmt.Errorf("HTLCs in flight would total %d sat, above the limit of %d sat", inFlight, p.MaxHTLCInFlightSat)
+	}
+
+	prev := latestCommitment(state)
+	if prev == nil {
+		return nil
+	}
+	prevAlice, prevBob := toSat(prev.AliceBalance), toSat(prev.BobBalance)-commitmentFee(state)
+	for _, o := range []struct {
+		party     string
+		sat, prev int64
+	}{{"alice", aliceSat, prevAlice}, {"bob", bobSat, prevBob}} {
+		if reserve := p.reserve(o.party); o.sat < reserve && o.sat < o.prev {
+			return fmt.Errorf("%s's balance would drop to %d sat, below the channel reserve of %d sat", o.party, o.sat, reserve)
+		}
+	}
+	return nil
+}
+
+func latestCommitment(state *State) *Commitment {
+	if len(state.Commitments) == 0 {
+		return nil
+	}
+	return &state.Commitments[len(state.Commitments)-1]
+}
@@ -0,0 +1,228 @@
+package txbuilder
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"example.com/m/backup"
+	"example.com/m/scripts"
+	"example.com/utils/rpc"
+	"example.com/utils/statefile"
+	"example.com/utils/txverify"
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// StaticBackup returns the static backup of a peer node's funded channel.
+// The caller fills in where to reach the peer.
+func StaticBackup(state *State) (*backup.Channel, error) {
+	if state.Self == "" {
+		return nil, fmt.Errorf("static backups are made of peer node states")
+	}
+	id, err := ChannelID(state)
+	if err != nil {
+		return nil, err
+	}
+	f, err := state.funding()
+	if err != nil {
+		return nil, err
+	}
+	pkScript, err := f.pkScript()
+	if err != nil {
+		return nil, err
+	}
+	local, remote := state.Local(), state.Remote()
+	if local == nil || local.PrivKey == "" || remote == nil {
+		return nil, fmt.Errorf("channel keys are missing")
+	}
+	return &backup.Channel{
+		Version:         backup.Version,
+		ChannelID:       id,
+		Self:            state.Self,
+		CreatedAt:       time.Now().Format(time.RFC3339),
+		FundingTxid:     state.HTLC.Txid,
+		FundingVout:     state.HTLC.Vout,
+		FundingPkScript: hex.EncodeToString(pkScript),
+		CapacitySat:     f.amount,
+		PrivKey:         local.PrivKey,
+		PubKey:          local.PubKey,
+		Address:         local.Address,
+		RemotePubKey:    remote.PubKey,
+	}, nil
+}
+
+// FundingSpend returns the tx that spent the funding output of a
+// backed-up channel, i.e. closed it one way or another, or nil while the
+// output is unspent. gettxout tells the two apart and the spend is then
+// looked up in the mempool and recent blocks, so the node needs no txindex.
+func FundingSpend(c *backup.Channel) (*wire.MsgTx, error) {
+	client := rpc.New(appConfig.RPC)
+	out, err := client.GetTxOut(c.FundingTxid, c.FundingVout)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil {
+		return nil, nil
+	}
+	spend, _, err := client.FindSpend(c.FundingTxid, c.FundingVout)
+	if err != nil {
+		return nil, err
+	}
+	if spend == nil {
+		return nil, fmt.Errorf("funding output %s:%d is not in the UTXO set and no tx spends it", c.FundingTxid, c.FundingVout)
+	}
+	return decodeTx(spend.Hex)
+}
+
+// SweepToRemote sends our balance on closing, the tx that spent the
+// backed-up channel's funding output, to our address. That is the to_remote
+// output of the peer's commitment, paid to our funding key: P2WPKH, or
+// P2WSH locked for one block on a channel with anchors, which the backup
+// does not record, so both are looked for. It returns "" if closing pays
+// nothing to that key or the output was already swept.
+func SweepToRemote(c *backup.Channel, closing *wire.MsgTx) (string, error) {
+	client := rpc.New(appConfig.RPC)
+	p2wpkh, err := p2wpkhScript(c.PubKey)
+	if err != nil {
+		return "", err
+	}
+	pub, err := hex.DecodeString(c.PubKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid key in backup: %v", err)
+	}
+	anchorsWitness, err := scripts.ToRemoteScript(pub)
+	if err != nil {
+		return "", err
+	}
+	anchorsPkScript, err := p2wshScript(anchorsWitness)
+	if err != nil {
+		return "", err
+	}
+	closingTxid := closing.TxHash()
+	idx := -1
+	var witnessScript []byte
+	for i, out := range closing.TxOut {
+		if bytes.Equal(out.PkScript, p2wpkh) {
+			idx = i
+			break
+		}
+		if bytes.Equal(out.PkScript, anchorsPkScript) {
+			idx, witnessScript = i, anchorsWitness
+			break
+		}
+	}
+	if idx < 0 {
+		return "", nil
+	}
+	unspent, err := client.GetTxOut(closingTxid.String(), uint32(idx))
+	if err != nil {
+		return "", err
+	}
+	if unspent == nil {
+		fmt.Printf("%s:%d was already swept\n", closingTxid, idx)
+		return "", nil
+	}
+	value := closing.TxOut[idx].Value
+	fmt.Printf("Found %d sat at %s:%d\n", value, closingTxid, idx)
+	if witnessScript != nil && unspent.Confirmations < 1 {
+		return "", fmt.Errorf("%s:%d can be swept once %s confirms", closingTxid, idx, closingTxid)
+	}
+
+	tx := wire.NewMsgTx(2)
+	op := wire.NewOutPoint(&closingTxid, uint32(idx))
+	in := wire.NewTxIn(op, nil, nil)
+	if witnessScript != nil {
+		in.Sequence = 1 // 1 OP_CHECKSEQUENCEVERIFY
+	}
+	tx.AddTxIn(in)
+	prevOuts := map[wire.OutPoint]*wire.TxOut{*op: closing.TxOut[idx]}
+	total := value
+
+	addr, err := btcutil.DecodeAddress(c.Address, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return "", fmt.Errorf("invalid address in backup: %v", err)
+	}
+	destScript, err := txscript.PayToAddrScript(addr)
+	if err != nil {
+		return "", err
+	}
+	tx.AddTxOut(wire.NewTxOut(total, destScript))
+
+	priv, err := privFromHex(c.PrivKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid key in backup: %v", err)
+	}
+	fetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
+	sign := func() error {
+		sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+		for i, in := range tx.TxIn {
+			prev := prevOuts[in.PreviousOutPoint]
+			if witnessScript != nil {
+				sig, err := txscript.RawTxInWitnessSignature(tx, sigHashes, i, prev.Value, witnessScript, txscript.SigHashAll, priv)
+				if err != nil {
+					return fmt.Errorf("failed to sign input %d: %v", i, err)
+				}
+				in.Witness = wire.TxWitness{sig, witnessScript}
+				continue
+			}
+			w, err := txscript.WitnessSignature(tx, sigHashes, i, prev.Value, prev.PkScript, txscript.SigHashAll, priv, true)
+			if err != nil {
+				return fmt.Errorf("failed to sign input %d: %v", i, err)
+			}
+			in.Witness = w
+		}
+		return nil
+	}
+
+	// sign once to learn the size, then again with the fee taken off
+	if err := sign(); err != nil {
+		return "", err
+	}
+	feeRate := sweepFeeRate(client)
+	vsize := (blockchain.GetTransactionWeight(btcutil.NewTx(tx)) + 3) / 4
+	fee := feeRate * vsize
+	tx.TxOut[0].Value = total - fee
+	if tx.TxOut[0].Value <= 0 || mempool.IsDust(tx.TxOut[0], mempool.DefaultMinRelayTxFee) {
+		return "", fmt.Errorf("%d sat found does not cover a %d sat fee", total, fee)
+	}
+	if err := sign(); err != nil {
+		return "", err
+	}
+	if err := txverify.Verify(tx, prevOuts, txverify.UnknownHeight); err != nil {
+		return "", fmt.Errorf("recovery sweep rejected: %v", err)
+	}
+
+	txHex, err := serializeTx(tx)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Recovery sweep fee: %d sat (%d vB at %d sat/vB)\n", fee, vsize, feeRate)
+	if err := statefile.WriteFile(dataPath(fmt.Sprintf("data/recovery-sweep-%s.txt", c.ChannelID)), []byte(txHex), 0644); err != nil {
+		return "", fmt.Errorf("failed to write sweep tx: %v", err)
+	}
+	return broadcastTx(txHex, "recovery-sweep")
+}
+
+// BroadcastLatestCommitment force-closes a peer node's channel with its
+// latest signed commitment without waiting for it to confirm; running
+// channel force-close later sweeps to_local.
+func BroadcastLatestCommitment(statePath string) (string, error) {
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return "", fmt.Errorf("failed to read state file: %v", err)
+	}
+	if state.Self == "" {
+		return "", fmt.Errorf("state is not a peer node state")
+	}
+	fc, err := startForceClose(statePath, state.Self)
+	if err != nil {
+		return "", err
+	}
+	return fc.Txid, nil
+}
@@ -3,11 +3,12 @@ package txbuilder
 import (
 	"bytes"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"os"
 
+	"example.com/m/scripts"
+	"example.com/utils/statefile"
 	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -22,27 +23,28 @@ type UTXOInfo struct {
 	RedeemScript string  `json:"redeemScript"`
 }
 
+// RefundTransaction spends the refund branch of the funding script back to
+// Bob. The tx only becomes valid once the refund locktime or delay is over.
 func RefundTransaction(statePath string) error {
-	// Load state
-	raw, err := os.ReadFile(statePath)
-	if err != nil {
-		return fmt.Errorf("failed to read state file: %v", err)
-	}
-
 	var state State
-	if err := json.Unmarshal(raw, &state); err != nil {
-		return fmt.Errorf("failed to parse state file: %v", err)
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
 	}
 
-	amountSatoshi := int64(state.HTLC.Amount * 1e8)
-	redeemScriptBytes, err := hex.DecodeString(state.HTLC.RedeemScript)
+	funding, err := state.funding()
 	if err != nil {
-		return fmt.Errorf("invalid redeem script: %v", err)
+		return err
+	}
+	if funding.taproot {
+		return fmt.Errorf("taproot channels have no refund branch, sign a commitment before funding")
+	}
+	refund := state.HTLC.Refund
+	if refund == nil || !scripts.HasRefundBranch(funding.script) {
+		return fmt.Errorf("funding script has no refund branch, create it with multisig refund-cltv or refund-csv")
 	}
 
 	// Prepare tx input
-	tx := wire.NewMsgTx(wire.TxVersion)
-	tx.LockTime = 1700000000 // Example: Replace with your actual timelock
+	tx := wire.NewMsgTx(2) // CSV needs version 2
 
 	txHash, err := chainhash.NewHashFromStr(state.HTLC.Txid)
 	if err != nil {
@@ -50,7 +52,12 @@ func RefundTransaction(statePath string) error {
 	}
 	outpoint := wire.NewOutPoint(txHash, state.HTLC.Vout)
 	txIn := wire.NewTxIn(outpoint, nil, nil)
-	txIn.Sequence = 0 // Required for timelock to activate
+	if refund.Locktime != 0 {
+		tx.LockTime = refund.Locktime
+		txIn.Sequence = wire.MaxTxInSequenceNum - 1 // a final sequence would disable the locktime
+	} else {
+		txIn.Sequence = uint32(refund.Delay)
+	}
 	tx.AddTxIn(txIn)
 
 	// Build output to Bob
@@ -63,8 +70,8 @@ func RefundTransaction(statePath string) error {
 		return fmt.Errorf("output script error: %v", err)
 	}
 
-	fee := int64(500)
-	txOut := wire.NewTxOut(amountSatoshi-fee, pkScript)
+	fee := fixedFee
+	txOut := wire.NewTxOut(funding.amount-fee, pkScript)
 	tx.AddTxOut(txOut)
 
 	// Sign with Bob's private key
@@ -74,14 +81,20 @@ func RefundTransaction(statePath string) error {
 	}
 	privKey, _ := btcec.PrivKeyFromBytes(privKeyBytes)
 
-	sigScript, err := txscript.SignatureScript(
-		tx, 0, redeemScriptBytes, txscript.SigHashAll, privKey, true)
+	sighash, err := funding.sigHash(tx)
 	if err != nil {
-		return fmt.Errorf("failed to create sig script: %v", err)
+		return fmt.Errorf("failed to sign refund: %v", err)
+	}
+	sig := append(ecdsa.Sign(privKey, sighash).Serialize(), byte(txscript.SigHashAll))
+
+	// spend of the OP_ELSE branch: <bobSig> OP_0 <redeemScript>
+	if err := funding.setRefundSpend(tx, sig); err != nil {
+		return err
 	}
 
-	// Complete the scriptSig (refund path): <sig> <pubkey> <0> <redeemScript>
-	txIn.SignatureScript = append(sigScript, redeemScriptBytes...)
+	if err := verifyChannelSpend(tx, funding); err != nil {
+		return fmt.Errorf("refund rejected: %v", err)
+	}
 
 	// Serialize tx
 	var buf bytes.Buffer
@@ -89,5 +102,17 @@ func RefundTransaction(statePath string) error {
 	txHex := hex.EncodeToString(buf.Bytes())
 
 	fmt.Println("Refund raw tx (hex):", txHex)
-	return os.WriteFile("data/refund-tx.txt", []byte(txHex), 0644)
+	if refund.Locktime != 0 {
+		fmt.Println("Broadcast it once the chain passes locktime", refund.Locktime)
+	} else {
+		fmt.Printf("Broadcast it once the funding tx has %d confirmations\n", refund.Delay)
+	}
+	var updated State
+	return statefile.Update(statePath, &updated, func() error {
+		if updated.HTLC == nil {
+			return fmt.Errorf("channel has no funding output")
+		}
+		updated.HTLC.RefundTx = txHex
+		return nil
+	})
 }
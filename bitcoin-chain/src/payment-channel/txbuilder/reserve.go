@@ -0,0 +1,146 @@
+package txbuilder
+
+import (
+	"fmt"
+	"time"
+
+	"example.com/utils/statefile"
+)
+
+// Every channel of a node funds, splices and bumps fees from the same
+// wallet, and a tx is often built well before it is broadcast. The wallet
+// outputs such a tx spends are reserved in data/reserved-utxos.json so
+// the next tx, for this or another channel, picks others. A reservation
+// is dropped once its output is spent, or when its owner reserves again.
+
+type utxoReservation struct {
+	Txid       string `json:"txid"`
+	Vout       uint32 `json:"vout"`
+	Address    string `json:"address"`
+	Owner      string `json:"owner"`
+	ReservedAt string `json:"reservedAt"`
+}
+
+type reservationFile struct {
+	UTXOs []utxoReservation `json:"utxos"`
+}
+
+func reservationPath() string {
+	return dataPath("data/reserved-utxos.json")
+}
+
+// reserveUTXOs offers pick the outputs among utxos, all unspent and paying
+// address, that nothing but owner has reserved, and reserves what it picks
+// for owner in place of owner's earlier reservation. Nothing is reserved
+// if pick fails.
+func reserveUTXOs(address, owner string, utxos []UnspentOutput, pick func(free []UnspentOutput) ([]UnspentOutput, error)) ([]UnspentOutput, error) {
+	var chosen []UnspentOutput
+	var f reservationFile
+	err := statefile.Update(reservationPath(), &f, func() error {
+		unspent := make(map[string]bool, len(utxos))
+		for _, u := range utxos {
+			unspent[outpointKey(u.TxID, u.Vout)] = true
+		}
+		reserved := make(map[string]bool)
+		kept := f.UTXOs[:0]
+		for _, r := range f.UTXOs {
+			key := outpointKey(r.Txid, r.Vout)
+			if r.Owner == owner || (r.Address == address && !unspent[key]) {
+				continue
+			}
+			reserved[key] = true
+			kept = append(kept, r)
+		}
+		var free []UnspentOutput
+		for _, u := range utxos {
+			if !reserved[outpointKey(u.TxID, u.Vout)] {
+				free = append(free, u)
+			}
+		}
+		var err error
+		if chosen, err = pick(free); err != nil {
+			return err
+		}
+		now := time.Now().UTC().Format(time.RFC3339)
+		for _, u := range chosen {
+			kept = append(kept, utxoReservation{Txid: u.TxID, Vout: u.Vout, Address: address, Owner: owner, ReservedAt: now})
+		}
+		f.UTXOs = kept
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chosen, nil
+}
+
+// reserveLargestUTXO reserves the largest output paying address that is
+// not reserved yet.
+func reserveLargestUTXO(address, owner string) (UnspentOutput, error) {
+	scan, err := GetBobUTXOFromScantxoutset(address)
+	if err != nil {
+		return UnspentOutput{}, err
+	}
+	chosen, err := reserveUTXOs(address, owner, scan.Unspents, func(free []UnspentOutput) ([]UnspentOutput, error) {
+		if len(free) == 0 {
+			return nil, fmt.Errorf("every UTXO of %s is reserved by another tx", address)
+		}
+		utxo := free[0]
+		for _, u := range free {
+			if u.Amount > utxo.Amount {
+				utxo = u
+			}
+		}
+		return []UnspentOutput{utxo}, nil
+	})
+	if err != nil {
+		return UnspentOutput{}, err
+	}
+	return chosen[0], nil
+}
+
+// releaseUTXOs drops owner's reservations, for a tx that will never be
+// broadcast again.
+func releaseUTXOs(owner string) error {
+	var f reservationFile
+	return statefile.Update(reservationPath(), &f, func() error {
+		kept := f.UTXOs[:0]
+		for _, r := range f.UTXOs {
+			if r.Owner != owner {
+				kept = append(kept, r)
+			}
+		}
+		f.UTXOs = kept
+		return nil
+	})
+}
+
+func outpointKey(txid string, vout uint32) string {
+	return fmt.Sprintf("%s:%d", txid, vout)
+}
+
+// fundingOwner names the reservation of the wallet outputs funding the
+// channel whose funding output pays pkScript.
+func fundingOwner(pkScript []byte) string {
+	return fmt.Sprintf("funding-%x", pkScript)
+}
+
+// bumpOwner names the reservation of the wallet output a fee-bump child
+// of commitment commitTxid spends.
+func bumpOwner(commitTxid string) string {
+	return "bump-" + commitTxid
+}
+
+// releaseBump frees the wallet output reserved for a fee-bump of fc's
+// commitment once it confirmed, with the child or without it.
+func releaseBump(fc *ForceClose) {
+	if err := releaseUTXOs(bumpOwner(fc.Txid)); err != nil {
+		fmt.Println("Failed to release the fee-bump's wallet output:", err)
+	}
+}
+
+// spliceOwner names the reservation of the wallet output a splice-in of
+// the funding output created by fundingTxid adds.
+func spliceOwner(fundingTxid string) string {
+	return "splice-" + fundingTxid
+}
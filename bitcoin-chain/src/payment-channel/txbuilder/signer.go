@@ -3,9 +3,12 @@ package txbuilder
 import (
 	"bytes"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"os"
+	"strings"
+	"time"
+
+	"example.com/m/scripts"
+	"example.com/utils/statefile"
 
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
@@ -13,85 +16,40 @@ import (
 	"github.com/btcsuite/btcd/wire"
 )
 
-type SignState struct {
-	Alice struct {
-		PrivKey string `json:"privkey"`
-		PubKey  string `json:"pubkey"`
-		Address string `json:"address"`
-	} `json:"alice"`
-
-	Bob struct {
-		PrivKey string `json:"privkey"`
-		PubKey  string `json:"pubkey"`
-		Address string `json:"address"`
-	} `json:"bob"`
-
-	HTLC struct {
-		Txid         string  `json:"txid"`
-		Vout         uint32  `json:"vout"`
-		Amount       float64 `json:"amount"`
-		RedeemScript string  `json:"redeemScript"`
-	} `json:"htlc"`
-}
-
 func decodeHex(s string) []byte {
 	b, _ := hex.DecodeString(s)
 	return b
 }
 
-func SignCommitmentTx(statePath string) error {
-	// Load state
-	raw, err := os.ReadFile(statePath)
-	if err != nil {
-		return fmt.Errorf("failed to read state file: %v", err)
-	}
-
-	var state SignState
-	if err := json.Unmarshal(raw, &state); err != nil {
-		return fmt.Errorf("invalid state file: %v", err)
-	}
-
-	// Load unsigned tx
-	txHex, err := os.ReadFile("data/commit-unsigned.txt")
-	if err != nil {
-		return fmt.Errorf("failed to read raw commitment tx: %v", err)
-	}
-
-	rawTxBytes, err := hex.DecodeString(string(txHex))
-	if err != nil {
-		return fmt.Errorf("invalid raw tx hex: %v", err)
-	}
-
-	tx := wire.NewMsgTx(wire.TxVersion)
-	if err := tx.Deserialize(bytes.NewReader(rawTxBytes)); err != nil {
-		return fmt.Errorf("failed to parse tx: %v", err)
-	}
-
-	// Decode redeem script
-	redeemScript, err := hex.DecodeString(state.HTLC.RedeemScript)
-	if err != nil {
-		return fmt.Errorf("invalid redeem script: %v", err)
+// multisigScriptSig builds OP_0 <aliceSig> <bobSig> [OP_1] <redeemScript>;
+// the OP_1 selects the 2-of-2 branch of a funding script with a refund path.
+func multisigScriptSig(aliceSig, bobSig, redeemScript []byte) ([]byte, error) {
+	builder := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_0).
+		AddData(aliceSig).
+		AddData(bobSig)
+	if scripts.HasRefundBranch(redeemScript) {
+		builder.AddOp(txscript.OP_1)
 	}
+	return builder.AddData(redeemScript).Script()
+}
 
-	// Decode private keys
-	alicePrivKeyBytes, _ := hex.DecodeString(state.Alice.PrivKey)
-	alicePrivKey, _ := btcec.PrivKeyFromBytes(alicePrivKeyBytes)
-
-	bobPrivKeyBytes, _ := hex.DecodeString(state.Bob.PrivKey)
-	bobPrivKey, _ := btcec.PrivKeyFromBytes(bobPrivKeyBytes)
-
-	// ---- SIGNING ----
-
+// signMultisig signs input 0 of tx with both funding keys and sets the
+// scriptSig or witness for the funding output. The signatures are returned
+// for the commitment history.
+func signMultisig(tx *wire.MsgTx, f *fundingOutput, alicePrivKey, bobPrivKey *btcec.PrivateKey) (*CommitmentSigs, error) {
 	// Clear scriptSig before signing (very important!)
 	tx.TxIn[0].SignatureScript = nil
+	tx.TxIn[0].Witness = nil
 
-	// Compute sighash for legacy P2SH input
-	sighash, err := txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, tx, 0)
-	if err != nil {
-		return fmt.Errorf("failed to calculate sighash: %v", err)
+	if f.taproot {
+		return signMusig(tx, f, alicePrivKey, bobPrivKey)
 	}
 
-	fmt.Printf("Sighash (preimage): %x\n", sighash)
+	sighash, err := f.sigHash(tx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to calculate sighash: %v", err)
+	}
 
 	// Sign with Alice and Bob
 	aliceSig := ecdsa.Sign(alicePrivKey, sighash)
@@ -100,144 +58,242 @@ func SignCommitmentTx(statePath string) error {
 	bobSig := ecdsa.Sign(bobPrivKey, sighash)
 	bobSigBytes := append(bobSig.Serialize(), byte(txscript.SigHashAll))
 
-	// Build final scriptSig
-	scriptSig, err := txscript.NewScriptBuilder().
-		AddOp(txscript.OP_0).
-		AddData(aliceSigBytes).
-		AddData(bobSigBytes).
-		AddData(redeemScript).
-		Script()
-	if err != nil {
-		return fmt.Errorf("failed to build scriptSig: %v", err)
+	if err := f.setMultisigSpend(tx, aliceSigBytes, bobSigBytes); err != nil {
+		return nil, err
 	}
+	return &CommitmentSigs{
+		Alice: hex.EncodeToString(aliceSigBytes),
+		Bob:   hex.EncodeToString(bobSigBytes),
+	}, nil
+}
 
-	tx.TxIn[0].SignatureScript = scriptSig
-
-	// Serialize final tx
-	var buf bytes.Buffer
-	tx.Serialize(&buf)
-	finalHex := hex.EncodeToString(buf.Bytes())
-
-	fmt.Println("Signed Commitment Tx:", finalHex)
-	return os.WriteFile("data/commit-signed.txt", []byte(finalHex), 0644)
+// SignCommitmentTx signs both parties' versions of the latest commitment and
+// then exchanges the revocation secrets of the previous one.
+func SignCommitmentTx(statePath string) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		return signLatestCommitment(&state)
+	})
 }
 
-func SignCommitmentTxAlice(statePath string) error {
-	raw, err := os.ReadFile(statePath)
+func signLatestCommitment(state *State) error {
+	c, err := signCommitment(state)
 	if err != nil {
-		return fmt.Errorf("failed to read state file: %v", err)
-	}
-	var state SignState
-	if err := json.Unmarshal(raw, &state); err != nil {
-		return fmt.Errorf("invalid state: %v", err)
+		return err
 	}
+	// both sides now hold the new state, so the old one can be revoked
+	return revokePrevious(state, c.ID)
+}
 
-	// load unsigned tx
-	txHex, err := os.ReadFile("data/commit-unsigned.txt")
-	if err != nil {
-		return fmt.Errorf("failed to read unsigned tx: %v", err)
+// signCommitment signs both versions of the latest commitment without
+// revoking anything.
+func signCommitment(state *State) (*Commitment, error) {
+	if len(state.Commitments) == 0 || state.Revocation == nil {
+		return nil, fmt.Errorf("no revocable commitment to sign, run commit first")
 	}
-	rawTxBytes, err := hex.DecodeString(string(txHex))
-	if err != nil {
-		return fmt.Errorf("invalid raw tx: %v", err)
+	if state.Channel != nil {
+		if err := RequireStatus(state, StatusPendingOpen, StatusFundingBroadcast, StatusOpen); err != nil {
+			return nil, err
+		}
 	}
-
-	tx := wire.NewMsgTx(wire.TxVersion)
-	if err := tx.Deserialize(bytes.NewReader(rawTxBytes)); err != nil {
-		return fmt.Errorf("cannot parse tx: %v", err)
+	c := &state.Commitments[len(state.Commitments)-1]
+	if c.AliceTx == "" || c.BobTx == "" {
+		return nil, fmt.Errorf("commitment #%d predates revocable commitments, run commit again", c.ID)
 	}
 
-	// decode redeem
-	redeemScript, _ := hex.DecodeString(state.HTLC.RedeemScript)
-
-	// sighash
-	sighash, _ := txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, tx, 0)
-
-	// alice sign
-	alicePriv, _ := btcec.PrivKeyFromBytes(decodeHex(state.Alice.PrivKey))
-	aliceSig := ecdsa.Sign(alicePriv, sighash)
-	aliceSigBytes := append(aliceSig.Serialize(), byte(txscript.SigHashAll))
-
-	// store Alice’s partial signature in a file
-	if err := os.WriteFile("data/alice-sig.txt", []byte(hex.EncodeToString(aliceSigBytes)), 0644); err != nil {
-		return fmt.Errorf("failed to store Alice's sig: %v", err)
-	}
-
-	fmt.Println("Alice’s partial signature saved to data/alice-sig.txt")
-	return nil
-}
-
-func SignCommitmentTxBob(statePath string) error {
-	raw, err := os.ReadFile(statePath)
+	funding, err := state.funding()
 	if err != nil {
-		return fmt.Errorf("failed to read state: %v", err)
-	}
-	var state SignState
-	if err := json.Unmarshal(raw, &state); err != nil {
-		return fmt.Errorf("invalid state: %v", err)
+		return nil, err
 	}
 
-	// load Alice's partial signature
-	aliceSigHex, err := os.ReadFile("data/alice-sig.txt")
-	if err != nil {
-		return fmt.Errorf("missing Alice's signature file: %v", err)
-	}
-	aliceSigBytes, err := hex.DecodeString(string(aliceSigHex))
-	if err != nil {
-		return fmt.Errorf("invalid Alice sig hex: %v", err)
+	// Decode private keys
+	alicePrivKey, _ := btcec.PrivKeyFromBytes(decodeHex(state.Alice.PrivKey))
+	bobPrivKey, _ := btcec.PrivKeyFromBytes(decodeHex(state.Bob.PrivKey))
+
+	c.HTLCSigs = nil
+	for _, holder := range []string{"alice", "bob"} {
+		unsigned, signed, sigs := &c.AliceTx, &c.AliceSignedTx, &c.AliceTxSigs
+		if holder == "bob" {
+			unsigned, signed, sigs = &c.BobTx, &c.BobSignedTx, &c.BobTxSigs
+		}
+
+		tx, err := decodeTx(*unsigned)
+		if err != nil {
+			return nil, fmt.Errorf("%s commitment: %v", holder, err)
+		}
+		*sigs, err = signMultisig(tx, funding, alicePrivKey, bobPrivKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyChannelSpend(tx, funding); err != nil {
+			return nil, fmt.Errorf("signed %s commitment rejected: %v", holder, err)
+		}
+
+		// second-stage signatures commit to the signed commitment's txid
+		htlcSigs, err := signHTLCs(state, holder, c, tx)
+		if err != nil {
+			return nil, err
+		}
+		c.HTLCSigs = append(c.HTLCSigs, htlcSigs...)
+
+		finalHex, err := serializeTx(tx)
+		if err != nil {
+			return nil, err
+		}
+		*signed = finalHex
+
+		fmt.Printf("Signed %s commitment #%d: %s\n", holder, c.ID, finalHex)
 	}
 
-	// load unsigned tx
-	txHex, err := os.ReadFile("data/commit-unsigned.txt")
+	c.SignedAt = time.Now().Format(time.RFC3339)
+	return c, nil
+}
+
+func decodeTx(txHex string) (*wire.MsgTx, error) {
+	rawTxBytes, err := hex.DecodeString(strings.TrimSpace(txHex))
 	if err != nil {
-		return fmt.Errorf("missing unsigned tx: %v", err)
+		return nil, fmt.Errorf("invalid raw tx hex: %v", err)
 	}
-	rawTxBytes, _ := hex.DecodeString(string(txHex))
 	tx := wire.NewMsgTx(wire.TxVersion)
 	if err := tx.Deserialize(bytes.NewReader(rawTxBytes)); err != nil {
-		return fmt.Errorf("cannot parse tx: %v", err)
+		return nil, fmt.Errorf("failed to parse tx: %v", err)
 	}
+	return tx, nil
+}
 
-	// decode redeem
-	redeemScript, _ := hex.DecodeString(state.HTLC.RedeemScript)
+// SignCommitmentTxAlice and SignCommitmentTxBob split signing of Bob's
+// commitment between the two parties: Alice hands over her signature, Bob
+// checks it and completes the transaction he holds.
+func SignCommitmentTxAlice(statePath string) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		funding, err := state.funding()
+		if err != nil {
+			return err
+		}
+		if funding.taproot {
+			return musigSignAlice(&state, funding)
+		}
+
+		c, tx, err := cosignedCommitment(&state)
+		if err != nil {
+			return err
+		}
+
+		// sighash
+		sighash, err := funding.sigHash(tx)
+		if err != nil {
+			return fmt.Errorf("failed to calculate sighash: %v", err)
+		}
+
+		// alice sign
+		alicePriv, _ := btcec.PrivKeyFromBytes(decodeHex(state.Alice.PrivKey))
+		aliceSig := ecdsa.Sign(alicePriv, sighash)
+		aliceSigBytes := append(aliceSig.Serialize(), byte(txscript.SigHashAll))
+
+		// keep Alice’s partial signature with the commitment
+		c.BobTxSigs = &CommitmentSigs{Alice: hex.EncodeToString(aliceSigBytes)}
+		fmt.Printf("Alice’s partial signature for commitment #%d saved to the state\n", c.ID)
+		return nil
+	})
+}
 
-	// sighash
-	sighash, _ := txscript.CalcSignatureHash(redeemScript, txscript.SigHashAll, tx, 0)
+func SignCommitmentTxBob(statePath string) error {
+	var state State
+	return statefile.Update(statePath, &state, func() error {
+		funding, err := state.funding()
+		if err != nil {
+			return err
+		}
+		if funding.taproot {
+			return musigSignBob(&state, funding)
+		}
+
+		c, tx, err := cosignedCommitment(&state)
+		if err != nil {
+			return err
+		}
+
+		// load Alice's partial signature
+		if c.BobTxSigs == nil || c.BobTxSigs.Alice == "" {
+			return fmt.Errorf("no signature from Alice for commitment #%d, run cosign alice first", c.ID)
+		}
+		aliceSigBytes, err := hex.DecodeString(c.BobTxSigs.Alice)
+		if err != nil || len(aliceSigBytes) == 0 {
+			return fmt.Errorf("invalid Alice sig hex: %v", err)
+		}
+
+		// sighash
+		sighash, err := funding.sigHash(tx)
+		if err != nil {
+			return fmt.Errorf("failed to calculate sighash: %v", err)
+		}
+
+		// verify Alice's partial
+		alicePubBytes, _ := hex.DecodeString(state.Alice.PubKey)
+		alicePub, _ := btcec.ParsePubKey(alicePubBytes)
+		aliceSigParsed, err := ecdsa.ParseDERSignature(aliceSigBytes[:len(aliceSigBytes)-1])
+		if err != nil {
+			return fmt.Errorf("failed to parse Alice's sig: %v", err)
+		}
+		if !aliceSigParsed.Verify(sighash, alicePub) {
+			return fmt.Errorf("Alice signature invalid")
+		}
+		fmt.Println("Alice's signature verified")
+
+		// bob signs
+		bobPriv, _ := btcec.PrivKeyFromBytes(decodeHex(state.Bob.PrivKey))
+		bobSig := ecdsa.Sign(bobPriv, sighash)
+		bobSigBytes := append(bobSig.Serialize(), byte(txscript.SigHashAll))
+
+		if err := funding.setMultisigSpend(tx, aliceSigBytes, bobSigBytes); err != nil {
+			return err
+		}
+		if err := verifyChannelSpend(tx, funding); err != nil {
+			return fmt.Errorf("signed commitment rejected: %v", err)
+		}
+
+		finalHex, err := serializeTx(tx)
+		if err != nil {
+			return err
+		}
+		c.BobTxSigs.Bob = hex.EncodeToString(bobSigBytes)
+		c.BobSignedTx = finalHex
+		fmt.Println("Bob finalized signed commitment tx:", finalHex)
+		return nil
+	})
+}
 
-	// verify Alice's partial
-	alicePubBytes, _ := hex.DecodeString(state.Alice.PubKey)
-	alicePub, _ := btcec.ParsePubKey(alicePubBytes)
-	aliceSigParsed, err := ecdsa.ParseDERSignature(aliceSigBytes[:len(aliceSigBytes)-1])
-	if err != nil {
-		return fmt.Errorf("failed to parse Alice's sig: %v", err)
+// cosignedCommitment returns the latest commitment, whose Bob version
+// SignCommitmentTxAlice and SignCommitmentTxBob sign, and that version.
+func cosignedCommitment(state *State) (*Commitment, *wire.MsgTx, error) {
+	c := latestCommitment(state)
+	if c == nil || c.BobTx == "" {
+		return nil, nil, fmt.Errorf("no commitment to sign, run commit first")
 	}
-	if !aliceSigParsed.Verify(sighash, alicePub) {
-		return fmt.Errorf("Alice signature invalid")
-	}
-	fmt.Println("Alice's signature verified")
-
-	// bob signs
-	bobPriv, _ := btcec.PrivKeyFromBytes(decodeHex(state.Bob.PrivKey))
-	bobSig := ecdsa.Sign(bobPriv, sighash)
-	bobSigBytes := append(bobSig.Serialize(), byte(txscript.SigHashAll))
-
-	// build final scriptSig
-	scriptSig, err := txscript.NewScriptBuilder().
-		AddOp(txscript.OP_0).
-		AddData(aliceSigBytes).
-		AddData(bobSigBytes).
-		AddData(redeemScript).
-		Script()
+	tx, err := decodeTx(c.BobTx)
 	if err != nil {
-		return fmt.Errorf("failed to build scriptSig: %v", err)
+		return nil, nil, err
 	}
-	tx.TxIn[0].SignatureScript = scriptSig
-
-	// serialize
-	var buf bytes.Buffer
-	tx.Serialize(&buf)
-	finalHex := hex.EncodeToString(buf.Bytes())
+	return c, tx, nil
+}
 
-	fmt.Println("Bob finalized signed commitment tx:", finalHex)
-	return os.WriteFile("data/commit-signed.txt", []byte(finalHex), 0644)
+// SignedCommitmentTx is holder's latest signed commitment that has not
+// been revoked, ready to broadcast.
+func SignedCommitmentTx(statePath string, holder string) (string, error) {
+	var state State
+	if _, err := statefile.Load(statePath, &state); err != nil {
+		return "", fmt.Errorf("failed to read state file: %v", err)
+	}
+	for i := len(state.Commitments) - 1; i >= 0; i-- {
+		c := &state.Commitments[i]
+		signed := c.AliceSignedTx
+		if holder == "bob" {
+			signed = c.BobSignedTx
+		}
+		if signed != "" && !c.Revoked {
+			return signed, nil
+		}
+	}
+	return "", fmt.Errorf("no signed %s commitment", holder)
 }
@@ -0,0 +1,361 @@
+package txbuilder
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"example.com/utils/rpc"
+	"example.com/utils/statefile"
+	"example.com/utils/txverify"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Splice changes the channel's capacity without closing it. The splice tx
+// spends the funding output, plus an output of Party's for a splice-in,
+// into a new funding output with the same script, plus a payout to Party
+// for a splice-out. The channel moves to the new output as soon as the
+// splice is signed; the last commitment on the old output is only revoked
+// once the splice confirms, in case it never does. Until then the balances
+// cannot change, and AbortSplice can move the channel back.
+type Splice struct {
+	Txid      string `json:"txid"`
+	Party     string `json:"party"`
+	AmountSat int64  `json:"amountSat"` // positive for a splice-in
+	FeeSat    int64  `json:"feeSat"`
+	// the funding output spent and its last commitment
+	PrevFunding    *HTLC          `json:"prevFunding"`
+	PrevCommitment int            `json:"prevCommitment"`
+	PrevPolicy     *ChannelPolicy `json:"prevPolicy,omitempty"`
+	Commitment     int            `json:"commitment"` // first one on the new output
+	BroadcastAt    string         `json:"broadcastAt"`
+	LockedAt       string         `json:"lockedAt,omitempty"`
+}
+
+// Pending reports whether the splice has not confirmed yet.
+func (s *Splice) Pending() bool {
+	return s != nil && s.LockedAt == ""
+}
+
+// SpliceIn adds amountSat from party's wallet to the channel and to its
+// balance. The party's change pays the splice fee.
+func SpliceIn(statePath, party string, amountSat int64) (*Splice, error) {
+	if amountSat <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	return splice(statePath, party, amountSat, "")
+}
+
+// SpliceOut pays amountSat of party's balance to payTo, or to the party's
+// own address if empty. The splice fee also comes out of its balance.
+func SpliceOut(statePath, party string, amountSat int64, payTo string) (*Splice, error) {
+	if amountSat <= 0 {
+		return nil, fmt.Errorf("amount must be positive")
+	}
+	return splice(statePath, party, -amountSat, payTo)
+}
+
+// splice moves the channel to a new funding output amountSat larger (or
+// smaller) in one state file update: the splice tx is signed first so its
+// txid is final, then the balances move to a commitment on the new output,
+// and only once that is signed does the splice go out.
+func splice(statePath, party string, amountSat int64, payTo string) (*Splice, error) {
+	if party != "alice" && party != "bob" {
+		return nil, fmt.Errorf("party must be alice or bob")
+	}
+	var state State
+	var s *Splice
+	err := statefile.Update(statePath, &state, func() error {
+		if state.Self != "" {
+			return fmt.Errorf("the state belongs to %s's peer node, splicing needs both keys", state.Self)
+		}
+		if err := RequireStatus(&state, StatusOpen); err != nil {
+			return err
+		}
+		if p := state.Channel.Splice; p.Pending() {
+			return fmt.Errorf("splice %s has not confirmed yet", p.Txid)
+		}
+		prev := latestSigned(&state)
+		if prev == nil {
+			return fmt.Errorf("no signed commitment to fall back on")
+		}
+		f, err := state.funding()
+		if err != nil {
+			return err
+		}
+		if !f.segwit && !f.taproot {
+			// commitments on the new output are signed against the splice
+			// txid, which a P2SH spend does not fix
+			return fmt.Errorf("splicing needs a segwit funding output")
+		}
+		if f.taproot && amountSat > 0 {
+			return fmt.Errorf("splicing into a taproot channel is not supported, the MuSig2 signature covers only the funding input")
+		}
+
+		tx, prevOuts, capacity, err := buildSpliceTx(&state, f, party, amountSat, payTo)
+		if err != nil {
+			return err
+		}
+		policy, err := NewChannelPolicy(capacity)
+		if err != nil {
+			return err
+		}
+		if state.Channel.Policy != nil {
+			// the reserves follow the capacity, the rest was agreed on
+			policy.DustLimitSat = state.Channel.Policy.DustLimitSat
+			policy.MinChannelSat = state.Channel.Policy.MinChannelSat
+		}
+		alicePrivKey, _ := btcec.PrivKeyFromBytes(decodeHex(state.Alice.PrivKey))
+		bobPrivKey, _ := btcec.PrivKeyFromBytes(decodeHex(state.Bob.PrivKey))
+		if _, err := signMultisig(tx, f, alicePrivKey, bobPrivKey); err != nil {
+			return err
+		}
+		if err := txverify.Verify(tx, prevOuts, txverify.UnknownHeight); err != nil {
+			return fmt.Errorf("splice tx rejected: %v", err)
+		}
+
+		// the channel moves to the new output
+		balance := &state.Channel.AliceBalance
+		if party == "bob" {
+			balance = &state.Channel.BobBalance
+		}
+		delta := amountSat
+		if amountSat < 0 {
+			delta -= fixedFee
+		}
+		*balance = float64(toSat(*balance)+delta) / 1e8
+		old := *state.HTLC
+		prevPolicy := state.Channel.Policy
+		state.HTLC.Txid = tx.TxHash().String()
+		state.HTLC.Vout = 0
+		state.HTLC.Amount = float64(capacity) / 1e8
+		state.Channel.Policy = policy
+
+		n, err := addCommitment(&state)
+		if err != nil {
+			return err
+		}
+		if _, err := signCommitment(&state); err != nil {
+			return err
+		}
+
+		txHex, err := serializeTx(tx)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Signed splice tx (hex):", txHex)
+		state.HTLC.SignedTx = txHex
+		// nothing is saved unless the splice goes out
+		txid, err := broadcastTx(txHex, "channel-splice")
+		if err != nil {
+			return err
+		}
+		s = &Splice{
+			Txid:           txid,
+			Party:          party,
+			AmountSat:      amountSat,
+			FeeSat:         fixedFee,
+			PrevFunding:    &old,
+			PrevCommitment: prev.ID,
+			PrevPolicy:     prevPolicy,
+			Commitment:     n,
+			BroadcastAt:    time.Now().Format(time.RFC3339),
+		}
+		state.Channel.Splice = s
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// buildSpliceTx spends the funding output f and, for a splice-in, the
+// largest unreserved output of party's wallet, into the new funding output. It
+// returns the tx with the wallet input signed, every output it spends and
+// the new capacity.
+func buildSpliceTx(state *State, f *fundingOutput, party string, amountSat int64, payTo string) (*wire.MsgTx, map[wire.OutPoint]*wire.TxOut, int64, error) {
+	pkScript, err := f.pkScript()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	hash, err := chainhash.NewHashFromStr(state.HTLC.Txid)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("invalid HTLC txid: %v", err)
+	}
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(hash, state.HTLC.Vout), nil, nil))
+	prevOuts := map[wire.OutPoint]*wire.TxOut{
+		tx.TxIn[0].PreviousOutPoint: wire.NewTxOut(f.amount, pkScript),
+	}
+	key := state.walletKey(party)
+
+	if amountSat < 0 {
+		// splice-out: the payout and the fee leave the channel
+		if payTo == "" {
+			payTo = key.Address
+		}
+		addr, err := btcutil.DecodeAddress(payTo, &chaincfg.RegressionNetParams)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("invalid payout address: %v", err)
+		}
+		payScript, err := txscript.PayToAddrScript(addr)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		capacity := f.amount + amountSat - fixedFee
+		tx.AddTxOut(wire.NewTxOut(capacity, pkScript))
+		payout := wire.NewTxOut(-amountSat, payScript)
+		if mempool.IsDust(payout, mempool.DefaultMinRelayTxFee) {
+			return nil, nil, 0, fmt.Errorf("payout of %d sat is dust", -amountSat)
+		}
+		tx.AddTxOut(payout)
+		return tx, prevOuts, capacity, nil
+	}
+
+	// splice-in: the wallet input covers the amount and the fee
+	utxo, err := reserveLargestUTXO(key.Address, spliceOwner(state.HTLC.Txid))
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("failed to pick a %s UTXO: %v", party, err)
+	}
+	amountIn := toSat(utxo.Amount)
+	if amountIn < amountSat+fixedFee {
+		return nil, nil, 0, fmt.Errorf("insufficient balance (need %d, have %d)", amountSat+fixedFee, amountIn)
+	}
+	utxoHash, err := chainhash.NewHashFromStr(utxo.TxID)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("invalid txid %s: %v", utxo.TxID, err)
+	}
+	utxoScript, err := hex.DecodeString(utxo.ScriptPubKey)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("invalid scriptPubKey: %v", err)
+	}
+	tx.AddTxIn(wire.NewTxIn(wire.NewOutPoint(utxoHash, utxo.Vout), nil, nil))
+	prevOuts[tx.TxIn[1].PreviousOutPoint] = wire.NewTxOut(amountIn, utxoScript)
+
+	capacity := f.amount + amountSat
+	tx.AddTxOut(wire.NewTxOut(capacity, pkScript))
+	changeAddr, err := btcutil.DecodeAddress(key.Address, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("invalid %s address: %v", party, err)
+	}
+	changeScript, err := txscript.PayToAddrScript(changeAddr)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if change := wire.NewTxOut(amountIn-amountSat-fixedFee, changeScript); !mempool.IsDust(change, mempool.DefaultMinRelayTxFee) {
+		tx.AddTxOut(change)
+	}
+
+	priv, err := privFromHex(key.PrivKey)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("invalid %s key: %v", party, err)
+	}
+	if err := signWalletInput(tx, 1, txscript.NewMultiPrevOutFetcher(prevOuts), priv); err != nil {
+		return nil, nil, 0, err
+	}
+	return tx, prevOuts, capacity, nil
+}
+
+// lockSplice revokes the last commitment on the old funding output once a
+// pending splice confirms, which gettxout on the new funding output tells,
+// or the spend of the old one once the new one is spent as well. It
+// reports whether it did.
+func lockSplice(state *State) bool {
+	if appConfig == nil || state.Channel == nil || !state.Channel.Splice.Pending() {
+		return false
+	}
+	s := state.Channel.Splice
+	client := rpc.New(appConfig.RPC)
+	out, err := client.GetTxOut(state.HTLC.Txid, state.HTLC.Vout)
+	if err != nil {
+		return false
+	}
+	if out == nil && !spliceConfirmed(client, s) {
+		return false
+	}
+	if out != nil && out.Confirmations < fundingConfirmations {
+		return false
+	}
+	if state.Self == "" && state.Revocation != nil {
+		if err := revokePrevious(state, s.PrevCommitment+1); err != nil {
+			fmt.Println("Failed to revoke the pre-splice commitment:", err)
+			return false
+		}
+	}
+	s.LockedAt = time.Now().Format(time.RFC3339)
+	fmt.Printf("Splice %s confirmed\n", s.Txid)
+	return true
+}
+
+// spliceConfirmed finds the spend of the funding output s spends and
+// reports whether it is s, buried fundingConfirmations deep.
+func spliceConfirmed(client *rpc.Client, s *Splice) bool {
+	since, _ := time.Parse(time.RFC3339, s.BroadcastAt)
+	spend, height, err := client.FindSpendSince(s.PrevFunding.Txid, s.PrevFunding.Vout, since)
+	if err != nil || spend == nil || spend.Txid != s.Txid || height == 0 {
+		return false
+	}
+	tip, err := client.GetBlockCount()
+	return err == nil && tip-height+1 >= fundingConfirmations
+}
+
+// AbortSplice moves the channel back to the funding output of a pending
+// splice that will not confirm. The node must have dropped the splice tx,
+// so that the old output is unspent even counting the mempool. The
+// commitments on the new output are discarded, the splice tx is no longer
+// rebroadcast and a splice-in's wallet output is free again.
+func AbortSplice(statePath string) (*Splice, error) {
+	var state State
+	var s *Splice
+	err := statefile.Update(statePath, &state, func() error {
+		if state.Self != "" {
+			return fmt.Errorf("the state belongs to %s's peer node, splicing needs both keys", state.Self)
+		}
+		if state.Channel == nil || !state.Channel.Splice.Pending() {
+			return fmt.Errorf("no pending splice")
+		}
+		s = state.Channel.Splice
+		prev := s.PrevFunding
+		out, err := rpc.New(appConfig.RPC).GetTxOut(prev.Txid, prev.Vout)
+		if err != nil {
+			return fmt.Errorf("failed to look up %s:%d: %v", prev.Txid, prev.Vout, err)
+		}
+		if out == nil {
+			return fmt.Errorf("%s:%d is spent, by splice %s unless the node dropped it; wait for it to confirm", prev.Txid, prev.Vout, s.Txid)
+		}
+		c := findCommitment(&state, s.PrevCommitment)
+		if c == nil {
+			return fmt.Errorf("pre-splice commitment #%d not found", s.PrevCommitment)
+		}
+		state.Channel.AliceBalance, state.Channel.BobBalance = c.AliceBalance, c.BobBalance
+
+		kept := state.Commitments[:0]
+		for _, c := range state.Commitments {
+			if c.ID < s.Commitment {
+				kept = append(kept, c)
+			}
+		}
+		state.Commitments = kept
+		state.HTLC = prev
+		state.Channel.Policy = s.PrevPolicy
+		state.Channel.Splice = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := abandonTx(s.Txid); err != nil {
+		fmt.Printf("Failed to drop splice %s from the broadcast history: %v\n", s.Txid, err)
+	}
+	if err := releaseUTXOs(spliceOwner(s.PrevFunding.Txid)); err != nil {
+		fmt.Println("Failed to release the splice's wallet output:", err)
+	}
+	return s, nil
+}
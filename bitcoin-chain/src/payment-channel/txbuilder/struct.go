@@ -1,5 +1,7 @@
 package txbuilder
 
+import "example.com/m/scripts"
+
 type KeyInfo struct {
 	PrivKey string `json:"privkey"`
 	PubKey  string `json:"pubkey"`
@@ -11,27 +13,156 @@ type HTLC struct {
 	Vout         uint32  `json:"vout"`
 	Amount       float64 `json:"amount,omitempty"`
 	RedeemScript string  `json:"redeemScript,omitempty"`
+	// Segwit is set for P2WSH funding outputs; older channels are P2SH
+	Segwit bool `json:"segwit,omitempty"`
+	// Taproot funding outputs are a MuSig2 key with no script
+	Taproot bool                 `json:"taproot,omitempty"`
+	Refund  *scripts.RefundTerms `json:"refund,omitempty"`
+	// SignedTx is the signed tx creating the output, kept with the
+	// channel until it is broadcast; RefundTx spends it back to Bob
+	SignedTx string `json:"signedTx,omitempty"`
+	RefundTx string `json:"refundTx,omitempty"`
 }
 
 type ChannelState struct {
-	AliceBalance float64 `json:"aliceBalance"`
-	BobBalance   float64 `json:"bobBalance"`
+	AliceBalance float64        `json:"aliceBalance"`
+	BobBalance   float64        `json:"bobBalance"`
+	Status       ChannelStatus  `json:"status,omitempty"`
+	StatusAt     string         `json:"statusAt,omitempty"`
+	Policy       *ChannelPolicy `json:"policy,omitempty"`
+	// Splice is the latest splice, pending until it confirms
+	Splice *Splice `json:"splice,omitempty"`
+	// Closed is only read from state files written before Status
+	Closed      bool   `json:"closed,omitempty"`
+	ClosingTxid string `json:"closingTxid,omitempty"`
+	// ClosingTx is the signed cooperative closing tx
+	ClosingTx  string      `json:"closingTx,omitempty"`
+	ForceClose *ForceClose `json:"forceClose,omitempty"`
+	// HTLCs in flight; their amounts are not part of either balance
+	HTLCs      []ChannelHTLC `json:"htlcs,omitempty"`
+	NextHTLCID int           `json:"nextHtlcId,omitempty"`
+	// Approved are balances the local user agreed to let the peer move
+	// the channel to even though they lower ours
+	Approved *ApprovedUpdate `json:"approved,omitempty"`
+}
+
+// ChannelHTLC is a conditional payment carried by the commitments until it
+// is settled with the preimage of Hash or failed back to the offerer.
+type ChannelHTLC struct {
+	ID      int     `json:"id"`
+	Offerer string  `json:"offerer"` // alice or bob, who pays
+	Amount  float64 `json:"amount"`
+	Hash    string  `json:"hash"`   // sha256 of the preimage, hex
+	Expiry  uint32  `json:"expiry"` // block height the offerer can reclaim at
+}
+
+// ForceClose tracks a unilateral close from the broadcast of Holder's
+// commitment until its delayed to_local output has been swept.
+type ForceClose struct {
+	Holder          string `json:"holder"`
+	Commitment      int    `json:"commitment"`
+	Txid            string `json:"txid"`
+	BroadcastAt     string `json:"broadcastAt"`
+	ConfirmedHeight int64  `json:"confirmedHeight,omitempty"`
+	SweepTxid       string `json:"sweepTxid,omitempty"`
+	SweepTx         string `json:"sweepTx,omitempty"`
+	// BumpTxid is the latest child raising the commitment's fee
+	BumpTxid string `json:"bumpTxid,omitempty"`
+	BumpTx   string `json:"bumpTx,omitempty"`
 }
 
 type State struct {
-	Alice       *KeyInfo      `json:"alice"`
-	Bob         *KeyInfo      `json:"bob"`
+	// Self is the party a peer node plays; empty when one process holds
+	// both parties' keys
+	Self  string   `json:"self,omitempty"`
+	Alice *KeyInfo `json:"alice"`
+	Bob   *KeyInfo `json:"bob"`
+	// Wallet is the on-chain key of a managed channel's node: Self's coins
+	// come from it and its change goes back to it, while Self's key above
+	// is derived for this channel alone
+	Wallet      *KeyInfo      `json:"wallet,omitempty"`
 	HTLC        *HTLC         `json:"htlc,omitempty"`
 	Channel     *ChannelState `json:"channel,omitempty"`
+	Revocation  *Revocation   `json:"revocation,omitempty"`
 	Commitments []Commitment  `json:"commitments,omitempty"`
 }
 
+// Commitment is one channel state. Each party holds its own version of the
+// transaction: AliceTx pays Alice through a revocable to_local output and
+// Bob directly, BobTx the other way round.
 type Commitment struct {
-	ID           int     `json:"id"`
-	AliceBalance float64 `json:"aliceBalance"`
-	BobBalance   float64 `json:"bobBalance"`
-	SignedTx     string  `json:"signedTx"`
-	Timestamp    string  `json:"timestamp"`
+	ID            int             `json:"id"`
+	AliceBalance  float64         `json:"aliceBalance"`
+	BobBalance    float64         `json:"bobBalance"`
+	AliceTx       string          `json:"aliceTx,omitempty"`
+	BobTx         string          `json:"bobTx,omitempty"`
+	AliceTxSigs   *CommitmentSigs `json:"aliceTxSigs,omitempty"`
+	BobTxSigs     *CommitmentSigs `json:"bobTxSigs,omitempty"`
+	AliceSignedTx string          `json:"aliceSignedTx,omitempty"`
+	BobSignedTx   string          `json:"bobSignedTx,omitempty"`
+	SignedTx      string          `json:"signedTx,omitempty"` // pre-revocation format
+	HTLCs         []ChannelHTLC   `json:"htlcs,omitempty"`
+	HTLCFeeRate   int64           `json:"htlcFeeRate,omitempty"` // sat/vB of the second-stage txs
+	HTLCSigs      []HTLCSig       `json:"htlcSigs,omitempty"`
+	Revoked       bool            `json:"revoked,omitempty"`
+	Timestamp     string          `json:"timestamp"`
+	SignedAt      string          `json:"signedAt,omitempty"`
+	RevokedAt     string          `json:"revokedAt,omitempty"`
+	// Nonces are the MuSig2 nonces for signing BobTx in two steps, by
+	// party; the secret half is removed before it is used
+	Nonces map[string]*SigningNonce `json:"nonces,omitempty"`
+	// HTLCTxs are the txs htlc claim built, by "<kind>-<id>"
+	HTLCTxs map[string]string `json:"htlcTxs,omitempty"`
+	// JusticeTx takes every output of this commitment once revoked
+	JusticeTx string `json:"justiceTx,omitempty"`
+}
+
+// SigningNonce is one party's MuSig2 nonce for a message.
+type SigningNonce struct {
+	Message  string `json:"message"`
+	SecNonce string `json:"secNonce,omitempty"`
+	PubNonce string `json:"pubNonce"`
+	Created  string `json:"created"`
+}
+
+// CommitmentSigs are both parties' signatures (DER + sighash byte, hex) on
+// one version of a commitment.
+type CommitmentSigs struct {
+	Alice string `json:"alice,omitempty"`
+	Bob   string `json:"bob,omitempty"`
+}
+
+// HTLCSig is the counterparty's signature on the second-stage transaction
+// (HTLC-timeout or HTLC-success) of one HTLC output of Holder's commitment.
+type HTLCSig struct {
+	ID     int    `json:"id"`
+	Holder string `json:"holder"`
+	Sig    string `json:"sig"`
+}
+
+// Revocation holds the per-party secrets behind revocable commitments.
+type Revocation struct {
+	ToSelfDelay uint16       `json:"toSelfDelay"`
+	Alice       *ChannelKeys `json:"alice"`
+	Bob         *ChannelKeys `json:"bob"`
+}
+
+// ChannelKeys are one party's commitment secrets. Seed produces the
+// per-commitment secrets; the basepoint secrets are tweaked per commitment.
+type ChannelKeys struct {
+	Seed                 string `json:"seed"`
+	RevocationBaseSecret string `json:"revocationBaseSecret"`
+	DelayedBaseSecret    string `json:"delayedBaseSecret"`
+	HTLCBaseSecret       string `json:"htlcBaseSecret,omitempty"`
+	// per-commitment secrets revealed by the counterparty, by commitment ID
+	ReceivedSecrets map[int]string `json:"receivedSecrets,omitempty"`
+
+	// A peer node has no secrets of the counterparty, only the basepoints
+	// and per-commitment points it was sent.
+	RevocationBasepoint string         `json:"revocationBasepoint,omitempty"`
+	DelayedBasepoint    string         `json:"delayedBasepoint,omitempty"`
+	HTLCBasepoint       string         `json:"htlcBasepoint,omitempty"`
+	Points              map[int]string `json:"points,omitempty"`
 }
 
 type FundInput struct {
@@ -58,12 +189,14 @@ type BobKey struct {
 }
 
 type ScanTxOutResult struct {
-	Unspents []struct {
-		TxID         string  `json:"txid"`
-		Vout         uint32  `json:"vout"`
-		ScriptPubKey string  `json:"scriptPubKey"`
-		Amount       float64 `json:"amount"`
-		Height       int64   `json:"height"`
-	} `json:"unspents"`
-	TotalAmount float64 `json:"total_amount"`
+	Unspents    []UnspentOutput `json:"unspents"`
+	TotalAmount float64         `json:"total_amount"`
+}
+
+type UnspentOutput struct {
+	TxID         string  `json:"txid"`
+	Vout         uint32  `json:"vout"`
+	ScriptPubKey string  `json:"scriptPubKey"`
+	Amount       float64 `json:"amount"`
+	Height       int64   `json:"height"`
 }
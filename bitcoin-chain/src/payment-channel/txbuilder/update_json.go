@@ -1,35 +1,26 @@
 package txbuilder
 
 import (
-	"encoding/json"
 	"fmt"
-	"os"
-)
 
-func UpdateHTLCTx(stateFile string, txid string, vout uint32) error {
-	data, err := os.ReadFile(stateFile)
-	if err != nil {
-		return fmt.Errorf("failed to read state.json: %v", err)
-	}
+	"example.com/utils/statefile"
+)
 
+// UpdateHTLCTx records the signed tx creating the channel's output and
+// the outpoint it creates.
+func UpdateHTLCTx(stateFile string, txHex string, txid string, vout uint32) error {
 	var state State
-	if err := json.Unmarshal(data, &state); err != nil {
-		return fmt.Errorf("failed to parse state.json: %v", err)
-	}
-
-	if state.HTLC == nil {
-		state.HTLC = &HTLC{}
-	}
-
-	state.HTLC.Txid = txid
-	state.HTLC.Vout = vout
-
-	updated, err := json.MarshalIndent(state, "", "  ")
+	err := statefile.Update(stateFile, &state, func() error {
+		if state.HTLC == nil {
+			state.HTLC = &HTLC{}
+		}
+		state.HTLC.SignedTx = txHex
+		state.HTLC.Txid = txid
+		state.HTLC.Vout = vout
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated state.json: %v", err)
-	}
-	if err := os.WriteFile(stateFile, updated, 0644); err != nil {
-		return fmt.Errorf("failed to write updated state.json: %v", err)
+		return fmt.Errorf("failed to update state.json: %v", err)
 	}
 
 	fmt.Printf("Updated state.json with HTLC txid=%s, vout=%d\n", txid, vout)
@@ -37,32 +28,17 @@ func UpdateHTLCTx(stateFile string, txid string, vout uint32) error {
 }
 
 func UpdateHTLCAmount(stateFile string, amount float64) error {
-	// Load existing state
-	data, err := os.ReadFile(stateFile)
-	if err != nil {
-		return fmt.Errorf("failed to read state.json: %v", err)
-	}
-
 	var state State
-	if err := json.Unmarshal(data, &state); err != nil {
-		return fmt.Errorf("failed to parse state.json: %v", err)
-	}
-
-	// initialize HTLC if missing
-	if state.HTLC == nil {
-		state.HTLC = &HTLC{}
-	}
-
-	// store the amount
-	state.HTLC.Amount = amount
-
-	// write back
-	updated, err := json.MarshalIndent(state, "", "  ")
+	err := statefile.Update(stateFile, &state, func() error {
+		// initialize HTLC if missing
+		if state.HTLC == nil {
+			state.HTLC = &HTLC{}
+		}
+		state.HTLC.Amount = amount
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated state.json: %v", err)
-	}
-	if err := os.WriteFile(stateFile, updated, 0644); err != nil {
-		return fmt.Errorf("failed to write updated state.json: %v", err)
+		return fmt.Errorf("failed to update state.json: %v", err)
 	}
 
 	fmt.Printf("Updated state.json with HTLC amount: %.8f BTC\n", amount)
@@ -70,27 +46,30 @@ func UpdateHTLCAmount(stateFile string, amount float64) error {
 }
 
 func UpdateFund(amount float64) error {
-	// Load fund destination
-	fundRaw, err := os.ReadFile("data/fund.json")
-	if err != nil {
-		return fmt.Errorf("failed to read fund.json: %v", err)
-	}
+	// Load fund destination and override amount with input parameter
 	var fund FundData
-	if err := json.Unmarshal(fundRaw, &fund); err != nil {
-		return fmt.Errorf("invalid fund.json: %v", err)
-	}
-
-	// Override amount with input parameter
-	fund.Amount = amount
-
-	// Optionally store it back to fund.json
-	fundBytes, err := json.MarshalIndent(fund, "", "  ")
+	err := statefile.Update(dataPath("data/fund.json"), &fund, func() error {
+		if fund.Address == "" {
+			return fmt.Errorf("fund.json has no address, run multisig first")
+		}
+		fund.Amount = amount
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal updated fund.json: %v", err)
-	}
-	if err := os.WriteFile("data/fund.json", fundBytes, 0644); err != nil {
 		return fmt.Errorf("failed to update fund.json: %v", err)
 	}
 	fmt.Println("Updated fund.json with amount:", amount)
 	return nil
 }
+
+// loadFund reads data/fund.json without modifying it.
+func loadFund() (*FundData, error) {
+	var fund FundData
+	if _, err := statefile.Load(dataPath("data/fund.json"), &fund); err != nil {
+		return nil, fmt.Errorf("failed to read fund.json: %v", err)
+	}
+	if fund.Address == "" {
+		return nil, fmt.Errorf("invalid fund.json: missing address")
+	}
+	return &fund, nil
+}
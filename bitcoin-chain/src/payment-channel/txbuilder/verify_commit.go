@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 
+	"example.com/utils/txverify"
 	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcd/txscript"
@@ -53,3 +54,13 @@ func VerifyCommitmentProposal(txHex string) error {
 
 	return nil
 }
+
+// verifyChannelSpend runs the signed input of tx against the channel's
+// funding output and checks relay policy. Nothing is written if this fails.
+func verifyChannelSpend(tx *wire.MsgTx, f *fundingOutput) error {
+	prevOuts, err := f.prevOuts(tx)
+	if err != nil {
+		return err
+	}
+	return txverify.Verify(tx, prevOuts, txverify.UnknownHeight)
+}
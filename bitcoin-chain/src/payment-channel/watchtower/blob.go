@@ -0,0 +1,47 @@
+package watchtower
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Hint identifies a blob without revealing which commitment it belongs to:
+// the first half of the commitment txid. The tower only learns the full
+// txid, and with it the decryption key, once the commitment is broadcast.
+func Hint(commitTxid chainhash.Hash) string {
+	return commitTxid.String()[:32]
+}
+
+// Encrypt seals a justice transaction with the commitment txid as key. The
+// random nonce is prepended to the ciphertext.
+func Encrypt(commitTxid chainhash.Hash, justiceTx []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(commitTxid[:])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to read nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, justiceTx, nil), nil
+}
+
+// Decrypt opens a blob once the commitment with txid has been seen.
+func Decrypt(commitTxid chainhash.Hash, blob []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(commitTxid[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < aead.NonceSize() {
+		return nil, fmt.Errorf("blob too short")
+	}
+	nonce, sealed := blob[:aead.NonceSize()], blob[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("blob does not belong to this commitment: %v", err)
+	}
+	return plain, nil
+}
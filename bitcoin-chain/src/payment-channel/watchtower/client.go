@@ -0,0 +1,57 @@
+package watchtower
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+)
+
+// Client talks to a tower's local API on behalf of one channel party.
+type Client struct {
+	URL string
+	ID  string
+}
+
+func (c *Client) post(path string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(c.URL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("tower unreachable: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("tower returned %s: %s", resp.Status, e.Error)
+	}
+	return nil
+}
+
+// Register asks the tower to watch a funding outpoint ("txid:vout").
+func (c *Client) Register(outpoint string) error {
+	return c.post("/v1/register", RegisterRequest{Client: c.ID, Outpoint: outpoint})
+}
+
+// Upload encrypts the justice transaction for a revoked commitment and hands
+// it to the tower under the commitment's hint.
+func (c *Client) Upload(commitTxid chainhash.Hash, justiceTx []byte) error {
+	blob, err := Encrypt(commitTxid, justiceTx)
+	if err != nil {
+		return err
+	}
+	return c.post("/v1/blob", BlobRequest{
+		Client: c.ID,
+		Hint:   Hint(commitTxid),
+		Blob:   hex.EncodeToString(blob),
+	})
+}
@@ -0,0 +1,225 @@
+package watchtower
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"example.com/utils/config"
+	"example.com/utils/rpc"
+	"example.com/utils/statefile"
+)
+
+// Tower stores encrypted justice transactions for any number of clients and
+// broadcasts them when it sees the matching revoked commitment.
+type Tower struct {
+	cfg  *config.Config
+	rpc  *rpc.Client
+	path string
+
+	// mempool txids already checked, so each is only fetched once
+	seen map[string]bool
+}
+
+// DB is the tower's on-disk state.
+type DB struct {
+	Clients    map[string]*ClientInfo `json:"clients"`
+	Blobs      map[string][]Blob      `json:"blobs"` // by hint
+	LastHeight int64                  `json:"lastHeight"`
+	// breaches whose justice tx could not be broadcast yet, by commitment
+	// txid, retried every block until the to_local delay runs out
+	Pending map[string]*Pending `json:"pending,omitempty"`
+}
+
+type Pending struct {
+	Height int64  `json:"height,omitempty"` // block the breach confirmed in, 0 while in the mempool
+	Error  string `json:"error,omitempty"`  // last broadcast failure
+}
+
+type ClientInfo struct {
+	// funding outpoints as "txid:vout"
+	Outpoints  []string `json:"outpoints"`
+	Registered string   `json:"registered"`
+}
+
+type Blob struct {
+	Client    string `json:"client"`
+	Data      string `json:"data"`
+	Broadcast string `json:"broadcast,omitempty"` // justice txid once sent
+}
+
+func New(cfg *config.Config, path string) *Tower {
+	return &Tower{cfg: cfg, rpc: rpc.New(cfg.RPC), path: path, seen: map[string]bool{}}
+}
+
+func (t *Tower) update(fn func(db *DB) error) error {
+	var db DB
+	return statefile.Update(t.path, &db, func() error {
+		if db.Clients == nil {
+			db.Clients = map[string]*ClientInfo{}
+		}
+		if db.Blobs == nil {
+			db.Blobs = map[string][]Blob{}
+		}
+		if db.Pending == nil {
+			db.Pending = map[string]*Pending{}
+		}
+		return fn(&db)
+	})
+}
+
+func (t *Tower) load() (*DB, error) {
+	var db DB
+	if _, err := statefile.Load(t.path, &db); err != nil {
+		return nil, err
+	}
+	return &db, nil
+}
+
+type RegisterRequest struct {
+	Client   string `json:"client"`
+	Outpoint string `json:"outpoint"`
+}
+
+type BlobRequest struct {
+	Client string `json:"client"`
+	Hint   string `json:"hint"`
+	Blob   string `json:"blob"`
+}
+
+type StatusResponse struct {
+	Clients    int   `json:"clients"`
+	Outpoints  int   `json:"outpoints"`
+	Blobs      int   `json:"blobs"`
+	Pending    int   `json:"pending"`
+	LastHeight int64 `json:"lastHeight"`
+}
+
+var (
+	outpointRe = regexp.MustCompile(`^[0-9a-f]{64}:[0-9]+$`)
+	hintRe     = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+	errUnknownClient = fmt.Errorf("client is not registered")
+)
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (t *Tower) handleRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+		return
+	}
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Client == "" || !outpointRe.MatchString(req.Outpoint) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("client and outpoint (txid:vout) are required"))
+		return
+	}
+
+	err := t.update(func(db *DB) error {
+		c := db.Clients[req.Client]
+		if c == nil {
+			c = &ClientInfo{Registered: time.Now().Format(time.RFC3339)}
+			db.Clients[req.Client] = c
+		}
+		for _, op := range c.Outpoints {
+			if op == req.Outpoint {
+				return nil
+			}
+		}
+		c.Outpoints = append(c.Outpoints, req.Outpoint)
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Printf("Client %s watching %s\n", req.Client, req.Outpoint)
+	writeJSON(w, http.StatusOK, map[string]string{"status": "registered"})
+}
+
+func (t *Tower) handleBlob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST"))
+		return
+	}
+	var req BlobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if !hintRe.MatchString(req.Hint) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("hint must be 16 bytes of hex"))
+		return
+	}
+	if _, err := hex.DecodeString(req.Blob); err != nil || req.Blob == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("blob must be hex"))
+		return
+	}
+
+	err := t.update(func(db *DB) error {
+		if db.Clients[req.Client] == nil {
+			return errUnknownClient
+		}
+		for _, b := range db.Blobs[req.Hint] {
+			if b.Client == req.Client && b.Data == req.Blob {
+				return nil
+			}
+		}
+		db.Blobs[req.Hint] = append(db.Blobs[req.Hint], Blob{Client: req.Client, Data: req.Blob})
+		return nil
+	})
+	if err == errUnknownClient {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "stored"})
+}
+
+func (t *Tower) handleStatus(w http.ResponseWriter, r *http.Request) {
+	db, err := t.load()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	resp := StatusResponse{Clients: len(db.Clients), Pending: len(db.Pending), LastHeight: db.LastHeight}
+	for _, c := range db.Clients {
+		resp.Outpoints += len(c.Outpoints)
+	}
+	for _, bs := range db.Blobs {
+		resp.Blobs += len(bs)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Run serves the client API on addr and watches the chain every interval.
+// Only bind to a local address: the API has no authentication.
+func (t *Tower) Run(addr string, interval time.Duration) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/register", t.handleRegister)
+	mux.HandleFunc("/v1/blob", t.handleBlob)
+	mux.HandleFunc("/v1/status", t.handleStatus)
+
+	go t.Watch(interval)
+
+	fmt.Println("Watchtower listening on", addr)
+	return http.ListenAndServe(addr, mux)
+}
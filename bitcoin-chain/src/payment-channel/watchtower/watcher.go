@@ -0,0 +1,299 @@
+package watchtower
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"example.com/utils/broadcast"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+type rawTx struct {
+	Txid string `json:"txid"`
+	Hex  string `json:"hex"`
+	Vin  []struct {
+		Txid string `json:"txid"`
+		Vout uint32 `json:"vout"`
+	} `json:"vin"`
+}
+
+type block struct {
+	Tx []rawTx `json:"tx"`
+}
+
+// Watch polls the node for new blocks and mempool transactions forever.
+func (t *Tower) Watch(interval time.Duration) {
+	for {
+		if err := t.poll(); err != nil {
+			fmt.Println("Watch error:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (t *Tower) poll() error {
+	db, err := t.load()
+	if err != nil {
+		return err
+	}
+
+	watched := map[string]string{} // outpoint -> client
+	for id, c := range db.Clients {
+		for _, op := range c.Outpoints {
+			watched[op] = id
+		}
+	}
+
+	height, err := t.rpc.GetBlockCount()
+	if err != nil {
+		return fmt.Errorf("getblockcount: %v", err)
+	}
+
+	// a fresh tower starts at the tip instead of rescanning the chain
+	from := db.LastHeight + 1
+	if db.LastHeight == 0 {
+		from = height
+	}
+	for h := from; h <= height; h++ {
+		var hash string
+		if err := t.rpc.CallInto(&hash, "getblockhash", h); err != nil {
+			return fmt.Errorf("getblockhash %d: %v", h, err)
+		}
+		var b block
+		if err := t.rpc.CallInto(&b, "getblock", hash, 2); err != nil {
+			return fmt.Errorf("getblock %s: %v", hash, err)
+		}
+		for _, tx := range b.Tx {
+			// a breach whose justice tx failed is kept in db.Pending, so
+			// the height only moves on once that is on disk
+			if err := t.check(tx, watched, h); err != nil {
+				return err
+			}
+		}
+		if err := t.update(func(db *DB) error {
+			db.LastHeight = h
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	if from <= height {
+		if err := t.retryPending(height); err != nil {
+			return err
+		}
+	}
+
+	var mempool []string
+	if err := t.rpc.CallInto(&mempool, "getrawmempool"); err != nil {
+		return fmt.Errorf("getrawmempool: %v", err)
+	}
+	inPool := map[string]bool{}
+	for _, txid := range mempool {
+		inPool[txid] = true
+		if t.seen[txid] {
+			continue
+		}
+		var tx rawTx
+		if err := t.rpc.CallInto(&tx, "getrawtransaction", txid, true); err != nil {
+			continue // evicted or mined since getrawmempool
+		}
+		if err := t.check(tx, watched, 0); err != nil {
+			return err
+		}
+		t.seen[txid] = true
+	}
+	for txid := range t.seen {
+		if !inPool[txid] {
+			delete(t.seen, txid)
+		}
+	}
+	return nil
+}
+
+// check looks for a spend of a watched funding outpoint and, if a blob
+// matches the spending txid, decrypts and broadcasts the justice tx. A
+// breach whose justice tx cannot be sent is added to db.Pending; height is
+// the block tx confirmed in, or 0 for the mempool.
+func (t *Tower) check(tx rawTx, watched map[string]string, height int64) error {
+	client := ""
+	for _, in := range tx.Vin {
+		if c, ok := watched[fmt.Sprintf("%s:%d", in.Txid, in.Vout)]; ok {
+			client = c
+			break
+		}
+	}
+	if client == "" {
+		return nil
+	}
+	txid, err := chainhash.NewHashFromStr(tx.Txid)
+	if err != nil {
+		return nil
+	}
+	fmt.Printf("Funding output of %s spent by %s\n", client, tx.Txid)
+
+	_, sendErr := t.punish(*txid)
+	return t.update(func(db *DB) error {
+		p := db.Pending[tx.Txid]
+		if sendErr == nil {
+			delete(db.Pending, tx.Txid)
+			return nil
+		}
+		if p == nil {
+			p = &Pending{}
+			db.Pending[tx.Txid] = p
+		}
+		if height > 0 {
+			p.Height = height
+		}
+		p.Error = sendErr.Error()
+		return nil
+	})
+}
+
+// retryPending broadcasts the justice txs that failed before again. A
+// breach is dropped once its to_local delay has run out, as the cheater can
+// then sweep the output first.
+func (t *Tower) retryPending(height int64) error {
+	db, err := t.load()
+	if err != nil {
+		return err
+	}
+	for id, p := range db.Pending {
+		txid, err := chainhash.NewHashFromStr(id)
+		if err != nil {
+			continue
+		}
+		csv, sendErr := t.punish(*txid)
+		expired := sendErr != nil && p.Height > 0 && csv > 0 && height >= p.Height+csv
+		if expired {
+			fmt.Printf("Giving up on revoked commitment %s: to_local delay of %d blocks expired\n", id, csv)
+		}
+		if err := t.update(func(db *DB) error {
+			if sendErr == nil || expired {
+				delete(db.Pending, id)
+			} else if q := db.Pending[id]; q != nil {
+				q.Error = sendErr.Error()
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// punish broadcasts the justice tx of every blob stored for the revoked
+// commitment txid that has not been sent yet. It returns the commitment's
+// to_local delay as found in the justice txs, and the first broadcast
+// failure, if any.
+func (t *Tower) punish(txid chainhash.Hash) (int64, error) {
+	hint := Hint(txid)
+	db, err := t.load()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read tower db: %v", err)
+	}
+	blobs := db.Blobs[hint]
+	if len(blobs) == 0 {
+		fmt.Println("No revoked state matches, channel closed normally")
+		return 0, nil
+	}
+
+	var csv int64
+	var failed error
+	for i, b := range blobs {
+		data, err := hex.DecodeString(b.Data)
+		if err != nil {
+			continue
+		}
+		justice, err := Decrypt(txid, data)
+		if err != nil {
+			fmt.Printf("Blob from %s: %v\n", b.Client, err)
+			continue
+		}
+		if d := csvDelay(justice); d > csv {
+			csv = d
+		}
+		if b.Broadcast != "" {
+			continue
+		}
+
+		fmt.Printf("Revoked commitment %s detected, broadcasting justice tx for %s\n", txid, b.Client)
+		sent, err := t.broadcast(hex.EncodeToString(justice))
+		if err != nil {
+			fmt.Println("Justice broadcast failed:", err)
+			if failed == nil {
+				failed = err
+			}
+			continue
+		}
+
+		idx := i
+		err = t.update(func(db *DB) error {
+			if idx < len(db.Blobs[hint]) {
+				db.Blobs[hint][idx].Broadcast = sent
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println("Failed to record broadcast:", err)
+		}
+	}
+	return csv, failed
+}
+
+// csvDelay returns the largest relative delay in the witness scripts the
+// justice tx spends, which for a breach is the to_local delay.
+func csvDelay(justice []byte) int64 {
+	tx := wire.NewMsgTx(2)
+	if err := tx.Deserialize(bytes.NewReader(justice)); err != nil {
+		return 0
+	}
+	var delay int64
+	for _, in := range tx.TxIn {
+		if len(in.Witness) == 0 {
+			continue
+		}
+		script := in.Witness[len(in.Witness)-1]
+		var prev []byte
+		prevOp := byte(0)
+		tok := txscript.MakeScriptTokenizer(0, script)
+		for tok.Next() {
+			if tok.Opcode() == txscript.OP_CHECKSEQUENCEVERIFY {
+				var n int64
+				switch {
+				case prevOp >= txscript.OP_1 && prevOp <= txscript.OP_16:
+					n = int64(prevOp-txscript.OP_1) + 1
+				case len(prev) > 0:
+					if v, err := txscript.MakeScriptNum(prev, false, 5); err == nil {
+						n = int64(v)
+					}
+				}
+				if n > delay {
+					delay = n
+				}
+			}
+			prevOp, prev = tok.Opcode(), tok.Data()
+		}
+	}
+	return delay
+}
+
+// broadcast opens the swap database only for the duration of one send, so
+// the tower does not hold its lock while idle.
+func (t *Tower) broadcast(txHex string) (string, error) {
+	b, err := broadcast.Open(t.cfg)
+	if err != nil {
+		return "", err
+	}
+	defer b.Close()
+
+	res, err := b.Send(txHex, "justice")
+	if err != nil {
+		return "", err
+	}
+	return res.Txid, nil
+}
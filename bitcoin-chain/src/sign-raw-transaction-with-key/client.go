@@ -8,10 +8,11 @@ import (
 	"net/http"
 )
 
-const (
-	rpcUser     = "admin"
-	rpcPassword = "HouiWGc9wyj_2Fx2G9FYnQAr3AIXEeb-uRNRNITgKso"
-	rpcURL      = "http://127.0.0.1:8332"
+// Set from the config file in main.
+var (
+	rpcUser     string
+	rpcPassword string
+	rpcURL      string
 )
 
 type RPCRequest struct {
@@ -0,0 +1,362 @@
+package broadcast
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"example.com/utils/config"
+	"example.com/utils/rpc"
+	"example.com/utils/store"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Rejections reported by testmempoolaccept, mapped to something the caller
+// can act on. Use errors.Is to test for them.
+var (
+	ErrNonFinal      = errors.New("transaction is not final yet (locktime or CSV not reached), wait for more blocks")
+	ErrMissingInputs = errors.New("inputs are missing or already spent, check the funding tx is confirmed and not double-spent")
+	ErrFeeTooLow     = errors.New("fee is below the node's minimum, rebuild the tx with a higher fee")
+	ErrRejected      = errors.New("transaction rejected by mempool")
+)
+
+// bitcoind error code for sendrawtransaction when the tx is already mined
+const rpcVerifyAlreadyInChain = -27
+
+// Broadcast outcomes stored in Result.Status.
+const (
+	StatusAccepted       = "accepted"
+	StatusAlreadyInPool  = "already-in-mempool"
+	StatusAlreadyInChain = "already-in-chain"
+	StatusRebroadcast    = "rebroadcast"
+	StatusUnconfirmed    = "unconfirmed"
+)
+
+type Result struct {
+	Txid   string
+	Status string
+}
+
+// RejectError wraps one of the Err* values with the node's raw reason.
+type RejectError struct {
+	Txid   string
+	Reason string
+	Err    error
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("tx %s rejected (%s): %v", e.Txid, e.Reason, e.Err)
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+// Broadcaster sends transactions through a single path so every binary gets
+// the same preflight checks and history. db may be nil, in which case
+// nothing is recorded.
+type Broadcaster struct {
+	rpc *rpc.Client
+	db  *store.DB
+}
+
+func New(client *rpc.Client, db *store.DB) *Broadcaster {
+	return &Broadcaster{rpc: client, db: db}
+}
+
+// Open builds a Broadcaster from the RPC settings and swap database in cfg.
+// Call Close when done so the database file is released.
+func Open(cfg *config.Config) (*Broadcaster, error) {
+	db, err := store.Open(cfg.Files.SwapDB)
+	if err != nil {
+		return nil, err
+	}
+	return New(rpc.New(cfg.RPC), db), nil
+}
+
+func (b *Broadcaster) Close() error {
+	if b.db == nil {
+		return nil
+	}
+	return b.db.Close()
+}
+
+type mempoolAccept struct {
+	Txid         string `json:"txid"`
+	Allowed      bool   `json:"allowed"`
+	RejectReason string `json:"reject-reason"`
+}
+
+// Send checks rawHex with testmempoolaccept, submits it and records it under
+// label. A tx that is already in the mempool or in a block counts as success.
+func (b *Broadcaster) Send(rawHex string, label string) (*Result, error) {
+	rawHex = strings.TrimSpace(rawHex)
+	tx, err := decodeTx(rawHex)
+	if err != nil {
+		return nil, err
+	}
+	txid := tx.TxHash().String()
+
+	res, err := b.send(tx, rawHex)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.record(txid, rawHex, label, res.Status); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+func (b *Broadcaster) send(tx *wire.MsgTx, rawHex string) (*Result, error) {
+	txid := tx.TxHash().String()
+
+	var accept []mempoolAccept
+	if err := b.rpc.CallInto(&accept, "testmempoolaccept", []string{rawHex}); err != nil {
+		return nil, fmt.Errorf("testmempoolaccept failed: %v", err)
+	}
+	if len(accept) != 1 {
+		return nil, fmt.Errorf("testmempoolaccept returned %d results", len(accept))
+	}
+
+	if !accept[0].Allowed {
+		reason := accept[0].RejectReason
+		switch {
+		case strings.Contains(reason, "txn-already-in-mempool"), strings.Contains(reason, "txn-already-known"):
+			fmt.Println("Transaction already in mempool:", txid)
+			return &Result{Txid: txid, Status: StatusAlreadyInPool}, nil
+		case strings.Contains(reason, "missing-inputs"), strings.Contains(reason, "missingorspent"):
+			// A mined tx looks exactly like one whose inputs are gone,
+			// so check whether its own outputs exist before giving up
+			if b.inChain(tx) {
+				fmt.Println("Transaction already in chain:", txid)
+				return &Result{Txid: txid, Status: StatusAlreadyInChain}, nil
+			}
+			return nil, &RejectError{Txid: txid, Reason: reason, Err: ErrMissingInputs}
+		}
+		return nil, &RejectError{Txid: txid, Reason: reason, Err: classify(reason)}
+	}
+
+	var sent string
+	err := b.rpc.CallInto(&sent, "sendrawtransaction", rawHex)
+	if err != nil {
+		var rpcErr *rpc.Error
+		if errors.As(err, &rpcErr) && rpcErr.Code == rpcVerifyAlreadyInChain {
+			return &Result{Txid: txid, Status: StatusAlreadyInChain}, nil
+		}
+		return nil, fmt.Errorf("sendrawtransaction failed: %v", err)
+	}
+
+	fmt.Println("Broadcast successful! TXID:", sent)
+	return &Result{Txid: sent, Status: StatusAccepted}, nil
+}
+
+func classify(reason string) error {
+	switch {
+	case strings.Contains(reason, "non-final"), strings.Contains(reason, "non-BIP68-final"):
+		return ErrNonFinal
+	case strings.Contains(reason, "min relay fee not met"),
+		strings.Contains(reason, "mempool min fee not met"),
+		strings.Contains(reason, "insufficient fee"):
+		return ErrFeeTooLow
+	}
+	return ErrRejected
+}
+
+type txOut struct {
+	Confirmations int64 `json:"confirmations"`
+}
+
+// confirmations returns how deep the tx is buried, or 0 if it is not in a
+// block. gettxout finds it while one of its outputs is unspent and
+// getrawtransaction when the node keeps a txindex; once every output is
+// spent the tx that spent its first input tells whether it was mined.
+func (b *Broadcaster) confirmations(tx *wire.MsgTx) int64 {
+	txid := tx.TxHash().String()
+	for i := range tx.TxOut {
+		var out *txOut
+		if err := b.rpc.CallInto(&out, "gettxout", txid, i, false); err == nil && out != nil {
+			return out.Confirmations
+		}
+	}
+
+	var raw rpc.Tx
+	if err := b.rpc.CallInto(&raw, "getrawtransaction", txid, true); err == nil && raw.BlockHash != "" {
+		return raw.Confirmations
+	}
+
+	if len(tx.TxIn) == 0 {
+		return 0
+	}
+	prev := tx.TxIn[0].PreviousOutPoint
+	spend, height, err := b.rpc.FindSpend(prev.Hash.String(), prev.Index)
+	if err != nil || spend == nil || spend.Txid != txid || height == 0 {
+		return 0
+	}
+	tip, err := b.rpc.GetBlockCount()
+	if err != nil {
+		return 0
+	}
+	return tip - height + 1
+}
+
+func (b *Broadcaster) inChain(tx *wire.MsgTx) bool {
+	return b.confirmations(tx) > 0
+}
+
+func (b *Broadcaster) record(txid, rawHex, label, status string) error {
+	if b.db == nil {
+		return nil
+	}
+	return b.db.Update(func(tx *store.Tx) error {
+		rec, err := tx.Broadcast(txid)
+		if err != nil {
+			return err
+		}
+		if rec == nil {
+			rec = &store.TxRecord{Txid: txid, Label: label}
+		}
+		rec.Hex = rawHex
+		if label != "" {
+			rec.Label = label
+		}
+		if status == StatusAlreadyInChain {
+			rec.Status = store.TxStatusConfirmed
+		} else {
+			rec.Status = store.TxStatusBroadcast
+		}
+		rec.UpdatedAt = time.Now().Format(time.RFC3339)
+		return tx.PutBroadcast(rec)
+	})
+}
+
+// Rebroadcast resubmits every recorded tx that is not confirmed yet and
+// marks the ones that have been mined. It returns the per-tx outcome.
+func (b *Broadcaster) Rebroadcast() ([]Result, error) {
+	if b.db == nil {
+		return nil, fmt.Errorf("rebroadcast needs the swap database")
+	}
+
+	var pending []store.TxRecord
+	err := b.db.View(func(tx *store.Tx) error {
+		all, err := tx.Broadcasts()
+		if err != nil {
+			return err
+		}
+		for _, r := range all {
+			if r.Status == store.TxStatusBroadcast && r.Hex != "" {
+				pending = append(pending, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, rec := range pending {
+		tx, err := decodeTx(rec.Hex)
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", rec.Txid, err)
+			continue
+		}
+
+		if conf := b.confirmations(tx); conf > 0 {
+			if err := b.markConfirmed(rec.Txid, conf); err != nil {
+				return results, err
+			}
+			results = append(results, Result{Txid: rec.Txid, Status: StatusAlreadyInChain})
+			continue
+		}
+
+		res, err := b.send(tx, rec.Hex)
+		if err != nil {
+			fmt.Printf("Rebroadcast of %s failed: %v\n", rec.Txid, err)
+			results = append(results, Result{Txid: rec.Txid, Status: StatusUnconfirmed})
+			continue
+		}
+		if res.Status == StatusAccepted {
+			res.Status = StatusRebroadcast
+		}
+		results = append(results, *res)
+	}
+	return results, nil
+}
+
+// Watch calls Rebroadcast every interval until stop is closed. The swap
+// database is opened for each pass and closed again, so other binaries can
+// use it in between.
+func Watch(cfg *config.Config, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := rebroadcastOnce(cfg); err != nil {
+			fmt.Println("Rebroadcast error:", err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func rebroadcastOnce(cfg *config.Config) error {
+	b, err := Open(cfg)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	results, err := b.Rebroadcast()
+	for _, r := range results {
+		fmt.Printf("%s: %s\n", r.Txid, r.Status)
+	}
+	return err
+}
+
+// Abandon stops Rebroadcast from sending txid again, for a tx that was
+// replaced or whose effect was undone while it was unconfirmed.
+func (b *Broadcaster) Abandon(txid string) error {
+	if b.db == nil {
+		return nil
+	}
+	return b.db.Update(func(tx *store.Tx) error {
+		rec, err := tx.Broadcast(txid)
+		if err != nil || rec == nil {
+			return err
+		}
+		rec.Status = store.TxStatusAbandoned
+		rec.UpdatedAt = time.Now().Format(time.RFC3339)
+		return tx.PutBroadcast(rec)
+	})
+}
+
+func (b *Broadcaster) markConfirmed(txid string, confirmations int64) error {
+	return b.db.Update(func(tx *store.Tx) error {
+		rec, err := tx.Broadcast(txid)
+		if err != nil || rec == nil {
+			return err
+		}
+		rec.Status = store.TxStatusConfirmed
+		rec.Confirmations = confirmations
+		rec.UpdatedAt = time.Now().Format(time.RFC3339)
+		return tx.PutBroadcast(rec)
+	})
+}
+
+func decodeTx(rawHex string) (*wire.MsgTx, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(rawHex))
+	if err != nil {
+		return nil, fmt.Errorf("invalid transaction hex: %v", err)
+	}
+	tx := wire.NewMsgTx(wire.TxVersion)
+	if err := tx.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("failed to parse transaction: %v", err)
+	}
+	return tx, nil
+}
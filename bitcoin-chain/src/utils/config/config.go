@@ -0,0 +1,362 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/btcsuite/btcd/chaincfg"
+)
+
+// Config is the typed replacement for the old per-binary .env lookups.
+type Config struct {
+	DataDir string        `toml:"data_dir"`
+	Network string        `toml:"network"`
+	RPC     RPCConfig     `toml:"rpc"`
+	Fees    FeePolicy     `toml:"fees"`
+	Channel ChannelPolicy `toml:"channel"`
+	Keys    KeyStore      `toml:"keys"`
+	Files   Files         `toml:"files"`
+
+	path string
+}
+
+type RPCConfig struct {
+	URL      string `toml:"url"`
+	User     string `toml:"user"`
+	Password string `toml:"password"`
+}
+
+type FeePolicy struct {
+	FixedFeeSat int64 `toml:"fixed_fee_sat"`
+	// FeeRateSatVB is used for fee-rate based spends when the node has no
+	// estimate, e.g. on a fresh regtest chain.
+	FeeRateSatVB int64 `toml:"fee_rate_sat_vb"`
+}
+
+// ChannelPolicy is what a node requires of the channels it opens or
+// accepts. The reserve and in-flight limit are fixed per channel when it is
+// opened.
+type ChannelPolicy struct {
+	MinChannelSat int64 `toml:"min_channel_sat"`
+	// ReservePercent of the capacity is what each side must keep in the
+	// channel once its balance has reached it
+	ReservePercent int64 `toml:"reserve_percent"`
+	// DustLimitSat is the smallest output a commitment carries; smaller
+	// balances are trimmed and go to fees
+	DustLimitSat int64 `toml:"dust_limit_sat"`
+	// MaxHTLCInFlightSat caps the value of pending HTLCs, 0 for the capacity
+	MaxHTLCInFlightSat int64 `toml:"max_htlc_in_flight_sat"`
+	// ContributeSat is what we add to a dual-funded channel a peer opens
+	// with us, 0 to accept it without contributing
+	ContributeSat int64 `toml:"contribute_sat"`
+	// AnchorOutputs gives the commitments of channels we open an anchor
+	// per party, so a commitment can be fee-bumped by CPFP when it is
+	// broadcast
+	AnchorOutputs bool `toml:"anchor_outputs"`
+}
+
+type KeyStore struct {
+	// State is the state.json holding alice/bob keys and channel data.
+	State string `toml:"state"`
+}
+
+// Files are resolved relative to DataDir unless they are absolute.
+type Files struct {
+	PaymentMessage string `toml:"payment_message"`
+	OpReturnTx     string `toml:"opreturn_tx"`
+	ExchangeData   string `toml:"exchange_data"`
+	AddressTest    string `toml:"address_test"`
+	UTXO           string `toml:"utxo"`
+	UTXOHTLC       string `toml:"utxo_htlc"`
+	RawTx          string `toml:"raw_tx"`
+	RedeemTx       string `toml:"redeem_tx"`
+	SwapDB         string `toml:"swap_db"`
+}
+
+func defaults() *Config {
+	return &Config{
+		Network: "regtest",
+		RPC: RPCConfig{
+			URL: "http://127.0.0.1:8332",
+		},
+		Fees: FeePolicy{
+			FixedFeeSat:  500,
+			FeeRateSatVB: 2,
+		},
+		Channel: ChannelPolicy{
+			MinChannelSat:  100000,
+			ReservePercent: 1,
+			DustLimitSat:   546,
+		},
+		Keys: KeyStore{
+			State: "state.json",
+		},
+		Files: Files{
+			PaymentMessage: "payment_message.json",
+			OpReturnTx:     "payment_opreturn.txt",
+			ExchangeData:   "exchange-data.json",
+			AddressTest:    "address-test.json",
+			UTXO:           "utxo.json",
+			UTXOHTLC:       "utxo-htlc.json",
+			RawTx:          "raw-tx.json",
+			RedeemTx:       "redeem-tx.json",
+			SwapDB:         "swap.db",
+		},
+	}
+}
+
+type envOverride struct {
+	names []string
+	field *string
+}
+
+// envOverrides maps environment variables onto config fields. The old .env
+// names are kept so existing setups keep working; paths given this way are
+// used as-is instead of being joined with data_dir.
+func (c *Config) envOverrides() []envOverride {
+	return []envOverride{
+		{[]string{"DEX_DATA_DIR"}, &c.DataDir},
+		{[]string{"DEX_NETWORK"}, &c.Network},
+		{[]string{"DEX_RPC_URL", "RPC_HOST"}, &c.RPC.URL},
+		{[]string{"DEX_RPC_USER", "RPC_USER"}, &c.RPC.User},
+		{[]string{"DEX_RPC_PASSWORD", "RPC_PASS"}, &c.RPC.Password},
+		{[]string{"STATE_PATH", "STATE_PATH_HTLC"}, &c.Keys.State},
+		{[]string{"PAYMENT_MESSAGE", "PAYMENT_MESSAGE_HTLC"}, &c.Files.PaymentMessage},
+		{[]string{"OPRETURN_TX"}, &c.Files.OpReturnTx},
+		{[]string{"EXCHANGE_DATA", "EXCHANGE_DATA_HTLC"}, &c.Files.ExchangeData},
+		{[]string{"ADDRESS_TEST"}, &c.Files.AddressTest},
+		{[]string{"UTXO_JSON"}, &c.Files.UTXO},
+		{[]string{"UTXO_HTLC_JSON"}, &c.Files.UTXOHTLC},
+		{[]string{"RAW_TX_OUTPUT"}, &c.Files.RawTx},
+		{[]string{"REDEEM_TX_OUTPUT"}, &c.Files.RedeemTx},
+		{[]string{"SWAP_DB"}, &c.Files.SwapDB},
+	}
+}
+
+// FromArgs pulls a "--config <file>" (or "--config=<file>") flag out of args,
+// loads that file and returns the remaining arguments. Without the flag the
+// DEX_CONFIG environment variable is used; without either, only defaults and
+// environment overrides apply.
+func FromArgs(args []string) (*Config, []string, error) {
+	path := os.Getenv("DEX_CONFIG")
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--config" || arg == "-config":
+			if i+1 >= len(args) {
+				return nil, nil, fmt.Errorf("--config requires a file argument")
+			}
+			path = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "--config="):
+			path = strings.TrimPrefix(arg, "--config=")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, rest, nil
+}
+
+// Load reads the TOML file at path (if any), applies environment overrides,
+// resolves relative paths and validates the result.
+func Load(path string) (*Config, error) {
+	cfg := defaults()
+	cfg.path = path
+
+	if path != "" {
+		md, err := toml.DecodeFile(path, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config %s: %v", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			keys := make([]string, len(undecoded))
+			for i, k := range undecoded {
+				keys[i] = k.String()
+			}
+			return nil, fmt.Errorf("unknown keys in config %s: %s", path, strings.Join(keys, ", "))
+		}
+		if cfg.DataDir != "" && !filepath.IsAbs(cfg.DataDir) {
+			cfg.DataDir = filepath.Join(filepath.Dir(path), cfg.DataDir)
+		}
+	}
+
+	overrides := cfg.envOverrides()
+	applyEnv(overrides[:1]) // data_dir first, the file paths hang off it
+	cfg.resolvePaths()
+	applyEnv(overrides[1:])
+
+	// RPC_HOST used to be a bare host:port
+	if c := cfg.RPC.URL; c != "" && !strings.Contains(c, "://") {
+		cfg.RPC.URL = "http://" + c
+	}
+
+	var problems []string
+	if v := os.Getenv("DEX_FIXED_FEE_SAT"); v != "" {
+		fee, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("DEX_FIXED_FEE_SAT %q is not an integer", v))
+		} else {
+			cfg.Fees.FixedFeeSat = fee
+		}
+	}
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Path: path, Problems: problems}
+	}
+	return cfg, nil
+}
+
+func applyEnv(overrides []envOverride) {
+	for _, o := range overrides {
+		for _, name := range o.names {
+			if v := os.Getenv(name); v != "" {
+				*o.field = v
+				break
+			}
+		}
+	}
+}
+
+// Path returns the config file the values were loaded from, if any.
+func (c *Config) Path() string {
+	return c.path
+}
+
+func (c *Config) filePaths() []struct {
+	name  string
+	value *string
+} {
+	return []struct {
+		name  string
+		value *string
+	}{
+		{"keys.state", &c.Keys.State},
+		{"files.payment_message", &c.Files.PaymentMessage},
+		{"files.opreturn_tx", &c.Files.OpReturnTx},
+		{"files.exchange_data", &c.Files.ExchangeData},
+		{"files.address_test", &c.Files.AddressTest},
+		{"files.utxo", &c.Files.UTXO},
+		{"files.utxo_htlc", &c.Files.UTXOHTLC},
+		{"files.raw_tx", &c.Files.RawTx},
+		{"files.redeem_tx", &c.Files.RedeemTx},
+		{"files.swap_db", &c.Files.SwapDB},
+	}
+}
+
+func (c *Config) resolvePaths() {
+	if c.DataDir == "" {
+		return
+	}
+	for _, f := range c.filePaths() {
+		if *f.value != "" && !filepath.IsAbs(*f.value) {
+			*f.value = filepath.Join(c.DataDir, *f.value)
+		}
+	}
+}
+
+// Host returns the host:port part of the RPC URL.
+func (r RPCConfig) Host() string {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return r.URL
+	}
+	return u.Host
+}
+
+// ValidationError lists every problem found in a config at once.
+type ValidationError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	source := e.Path
+	if source == "" {
+		source = "defaults/environment"
+	}
+	return fmt.Sprintf("invalid configuration (%s):\n  - %s", source, strings.Join(e.Problems, "\n  - "))
+}
+
+func (c *Config) validate() []string {
+	var problems []string
+
+	if c.DataDir == "" {
+		problems = append(problems, "data_dir is not set (use --config or DEX_DATA_DIR)")
+	} else if info, err := os.Stat(c.DataDir); err != nil || !info.IsDir() {
+		problems = append(problems, fmt.Sprintf("data_dir %s does not exist or is not a directory", c.DataDir))
+	}
+
+	if _, err := c.NetParams(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if c.RPC.URL == "" {
+		problems = append(problems, "rpc.url is not set")
+	} else if u, err := url.Parse(c.RPC.URL); err != nil || u.Scheme == "" || u.Host == "" {
+		problems = append(problems, fmt.Sprintf("rpc.url %q is not a valid URL", c.RPC.URL))
+	}
+	if c.RPC.User == "" {
+		problems = append(problems, "rpc.user is not set")
+	}
+	if c.RPC.Password == "" {
+		problems = append(problems, "rpc.password is not set")
+	}
+
+	if c.Fees.FixedFeeSat <= 0 {
+		problems = append(problems, fmt.Sprintf("fees.fixed_fee_sat must be positive, got %d", c.Fees.FixedFeeSat))
+	}
+	if c.Fees.FeeRateSatVB <= 0 {
+		problems = append(problems, fmt.Sprintf("fees.fee_rate_sat_vb must be positive, got %d", c.Fees.FeeRateSatVB))
+	}
+
+	if c.Channel.MinChannelSat < 0 {
+		problems = append(problems, fmt.Sprintf("channel.min_channel_sat must not be negative, got %d", c.Channel.MinChannelSat))
+	}
+	if c.Channel.ReservePercent < 0 || c.Channel.ReservePercent > 50 {
+		problems = append(problems, fmt.Sprintf("channel.reserve_percent must be between 0 and 50, got %d", c.Channel.ReservePercent))
+	}
+	// BOLT #2 minimum: below it some outputs are non-standard
+	if c.Channel.DustLimitSat < 354 {
+		problems = append(problems, fmt.Sprintf("channel.dust_limit_sat must be at least 354, got %d", c.Channel.DustLimitSat))
+	}
+	if c.Channel.MaxHTLCInFlightSat < 0 {
+		problems = append(problems, fmt.Sprintf("channel.max_htlc_in_flight_sat must not be negative, got %d", c.Channel.MaxHTLCInFlightSat))
+	}
+	if c.Channel.ContributeSat < 0 {
+		problems = append(problems, fmt.Sprintf("channel.contribute_sat must not be negative, got %d", c.Channel.ContributeSat))
+	}
+
+	for _, f := range c.filePaths() {
+		if *f.value == "" {
+			problems = append(problems, f.name+" is not set")
+		}
+	}
+	return problems
+}
+
+// NetParams returns the chain parameters for the configured network.
+func (c *Config) NetParams() (*chaincfg.Params, error) {
+	switch c.Network {
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	case "testnet", "testnet3":
+		return &chaincfg.TestNet3Params, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+	case "mainnet":
+		return &chaincfg.MainNetParams, nil
+	}
+	return nil, fmt.Errorf("network %q is not one of regtest, testnet, signet, mainnet", c.Network)
+}
@@ -0,0 +1,231 @@
+package noise
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+const (
+	// MaxFrameSize is the largest plaintext in one frame; Write splits
+	// anything bigger.
+	MaxFrameSize = 65535
+	// rotateAfter is how many messages one key encrypts before rotation.
+	rotateAfter = 1000
+	// handshakeTimeout bounds how long a peer may stall the handshake.
+	handshakeTimeout = 15 * time.Second
+)
+
+// cipherState encrypts one direction of the transport.
+type cipherState struct {
+	key [32]byte
+	ck  [32]byte
+	n   uint64
+}
+
+func (c *cipherState) seal(plaintext []byte) []byte {
+	out := aead(c.key).Seal(nil, nonce(c.n), plaintext, nil)
+	c.next()
+	return out
+}
+
+func (c *cipherState) open(ciphertext []byte) ([]byte, error) {
+	out, err := aead(c.key).Open(nil, nonce(c.n), ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("noise: bad MAC on frame")
+	}
+	c.next()
+	return out, nil
+}
+
+// next counts a use of the key; the length and the body of a frame count
+// separately.
+func (c *cipherState) next() {
+	c.n++
+	if c.n == rotateAfter {
+		c.ck, c.key = hkdf2(c.ck[:], c.key[:])
+		c.n = 0
+	}
+}
+
+// Conn is an encrypted connection to an authenticated peer. It is a byte
+// stream, so any framing can run on top of it.
+type Conn struct {
+	conn   net.Conn
+	remote *btcec.PublicKey
+
+	wmu  sync.Mutex
+	send *cipherState
+
+	recv    *cipherState
+	pending []byte
+}
+
+func (c *Conn) handshake(fn func() error) error {
+	c.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := fn(); err != nil {
+		c.conn.Close()
+		return err
+	}
+	c.conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// Client runs the initiator's handshake over conn. remote is the key we
+// expect the peer to hold; the handshake fails if it does not.
+func Client(conn net.Conn, local *btcec.PrivateKey, remote *btcec.PublicKey) (*Conn, error) {
+	c := &Conn{conn: conn, remote: remote}
+	err := c.handshake(func() error {
+		e, err := btcec.NewPrivateKey()
+		if err != nil {
+			return err
+		}
+		c.send, c.recv, err = initiate(conn, []byte(prologue), local, e, remote)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Server runs the responder's handshake over conn; RemoteKey tells who
+// connected.
+func Server(conn net.Conn, local *btcec.PrivateKey) (*Conn, error) {
+	c := &Conn{conn: conn}
+	err := c.handshake(func() error {
+		e, err := btcec.NewPrivateKey()
+		if err != nil {
+			return err
+		}
+		c.send, c.recv, c.remote, err = respond(conn, []byte(prologue), local, e)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Dial connects to addr and authenticates the peer as remote.
+func Dial(addr string, local *btcec.PrivateKey, remote *btcec.PublicKey) (*Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, handshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return Client(conn, local, remote)
+}
+
+// RemoteKey is the peer's authenticated static key.
+func (c *Conn) RemoteKey() *btcec.PublicKey {
+	return c.remote
+}
+
+// Write encrypts b as one or more frames: an encrypted 2-byte length, then
+// the encrypted body.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > MaxFrameSize {
+			chunk = chunk[:MaxFrameSize]
+		}
+		var l [2]byte
+		binary.BigEndian.PutUint16(l[:], uint16(len(chunk)))
+		frame := c.send.seal(l[:])
+		frame = append(frame, c.send.seal(chunk)...)
+		if _, err := c.conn.Write(frame); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// Read returns decrypted bytes, reading a new frame when the last one has
+// been consumed.
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		frame, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = frame
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) readFrame() ([]byte, error) {
+	var hdr [2 + macSize]byte
+	if _, err := io.ReadFull(c.conn, hdr[:]); err != nil {
+		return nil, err
+	}
+	l, err := c.recv.open(hdr[:])
+	if err != nil {
+		return nil, err
+	}
+	body := make([]byte, int(binary.BigEndian.Uint16(l))+macSize)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return nil, fmt.Errorf("noise: truncated frame: %v", err)
+	}
+	return c.recv.open(body)
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Listener accepts encrypted connections.
+type Listener struct {
+	ln    net.Listener
+	local *btcec.PrivateKey
+}
+
+func Listen(addr string, local *btcec.PrivateKey) (*Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln: ln, local: local}, nil
+}
+
+// Accept waits for a connection and runs the handshake. A failed handshake
+// is returned as an error; the listener stays usable.
+func (l *Listener) Accept() (*Conn, error) {
+	conn, err := l.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, l.local)
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
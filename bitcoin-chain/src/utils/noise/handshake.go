@@ -0,0 +1,217 @@
+// Package noise is an authenticated, encrypted transport between two nodes
+// identified by secp256k1 keys. It follows BOLT #8: a Noise XK handshake
+// (Noise_XK_secp256k1_ChaChaPoly_SHA256) followed by length-prefixed
+// ChaCha20-Poly1305 frames with key rotation every 1000 messages. The
+// initiator must know the responder's static key; the responder learns the
+// initiator's key in the third act.
+package noise
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	protocolName = "Noise_XK_secp256k1_ChaChaPoly_SHA256"
+	// prologue binds the handshake to this application, so our nodes cannot
+	// be confused with lightning nodes using the same keys.
+	prologue = "intent-dex"
+
+	handshakeVersion = 0
+	macSize          = 16
+	actOneSize       = 1 + 33 + macSize
+	actTwoSize       = 1 + 33 + macSize
+	actThreeSize     = 1 + 33 + 2*macSize
+)
+
+var errHandshake = errors.New("noise handshake failed")
+
+// ecdh is SHA256 of the compressed shared point, as BOLT #8 defines it.
+func ecdh(priv *btcec.PrivateKey, pub *btcec.PublicKey) []byte {
+	var point, result btcec.JacobianPoint
+	pub.AsJacobian(&point)
+	btcec.ScalarMultNonConst(&priv.Key, &point, &result)
+	result.ToAffine()
+	shared := btcec.NewPublicKey(&result.X, &result.Y)
+	h := sha256.Sum256(shared.SerializeCompressed())
+	return h[:]
+}
+
+// hkdf2 splits one HKDF-SHA256 expansion into two 32-byte keys.
+func hkdf2(salt, ikm []byte) (k1, k2 [32]byte) {
+	r := hkdf.New(sha256.New, ikm, salt, nil)
+	io.ReadFull(r, k1[:])
+	io.ReadFull(r, k2[:])
+	return k1, k2
+}
+
+func aead(key [32]byte) cipher.AEAD {
+	a, _ := chacha20poly1305.New(key[:])
+	return a
+}
+
+// nonce is 32 zero bits followed by the little-endian counter.
+func nonce(n uint64) []byte {
+	var b [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(b[4:], n)
+	return b[:]
+}
+
+// symmetricState is the chaining key, handshake hash and current
+// temporary key of the handshake.
+type symmetricState struct {
+	ck, h, k [32]byte
+}
+
+func newSymmetricState(prologue []byte, responderStatic *btcec.PublicKey) *symmetricState {
+	s := &symmetricState{h: sha256.Sum256([]byte(protocolName))}
+	s.ck = s.h
+	s.mixHash(prologue)
+	s.mixHash(responderStatic.SerializeCompressed())
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	s.h = sha256.Sum256(append(s.h[:], data...))
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	s.ck, s.k = hkdf2(s.ck[:], ikm)
+}
+
+// encryptAndHash always uses nonce 0 except for the static key in act
+// three, which is the only second use of a temporary key.
+func (s *symmetricState) encryptAndHash(n uint64, plaintext []byte) []byte {
+	c := aead(s.k).Seal(nil, nonce(n), plaintext, s.h[:])
+	s.mixHash(c)
+	return c
+}
+
+func (s *symmetricState) decryptAndHash(n uint64, ciphertext []byte) ([]byte, error) {
+	p, err := aead(s.k).Open(nil, nonce(n), ciphertext, s.h[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad MAC", errHandshake)
+	}
+	s.mixHash(ciphertext)
+	return p, nil
+}
+
+// split derives the two transport keys; the first encrypts what the
+// initiator sends.
+func (s *symmetricState) split() (initiator, responder *cipherState) {
+	k1, k2 := hkdf2(s.ck[:], nil)
+	return &cipherState{key: k1, ck: s.ck}, &cipherState{key: k2, ck: s.ck}
+}
+
+func readAct(r io.Reader, size int) ([]byte, *btcec.PublicKey, []byte, error) {
+	act := make([]byte, size)
+	if _, err := io.ReadFull(r, act); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", errHandshake, err)
+	}
+	if act[0] != handshakeVersion {
+		return nil, nil, nil, fmt.Errorf("%w: unknown version %d", errHandshake, act[0])
+	}
+	if size == actThreeSize {
+		return act[1 : size-macSize], nil, act[size-macSize:], nil
+	}
+	pub, err := btcec.ParsePubKey(act[1:34])
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: bad ephemeral key", errHandshake)
+	}
+	return act[1:34], pub, act[34:], nil
+}
+
+// initiate runs the initiator's side of the handshake with ephemeral key e:
+// act one, read act two, act three.
+func initiate(rw io.ReadWriter, prologue []byte, local, e *btcec.PrivateKey, remote *btcec.PublicKey) (send, recv *cipherState, err error) {
+	s := newSymmetricState(prologue, remote)
+
+	// act one: e, es
+	ePub := e.PubKey().SerializeCompressed()
+	s.mixHash(ePub)
+	s.mixKey(ecdh(e, remote))
+	act := append([]byte{handshakeVersion}, ePub...)
+	act = append(act, s.encryptAndHash(0, nil)...)
+	if _, err := rw.Write(act); err != nil {
+		return nil, nil, err
+	}
+
+	// act two: e, ee
+	reRaw, re, tag, err := readAct(rw, actTwoSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.mixHash(reRaw)
+	s.mixKey(ecdh(e, re))
+	if _, err := s.decryptAndHash(0, tag); err != nil {
+		return nil, nil, err
+	}
+
+	// act three: s, se
+	c := s.encryptAndHash(1, local.PubKey().SerializeCompressed())
+	s.mixKey(ecdh(local, re))
+	act = append([]byte{handshakeVersion}, c...)
+	act = append(act, s.encryptAndHash(0, nil)...)
+	if _, err := rw.Write(act); err != nil {
+		return nil, nil, err
+	}
+
+	send, recv = s.split()
+	return send, recv, nil
+}
+
+// respond runs the responder's side with ephemeral key e and returns the
+// initiator's static key.
+func respond(rw io.ReadWriter, prologue []byte, local, e *btcec.PrivateKey) (send, recv *cipherState, remote *btcec.PublicKey, err error) {
+	s := newSymmetricState(prologue, local.PubKey())
+
+	// act one
+	reRaw, re, tag, err := readAct(rw, actOneSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	s.mixHash(reRaw)
+	s.mixKey(ecdh(local, re))
+	if _, err := s.decryptAndHash(0, tag); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// act two
+	ePub := e.PubKey().SerializeCompressed()
+	s.mixHash(ePub)
+	s.mixKey(ecdh(e, re))
+	act := append([]byte{handshakeVersion}, ePub...)
+	act = append(act, s.encryptAndHash(0, nil)...)
+	if _, err := rw.Write(act); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// act three
+	c, _, tag, err := readAct(rw, actThreeSize)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rsRaw, err := s.decryptAndHash(1, c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	remote, err = btcec.ParsePubKey(rsRaw)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: bad static key", errHandshake)
+	}
+	s.mixKey(ecdh(e, remote))
+	if _, err := s.decryptAndHash(0, tag); err != nil {
+		return nil, nil, nil, err
+	}
+
+	recv, send = s.split()
+	return send, recv, remote, nil
+}
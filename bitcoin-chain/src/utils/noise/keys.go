@@ -0,0 +1,124 @@
+package noise
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"example.com/utils/statefile"
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// LoadKey reads the hex node key at path, creating one on first use. The
+// node key only authenticates the transport; it never signs transactions.
+func LoadKey(path string) (*btcec.PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := btcec.NewPrivateKey()
+		if err != nil {
+			return nil, err
+		}
+		data := []byte(hex.EncodeToString(key.Serialize()) + "\n")
+		if err := statefile.WriteFile(path, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save node key: %v", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("invalid node key in %s", path)
+	}
+	key, _ := btcec.PrivKeyFromBytes(raw)
+	return key, nil
+}
+
+// ParseKey parses a hex compressed node public key.
+func ParseKey(s string) (*btcec.PublicKey, error) {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node key: %v", err)
+	}
+	return btcec.ParsePubKey(raw)
+}
+
+// KeyString is the hex form used in addresses and pin files.
+func KeyString(key *btcec.PublicKey) string {
+	return hex.EncodeToString(key.SerializeCompressed())
+}
+
+// SplitAddress splits "<node-key>@host:port"; the key part is optional.
+func SplitAddress(s string) (*btcec.PublicKey, string, error) {
+	at := strings.LastIndex(s, "@")
+	if at < 0 {
+		return nil, s, nil
+	}
+	key, err := ParseKey(s[:at])
+	if err != nil {
+		return nil, "", err
+	}
+	return key, s[at+1:], nil
+}
+
+// Pins remembers the node key each named peer used the first time we talked
+// to it, and refuses a different key afterwards.
+type Pins struct {
+	path string
+}
+
+type pinFile struct {
+	Peers map[string]string `json:"peers"`
+}
+
+func OpenPins(path string) *Pins {
+	return &Pins{path: path}
+}
+
+// Lookup returns the pinned key for name, or nil if there is none.
+func (p *Pins) Lookup(name string) (*btcec.PublicKey, error) {
+	var f pinFile
+	if _, err := statefile.Load(p.path, &f); err != nil {
+		return nil, err
+	}
+	s, ok := f.Peers[name]
+	if !ok {
+		return nil, nil
+	}
+	return ParseKey(s)
+}
+
+// Check accepts key for name if it matches the pin, pinning it if name has
+// never been seen.
+func (p *Pins) Check(name string, key *btcec.PublicKey) error {
+	var f pinFile
+	return statefile.Update(p.path, &f, func() error {
+		got := KeyString(key)
+		pinned, ok := f.Peers[name]
+		if ok && pinned != got {
+			return fmt.Errorf("%s presented node key %s, pinned key is %s", name, got, pinned)
+		}
+		if ok {
+			return nil
+		}
+		if f.Peers == nil {
+			f.Peers = map[string]string{}
+		}
+		f.Peers[name] = got
+		fmt.Printf("Pinned %s's node key %s\n", name, got)
+		return nil
+	})
+}
+
+// Forget drops the pin for name, for when a peer legitimately rotates its
+// node key.
+func (p *Pins) Forget(name string) error {
+	var f pinFile
+	return statefile.Update(p.path, &f, func() error {
+		delete(f.Peers, name)
+		return nil
+	})
+}
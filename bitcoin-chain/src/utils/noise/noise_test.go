@@ -0,0 +1,291 @@
+package noise
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+)
+
+// BOLT #8 appendix A test vectors. They use the lightning prologue, not
+// ours.
+const (
+	vectorPrologue = "lightning"
+
+	initiatorStaticPriv    = "1111111111111111111111111111111111111111111111111111111111111111"
+	initiatorEphemeralPriv = "1212121212121212121212121212121212121212121212121212121212121212"
+	responderStaticPriv    = "2121212121212121212121212121212121212121212121212121212121212121"
+	responderEphemeralPriv = "2222222222222222222222222222222222222222222222222222222222222222"
+
+	actOneVector   = "00036360e856310ce5d294e8be33fc807077dc56ac80d95d9cd4ddbd21325eff73f70df6086551151f58b8afe6c195782c6a"
+	actTwoVector   = "0002466d7fcae563e5cb09a0d1870bb580344804617879a14949cf22285f1bae3f276e2470b93aac583c9ef6eafca3f730ae"
+	actThreeVector = "00b9e3a702e93e3a9948c2ed6e5fd7590a6e1c3a0344cfc9d5b57357049aa22355361aa02e55a8fc28fef5bd6d71ad0c38228dc68b1c466263b47fdf31e560e139ba"
+
+	sendKeyVector = "969ab31b4d288cedf6218839b27a3e2140827047f2c0f01bf5c04435d43511a9"
+	recvKeyVector = "bb9020b8965f4df047e07f955f3c4b88418984aadc5cdb35096b9ea8fa5c3442"
+)
+
+// the encrypted "hello" the initiator sends as its nth message; 500 and
+// 1000 are the first messages after a key rotation
+var messageVectors = map[int]string{
+	0:    "cf2b30ddf0cf3f80e7c35a6e6730b59fe802473180f396d88a8fb0db8cbcf25d2f214cf9ea1d95",
+	1:    "72887022101f0b6753e0c7de21657d35a4cb2a1f5cde2650528bbc8f837d0f0d7ad833b1a256a1",
+	500:  "178cb9d7387190fa34db9c2d50027d21793c9bc2d40b1e14dcf30ebeeeb220f48364f7a4c68bf8",
+	501:  "1b186c57d44eb6de4c057c49940d79bb838a145cb528d6e8fd26dbe50a60ca2c104b56b60e45bd",
+	1000: "4a2f3cc3b5e78ddb83dcb426d9863d9d9a723b0337c89dd0b005d89f8d3c05c52b76b29b740f09",
+	1001: "2ecd8c8a5629d0d02ab457a0fdd0f7b90a192cd46be5ecb6ca570bfc5e268338b1a16cf4ef2d36",
+}
+
+func privKey(t *testing.T, s string) *btcec.PrivateKey {
+	t.Helper()
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := btcec.PrivKeyFromBytes(raw)
+	return key
+}
+
+// recorder keeps a copy of everything written through it.
+type recorder struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.written.Write(b)
+	return r.Conn.Write(b)
+}
+
+type handshakeResult struct {
+	send, recv *cipherState
+	remote     *btcec.PublicKey
+	err        error
+}
+
+// vectorHandshake runs both sides of the handshake with the vector keys and
+// returns the initiator's result, the responder's result and the acts each
+// side wrote.
+func vectorHandshake(t *testing.T, prologue string) (initiator, responder handshakeResult, initiatorActs, responderActs []byte) {
+	t.Helper()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ra, rb := &recorder{Conn: a}, &recorder{Conn: b}
+
+	rs := privKey(t, responderStaticPriv)
+	done := make(chan handshakeResult, 1)
+	go func() {
+		var r handshakeResult
+		r.send, r.recv, r.remote, r.err = respond(rb, []byte(prologue), rs, privKey(t, responderEphemeralPriv))
+		if r.err != nil {
+			b.Close()
+		}
+		done <- r
+	}()
+	initiator.send, initiator.recv, initiator.err = initiate(ra, []byte(prologue), privKey(t, initiatorStaticPriv), privKey(t, initiatorEphemeralPriv), rs.PubKey())
+	if initiator.err != nil {
+		a.Close()
+	}
+	responder = <-done
+	return initiator, responder, ra.written.Bytes(), rb.written.Bytes()
+}
+
+func TestHandshakeVectors(t *testing.T) {
+	initiator, responder, initiatorActs, responderActs := vectorHandshake(t, vectorPrologue)
+	if initiator.err != nil {
+		t.Fatalf("initiator: %v", initiator.err)
+	}
+	if responder.err != nil {
+		t.Fatalf("responder: %v", responder.err)
+	}
+
+	if got := hex.EncodeToString(initiatorActs); got != actOneVector+actThreeVector {
+		t.Errorf("acts one and three\n got %s\nwant %s", got, actOneVector+actThreeVector)
+	}
+	if got := hex.EncodeToString(responderActs); got != actTwoVector {
+		t.Errorf("act two\n got %s\nwant %s", got, actTwoVector)
+	}
+	if !responder.remote.IsEqual(privKey(t, initiatorStaticPriv).PubKey()) {
+		t.Errorf("responder learned %s, want the initiator's static key", KeyString(responder.remote))
+	}
+
+	for _, c := range []struct {
+		name string
+		key  [32]byte
+		want string
+	}{
+		{"initiator sending key", initiator.send.key, sendKeyVector},
+		{"initiator receiving key", initiator.recv.key, recvKeyVector},
+		{"responder sending key", responder.send.key, recvKeyVector},
+		{"responder receiving key", responder.recv.key, sendKeyVector},
+	} {
+		if got := hex.EncodeToString(c.key[:]); got != c.want {
+			t.Errorf("%s is %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestHandshakePrologueMismatch(t *testing.T) {
+	// our own prologue must not interoperate with the lightning one
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	rs := privKey(t, responderStaticPriv)
+	done := make(chan error, 1)
+	go func() {
+		_, _, _, err := respond(b, []byte(vectorPrologue), rs, privKey(t, responderEphemeralPriv))
+		b.Close()
+		done <- err
+	}()
+	_, _, err := initiate(a, []byte(prologue), privKey(t, initiatorStaticPriv), privKey(t, initiatorEphemeralPriv), rs.PubKey())
+	if err == nil {
+		t.Error("initiator completed a handshake with a different prologue")
+	}
+	if err := <-done; err == nil {
+		t.Error("responder completed a handshake with a different prologue")
+	}
+}
+
+func TestMessageVectors(t *testing.T) {
+	initiator, _, _, _ := vectorHandshake(t, vectorPrologue)
+	if initiator.err != nil {
+		t.Fatal(initiator.err)
+	}
+	send := initiator.send
+	hello := []byte("hello")
+	for i := 0; i <= 1001; i++ {
+		l := []byte{0, byte(len(hello))}
+		frame := append(send.seal(l), send.seal(hello)...)
+		want, ok := messageVectors[i]
+		if !ok {
+			continue
+		}
+		if got := hex.EncodeToString(frame); got != want {
+			t.Errorf("message %d\n got %s\nwant %s", i, got, want)
+		}
+	}
+}
+
+// pipe connects a Client and a Server over net.Pipe.
+func pipe(t *testing.T, clientKey, serverKey *btcec.PrivateKey, expect *btcec.PublicKey) (client, server *Conn, err error) {
+	t.Helper()
+	a, b := net.Pipe()
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := Server(b, serverKey)
+		done <- result{conn, err}
+	}()
+	client, err = Client(a, clientKey, expect)
+	r := <-done
+	if err != nil || r.err != nil {
+		a.Close()
+		b.Close()
+		if err == nil {
+			err = r.err
+		}
+		return nil, nil, err
+	}
+	t.Cleanup(func() {
+		client.Close()
+		r.conn.Close()
+	})
+	return client, r.conn, nil
+}
+
+func newKey(t *testing.T) *btcec.PrivateKey {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// echo sends msg through conn, which the other side copies back. The write
+// runs on its own goroutine because net.Pipe has no buffer.
+func echo(conn *Conn, msg []byte) error {
+	written := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(msg)
+		written <- err
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if err := <-written; err != nil {
+		return err
+	}
+	if !bytes.Equal(got, msg) {
+		return fmt.Errorf("echo differs from what was sent")
+	}
+	return nil
+}
+
+func TestConn(t *testing.T) {
+	clientKey, serverKey := newKey(t), newKey(t)
+	client, server, err := pipe(t, clientKey, serverKey, serverKey.PubKey())
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if !server.RemoteKey().IsEqual(clientKey.PubKey()) {
+		t.Fatalf("server learned %s, want the client's key", KeyString(server.RemoteKey()))
+	}
+	go io.Copy(server, server)
+
+	if err := echo(client, []byte("hello")); err != nil {
+		t.Fatalf("small message: %v", err)
+	}
+	big := make([]byte, 3*MaxFrameSize+17)
+	rand.Read(big)
+	if err := echo(client, big); err != nil {
+		t.Fatalf("multi-frame message: %v", err)
+	}
+	for i := 0; i < 2*rotateAfter+5; i++ {
+		if err := echo(client, []byte(fmt.Sprintf("message %d", i))); err != nil {
+			t.Fatalf("message %d across key rotations: %v", i, err)
+		}
+	}
+}
+
+func TestWrongNodeKey(t *testing.T) {
+	clientKey, serverKey := newKey(t), newKey(t)
+	if _, _, err := pipe(t, clientKey, serverKey, newKey(t).PubKey()); err == nil {
+		t.Fatal("dial to the wrong node key succeeded")
+	}
+}
+
+func TestPins(t *testing.T) {
+	pins := OpenPins(filepath.Join(t.TempDir(), "peers.json"))
+	key, other := newKey(t).PubKey(), newKey(t).PubKey()
+
+	if err := pins.Check("peer", key); err != nil {
+		t.Fatalf("first contact: %v", err)
+	}
+	if err := pins.Check("peer", key); err != nil {
+		t.Fatalf("pinned key: %v", err)
+	}
+	err := pins.Check("peer", other)
+	if err == nil || !strings.Contains(err.Error(), "pinned key") {
+		t.Fatalf("changed key: got %v, want a pin mismatch", err)
+	}
+
+	if err := pins.Forget("peer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pins.Check("peer", other); err != nil {
+		t.Fatalf("new key after forget: %v", err)
+	}
+}
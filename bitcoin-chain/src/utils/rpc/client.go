@@ -0,0 +1,264 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"example.com/utils/config"
+)
+
+type Client struct {
+	URL      string
+	User     string
+	Password string
+}
+
+func New(cfg config.RPCConfig) *Client {
+	return &Client{URL: cfg.URL, User: cfg.User, Password: cfg.Password}
+}
+
+type request struct {
+	Jsonrpc string        `json:"jsonrpc"`
+	ID      string        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Error is a JSON-RPC error returned by bitcoind.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("RPC error %d: %s", e.Code, e.Message)
+}
+
+// Call invokes method and returns the raw result. RPC-level failures are
+// returned as *Error so callers can inspect the code.
+func (c *Client) Call(method string, params ...interface{}) (json.RawMessage, error) {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(request{Jsonrpc: "1.0", ID: "dex", Method: method, Params: params})
+	if err != nil {
+		return nil, fmt.Errorf("marshal error: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("request error: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.User, c.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("RPC request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response error: %w", err)
+	}
+
+	var out response
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("JSON decode error (HTTP %d): %w", resp.StatusCode, err)
+	}
+	if out.Error != nil {
+		return nil, out.Error
+	}
+	return out.Result, nil
+}
+
+// CallInto invokes method and decodes the result into v.
+func (c *Client) CallInto(v interface{}, method string, params ...interface{}) error {
+	raw, err := c.Call(method, params...)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("failed to decode %s result: %w", method, err)
+	}
+	return nil
+}
+
+// EstimateFeeRate returns the node's fee estimate for confirmation within
+// target blocks, in sat/vB.
+func (c *Client) EstimateFeeRate(target int) (int64, error) {
+	var res struct {
+		FeeRate float64  `json:"feerate"` // BTC/kvB
+		Errors  []string `json:"errors"`
+	}
+	if err := c.CallInto(&res, "estimatesmartfee", target); err != nil {
+		return 0, err
+	}
+	if res.FeeRate <= 0 {
+		return 0, fmt.Errorf("no fee estimate: %v", res.Errors)
+	}
+	return int64(math.Ceil(res.FeeRate * 1e8 / 1000)), nil
+}
+
+// GetTxConfirmations returns how many confirmations a tx with nOut outputs
+// has, 0 while it is in the mempool, by asking gettxout for each output in
+// turn, so the node needs no txindex. It only finds the tx while one of its
+// outputs is unspent; found is false otherwise.
+func (c *Client) GetTxConfirmations(txid string, nOut int) (confs int64, found bool, err error) {
+	for i := 0; i < nOut; i++ {
+		out, err := c.GetTxOut(txid, uint32(i))
+		if err != nil {
+			return 0, false, err
+		}
+		if out != nil {
+			return out.Confirmations, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (c *Client) GetBlockCount() (int64, error) {
+	var height int64
+	err := c.CallInto(&height, "getblockcount")
+	return height, err
+}
+
+// Tx is a transaction as getrawtransaction and getblock with verbosity 2
+// report it.
+type Tx struct {
+	Txid string `json:"txid"`
+	Hex  string `json:"hex"`
+	Vin  []struct {
+		Txid string `json:"txid"`
+		Vout uint32 `json:"vout"`
+	} `json:"vin"`
+	// set by getrawtransaction once the tx is in a block
+	BlockHash     string `json:"blockhash,omitempty"`
+	Confirmations int64  `json:"confirmations,omitempty"`
+}
+
+func (tx *Tx) spends(txid string, vout uint32) bool {
+	for _, in := range tx.Vin {
+		if in.Txid == txid && in.Vout == vout {
+			return true
+		}
+	}
+	return false
+}
+
+// FindSpend looks for the tx spending output vout of txid, first in the
+// mempool, then in the blocks from the tip back to the one that confirmed
+// txid. It needs no txindex. It returns nil if no tx spends the output;
+// height is 0 for a spend in the mempool.
+func (c *Client) FindSpend(txid string, vout uint32) (tx *Tx, height int64, err error) {
+	return c.FindSpendSince(txid, vout, time.Time{})
+}
+
+// blockTimeSlack is how far a block's timestamp may lag the time it was
+// mined: consensus accepts any time after the median of the last 11 blocks.
+const blockTimeSlack = 2 * time.Hour
+
+// FindSpendSince is FindSpend for an output that cannot have been spent
+// before since, e.g. one that did not exist yet: the scan also stops at
+// blocks older than that, so it does not walk back to genesis looking for a
+// tx that was never mined. A zero since scans as FindSpend does.
+func (c *Client) FindSpendSince(txid string, vout uint32, since time.Time) (tx *Tx, height int64, err error) {
+	var mempool []string
+	if err := c.CallInto(&mempool, "getrawmempool"); err != nil {
+		return nil, 0, fmt.Errorf("getrawmempool: %v", err)
+	}
+	for _, id := range mempool {
+		var tx Tx
+		if err := c.CallInto(&tx, "getrawtransaction", id, true); err != nil {
+			continue // evicted or mined since getrawmempool
+		}
+		if tx.spends(txid, vout) {
+			return &tx, 0, nil
+		}
+	}
+
+	tip, err := c.GetBlockCount()
+	if err != nil {
+		return nil, 0, fmt.Errorf("getblockcount: %v", err)
+	}
+	for h := tip; h >= 0; h-- {
+		var hash string
+		if err := c.CallInto(&hash, "getblockhash", h); err != nil {
+			return nil, 0, fmt.Errorf("getblockhash %d: %v", h, err)
+		}
+		var b struct {
+			Time int64 `json:"time"`
+			Tx   []Tx  `json:"tx"`
+		}
+		if err := c.CallInto(&b, "getblock", hash, 2); err != nil {
+			return nil, 0, fmt.Errorf("getblock %s: %v", hash, err)
+		}
+		created := false
+		for i := range b.Tx {
+			if b.Tx[i].spends(txid, vout) {
+				return &b.Tx[i], h, nil
+			}
+			created = created || b.Tx[i].Txid == txid
+		}
+		if created || !since.IsZero() && time.Unix(b.Time, 0).Before(since.Add(-blockTimeSlack)) {
+			break
+		}
+	}
+	return nil, 0, nil
+}
+
+// SubmitPackage submits a child with its unconfirmed parents, parents
+// first, so the child's fee counts towards a parent too cheap to enter the
+// mempool alone.
+func (c *Client) SubmitPackage(txHexes ...string) error {
+	var res struct {
+		PackageMsg string `json:"package_msg"`
+		TxResults  map[string]struct {
+			Txid  string `json:"txid"`
+			Error string `json:"error"`
+		} `json:"tx-results"`
+	}
+	if err := c.CallInto(&res, "submitpackage", txHexes); err != nil {
+		return err
+	}
+	if res.PackageMsg == "success" {
+		return nil
+	}
+	var errs []string
+	for _, r := range res.TxResults {
+		if r.Error != "" {
+			errs = append(errs, r.Txid+": "+r.Error)
+		}
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("package rejected: %s %v", res.PackageMsg, errs)
+}
+
+// TxOut is an unspent output as gettxout reports it.
+type TxOut struct {
+	Confirmations int64   `json:"confirmations"`
+	Value         float64 `json:"value"` // BTC
+	ScriptPubKey  struct {
+		Hex string `json:"hex"`
+	} `json:"scriptPubKey"`
+}
+
+// GetTxOut returns output vout of txid, or nil if it is spent or was never
+// created.
+func (c *Client) GetTxOut(txid string, vout uint32) (*TxOut, error) {
+	var out *TxOut
+	err := c.CallInto(&out, "gettxout", txid, vout, true)
+	return out, err
+}
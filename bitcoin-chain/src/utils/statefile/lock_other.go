@@ -0,0 +1,13 @@
+//go:build !unix
+
+package statefile
+
+// Advisory locks are only implemented on unix; elsewhere the atomic rename
+// and version check are the only protection.
+type fileLock struct{}
+
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	return &fileLock{}, nil
+}
+
+func (l *fileLock) unlock() {}
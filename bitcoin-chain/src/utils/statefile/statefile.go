@@ -0,0 +1,173 @@
+package statefile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// versionKey is the top-level field used for optimistic concurrency checks.
+const versionKey = "version"
+
+// ErrStale is returned by Save when the file was written by someone else
+// after it was loaded.
+var ErrStale = errors.New("state file was modified by another process, reload and retry")
+
+// Snapshot remembers the version a state file had when it was loaded.
+type Snapshot struct {
+	Version uint64
+}
+
+// Load reads path into v under a shared lock. A missing file loads as an
+// empty document with version 0.
+func Load(path string, v interface{}) (*Snapshot, error) {
+	lock, err := lockFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	return read(path, v)
+}
+
+// Save writes v back to path if nobody else saved since snap was loaded.
+func Save(path string, snap *Snapshot, v interface{}) error {
+	lock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	current, err := read(path, nil)
+	if err != nil {
+		return err
+	}
+	if current.Version != snap.Version {
+		return fmt.Errorf("%s: %w (loaded version %d, found %d)", path, ErrStale, snap.Version, current.Version)
+	}
+	return write(path, snap, v)
+}
+
+// Update holds an exclusive lock on path while it loads the state into v,
+// runs fn and writes the result back. If fn returns an error nothing is
+// written.
+func Update(path string, v interface{}, fn func() error) error {
+	lock, err := lockFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	snap, err := read(path, v)
+	if err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return write(path, snap, v)
+}
+
+// WriteFile atomically replaces path with data: the bytes go to a temporary
+// file in the same directory which is fsynced and then renamed over path.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %v", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temp file: %v", err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to chmod temp file: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to fsync temp file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temp file: %v", err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+
+	// Persist the rename itself.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+func read(path string, v interface{}) (*Snapshot, error) {
+	snap := &Snapshot{}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snap, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if len(data) == 0 {
+		return snap, nil
+	}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if raw, ok := doc[versionKey]; ok {
+		if err := json.Unmarshal(raw, &snap.Version); err != nil {
+			return nil, fmt.Errorf("invalid version in %s: %v", path, err)
+		}
+	}
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+	}
+	return snap, nil
+}
+
+// write replaces path with v plus the bumped version. Only v is written:
+// a field v clears or omits is gone from the file afterwards.
+func write(path string, snap *Snapshot, v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		return fmt.Errorf("state must encode to a JSON object: %v", err)
+	}
+	if doc == nil {
+		doc = map[string]json.RawMessage{}
+	}
+
+	next := snap.Version + 1
+	doc[versionKey], _ = json.Marshal(next)
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state: %v", err)
+	}
+	if err := WriteFile(path, out, 0644); err != nil {
+		return err
+	}
+	snap.Version = next
+	return nil
+}
@@ -0,0 +1,193 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The JSON files the swap binaries hand each other. Each reader returns an
+// error naming the file and the missing field instead of a zero value, so
+// a malformed or half-written file stops the binary rather than panicking
+// in it or signing with an empty key.
+
+// KeyPair is one party's key as state.json and address-test.json hold it.
+type KeyPair struct {
+	PrivKey string `json:"privkey"`
+	PubKey  string `json:"pubkey"`
+	Address string `json:"address"`
+}
+
+func (k *KeyPair) check(path, name string) error {
+	switch {
+	case k == nil:
+		return fmt.Errorf("%s has no %s key", path, name)
+	case k.PrivKey == "":
+		return fmt.Errorf("%s: %s has no privkey", path, name)
+	case k.PubKey == "":
+		return fmt.Errorf("%s: %s has no pubkey", path, name)
+	case k.Address == "":
+		return fmt.Errorf("%s: %s has no address", path, name)
+	}
+	return nil
+}
+
+// KeyFile is state.json: both parties' keys.
+type KeyFile struct {
+	Alice *KeyPair `json:"alice"`
+	Bob   *KeyPair `json:"bob"`
+}
+
+// HTLCAddress is an HTLC's address and redeem script as create-htlc
+// writes them.
+type HTLCAddress struct {
+	Address      string `json:"address"`
+	RedeemScript string `json:"redeemScript"`
+}
+
+// AddressBook is address-test.json: the sender's keys and the HTLC.
+type AddressBook struct {
+	Sender []KeyPair     `json:"sender"`
+	HTLC   []HTLCAddress `json:"HTLC"`
+}
+
+// Unspent is one output of a scantxoutset result.
+type Unspent struct {
+	TxID         string  `json:"txid"`
+	Vout         uint32  `json:"vout"`
+	ScriptPubKey string  `json:"scriptPubKey"`
+	Amount       float64 `json:"amount"` // BTC
+	Height       int64   `json:"height"`
+}
+
+// ScanResult is a scantxoutset result as utxo.json and utxo-htlc.json hold
+// it.
+type ScanResult struct {
+	Unspents []Unspent `json:"unspents"`
+}
+
+// PaymentMessage is payment_message.json, the swap terms both sides
+// signed.
+type PaymentMessage struct {
+	BTCAmount    float64 `json:"btc_amount"`
+	SecretHash   string  `json:"secret_hash"`
+	Signature    string  `json:"signature"`
+	PubKey       string  `json:"pubkey"`
+	SenderPubKey string  `json:"sender_pubkey"`
+}
+
+// ExchangeData is exchange-data.json, which carries the swap secret.
+type ExchangeData struct {
+	HTLCs []struct {
+		Secret    string  `json:"secret"`
+		BtcAmount float64 `json:"btcAmount"`
+	} `json:"htlcs"`
+}
+
+func readJSON(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid JSON in %s: %v", path, err)
+	}
+	return nil
+}
+
+// ReadKeyPair returns role's key (alice or bob) from the state file at
+// path.
+func ReadKeyPair(path, role string) (*KeyPair, error) {
+	var f KeyFile
+	if err := readJSON(path, &f); err != nil {
+		return nil, err
+	}
+	k := f.Alice
+	if role == "bob" {
+		k = f.Bob
+	}
+	if err := k.check(path, role); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ReadAddressBook reads address-test.json.
+func ReadAddressBook(path string) (*AddressBook, error) {
+	var b AddressBook
+	if err := readJSON(path, &b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// ReadSender returns the first sender key of the address book at path.
+func ReadSender(path string) (*KeyPair, error) {
+	b, err := ReadAddressBook(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.Sender) == 0 {
+		return nil, fmt.Errorf("%s has no sender", path)
+	}
+	if err := b.Sender[0].check(path, "sender"); err != nil {
+		return nil, err
+	}
+	return &b.Sender[0], nil
+}
+
+// ReadHTLCAddress returns the HTLC of the address book at path.
+func ReadHTLCAddress(path string) (*HTLCAddress, error) {
+	b, err := ReadAddressBook(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.HTLC) == 0 {
+		return nil, fmt.Errorf("%s has no HTLC, run create-htlc first", path)
+	}
+	h := &b.HTLC[0]
+	if h.Address == "" || h.RedeemScript == "" {
+		return nil, fmt.Errorf("%s: HTLC is missing its address or redeem script", path)
+	}
+	return h, nil
+}
+
+// ReadFirstUnspent returns the first output of the scan result at path.
+func ReadFirstUnspent(path string) (*Unspent, error) {
+	var scan ScanResult
+	if err := readJSON(path, &scan); err != nil {
+		return nil, err
+	}
+	if len(scan.Unspents) == 0 {
+		return nil, fmt.Errorf("no unspents found in %s", path)
+	}
+	u := &scan.Unspents[0]
+	if u.TxID == "" || u.Amount <= 0 {
+		return nil, fmt.Errorf("%s: first unspent is missing its txid or amount", path)
+	}
+	return u, nil
+}
+
+// ReadPaymentMessage reads payment_message.json.
+func ReadPaymentMessage(path string) (*PaymentMessage, error) {
+	var msg PaymentMessage
+	if err := readJSON(path, &msg); err != nil {
+		return nil, err
+	}
+	if msg.BTCAmount <= 0 {
+		return nil, fmt.Errorf("%s: missing or invalid btc_amount", path)
+	}
+	return &msg, nil
+}
+
+// ReadSecret returns the secret of the first HTLC in exchange-data.json.
+func ReadSecret(path string) (string, error) {
+	var data ExchangeData
+	if err := readJSON(path, &data); err != nil {
+		return "", err
+	}
+	if len(data.HTLCs) == 0 || data.HTLCs[0].Secret == "" {
+		return "", fmt.Errorf("%s has no HTLC secret", path)
+	}
+	return data.HTLCs[0].Secret, nil
+}
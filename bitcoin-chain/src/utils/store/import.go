@@ -0,0 +1,325 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// ImportFiles lists the legacy JSON/text files to import. Empty paths and
+// files that do not exist are skipped.
+type ImportFiles struct {
+	ChannelState   string // payment-channel state.json
+	HTLCState      string // state.json used by the htlc binaries
+	AddressTest    string // address-test.json
+	UTXO           string // utxo.json
+	UTXOHTLC       string // utxo-htlc.json
+	PaymentMessage string // payment_message.json
+	ExchangeData   string // exchange-data.json
+	Fund           string // data/fund.json
+	CommitUnsigned string // data/commit-unsigned.txt
+	CommitSigned   string // data/commit-signed.txt
+}
+
+type ImportReport struct {
+	Imported map[string]int
+	Skipped  []string
+}
+
+func (r *ImportReport) add(kind string) {
+	r.Imported[kind]++
+}
+
+type legacyChannelState struct {
+	Alice *KeyPair `json:"alice"`
+	Bob   *KeyPair `json:"bob"`
+	HTLC  *struct {
+		Txid         string  `json:"txid"`
+		Vout         uint32  `json:"vout"`
+		Amount       float64 `json:"amount"`
+		RedeemScript string  `json:"redeemScript"`
+	} `json:"htlc"`
+	Channel *struct {
+		AliceBalance float64 `json:"aliceBalance"`
+		BobBalance   float64 `json:"bobBalance"`
+	} `json:"channel"`
+	Commitments []struct {
+		ID           uint64  `json:"id"`
+		AliceBalance float64 `json:"aliceBalance"`
+		BobBalance   float64 `json:"bobBalance"`
+		SignedTx     string  `json:"signedTx"`
+		Timestamp    string  `json:"timestamp"`
+	} `json:"commitments"`
+}
+
+type legacyFund struct {
+	Address string  `json:"address"`
+	Amount  float64 `json:"amount"`
+}
+
+// LegacyChannelID is the id given to the single channel found in a legacy
+// payment-channel state.json.
+const LegacyChannelID = "legacy"
+
+// ImportJSON reads the legacy state files and writes them into db as typed
+// records. The whole import runs in one transaction, so a malformed file
+// leaves the database untouched.
+func ImportJSON(db *DB, files ImportFiles) (*ImportReport, error) {
+	report := &ImportReport{Imported: map[string]int{}}
+	now := time.Now().Format(time.RFC3339)
+
+	err := db.Update(func(tx *Tx) error {
+		var channelState legacyChannelState
+		if ok, err := readLegacy(files.ChannelState, &channelState, report); err != nil {
+			return err
+		} else if ok {
+			if err := importKeys(tx, channelState.Alice, channelState.Bob, "payment-channel", report); err != nil {
+				return err
+			}
+			ch := &ChannelRecord{ID: LegacyChannelID, UpdatedAt: now}
+			if channelState.HTLC != nil {
+				ch.FundingTxid = channelState.HTLC.Txid
+				ch.FundingVout = channelState.HTLC.Vout
+				ch.Capacity = channelState.HTLC.Amount
+				ch.RedeemScript = channelState.HTLC.RedeemScript
+			}
+			if channelState.Channel != nil {
+				ch.AliceBalance = channelState.Channel.AliceBalance
+				ch.BobBalance = channelState.Channel.BobBalance
+			}
+			var fund legacyFund
+			if ok, err := readLegacy(files.Fund, &fund, report); err != nil {
+				return err
+			} else if ok {
+				ch.FundAddress = fund.Address
+				if ch.Capacity == 0 {
+					ch.Capacity = fund.Amount
+				}
+			}
+			if err := tx.PutChannel(ch); err != nil {
+				return err
+			}
+			report.add("channels")
+
+			for _, c := range channelState.Commitments {
+				rec := &CommitmentRecord{
+					ChannelID:    LegacyChannelID,
+					Number:       c.ID,
+					AliceBalance: c.AliceBalance,
+					BobBalance:   c.BobBalance,
+					UnsignedTx:   c.SignedTx, // legacy field held the unsigned hex
+					Timestamp:    c.Timestamp,
+				}
+				if signed, ok := readLegacyText(files.CommitSigned); ok {
+					rec.SignedTx = signed
+				}
+				if err := tx.PutCommitment(rec); err != nil {
+					return err
+				}
+				report.add("commitments")
+			}
+			if len(channelState.Commitments) == 0 {
+				if unsigned, ok := readLegacyText(files.CommitUnsigned); ok {
+					rec := &CommitmentRecord{ChannelID: LegacyChannelID, Number: 1, UnsignedTx: unsigned, Timestamp: now}
+					if signed, ok := readLegacyText(files.CommitSigned); ok {
+						rec.SignedTx = signed
+					}
+					if err := tx.PutCommitment(rec); err != nil {
+						return err
+					}
+					report.add("commitments")
+				}
+			}
+		}
+
+		var htlcState legacyChannelState
+		if ok, err := readLegacy(files.HTLCState, &htlcState, report); err != nil {
+			return err
+		} else if ok {
+			if err := importKeys(tx, htlcState.Alice, htlcState.Bob, "htlc", report); err != nil {
+				return err
+			}
+		}
+
+		var msg PaymentMessage
+		if ok, err := readLegacy(files.PaymentMessage, &msg, report); err != nil {
+			return err
+		} else if ok && msg.SecretHash != "" {
+			swap := &SwapRecord{
+				SecretHash:     msg.SecretHash,
+				BTCAmount:      msg.BTCAmount,
+				ReceiverPubKey: msg.PubKey,
+				SenderPubKey:   msg.SenderPubKey,
+				Signature:      msg.Signature,
+				Status:         "negotiated",
+				UpdatedAt:      now,
+			}
+			if err := tx.PutSwap(swap); err != nil {
+				return err
+			}
+			report.add("swaps")
+		}
+
+		var exchange ExchangeData
+		if ok, err := readLegacy(files.ExchangeData, &exchange, report); err != nil {
+			return err
+		} else if ok {
+			for _, h := range exchange.HTLCs {
+				if h.Secret == "" {
+					continue
+				}
+				sum := sha256.Sum256([]byte(h.Secret))
+				secretHash := hex.EncodeToString(sum[:])
+				swap, err := tx.Swap(secretHash)
+				if err != nil {
+					return err
+				}
+				if swap == nil {
+					swap = &SwapRecord{SecretHash: secretHash, Status: "negotiated"}
+				}
+				swap.Secret = h.Secret
+				if swap.BTCAmount == 0 {
+					swap.BTCAmount = h.BtcAmount
+				}
+				swap.UpdatedAt = now
+				if err := tx.PutSwap(swap); err != nil {
+					return err
+				}
+				report.add("swaps")
+			}
+		}
+
+		var addrs AddressBook
+		if ok, err := readLegacy(files.AddressTest, &addrs, report); err != nil {
+			return err
+		} else if ok {
+			var htlcUTXO ScanResult
+			if _, err := readLegacy(files.UTXOHTLC, &htlcUTXO, &ImportReport{}); err != nil {
+				return err
+			}
+			for _, h := range addrs.HTLC {
+				if h.Address == "" {
+					continue
+				}
+				rec := &HTLCRecord{Address: h.Address, RedeemScript: h.RedeemScript, SecretHash: msg.SecretHash, UpdatedAt: now}
+				scripts := htlcScripts(h.RedeemScript)
+				for _, u := range htlcUTXO.Unspents {
+					if scripts[strings.ToLower(u.ScriptPubKey)] {
+						rec.Txid, rec.Vout, rec.Amount = u.TxID, u.Vout, u.Amount
+						break
+					}
+				}
+				if err := tx.PutHTLC(rec); err != nil {
+					return err
+				}
+				report.add("htlcs")
+			}
+		}
+
+		for _, src := range []struct{ path, label string }{
+			{files.UTXO, "wallet-utxo"},
+			{files.UTXOHTLC, "htlc-utxo"},
+		} {
+			var scan ScanResult
+			ok, err := readLegacy(src.path, &scan, report)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			for _, u := range scan.Unspents {
+				rec := &TxRecord{
+					Txid:         u.TxID,
+					Label:        src.label,
+					Status:       TxStatusUnspent,
+					Vout:         u.Vout,
+					Amount:       u.Amount,
+					ScriptPubKey: u.ScriptPubKey,
+					Height:       u.Height,
+					UpdatedAt:    now,
+				}
+				if err := tx.PutTx(rec); err != nil {
+					return err
+				}
+				report.add("transactions")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// htlcScripts returns the P2SH and P2WSH scriptPubKeys, hex encoded, that
+// pay to redeemScript, so a scanned unspent can be matched to its address.
+func htlcScripts(redeemScript string) map[string]bool {
+	rs, err := hex.DecodeString(redeemScript)
+	if err != nil || len(rs) == 0 {
+		return nil
+	}
+	out := map[string]bool{}
+	if p2sh, err := txscript.NewScriptBuilder().AddOp(txscript.OP_HASH160).
+		AddData(btcutil.Hash160(rs)).AddOp(txscript.OP_EQUAL).Script(); err == nil {
+		out[hex.EncodeToString(p2sh)] = true
+	}
+	sum := sha256.Sum256(rs)
+	if p2wsh, err := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData(sum[:]).Script(); err == nil {
+		out[hex.EncodeToString(p2wsh)] = true
+	}
+	return out
+}
+
+func importKeys(tx *Tx, alice, bob *KeyPair, source string, report *ImportReport) error {
+	for role, k := range map[string]*KeyPair{"alice": alice, "bob": bob} {
+		if k == nil || k.PubKey == "" {
+			continue
+		}
+		rec := &KeyRecord{PubKey: k.PubKey, PrivKey: k.PrivKey, Address: k.Address, Role: role, Source: source}
+		if err := tx.PutKey(rec); err != nil {
+			return err
+		}
+		report.add("keys")
+	}
+	return nil
+}
+
+// readLegacy decodes path into v. A missing file is reported as skipped,
+// a file that exists but does not parse is an error.
+func readLegacy(path string, v interface{}, report *ImportReport) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		report.Skipped = append(report.Skipped, path)
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("invalid JSON in %s: %v", path, err)
+	}
+	return true, nil
+}
+
+func readLegacyText(path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *bolt.Tx) error
+}
+
+// migrations must only ever be appended to. Each entry runs exactly once, in
+// its own transaction, and bumps the stored schema version on success.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create record buckets",
+		apply: func(tx *bolt.Tx) error {
+			for _, name := range [][]byte{
+				bucketKeys, bucketSwaps, bucketHTLCs,
+				bucketChannels, bucketCommitments, bucketTxs,
+			} {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "key transaction records by txid:vout",
+		apply: func(tx *bolt.Tx) error {
+			b := tx.Bucket(bucketTxs)
+			if b == nil {
+				return nil
+			}
+			var old [][]byte
+			var recs []TxRecord
+			err := b.ForEach(func(k, v []byte) error {
+				if strings.Contains(string(k), ":") {
+					return nil
+				}
+				var r TxRecord
+				if err := json.Unmarshal(v, &r); err != nil {
+					return fmt.Errorf("failed to decode %s/%s: %v", bucketTxs, k, err)
+				}
+				old = append(old, append([]byte(nil), k...))
+				recs = append(recs, r)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for i, k := range old {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				data, err := json.Marshal(recs[i])
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(txKey(recs[i].Txid, recs[i].Vout)), data); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		version:     3,
+		description: "move broadcast history to its own bucket keyed by txid",
+		apply: func(tx *bolt.Tx) error {
+			dst, err := tx.CreateBucketIfNotExists(bucketBroadcasts)
+			if err != nil {
+				return err
+			}
+			src := tx.Bucket(bucketTxs)
+			if src == nil {
+				return nil
+			}
+			// only the broadcaster stored the raw hex
+			var moved [][]byte
+			err = src.ForEach(func(k, v []byte) error {
+				var r TxRecord
+				if err := json.Unmarshal(v, &r); err != nil {
+					return fmt.Errorf("failed to decode %s/%s: %v", bucketTxs, k, err)
+				}
+				if r.Hex == "" {
+					return nil
+				}
+				r.Vout = 0
+				data, err := json.Marshal(r)
+				if err != nil {
+					return err
+				}
+				moved = append(moved, append([]byte(nil), k...))
+				return dst.Put([]byte(r.Txid), data)
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range moved {
+				if err := src.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+func readSchemaVersion(tx *bolt.Tx) int {
+	meta := tx.Bucket(bucketMeta)
+	if meta == nil {
+		return 0
+	}
+	v, err := strconv.Atoi(string(meta.Get(keySchemaVersion)))
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+func (db *DB) migrate() error {
+	for _, m := range migrations {
+		err := db.bolt.Update(func(tx *bolt.Tx) error {
+			meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+			if err != nil {
+				return err
+			}
+			if readSchemaVersion(tx) >= m.version {
+				return nil
+			}
+			if err := m.apply(tx); err != nil {
+				return err
+			}
+			return meta.Put(keySchemaVersion, []byte(strconv.Itoa(m.version)))
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+)
+
+type KeyRecord struct {
+	PubKey  string `json:"pubkey"`
+	PrivKey string `json:"privkey,omitempty"`
+	Address string `json:"address"`
+	Role    string `json:"role"`
+	Source  string `json:"source,omitempty"`
+}
+
+type SwapRecord struct {
+	SecretHash     string  `json:"secretHash"`
+	Secret         string  `json:"secret,omitempty"`
+	BTCAmount      float64 `json:"btcAmount"`
+	ReceiverPubKey string  `json:"receiverPubKey,omitempty"`
+	SenderPubKey   string  `json:"senderPubKey,omitempty"`
+	Signature      string  `json:"signature,omitempty"`
+	Status         string  `json:"status"`
+	UpdatedAt      string  `json:"updatedAt"`
+}
+
+type HTLCRecord struct {
+	Address      string  `json:"address"`
+	RedeemScript string  `json:"redeemScript"`
+	SecretHash   string  `json:"secretHash,omitempty"`
+	Txid         string  `json:"txid,omitempty"`
+	Vout         uint32  `json:"vout"`
+	Amount       float64 `json:"amount,omitempty"`
+	UpdatedAt    string  `json:"updatedAt"`
+}
+
+type ChannelRecord struct {
+	ID           string  `json:"id"`
+	FundAddress  string  `json:"fundAddress,omitempty"`
+	RedeemScript string  `json:"redeemScript,omitempty"`
+	FundingTxid  string  `json:"fundingTxid,omitempty"`
+	FundingVout  uint32  `json:"fundingVout"`
+	Capacity     float64 `json:"capacity"`
+	AliceBalance float64 `json:"aliceBalance"`
+	BobBalance   float64 `json:"bobBalance"`
+	UpdatedAt    string  `json:"updatedAt"`
+}
+
+type CommitmentRecord struct {
+	ChannelID    string  `json:"channelId"`
+	Number       uint64  `json:"number"`
+	AliceBalance float64 `json:"aliceBalance"`
+	BobBalance   float64 `json:"bobBalance"`
+	UnsignedTx   string  `json:"unsignedTx,omitempty"`
+	SignedTx     string  `json:"signedTx,omitempty"`
+	Timestamp    string  `json:"timestamp"`
+}
+
+// TxRecord is an output in the transactions bucket, keyed by outpoint, or
+// a broadcast tx in the broadcasts bucket, keyed by txid.
+type TxRecord struct {
+	Txid          string  `json:"txid"`
+	Hex           string  `json:"hex,omitempty"`
+	Label         string  `json:"label"`
+	Status        string  `json:"status"`
+	Vout          uint32  `json:"vout"`
+	Amount        float64 `json:"amount,omitempty"`
+	ScriptPubKey  string  `json:"scriptPubKey,omitempty"`
+	Height        int64   `json:"height,omitempty"`
+	Confirmations int64   `json:"confirmations,omitempty"`
+	UpdatedAt     string  `json:"updatedAt"`
+}
+
+// Transaction statuses used by TxRecord.Status.
+const (
+	TxStatusUnspent   = "unspent"
+	TxStatusSigned    = "signed"
+	TxStatusBroadcast = "broadcast"
+	TxStatusConfirmed = "confirmed"
+	// TxStatusAbandoned is a broadcast tx given up on; it is not sent again
+	TxStatusAbandoned = "abandoned"
+)
+
+func commitmentKey(channelID string, number uint64) string {
+	return fmt.Sprintf("%s/%020d", channelID, number)
+}
+
+func (tx *Tx) PutKey(r *KeyRecord) error {
+	if r.PubKey == "" {
+		return fmt.Errorf("key record is missing pubkey")
+	}
+	return tx.put(bucketKeys, r.PubKey, r)
+}
+
+func (tx *Tx) PutSwap(r *SwapRecord) error {
+	if r.SecretHash == "" {
+		return fmt.Errorf("swap record is missing secret hash")
+	}
+	return tx.put(bucketSwaps, r.SecretHash, r)
+}
+
+func (tx *Tx) Swap(secretHash string) (*SwapRecord, error) {
+	var r SwapRecord
+	ok, err := tx.get(bucketSwaps, secretHash, &r)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (tx *Tx) PutHTLC(r *HTLCRecord) error {
+	if r.Address == "" {
+		return fmt.Errorf("htlc record is missing address")
+	}
+	return tx.put(bucketHTLCs, r.Address, r)
+}
+
+func (tx *Tx) HTLC(address string) (*HTLCRecord, error) {
+	var r HTLCRecord
+	ok, err := tx.get(bucketHTLCs, address, &r)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (tx *Tx) PutChannel(r *ChannelRecord) error {
+	if r.ID == "" {
+		return fmt.Errorf("channel record is missing id")
+	}
+	return tx.put(bucketChannels, r.ID, r)
+}
+
+func (tx *Tx) Channel(id string) (*ChannelRecord, error) {
+	var r ChannelRecord
+	ok, err := tx.get(bucketChannels, id, &r)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (tx *Tx) PutCommitment(r *CommitmentRecord) error {
+	if r.ChannelID == "" {
+		return fmt.Errorf("commitment record is missing channel id")
+	}
+	return tx.put(bucketCommitments, commitmentKey(r.ChannelID, r.Number), r)
+}
+
+// Commitments returns every commitment of a channel ordered by number.
+func (tx *Tx) Commitments(channelID string) ([]CommitmentRecord, error) {
+	var out []CommitmentRecord
+	prefix := channelID + "/"
+	err := tx.each(bucketCommitments, func(k, v []byte) error {
+		if len(k) < len(prefix) || string(k[:len(prefix)]) != prefix {
+			return nil
+		}
+		var r CommitmentRecord
+		if _, err := tx.get(bucketCommitments, string(k), &r); err != nil {
+			return err
+		}
+		out = append(out, r)
+		return nil
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].Number < out[j].Number })
+	return out, err
+}
+
+// txKey keys transaction records by outpoint, so several outputs of one
+// tx each keep their own record.
+func txKey(txid string, vout uint32) string {
+	return fmt.Sprintf("%s:%d", txid, vout)
+}
+
+func (tx *Tx) PutTx(r *TxRecord) error {
+	if r.Txid == "" {
+		return fmt.Errorf("transaction record is missing txid")
+	}
+	return tx.put(bucketTxs, txKey(r.Txid, r.Vout), r)
+}
+
+func (tx *Tx) Tx(txid string, vout uint32) (*TxRecord, error) {
+	var r TxRecord
+	ok, err := tx.get(bucketTxs, txKey(txid, vout), &r)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// PutBroadcast records a tx sent through the broadcaster. Broadcasts are
+// keyed by txid in a bucket of their own, so they never overwrite the
+// output records of the same tx.
+func (tx *Tx) PutBroadcast(r *TxRecord) error {
+	if r.Txid == "" {
+		return fmt.Errorf("broadcast record is missing txid")
+	}
+	return tx.put(bucketBroadcasts, r.Txid, r)
+}
+
+func (tx *Tx) Broadcast(txid string) (*TxRecord, error) {
+	var r TxRecord
+	ok, err := tx.get(bucketBroadcasts, txid, &r)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Broadcasts returns every recorded broadcast.
+func (tx *Tx) Broadcasts() ([]TxRecord, error) {
+	var out []TxRecord
+	err := tx.each(bucketBroadcasts, func(k, v []byte) error {
+		var r TxRecord
+		if _, err := tx.get(bucketBroadcasts, string(k), &r); err != nil {
+			return err
+		}
+		out = append(out, r)
+		return nil
+	})
+	return out, err
+}
+
+// Txs returns every stored transaction record.
+func (tx *Tx) Txs() ([]TxRecord, error) {
+	var out []TxRecord
+	err := tx.each(bucketTxs, func(k, v []byte) error {
+		var r TxRecord
+		if _, err := tx.get(bucketTxs, string(k), &r); err != nil {
+			return err
+		}
+		out = append(out, r)
+		return nil
+	})
+	return out, err
+}
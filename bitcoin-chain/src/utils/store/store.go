@@ -0,0 +1,126 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketMeta        = []byte("meta")
+	bucketKeys        = []byte("keys")
+	bucketSwaps       = []byte("swaps")
+	bucketHTLCs       = []byte("htlcs")
+	bucketChannels    = []byte("channels")
+	bucketCommitments = []byte("commitments")
+	bucketTxs         = []byte("transactions")
+	bucketBroadcasts  = []byte("broadcasts")
+
+	keySchemaVersion = []byte("schema_version")
+)
+
+// DB is the embedded swap database. All records are stored as JSON values
+// inside bbolt buckets, one bucket per record type.
+type DB struct {
+	bolt *bolt.DB
+	path string
+}
+
+// Open opens (or creates) the database at path and applies any pending
+// schema migrations before returning.
+func Open(path string) (*DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create db directory: %v", err)
+	}
+
+	b, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+
+	db := &DB{bolt: b, path: path}
+	if err := db.migrate(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Close releases the database file.
+func (db *DB) Close() error {
+	return db.bolt.Close()
+}
+
+// Path returns the file the database was opened from.
+func (db *DB) Path() string {
+	return db.path
+}
+
+// SchemaVersion returns the version of the last applied migration.
+func (db *DB) SchemaVersion() (int, error) {
+	var version int
+	err := db.bolt.View(func(tx *bolt.Tx) error {
+		version = readSchemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+// Update runs fn inside a single read-write transaction. Either every write
+// made through the Tx is committed or none of them is.
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	return db.bolt.Update(func(btx *bolt.Tx) error {
+		return fn(&Tx{btx: btx})
+	})
+}
+
+// View runs fn inside a read-only transaction.
+func (db *DB) View(fn func(tx *Tx) error) error {
+	return db.bolt.View(func(btx *bolt.Tx) error {
+		return fn(&Tx{btx: btx})
+	})
+}
+
+// Tx wraps a bbolt transaction with typed accessors for each record type.
+type Tx struct {
+	btx *bolt.Tx
+}
+
+func (tx *Tx) put(bucket []byte, key string, v interface{}) error {
+	b := tx.btx.Bucket(bucket)
+	if b == nil {
+		return fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s/%s: %v", bucket, key, err)
+	}
+	return b.Put([]byte(key), data)
+}
+
+func (tx *Tx) get(bucket []byte, key string, v interface{}) (bool, error) {
+	b := tx.btx.Bucket(bucket)
+	if b == nil {
+		return false, fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("failed to decode %s/%s: %v", bucket, key, err)
+	}
+	return true, nil
+}
+
+func (tx *Tx) each(bucket []byte, fn func(k, v []byte) error) error {
+	b := tx.btx.Bucket(bucket)
+	if b == nil {
+		return fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	return b.ForEach(fn)
+}
@@ -0,0 +1,166 @@
+package txverify
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	maxStandardTxWeight      = 400000
+	maxStandardSigScriptSize = 1650
+	lockTimeThreshold        = 500000000 // below: block height, above: unix time
+)
+
+// UnknownHeight disables the locktime-vs-tip check for transactions that are
+// verified offline.
+const UnknownHeight = -1
+
+// InputError describes why a single input failed to verify.
+type InputError struct {
+	Index    int
+	Outpoint wire.OutPoint
+	Err      error
+}
+
+// Error collects every problem found in a transaction.
+type Error struct {
+	Txid   string
+	Inputs []InputError
+	Policy []string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "transaction %s failed verification:", e.Txid)
+	for _, in := range e.Inputs {
+		fmt.Fprintf(&b, "\n  input %d (%s): %v", in.Index, in.Outpoint, in.Err)
+	}
+	for _, p := range e.Policy {
+		fmt.Fprintf(&b, "\n  policy: %s", p)
+	}
+	return b.String()
+}
+
+// Verify executes every input script of tx against the output it spends and
+// checks the main relay policy rules. prevOuts must contain the spent output
+// (script and amount) for each input. height is the current chain tip, or
+// UnknownHeight to skip the height locktime check.
+func Verify(tx *wire.MsgTx, prevOuts map[wire.OutPoint]*wire.TxOut, height int64) error {
+	verr := &Error{Txid: tx.TxHash().String()}
+
+	fetcher := txscript.NewMultiPrevOutFetcher(prevOuts)
+	sigHashes := txscript.NewTxSigHashes(tx, fetcher)
+
+	var totalIn int64
+	for i, in := range tx.TxIn {
+		prev, ok := prevOuts[in.PreviousOutPoint]
+		if !ok {
+			verr.Inputs = append(verr.Inputs, InputError{i, in.PreviousOutPoint, fmt.Errorf("spent output is unknown")})
+			continue
+		}
+		totalIn += prev.Value
+
+		if len(in.SignatureScript) > maxStandardSigScriptSize {
+			verr.Inputs = append(verr.Inputs, InputError{i, in.PreviousOutPoint,
+				fmt.Errorf("scriptSig is %d bytes, max standard is %d", len(in.SignatureScript), maxStandardSigScriptSize)})
+		}
+		if !txscript.IsPushOnlyScript(in.SignatureScript) {
+			verr.Inputs = append(verr.Inputs, InputError{i, in.PreviousOutPoint, fmt.Errorf("scriptSig is not push-only")})
+		}
+
+		vm, err := txscript.NewEngine(prev.PkScript, tx, i, txscript.StandardVerifyFlags, nil, sigHashes, prev.Value, fetcher)
+		if err != nil {
+			verr.Inputs = append(verr.Inputs, InputError{i, in.PreviousOutPoint, fmt.Errorf("cannot start script engine: %v", err)})
+			continue
+		}
+		if err := vm.Execute(); err != nil {
+			class := txscript.GetScriptClass(prev.PkScript)
+			verr.Inputs = append(verr.Inputs, InputError{i, in.PreviousOutPoint, fmt.Errorf("script (%s) failed: %v", class, err)})
+		}
+	}
+
+	var totalOut int64
+	nullData := 0
+	for i, out := range tx.TxOut {
+		totalOut += out.Value
+		class := txscript.GetScriptClass(out.PkScript)
+		switch class {
+		case txscript.NonStandardTy:
+			verr.Policy = append(verr.Policy, fmt.Sprintf("output %d has a non-standard script", i))
+		case txscript.NullDataTy:
+			nullData++
+		default:
+			if mempool.IsDust(out, mempool.DefaultMinRelayTxFee) {
+				verr.Policy = append(verr.Policy, fmt.Sprintf("output %d (%d sat) is dust", i, out.Value))
+			}
+		}
+	}
+	if nullData > 1 {
+		verr.Policy = append(verr.Policy, fmt.Sprintf("%d OP_RETURN outputs, only one is standard", nullData))
+	}
+
+	weight := blockchain.GetTransactionWeight(btcutil.NewTx(tx))
+	if weight > maxStandardTxWeight {
+		verr.Policy = append(verr.Policy, fmt.Sprintf("weight %d exceeds %d", weight, maxStandardTxWeight))
+	}
+	if tx.Version < 1 || tx.Version > 2 {
+		verr.Policy = append(verr.Policy, fmt.Sprintf("version %d is not standard", tx.Version))
+	}
+
+	if len(verr.Inputs) == 0 {
+		fee := totalIn - totalOut
+		vsize := (weight + 3) / 4
+		minFee := int64(mempool.DefaultMinRelayTxFee) * vsize / 1000
+		switch {
+		case fee < 0:
+			verr.Policy = append(verr.Policy, fmt.Sprintf("outputs (%d sat) exceed inputs (%d sat)", totalOut, totalIn))
+		case fee < minFee:
+			verr.Policy = append(verr.Policy, fmt.Sprintf("fee %d sat is below min relay fee %d sat for %d vbytes", fee, minFee, vsize))
+		}
+	}
+
+	if problem := checkLockTime(tx, height); problem != "" {
+		verr.Policy = append(verr.Policy, problem)
+	}
+
+	if len(verr.Inputs) > 0 || len(verr.Policy) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// checkLockTime reports a transaction that could not be mined in the next
+// block because its locktime is still in the future.
+func checkLockTime(tx *wire.MsgTx, height int64) string {
+	if tx.LockTime == 0 {
+		return ""
+	}
+	final := true
+	for _, in := range tx.TxIn {
+		if in.Sequence != wire.MaxTxInSequenceNum {
+			final = false
+		}
+	}
+	if final {
+		return ""
+	}
+
+	if tx.LockTime < lockTimeThreshold {
+		if height != UnknownHeight && int64(tx.LockTime) > height {
+			return fmt.Sprintf("non-final: locktime is block %d, chain tip is %d", tx.LockTime, height)
+		}
+		return ""
+	}
+	if now := time.Now().Unix(); int64(tx.LockTime) > now {
+		return fmt.Sprintf("non-final: locktime is %s, still in the future",
+			time.Unix(int64(tx.LockTime), 0).UTC().Format(time.RFC3339))
+	}
+	return ""
+}